@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+type auditItem struct {
+	Source string `json:"source,omitempty"`
+	Output string `json:"output,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditReport is the result of comparing source trees, the state DB and the output tree.
+type auditReport struct {
+	NeverConverted []auditItem `json:"neverConverted"`
+	Stale          []auditItem `json:"stale"`
+	MissingSource  []auditItem `json:"missingSource"`
+	HashMismatch   []auditItem `json:"hashMismatch"`
+	Quarantined    []auditItem `json:"quarantined"`
+	Warned         []auditItem `json:"warned"` // informational: not counted as issues
+}
+
+func (r *auditReport) issues() int {
+	return len(r.NeverConverted) + len(r.Stale) + len(r.MissingSource) + len(r.HashMismatch) + len(r.Quarantined)
+}
+
+// runAudit implements `gosnare audit [--config config.toml] [-i dir -o dir] [--json]`.
+func runAudit(args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ExitOnError)
+	var input, output, configPath string
+	fs.StringVar(&input, "i", "", "Input directory (default: [watch] sources from config)")
+	fs.StringVar(&input, "input", "", "Input directory (default: [watch] sources from config)")
+	fs.StringVar(&output, "o", "", "Output directory (default: [watch] location from config)")
+	fs.StringVar(&output, "output", "", "Output directory (default: [watch] location from config)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare audit [--config config.toml] [-i <dir> -o <dir>] [--json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	var targets []WatchTarget
+	var stateOverride, trashOutput string
+	if input != "" || output != "" {
+		if input == "" || output == "" {
+			return fmt.Errorf("-i and -o must be given together")
+		}
+		targets = []WatchTarget{{Input: input, Output: output}}
+	} else {
+		targets, stateOverride, trashOutput = cfg.Watch.Targets(), cfg.Watch.StateDB, cfg.Watch.TrashOutput
+		if len(targets) == 0 {
+			return fmt.Errorf("audit needs -i/-o or a [watch] section with sources and location")
+		}
+	}
+
+	// Audit each output root against all targets mirrored into it
+	report := newAuditReport()
+	outDirs := WatchConfig{Target: targets}.OutputDirs()
+	if len(outDirs) > 1 {
+		stateOverride = ""
+	}
+	for _, outDir := range outDirs {
+		state, err := openStateDB(outDir, stateOverride)
+		if err != nil {
+			return fmt.Errorf("opening state DB: %w", err)
+		}
+		var group []WatchTarget
+		for _, t := range targets {
+			if t.Output == outDir {
+				group = append(group, t)
+			}
+		}
+		nested := WatchConfig{Target: targets, TrashOutput: trashOutput}.nestedOutputDirs(outDir)
+		if err := auditTrees(report, group, cfg.Filter, outDir, nested, state); err != nil {
+			return err
+		}
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printAuditReport(report)
+	}
+
+	if n := report.issues(); n > 0 {
+		return fmt.Errorf("audit found %d issue(s)", n)
+	}
+	return nil
+}
+
+func newAuditReport() *auditReport {
+	return &auditReport{
+		NeverConverted: []auditItem{},
+		Stale:          []auditItem{},
+		MissingSource:  []auditItem{},
+		HashMismatch:   []auditItem{},
+		Quarantined:    []auditItem{},
+		Warned:         []auditItem{},
+	}
+}
+
+// auditTrees adds the findings for one output root and the targets mirrored
+// into it. The output roots nested below outDir are audited on their own.
+func auditTrees(report *auditReport, targets []WatchTarget, global FilterConfig, outDir string, nested []string, state *stateDB) error {
+	var inputDirs []string
+	for _, t := range targets {
+		inputDirs = append(inputDirs, t.Input)
+	}
+
+	// Sources without an up-to-date output
+	for _, t := range targets {
+		dir := t.Input
+		filter := t.Filter(global)
+		err := filter.walk(dir, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if filter.skipDir(dir, path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !filter.allows(dir, path) {
+				return nil
+			}
+			var out, companion string
+			switch {
+			case strings.HasSuffix(path, ".note"):
+				out = outputPath(path, dir, outDir, ".note", ".pdf")
+			case strings.HasSuffix(path, ".mark"):
+				out = outputPath(path, dir, outDir, ".mark", "")
+				companion = strings.TrimSuffix(path, ".mark")
+			default:
+				return nil
+			}
+			item := auditItem{Source: path, Output: out}
+
+			if e, ok := state.lookup(out); ok && e.Quarantined() {
+				item.Detail = e.Error + " (" + e.retryStatus() + ")"
+				report.Quarantined = append(report.Quarantined, item)
+				return nil
+			}
+			if companion != "" {
+				if _, err := os.Stat(companion); err != nil {
+					item.Detail = "companion PDF missing"
+					report.NeverConverted = append(report.NeverConverted, item)
+					return nil
+				}
+			}
+			if _, err := os.Stat(out); err != nil {
+				report.NeverConverted = append(report.NeverConverted, item)
+				return nil
+			}
+			upToDate := isUpToDate(path, out)
+			if companion != "" {
+				upToDate = isMarkUpToDate(path, companion, out)
+			}
+			if !upToDate {
+				item.Detail = "source is newer than output"
+				report.Stale = append(report.Stale, item)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("walking %s: %w", dir, err)
+		}
+	}
+
+	// Outputs without a source
+	err := filepath.WalkDir(outDir, func(path string, d os.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			return skipNested(path, nested)
+		}
+		if err != nil || !strings.HasSuffix(path, ".pdf") {
+			return nil
+		}
+		if hasSourceFileIn(path, outDir, inputDirs) {
+			return nil
+		}
+		item := auditItem{Output: path, Detail: "not in state DB"}
+		if e, ok := state.lookup(path); ok {
+			item.Source, item.Detail = e.Source, "source deleted"
+		}
+		report.MissingSource = append(report.MissingSource, item)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walking %s: %w", outDir, err)
+	}
+
+	// Recorded hashes that no longer match the files on disk
+	entries := state.snapshot()
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		e := entries[k]
+		if e.Quarantined() {
+			continue
+		}
+		out := state.outputPath(k)
+		item := auditItem{Source: e.Source, Output: out}
+		if len(e.Warnings) > 0 {
+			details := make([]string, len(e.Warnings))
+			for i, w := range e.Warnings {
+				details[i] = w.String()
+			}
+			report.Warned = append(report.Warned, auditItem{Source: e.Source, Output: out, Detail: strings.Join(details, "; ")})
+		}
+		if _, err := os.Stat(out); err != nil {
+			if _, err := os.Stat(e.Source); err == nil {
+				item.Detail = "recorded output is missing"
+				report.HashMismatch = append(report.HashMismatch, item)
+			}
+			continue
+		}
+		if h, err := hashFile(out); err == nil && h != e.OutputHash {
+			item.Detail = "output modified since conversion"
+			report.HashMismatch = append(report.HashMismatch, item)
+			continue
+		}
+		upToDate := isUpToDate(e.Source, out)
+		if e.Companion != "" {
+			upToDate = isMarkUpToDate(e.Source, e.Companion, out)
+		}
+		if !upToDate {
+			continue // already reported as stale
+		}
+		j := convJob{input: e.Source, output: out, companionPDF: e.Companion}
+		if h, err := hashSource(j); err == nil && h != e.SourceHash {
+			item.Detail = "source changed but output looks up-to-date"
+			report.HashMismatch = append(report.HashMismatch, item)
+		}
+	}
+
+	return nil
+}
+
+func printAuditReport(r *auditReport) {
+	sections := []struct {
+		title string
+		items []auditItem
+	}{
+		{"Sources never converted", r.NeverConverted},
+		{"Stale outputs", r.Stale},
+		{"Outputs missing sources", r.MissingSource},
+		{"Hash mismatches", r.HashMismatch},
+		{"Quarantined sources", r.Quarantined},
+		{"Converted with warnings", r.Warned},
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, sec := range sections {
+		fmt.Fprintf(tw, "%s (%d)\n", sec.title, len(sec.items))
+		for _, it := range sec.items {
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", it.Source, it.Output, it.Detail)
+		}
+	}
+	tw.Flush()
+
+	if r.issues() == 0 {
+		fmt.Println("All sources are converted and up-to-date.")
+	}
+}
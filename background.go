@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// BackgroundRule replaces the device's rendering of matching page templates
+// with a user-supplied file ([[note.background]]).
+type BackgroundRule struct {
+	Template string `toml:"template"` // template name or path.Match pattern; "*" for all pages
+	File     string `toml:"file"`     // .png (fitted to the page) or .pdf (first page, stamped under the ink)
+}
+
+func (r BackgroundRule) isPDF() bool {
+	return strings.EqualFold(filepath.Ext(r.File), ".pdf")
+}
+
+func (c NoteConfig) validateBackgrounds() error {
+	for i, r := range c.Backgrounds {
+		if r.Template == "" || r.File == "" {
+			return fmt.Errorf("background %d needs template and file", i+1)
+		}
+		if _, err := path.Match(r.Template, ""); err != nil {
+			return fmt.Errorf("background %d: template %q: %w", i+1, r.Template, err)
+		}
+		switch strings.ToLower(filepath.Ext(r.File)) {
+		case ".png", ".pdf":
+		default:
+			return fmt.Errorf("background %d: file must be a .png or .pdf, got %q", i+1, r.File)
+		}
+		if _, err := os.Stat(r.File); err != nil {
+			return fmt.Errorf("background %d: %w", i+1, err)
+		}
+	}
+	if c.BackgroundOpacity < 0 || c.BackgroundOpacity > 1 {
+		return fmt.Errorf("background_opacity must be between 0 and 1, got %g", c.BackgroundOpacity)
+	}
+	return nil
+}
+
+// backgroundOpacity returns [note] background_opacity, 1 when unset.
+func (c NoteConfig) backgroundOpacity() float64 {
+	if c.BackgroundOpacity == 0 {
+		return 1
+	}
+	return c.BackgroundOpacity
+}
+
+// fadeBackground blends an RGB background toward white paper by [note]
+// background_opacity. It returns a copy, as PNG substitutes are shared by the
+// pages using them.
+func (c NoteConfig) fadeBackground(rgb []byte) []byte {
+	opacity := c.backgroundOpacity()
+	if opacity == 1 || rgb == nil {
+		return rgb
+	}
+	var lut [256]byte
+	for v := range lut {
+		lut[v] = byte(255 - math.Round(float64(255-v)*opacity))
+	}
+	faded := make([]byte, len(rgb))
+	for i, v := range rgb {
+		faded[i] = lut[v]
+	}
+	return faded
+}
+
+// templateName returns the name of a PAGESTYLE as used in background rules:
+// built-in templates without their "style_" prefix ("8mm_ruled_line",
+// "white"), custom templates without "user_" and their image extension.
+func templateName(style string) string {
+	if name, ok := strings.CutPrefix(style, "style_"); ok {
+		return name
+	}
+	if name, ok := strings.CutPrefix(style, "user_"); ok {
+		return strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return style
+}
+
+// backgroundFor returns the first rule whose template matches style, by
+// template name or full PAGESTYLE, or nil.
+func (c NoteConfig) backgroundFor(style string) *BackgroundRule {
+	name := templateName(style)
+	for i, r := range c.Backgrounds {
+		if ok, _ := path.Match(r.Template, name); ok {
+			return &c.Backgrounds[i]
+		}
+		if ok, _ := path.Match(r.Template, style); ok {
+			return &c.Backgrounds[i]
+		}
+	}
+	return nil
+}
+
+// backgroundImages decodes the PNG substitutes of one conversion once, fitted
+// to its page size. It is safe for concurrent use by page workers.
+type backgroundImages struct {
+	width, height int
+	mu            sync.Mutex
+	rgb           map[string][]byte
+}
+
+func newBackgroundImages(width, height int) *backgroundImages {
+	return &backgroundImages{width: width, height: height, rgb: make(map[string][]byte)}
+}
+
+// load returns the PNG file as page-sized RGB over white paper.
+func (b *backgroundImages) load(file string) ([]byte, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rgb, ok := b.rgb[file]; ok {
+		return rgb, nil
+	}
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	img, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("background %s: %w", file, err)
+	}
+	canvas := image.NewNRGBA(image.Rect(0, 0, b.width, b.height))
+	draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(canvas, canvas.Bounds(), fitBackground(img, b.width, b.height), image.Point{}, draw.Over)
+	rgb := make([]byte, b.width*b.height*3)
+	for j := range b.width * b.height {
+		copy(rgb[j*3:], canvas.Pix[j*4:j*4+3])
+	}
+	b.rgb[file] = rgb
+	return rgb, nil
+}
+
+// pageBackground returns the RGB background of a page: its PNG substitute
+// when a rule matches, else the device's background layer. Pages whose rule
+// names a PDF get none here; pdfFile is returned for stampPDFBackgrounds.
+// Backgrounds are faded by [note] background_opacity.
+func pageBackground(src io.ReaderAt, page Page, width, height int, p *Palette, cfg NoteConfig, images *backgroundImages) (rgb []byte, pdfFile string, err error) {
+	if rule := cfg.backgroundFor(page.Style); rule != nil {
+		if rule.isPDF() {
+			return nil, rule.File, nil
+		}
+		rgb, err = images.load(rule.File)
+		return cfg.fadeBackground(rgb), "", err
+	}
+	rgb, err = renderBGLayerRGB(src, page, width, height, p)
+	return cfg.fadeBackground(rgb), "", err
+}
+
+// stampPDFBackgrounds draws the first page of each PDF substitute behind the
+// content of its pages (1-indexed, of the written PDF at path), scaled to fit
+// and at the given opacity ([note] background_opacity). pdfcpu rewrites the
+// file, so its pages cannot be reused by the next conversion.
+func stampPDFBackgrounds(path string, pages map[string][]int, opacity float64) error {
+	doc, err := readMemPDF(path)
+	if err != nil {
+		return err
+	}
+	wms := make(map[int][]*model.Watermark)
+	for file, list := range pages {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		for _, page := range list {
+			wm, err := api.PDFWatermarkForReadSeeker(bytes.NewReader(data), 1, fmt.Sprintf("pos:c, scale:1 rel, rotation:0, opacity:%g", opacity), false, false, types.POINTS)
+			if err != nil {
+				return fmt.Errorf("background %s: %w", file, err)
+			}
+			wms[page] = append(wms[page], wm)
+		}
+	}
+	if err := doc.apply(func(rs io.ReadSeeker, w io.Writer) error {
+		return api.AddWatermarksSliceMap(rs, w, wms, nil)
+	}); err != nil {
+		return err
+	}
+	return doc.save(path)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+)
+
+// defaultBackgroundQuality is the JPEG quality of backgrounds when
+// [pdf] background_quality is not set.
+const defaultBackgroundQuality = 85
+
+// flatColorLimit is the number of distinct colors up to which a background
+// counts as a flat template, kept lossless: Flate compresses such images to
+// almost nothing, and JPEG would blur their lines.
+const flatColorLimit = 64
+
+func (c PDFConfig) validateBackgroundImage() error {
+	switch c.BackgroundImage {
+	case "", "flate", "jpeg":
+	default:
+		return fmt.Errorf("background_image must be \"flate\" or \"jpeg\", got %q", c.BackgroundImage)
+	}
+	if c.BackgroundQuality < 0 || c.BackgroundQuality > 100 {
+		return fmt.Errorf("background_quality must be between 1 and 100, got %d", c.BackgroundQuality)
+	}
+	if c.BackgroundDPI < 0 {
+		return fmt.Errorf("background_dpi must not be negative, got %g", c.BackgroundDPI)
+	}
+	return nil
+}
+
+// bgImageOptions controls how a page background image is stored.
+type bgImageOptions struct {
+	quality int     // JPEG quality; 0 stores the image losslessly
+	scale   float64 // resampling factor below 1; 0 keeps the device resolution
+}
+
+// backgroundImage returns how backgrounds of a notebook of the given
+// resolution are stored.
+func (c PDFConfig) backgroundImage(ppi float64) bgImageOptions {
+	var o bgImageOptions
+	if c.BackgroundImage == "jpeg" {
+		o.quality = c.BackgroundQuality
+		if o.quality == 0 {
+			o.quality = defaultBackgroundQuality
+		}
+	}
+	if c.BackgroundDPI > 0 && c.BackgroundDPI < ppi {
+		o.scale = c.BackgroundDPI / ppi
+	}
+	return o
+}
+
+// flatColors reports whether samples (n channels per pixel) hold at most
+// flatColorLimit distinct colors.
+func flatColors(samples []byte, n int) bool {
+	seen := make(map[uint32]struct{}, flatColorLimit+1)
+	for i := 0; i+n <= len(samples); i += n {
+		var c uint32
+		for _, b := range samples[i : i+n] {
+			c = c<<8 | uint32(b)
+		}
+		if _, ok := seen[c]; ok {
+			continue
+		}
+		if seen[c] = struct{}{}; len(seen) > flatColorLimit {
+			return false
+		}
+	}
+	return true
+}
+
+// backgroundImageObject returns the image XObject id of an RGB background,
+// resampled by o.scale and JPEG-encoded (DCTDecode) when o.quality is set and
+// the image is not a flat template, FlateDecode otherwise. The page content
+// scales the image to the page, whatever its pixel size.
+func backgroundImageObject(id int, rgb []byte, width, height int, cs colorSpace, o bgImageOptions) pdfObject {
+	samples, space := cs.image(rgb)
+	n := len(samples) / (width * height)
+	// Flatness is judged before resampling, which blends in new shades
+	lossy := o.quality > 0 && !flatColors(samples, n)
+	if o.scale > 0 {
+		w, h := max(1, int(float64(width)*o.scale+0.5)), max(1, int(float64(height)*o.scale+0.5))
+		samples = resampleBox(samples, n, width, height, w, h)
+		width, height = w, h
+	}
+
+	filter := "/FlateDecode"
+	var data []byte
+	if lossy {
+		var img image.Image
+		if n == 1 {
+			img = &image.Gray{Pix: samples, Stride: width, Rect: image.Rect(0, 0, width, height)}
+		} else {
+			rgba := image.NewRGBA(image.Rect(0, 0, width, height))
+			for j := range width * height {
+				copy(rgba.Pix[j*4:], samples[j*3:j*3+3])
+				rgba.Pix[j*4+3] = 0xFF
+			}
+			img = rgba
+		}
+		var buf bytes.Buffer
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: o.quality}); err == nil {
+			filter, data = "/DCTDecode", buf.Bytes()
+		}
+	}
+	if data == nil {
+		var err error
+		if data, err = compressZlib(samples); err != nil {
+			filter, data = "", samples
+		}
+	}
+	if filter != "" {
+		filter = "\n   /Filter " + filter
+	}
+
+	header := fmt.Sprintf(
+		"%d 0 obj\n<< /Type /XObject\n   /Subtype /Image\n   /Width %d\n   /Height %d\n   /ColorSpace %s\n   /BitsPerComponent 8%s\n   /Length %d >>\nstream\n",
+		id, width, height, space, filter, len(data),
+	)
+	var obj bytes.Buffer
+	obj.Grow(len(header) + len(data) + 30)
+	obj.WriteString(header)
+	obj.Write(data)
+	obj.WriteString("\nendstream\nendobj\n")
+	return pdfObject{id: id, data: obj.Bytes()}
+}
+
+// resampleBox downsamples an image of n-channel samples from w×h to dw×dh,
+// averaging the source pixels each destination pixel covers.
+func resampleBox(samples []byte, n, w, h, dw, dh int) []byte {
+	out := make([]byte, dw*dh*n)
+	sum := make([]int, n)
+	for dy := range dh {
+		y0, y1 := dy*h/dh, max((dy+1)*h/dh, dy*h/dh+1)
+		for dx := range dw {
+			x0, x1 := dx*w/dw, max((dx+1)*w/dw, dx*w/dw+1)
+			clear(sum)
+			for y := y0; y < y1; y++ {
+				row := samples[(y*w+x0)*n : (y*w+x1)*n]
+				for i, b := range row {
+					sum[i%n] += int(b)
+				}
+			}
+			count := (y1 - y0) * (x1 - x0)
+			for c := range n {
+				out[(dy*dw+dx)*n+c] = byte((sum[c] + count/2) / count)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+)
+
+// ocgObjRe matches the background optional content group of an earlier output.
+var ocgObjRe = regexp.MustCompile(`^\d+ 0 obj\n<< /Type /OCG /Name \(Background\)`)
+
+// backgroundLayer reports whether page backgrounds are drawn in an optional
+// content group, which viewers list as a layer that can be hidden at view time.
+func (c PDFConfig) backgroundLayer(noBg bool) bool {
+	return c.BackgroundLayer && !noBg
+}
+
+// ocgObject returns the optional content group of the background, numbered id.
+func ocgObject(id int) pdfObject {
+	return pdfObject{id: id, data: fmt.Appendf(nil, "%d 0 obj\n<< /Type /OCG /Name (Background) /Intent /View >>\nendobj\n", id)}
+}
+
+// withOCProperties adds the /OCProperties of the background group ocgID to a
+// catalog written by catalogObject. The group is visible by default.
+func withOCProperties(catalog pdfObject, ocgID int) pdfObject {
+	i := bytes.LastIndex(catalog.data, []byte("\n>>\nendobj"))
+	if ocgID == 0 || i < 0 {
+		return catalog
+	}
+	data := append(catalog.data[:i:i], fmt.Appendf(nil, "\n   /OCProperties << /OCGs [%d 0 R] /D << /Order [%d 0 R] /ON [%d 0 R] >> >>", ocgID, ocgID, ocgID)...)
+	return pdfObject{id: catalog.id, data: append(data, catalog.data[i:]...)}
+}
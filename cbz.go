@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// comicInfo is the ComicInfo.xml of a CBZ, read by comic readers for the
+// title, page count and bookmarks.
+type comicInfo struct {
+	XMLName   xml.Name        `xml:"ComicInfo"`
+	Title     string          `xml:"Title"`
+	PageCount int             `xml:"PageCount"`
+	Year      int             `xml:"Year,omitempty"`
+	Month     int             `xml:"Month,omitempty"`
+	Day       int             `xml:"Day,omitempty"`
+	Pages     []comicInfoPage `xml:"Pages>Page"`
+}
+
+type comicInfoPage struct {
+	Image    int    `xml:"Image,attr"`
+	Bookmark string `xml:"Bookmark,attr,omitempty"`
+}
+
+// ConvertNoteToCBZ rasterizes a .note at the device resolution and packages
+// the pages as page-001.png... in a comic book archive (a ZIP), for e-readers
+// and tablet apps that handle CBZ better than PDF. Starred pages are
+// bookmarked in ComicInfo.xml. onPage, if non-nil, is called after each page.
+func ConvertNoteToCBZ(ctx context.Context, inputPath, outputPath string, noBg bool, cfg *Config, onPage func()) (*Result, error) {
+	res := &Result{}
+	defer res.sort()
+	src, notebook, err := openNotebook(inputPath)
+	if err != nil {
+		return res, fmt.Errorf("parsing notebook: %w", err)
+	}
+	defer src.Close()
+	res.warnFormatVersion(notebook)
+	notebook.selectLayers(cfg.Note)
+	palette := cfg.Note.palette()
+	res.Starred = starredPages(notebook)
+
+	tmpPath := outputPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return res, err
+	}
+	defer os.Remove(tmpPath)
+	zw := zip.NewWriter(f)
+
+	info := comicInfo{
+		Title:     strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath)),
+		PageCount: len(notebook.Pages),
+	}
+	if st, err := os.Stat(inputPath); err == nil {
+		t := st.ModTime()
+		info.Year, info.Month, info.Day = t.Year(), int(t.Month()), t.Day()
+	}
+	width, height := notebook.Width, notebook.Height
+	bgImages := newBackgroundImages(width, height)
+	for i, page := range notebook.Pages {
+		if err := ctx.Err(); err != nil {
+			f.Close()
+			return res, err
+		}
+		res.warnUnknownLayers(page)
+		img, err := renderPageImage(src, page, width, height, noBg, palette, cfg.Note, bgImages)
+		if err != nil {
+			f.Close()
+			return res, fmt.Errorf("page %d: %w", i+1, err)
+		}
+		// Pages are already compressed, so they are stored rather than
+		// deflated again
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: fmt.Sprintf("page-%03d.png", i+1), Method: zip.Store, Modified: time.Now()})
+		if err == nil {
+			err = png.Encode(w, img)
+		}
+		if err != nil {
+			f.Close()
+			return res, err
+		}
+		p := comicInfoPage{Image: i}
+		if page.Starred {
+			p.Bookmark = fmt.Sprintf("Page %d", i+1)
+		}
+		info.Pages = append(info.Pages, p)
+		if onPage != nil {
+			onPage()
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	enc := xml.NewEncoder(&buf)
+	enc.Indent("", "  ")
+	if err := enc.Encode(info); err != nil {
+		f.Close()
+		return res, err
+	}
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "ComicInfo.xml", Method: zip.Deflate, Modified: time.Now()})
+	if err == nil {
+		_, err = w.Write(buf.Bytes())
+	}
+	if err == nil {
+		err = zw.Close()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return res, err
+	}
+	return res, os.Rename(tmpPath, outputPath)
+}
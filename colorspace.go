@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+
+	pdfcolor "github.com/pdfcpu/pdfcpu/pkg/pdfcpu/color"
+)
+
+// colorSpace selects how stroke colors and background images are written.
+type colorSpace struct {
+	mode    string // "rgb" (DeviceRGB), "auto" (DeviceGray for neutral colors), "gray" (DeviceGray) or "icc"
+	profile []byte // ICC profile, for "icc"
+	n       int    // profile components: 1 (gray) or 3 (RGB)
+	iccID   int    // object ID of the profile stream in the file being written
+}
+
+// useDeviceGrays resets the [note] and [mark] colors to the device's grays
+// when the color space is "gray", which maps every code to its own gray level
+// rather than to the luminance of a configured color. Marker opacity is kept.
+func (c *Config) useDeviceGrays() {
+	if c.PDF.ColorSpace != "gray" {
+		return
+	}
+	defaults := defaultConfig()
+	for _, colors := range []struct{ cfg, def *ColorConfig }{
+		{&c.Note.ColorConfig, &defaults.Note.ColorConfig},
+		{&c.Mark.ColorConfig, &defaults.Mark.ColorConfig},
+	} {
+		opacity := colors.cfg.MarkerOpacity
+		*colors.cfg = *colors.def
+		colors.cfg.MarkerOpacity = opacity
+	}
+}
+
+// colorSpace loads the configured color space, including its ICC profile.
+func (c PDFConfig) colorSpace() (colorSpace, error) {
+	switch c.ColorSpace {
+	case "", "rgb":
+		return colorSpace{mode: "rgb"}, nil
+	case "auto":
+		return colorSpace{mode: "auto"}, nil
+	case "gray":
+		return colorSpace{mode: "gray"}, nil
+	case "icc":
+	default:
+		return colorSpace{}, fmt.Errorf("color_space must be \"rgb\", \"auto\", \"gray\" or \"icc\", got %q", c.ColorSpace)
+	}
+	if c.ICCProfile == "" {
+		return colorSpace{}, errors.New("color_space \"icc\" requires icc_profile")
+	}
+	profile, err := os.ReadFile(c.ICCProfile)
+	if err != nil {
+		return colorSpace{}, fmt.Errorf("icc_profile: %w", err)
+	}
+	if len(profile) < 128 || string(profile[36:40]) != "acsp" {
+		return colorSpace{}, fmt.Errorf("icc_profile %s: not an ICC profile", c.ICCProfile)
+	}
+	cs := colorSpace{mode: "icc", profile: profile}
+	switch string(profile[16:20]) {
+	case "RGB ":
+		cs.n = 3
+	case "GRAY":
+		cs.n = 1
+	default:
+		return colorSpace{}, fmt.Errorf("icc_profile %s: %q profiles are not supported; use an RGB or gray profile",
+			c.ICCProfile, bytes.TrimSpace(profile[16:20]))
+	}
+	return cs, nil
+}
+
+// key identifies the color space for page fingerprints.
+func (cs colorSpace) key() string {
+	if cs.mode != "icc" {
+		return cs.mode
+	}
+	sum := sha256.Sum256(cs.profile)
+	return "icc:" + hex.EncodeToString(sum[:8])
+}
+
+// profileObject returns the ICC profile stream, numbered cs.iccID.
+func (cs colorSpace) profileObject() pdfObject {
+	alternate := "/DeviceRGB"
+	if cs.n == 1 {
+		alternate = "/DeviceGray"
+	}
+	data := cs.profile
+	filter := ""
+	if compressed, err := compressZlib(cs.profile); err == nil {
+		data, filter = compressed, " /Filter /FlateDecode"
+	}
+	obj := fmt.Appendf(nil, "%d 0 obj\n<< /N %d /Alternate %s%s /Length %d >>\nstream\n", cs.iccID, cs.n, alternate, filter, len(data))
+	obj = append(obj, data...)
+	return pdfObject{id: cs.iccID, data: append(obj, "\nendstream\nendobj\n"...)}
+}
+
+// resources returns the /ColorSpace resource entry, if any.
+func (cs colorSpace) resources() string {
+	if cs.mode != "icc" {
+		return ""
+	}
+	return fmt.Sprintf("/ColorSpace << /CS0 %d 0 R >> ", cs.iccID)
+}
+
+// luminance converts an RGB color to gray (ITU-R BT.601 weights).
+func luminance(r, g, b byte) byte {
+	return byte((299*int(r) + 587*int(g) + 114*int(b) + 500) / 1000)
+}
+
+// appendColor appends the operators setting the fill (stroke false) or
+// stroke color to r, g, b.
+func (cs colorSpace) appendColor(buf []byte, r, g, b byte, stroke bool) []byte {
+	gray := r == g && g == b
+	switch {
+	case cs.mode == "icc":
+		op := " sc\n"
+		if stroke {
+			buf = append(buf, "/CS0 CS\n"...)
+			op = " SC\n"
+		} else {
+			buf = append(buf, "/CS0 cs\n"...)
+		}
+		if cs.n == 1 {
+			buf = appendFloat4(buf, float64(luminance(r, g, b))/255.0)
+		} else {
+			buf = appendRGB(buf, r, g, b)
+		}
+		return append(buf, op...)
+	case cs.mode == "gray" || cs.mode == "auto" && gray:
+		buf = appendFloat4(buf, float64(luminance(r, g, b))/255.0)
+		if stroke {
+			return append(buf, " G\n"...)
+		}
+		return append(buf, " g\n"...)
+	default:
+		buf = appendRGB(buf, r, g, b)
+		if stroke {
+			return append(buf, " RG\n"...)
+		}
+		return append(buf, " rg\n"...)
+	}
+}
+
+func appendRGB(buf []byte, r, g, b byte) []byte {
+	buf = appendFloat4(buf, float64(r)/255.0)
+	buf = append(buf, ' ')
+	buf = appendFloat4(buf, float64(g)/255.0)
+	buf = append(buf, ' ')
+	return appendFloat4(buf, float64(b)/255.0)
+}
+
+// annotationColor returns the color of an annotation written through pdfcpu,
+// which takes RGB colors: c, or its luminance in the "gray" space.
+func (cs colorSpace) annotationColor(c pdfcolor.SimpleColor) pdfcolor.SimpleColor {
+	if cs.mode != "gray" {
+		return c
+	}
+	l := 0.299*c.R + 0.587*c.G + 0.114*c.B
+	return pdfcolor.SimpleColor{R: l, G: l, B: l}
+}
+
+// image returns the samples and /ColorSpace value for an RGB background image:
+// one gray channel when the space is gray (or "auto" and the image is neutral).
+func (cs colorSpace) image(rgb []byte) ([]byte, string) {
+	space := "/DeviceRGB"
+	toGray := false
+	switch cs.mode {
+	case "gray":
+		space, toGray = "/DeviceGray", true
+	case "icc":
+		space = fmt.Sprintf("%d 0 R", cs.iccID)
+		toGray = cs.n == 1
+	case "auto":
+		toGray = true
+		for i := 0; i+2 < len(rgb); i += 3 {
+			if rgb[i] != rgb[i+1] || rgb[i+1] != rgb[i+2] {
+				toGray = false
+				break
+			}
+		}
+		if toGray {
+			space = "/DeviceGray"
+		}
+	}
+	if !toGray {
+		return rgb, space
+	}
+	gray := make([]byte, len(rgb)/3)
+	for i := range gray {
+		gray[i] = luminance(rgb[3*i], rgb[3*i+1], rgb[3*i+2])
+	}
+	return gray, space
+}
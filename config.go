@@ -3,7 +3,11 @@ package main
 import (
 	"errors"
 	"fmt"
+	"math"
 	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -12,26 +16,166 @@ import (
 )
 
 type ColorConfig struct {
+	Palette   string `toml:"palette"` // preset from [resources] palettes or built-in; explicit colors override it
 	Black     string `toml:"black"`
 	DarkGray  string `toml:"dark_gray"`
 	LightGray string `toml:"light_gray"`
 	White     string `toml:"white"`
+	// Alternate gray codes (0x9d/0x9e, 0xc9/0xca) come from other pen
+	// settings; by default they share the dark and light gray colors
+	DarkGrayAlt  string `toml:"dark_gray_alt"`
+	LightGrayAlt string `toml:"light_gray_alt"`
+	// Blue and red ballpoint pens of firmware that has them (codes 0x69 and
+	// 0x6a); unset, these codes are anti-aliasing grays
+	Blue string `toml:"blue"`
+	Red  string `toml:"red"`
+	// Opacity of highlighter (marker) strokes, 0-1
+	MarkerOpacity float64 `toml:"marker_opacity"`
+	// Gradient anchors ([[note.anchor]]) replacing the black, dark gray,
+	// light gray and white anchors at 0, 157, 201 and 255
+	Anchors []PaletteAnchor `toml:"anchor"`
+
+	codes   []codeColor // [colors.codes], set by LoadConfig
+	anchors []codeColor // parsed Anchors, set by LoadConfig
+}
+
+// PaletteAnchor is a palette color at an RLE code; the codes between two
+// anchors are interpolated, color and opacity.
+type PaletteAnchor struct {
+	Position int    `toml:"position"` // RLE code, 0-255
+	Color    string `toml:"color"`    // "#RRGGBB" or "#RRGGBBAA"
+}
+
+// colorField is a color setting of a ColorConfig with its TOML key.
+type colorField struct {
+	key   string
+	value *string
+}
+
+// fields returns the colors of c (every field but the palette).
+func (c *ColorConfig) fields() []colorField {
+	return []colorField{
+		{"black", &c.Black},
+		{"dark_gray", &c.DarkGray},
+		{"light_gray", &c.LightGray},
+		{"white", &c.White},
+		{"dark_gray_alt", &c.DarkGrayAlt},
+		{"light_gray_alt", &c.LightGrayAlt},
+		{"blue", &c.Blue},
+		{"red", &c.Red},
+	}
+}
+
+// coloredPens reports whether the blue and red pen codes are traced as pens.
+func (c ColorConfig) coloredPens() bool {
+	return c.Blue != "" || c.Red != ""
+}
+
+// altGrays reports whether the alternate gray codes have colors of their own.
+func (c ColorConfig) altGrays() bool {
+	return c.DarkGrayAlt != "" || c.LightGrayAlt != ""
+}
+
+// ColorsConfig holds palette entries shared by [note] and [mark].
+type ColorsConfig struct {
+	// RLE code (e.g. "0x9d") -> output color "#RRGGBB" or "#RRGGBBAA"
+	Codes map[string]string `toml:"codes"`
 }
 
 type MarkConfig struct {
 	ColorConfig
-	MarkerOpacity float64 `toml:"marker_opacity"`
+	// Highlight and underline colors by the device's colorType index
+	// (e.g. "0" = "#FFFF00"), on top of the built-in yellow and red
+	HighlightColors map[string]string `toml:"highlight_colors"`
+	// "native" (default): ink stamped into the page, highlights as annotations;
+	// "flatten": highlights drawn into the page too; "only" (experimental): ink
+	// as annotations too, from the stroke data
+	Annotations string `toml:"annotations"`
+
+	highlightColors map[int][3]byte // parsed HighlightColors, set by LoadConfig
 }
 
 type NoteConfig struct {
 	ColorConfig
+	RealtimeMode    string `toml:"realtime_mode"`    // real-time recognition notes: "ink" (default) or "text"
+	VectorTemplates bool   `toml:"vector_templates"` // draw built-in templates as vectors instead of images
+	MarkerBlend     string `toml:"marker_blend"`     // highlighter strokes: "normal" (default) or "multiply", darkening where they overlap
+	// Ink layers to render (e.g. ["MAINLAYER", "LAYER1"]) or, prefixed with
+	// "-", to leave out (e.g. ["-LAYER3"]); default: all
+	Layers []string `toml:"layers"`
+	// Replacement backgrounds for matching page templates, first match wins
+	Backgrounds []BackgroundRule `toml:"background"`
+	Format      string           `toml:"format"` // output of -i/-o conversions: "pdf" (default), "cbz" or "epub"; watch mode writes PDF
+	// Fade page backgrounds toward white behind the ink, e.g. 0.3; default 1
+	BackgroundOpacity float64 `toml:"background_opacity"`
+}
+
+// palette builds the palette of .note conversions.
+func (c NoteConfig) palette() *Palette {
+	p := BuildPalette(c.ColorConfig)
+	p.Multiply = c.MarkerBlend == "multiply"
+	return p
+}
+
+// outputFormats maps the [note] format values to their file extensions.
+var outputFormats = map[string]string{"": ".pdf", "pdf": ".pdf", "cbz": ".cbz", "epub": ".epub"}
+
+// outputExt returns the file extension of .note outputs.
+func (c NoteConfig) outputExt() string {
+	return outputFormats[c.Format]
+}
+
+func (c NoteConfig) validateFormat() error {
+	if _, ok := outputFormats[c.Format]; !ok {
+		return fmt.Errorf("format must be \"pdf\", \"cbz\" or \"epub\", got %q", c.Format)
+	}
+	return nil
+}
+
+// WatchTarget is one watched input directory mirrored into its own output directory.
+type WatchTarget struct {
+	Input   string   `toml:"input"`
+	Output  string   `toml:"output"`
+	NoBg    bool     `toml:"no_bg"`
+	Include []string `toml:"include"` // globs relative to Input; replaces [filter] include
+	Ignore  []string `toml:"ignore"`  // globs relative to Input, e.g. "**/Trash/**"; added to [filter] ignore
+	Mount   string   `toml:"mount"`   // mount point Input lives on; the source is unavailable while it is not mounted
+}
+
+// Filter combines the target's globs with the global [filter] section.
+func (t WatchTarget) Filter(global FilterConfig) pathFilter {
+	f := global.Paths()
+	f.ignore = append(slices.Clip(global.Ignore), t.Ignore...)
+	if len(t.Include) > 0 {
+		f.include = t.Include
+	}
+	return f
 }
 
 type WatchConfig struct {
-	SupernotePrivateCloud string `toml:"supernote_private_cloud"`
-	WebDAV                string `toml:"webdav"`
-	Location              string `toml:"location"`
-	PollInterval          int    `toml:"poll_interval"` // seconds, 0 = default (5s)
+	SupernotePrivateCloud string        `toml:"supernote_private_cloud"`
+	WebDAV                string        `toml:"webdav"`      // mounted path, or server URL (https://...)
+	WebDAVUser            string        `toml:"webdav_user"` // credentials for a webdav URL
+	WebDAVPassword        string        `toml:"webdav_password"`
+	WebDAVMirror          string        `toml:"webdav_mirror"` // local copy of a webdav URL; default: <user cache dir>/gosnare/webdav
+	Location              string        `toml:"location"`
+	PollInterval          int           `toml:"poll_interval"`    // seconds, 0 = default (5s)
+	StateDB               string        `toml:"state_db"`         // default: <location>/.gosnare/state.json
+	Cleanup               string        `toml:"cleanup"`          // orphan removal: "all" (default) or "state" (only recorded outputs)
+	Protect               []string      `toml:"protect"`          // output globs never removed, e.g. "Manual/**"
+	ClassifyWorkers       int           `toml:"classify_workers"` // concurrent event checks (stat calls on sources); 0 = 4
+	StabilityWindow       int           `toml:"stability_window"` // seconds a changed source must stay unmodified before converting; 0 = 5
+	RemountCommand        string        `toml:"remount_command"`  // shell command run while a source is unavailable
+	TrashOutput           string        `toml:"trash_output"`     // archive tree for conversions of notes in trash folders
+	Notify                bool          `toml:"notify"`           // desktop notifications of conversions and failures (macOS, Linux)
+	RetryAttempts         int           `toml:"retry_attempts"`   // conversion attempts before a failing source waits for a change; 0 = 5
+	RetryDelay            int           `toml:"retry_delay"`      // seconds before the first retry, doubled for each further one; 0 = 30
+	Target                []WatchTarget `toml:"target"`
+
+	SupernoteCloud SupernoteCloudConfig `toml:"supernote_cloud"` // mirrored from the cloud account instead of a local folder
+	Dropbox        DropboxConfig        `toml:"dropbox"`         // notes pulled from, PDFs pushed to Dropbox
+	GoogleDrive    GoogleDriveConfig    `toml:"google_drive"`    // same for Google Drive
+	SFTP           SFTPConfig           `toml:"sftp"`            // same for a directory on an SSH server
 }
 
 func (w WatchConfig) PollDuration() time.Duration {
@@ -41,45 +185,404 @@ func (w WatchConfig) PollDuration() time.Duration {
 	return 5 * time.Second
 }
 
+// StabilityDuration returns how long a source must be left unmodified before
+// the watcher converts it.
+func (w WatchConfig) StabilityDuration() time.Duration {
+	if w.StabilityWindow > 0 {
+		return time.Duration(w.StabilityWindow) * time.Second
+	}
+	return 5 * time.Second
+}
+
+// ClassifyWorkerCount returns how many changed paths may be checked at once.
+func (w WatchConfig) ClassifyWorkerCount() int {
+	if w.ClassifyWorkers > 0 {
+		return w.ClassifyWorkers
+	}
+	return 4
+}
+
+// Targets returns all watch targets: the legacy supernote_private_cloud/webdav
+// sources (both mirrored into location), the local mirrors of remote sources,
+// then any [[watch.target]] entries.
+func (w WatchConfig) Targets() []WatchTarget {
+	var targets []WatchTarget
+	if w.Location != "" {
+		for _, dir := range w.InputDirs() {
+			targets = append(targets, WatchTarget{Input: dir, Output: w.Location})
+		}
+	}
+	if c := w.SupernoteCloud; c.enabled() {
+		out := c.Output
+		if out == "" {
+			out = w.Location
+		}
+		targets = append(targets, WatchTarget{Input: c.mirrorDir(), Output: out})
+	}
+	if c := w.Dropbox; c.enabled() && c.Folder != "" {
+		targets = append(targets, WatchTarget{Input: c.mirrorDir(), Output: c.outputDir(w.Location)})
+	}
+	if c := w.GoogleDrive; c.enabled() && c.Folder != "" {
+		targets = append(targets, WatchTarget{Input: c.mirrorDir(), Output: c.outputDir(w.Location)})
+	}
+	if c := w.SFTP; c.enabled() && c.Folder != "" {
+		targets = append(targets, WatchTarget{Input: c.mirrorDir(), Output: c.outputDir(w.Location)})
+	}
+	return append(targets, w.Target...)
+}
+
+// OutputDirs returns the distinct output directories of all targets.
+func (w WatchConfig) OutputDirs() []string {
+	var dirs []string
+	for _, t := range w.Targets() {
+		if !slices.Contains(dirs, t.Output) {
+			dirs = append(dirs, t.Output)
+		}
+	}
+	return dirs
+}
+
+// InputDirsFor returns the input directories of all targets writing into outDir.
+func (w WatchConfig) InputDirsFor(outDir string) []string {
+	var dirs []string
+	for _, t := range w.Targets() {
+		if t.Output == outDir {
+			dirs = append(dirs, t.Input)
+		}
+	}
+	return dirs
+}
+
+// Validate checks that the [watch] section describes at least one complete target.
+func (w WatchConfig) Validate() error {
+	if len(w.InputDirs()) > 0 && w.Location == "" {
+		return errors.New("[watch] location must be set in config for --watch mode")
+	}
+	if len(w.Targets()) == 0 {
+		return errors.New("[watch] requires supernote_private_cloud/webdav with location, or at least one [[watch.target]] in config")
+	}
+	if isWebDAVURL(w.WebDAV) {
+		if _, err := newWebDAVClient(w.WebDAV, w.WebDAVUser, w.WebDAVPassword); err != nil {
+			return err
+		}
+	}
+	if c := w.SupernoteCloud; c.enabled() {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.Output == "" && w.Location == "" {
+			return errors.New("[watch.supernote_cloud] requires output, or [watch] location")
+		}
+	}
+	if c := w.Dropbox; c.enabled() {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.Folder != "" && c.outputDir(w.Location) == "" {
+			return errors.New("[watch.dropbox] requires output or output_folder, or [watch] location")
+		}
+	}
+	if c := w.GoogleDrive; c.enabled() {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.Folder != "" && c.outputDir(w.Location) == "" {
+			return errors.New("[watch.google_drive] requires output or output_folder, or [watch] location")
+		}
+	}
+	if c := w.SFTP; c.enabled() {
+		if err := c.validate(); err != nil {
+			return err
+		}
+		if c.Folder != "" && c.outputDir(w.Location) == "" {
+			return errors.New("[watch.sftp] requires output or output_folder, or [watch] location")
+		}
+	}
+	for i, t := range w.Target {
+		if t.Input == "" || t.Output == "" {
+			return fmt.Errorf("[[watch.target]] #%d requires both input and output", i+1)
+		}
+	}
+	// Archived conversions have no source, so they must not share a tree
+	// whose orphans cleanup removes
+	for _, o := range w.OutputDirs() {
+		if w.TrashOutput != "" && isUnderDir(o, w.TrashOutput) {
+			return fmt.Errorf("[watch] trash_output %s must not be or contain the output directory %s", w.TrashOutput, o)
+		}
+	}
+	return nil
+}
+
 func (w WatchConfig) InputDirs() []string {
 	var dirs []string
 	if w.SupernotePrivateCloud != "" {
 		dirs = append(dirs, w.SupernotePrivateCloud)
 	}
-	if w.WebDAV != "" {
+	if isWebDAVURL(w.WebDAV) {
+		dirs = append(dirs, mirrorDir(w.WebDAVMirror, "webdav"))
+	} else if w.WebDAV != "" {
 		dirs = append(dirs, w.WebDAV)
 	}
 	return dirs
 }
 
+type LogConfig struct {
+	Level  string `toml:"level"`  // debug, info (default), warn, error
+	Format string `toml:"format"` // text (default) or json
+}
+
+// TraceConfig controls how traced ink paths are painted.
+type TraceConfig struct {
+	FillRule     string  `toml:"fill_rule"`     // "evenodd" (default) or "nonzero"
+	Outline      bool    `toml:"outline"`       // also stroke each shape's outline in its fill color
+	OutlineWidth float64 `toml:"outline_width"` // points; 0 = hairline
+	LineJoin     string  `toml:"line_join"`     // outline joins: "miter" (default), "round" or "bevel"
+	Antialias    string  `toml:"antialias"`     // anti-aliasing pixels: "drop" (default), "nearest" or "edges"
+	Strokes      bool    `toml:"strokes"`       // experimental: draw pen strokes from the stroke data (TOTALPATH) instead of tracing
+	Simplify     float64 `toml:"simplify"`      // merge traced segments within this many device pixels; 0 = off
+	Precision    int     `toml:"precision"`     // decimals of path coordinates; 0 = from the page scale
+	// Raster embeds note pages as images instead of traced paths: "never"
+	// (default), "always", or "auto" for pages over RasterThreshold segments
+	Raster          string `toml:"raster"`
+	RasterThreshold int    `toml:"raster_threshold"` // path segments; 0 = 100000
+}
+
+// validate checks the enumerated [trace] options.
+func (t TraceConfig) validate() error {
+	switch t.FillRule {
+	case "", "evenodd", "nonzero":
+	default:
+		return fmt.Errorf("fill_rule must be \"evenodd\" or \"nonzero\", got %q", t.FillRule)
+	}
+	switch t.LineJoin {
+	case "", "miter", "round", "bevel":
+	default:
+		return fmt.Errorf("line_join must be \"miter\", \"round\" or \"bevel\", got %q", t.LineJoin)
+	}
+	switch t.Antialias {
+	case "", "drop", "nearest", "edges":
+	default:
+		return fmt.Errorf("antialias must be \"drop\", \"nearest\" or \"edges\", got %q", t.Antialias)
+	}
+	switch t.Raster {
+	case "", "never", "always", "auto":
+	default:
+		return fmt.Errorf("raster must be \"never\", \"always\" or \"auto\", got %q", t.Raster)
+	}
+	if t.RasterThreshold < 0 {
+		return fmt.Errorf("raster_threshold must not be negative")
+	}
+	if t.OutlineWidth < 0 {
+		return fmt.Errorf("outline_width must not be negative")
+	}
+	if t.Simplify < 0 {
+		return fmt.Errorf("simplify must not be negative")
+	}
+	if t.Precision < 0 || t.Precision > 6 {
+		return fmt.Errorf("precision must be between 0 and 6, got %d", t.Precision)
+	}
+	return nil
+}
+
+// precision returns the decimals of path coordinates on a page whose device
+// pixels are sx points wide: Precision, or by default the fewest that keep
+// rounding within a tenth of a pixel (2 at the device's 300 PPI).
+func (t TraceConfig) precision(sx float64) int {
+	if t.Precision > 0 {
+		return t.Precision
+	}
+	return max(1, min(4, int(math.Ceil(math.Log10(10/sx)))))
+}
+
+// paintOperator returns the PDF path-painting operator for traced shapes.
+func (t TraceConfig) paintOperator() string {
+	op := "f"
+	if t.Outline {
+		op = "B"
+	}
+	if t.FillRule != "nonzero" {
+		op += "*"
+	}
+	return op
+}
+
+// lineJoin returns the PDF line join style (j operand).
+func (t TraceConfig) lineJoin() int {
+	switch t.LineJoin {
+	case "round":
+		return 1
+	case "bevel":
+		return 2
+	default:
+		return 0
+	}
+}
+
+// FilterConfig selects which sources are converted, in directory mode, watch
+// mode and audits. Globs are relative to the input directory; "**" spans
+// directories.
+type FilterConfig struct {
+	Include      []string `toml:"include"`       // e.g. ["**/*.note"]; default: everything
+	Ignore       []string `toml:"ignore"`        // e.g. ["**/Archive/**", "Work/**"]
+	Trash        []string `toml:"trash"`         // trash folder names; default: RECYCLE, Recycle Bin, .Trash, .recycle
+	ConvertTrash bool     `toml:"convert_trash"` // convert notes in trash folders like any other
+	Hidden       bool     `toml:"hidden"`        // convert dot-files and notes in dot-directories
+	// FollowSymlinks descends into symlinked directories, which are walked
+	// (and watched) as if their contents were below the link
+	FollowSymlinks bool `toml:"follow_symlinks"`
+}
+
+// Paths returns the filter applied to sources of a plain -i/-o conversion.
+func (f FilterConfig) Paths() pathFilter {
+	return pathFilter{include: f.Include, ignore: f.Ignore, trash: f.skippedTrash(), hidden: !f.Hidden, trashDirs: f.trashDirs(), followSymlinks: f.FollowSymlinks}
+}
+
+// PerformanceConfig bounds how much of the machine a conversion may use.
+type PerformanceConfig struct {
+	Workers  int `toml:"workers"`   // files and pages converted concurrently; 0 = all CPUs
+	MemoryMB int `toml:"memory_mb"` // approximate page buffer budget per notebook; 0 = 2 pages per worker
+}
+
+// defaultWorkers is the CPU count Go detected at startup (honours $GOMAXPROCS).
+var defaultWorkers = runtime.GOMAXPROCS(0)
+
+// WorkerCount returns the configured worker count, or defaultWorkers if unset.
+func (p PerformanceConfig) WorkerCount() int {
+	if p.Workers > 0 {
+		return p.Workers
+	}
+	return defaultWorkers
+}
+
+// pageBytesPerPixel approximates the memory one page holds while it is
+// rendered and waiting to be written: the code map, background RGB, trace
+// bitmaps and path trees.
+const pageBytesPerPixel = 12
+
+// pageWindow returns how many pages of width x height pixels a conversion may
+// hold at once (rendering or waiting to be written). It is at least 1.
+func (p PerformanceConfig) pageWindow(width, height int) int {
+	n := 2 * p.WorkerCount()
+	if p.MemoryMB > 0 {
+		perPage := int64(width) * int64(height) * pageBytesPerPixel
+		n = min(n, max(1, int(int64(p.MemoryMB)<<20/perPage)))
+	}
+	return n
+}
+
+// apply caps the Go scheduler at WorkerCount threads, so nested file and page
+// workers together never occupy more cores than configured.
+func (p PerformanceConfig) apply() {
+	runtime.GOMAXPROCS(p.WorkerCount())
+}
+
+// CacheConfig controls the on-disk cache of traced ink paths.
+type CacheConfig struct {
+	Trace bool   `toml:"trace"`  // default true
+	Dir   string `toml:"dir"`    // default: <user cache dir>/gosnare/trace
+	MaxMB int    `toml:"max_mb"` // evict least recently used entries above this size; 0 = unlimited
+}
+
+// PDFConfig controls the structure of written PDFs.
+type PDFConfig struct {
+	ObjectStreams bool   `toml:"object_streams"` // pack objects into compressed object streams with an xref stream (PDF 1.5)
+	Incremental   bool   `toml:"incremental"`    // append changed pages to the existing output instead of rewriting it
+	ColorSpace    string `toml:"color_space"`    // "rgb" (default), "auto" (DeviceGray for neutral colors), "gray" or "icc"
+	ICCProfile    string `toml:"icc_profile"`    // RGB or gray .icc profile for color_space = "icc"
+	Provenance    string `toml:"provenance"`     // "off" (default), "hidden" or "visible" source/version/settings note on page 1
+	// Draw page backgrounds in an optional content group that viewers can hide
+	BackgroundLayer bool `toml:"background_layer"`
+	TOCPage         bool `toml:"toc_page"` // prepend a contents page listing the notebook's headings
+	// Encoding of page background images: "flate" (lossless, default) or
+	// "jpeg" for photographic and PDF-derived templates; flat templates stay
+	// lossless either way
+	BackgroundImage   string  `toml:"background_image"`
+	BackgroundQuality int     `toml:"background_quality"` // JPEG quality, 1-100; default 85
+	BackgroundDPI     float64 `toml:"background_dpi"`     // resample backgrounds to this resolution; default: the device's
+	// AES-256 encryption of outputs: the user password is needed to open
+	// them, the owner password (default: the user password) to lift the
+	// permissions ("print", "copy", "annotate", "modify"; default: all)
+	UserPassword  string   `toml:"user_password"`
+	OwnerPassword string   `toml:"owner_password"`
+	Permissions   []string `toml:"permissions"`
+	// Blank space around notebook pages, e.g. "10mm" or "0 0 0 20mm" for a
+	// binding margin: one to four lengths (pt, mm, cm, in) in CSS order
+	Margins string `toml:"margins"`
+}
+
+// LocaleConfig controls how dates and numbers appear in generated pages.
+type LocaleConfig struct {
+	Language   string `toml:"language"`    // e.g. "en-US", "de", "fr-FR"; default: ISO 8601
+	DateFormat string `toml:"date_format"` // Go time layout, overrides the language default
+	Clock      string `toml:"clock"`       // 12h or 24h, overrides the language default
+}
+
 type Config struct {
-	Mark  MarkConfig  `toml:"mark"`
-	Note  NoteConfig  `toml:"note"`
-	Watch WatchConfig `toml:"watch"`
+	Mark        MarkConfig        `toml:"mark"`
+	Note        NoteConfig        `toml:"note"`
+	Colors      ColorsConfig      `toml:"colors"`
+	Watch       WatchConfig       `toml:"watch"`
+	Log         LogConfig         `toml:"log"`
+	Locale      LocaleConfig      `toml:"locale"`
+	Filter      FilterConfig      `toml:"filter"`
+	Trace       TraceConfig       `toml:"trace"`
+	Performance PerformanceConfig `toml:"performance"`
+	Cache       CacheConfig       `toml:"cache"`
+	Resources   ResourcesConfig   `toml:"resources"`
+	PDF         PDFConfig         `toml:"pdf"`
+	OCR         OCRConfig         `toml:"ocr"`
+	Device      DeviceConfig      `toml:"device"`
+	Index       IndexConfig       `toml:"index"`
+
+	unknownKeys []string // keys of the file no setting reads, set by LoadConfig
 }
 
 func defaultConfig() *Config {
 	return &Config{
 		Mark: MarkConfig{
 			ColorConfig: ColorConfig{
-				Black:     "#000000",
-				DarkGray:  "#9D9D9D",
-				LightGray: "#C9C9C9",
-				White:     "#FFFFFF",
+				Black:         "#000000",
+				DarkGray:      "#9D9D9D",
+				LightGray:     "#C9C9C9",
+				White:         "#FFFFFF",
+				MarkerOpacity: 0.38,
 			},
-			MarkerOpacity: 0.38,
 		},
 		Note: NoteConfig{
 			ColorConfig: ColorConfig{
-				Black:     "#000000",
-				DarkGray:  "#9D9D9D",
-				LightGray: "#C9C9C9",
-				White:     "#FFFFFF",
+				Black:         "#000000",
+				DarkGray:      "#9D9D9D",
+				LightGray:     "#C9C9C9",
+				White:         "#FFFFFF",
+				MarkerOpacity: 0.2,
 			},
 		},
+		Cache: CacheConfig{Trace: true, MaxMB: 512},
 	}
 }
 
+// defaultConfigPath is the config file used without --config: config.toml in
+// the working directory if there is one, else gosnare/config.toml under
+// $XDG_CONFIG_HOME or the user config directory (~/.config, ~/Library/Application
+// Support, %AppData%), so the daemon finds it whatever directory it starts in.
+// Without any, it is config.toml, which LoadConfig treats as all defaults.
+func defaultConfigPath() string {
+	const name = "config.toml"
+	candidates := []string{name}
+	if dir := os.Getenv("XDG_CONFIG_HOME"); dir != "" {
+		candidates = append(candidates, filepath.Join(dir, "gosnare", name))
+	}
+	if dir, err := os.UserConfigDir(); err == nil {
+		candidates = append(candidates, filepath.Join(dir, "gosnare", name))
+	}
+	for _, path := range candidates {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return name
+}
+
 func LoadConfig(path string) (*Config, error) {
 	cfg := defaultConfig()
 
@@ -91,13 +594,138 @@ func LoadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
-	if _, err := toml.DecodeFile(path, cfg); err != nil {
+	md, err := toml.DecodeFile(path, cfg)
+	if err != nil {
 		return nil, fmt.Errorf("parsing config %s: %w", path, err)
 	}
+	for _, key := range md.Undecoded() {
+		cfg.unknownKeys = append(cfg.unknownKeys, key.String())
+	}
+	if err := cfg.resolveColors(md); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	if err := cfg.Mark.validateAnnotations(); err != nil {
+		return nil, fmt.Errorf("config %s: [mark] %w", path, err)
+	}
+	if err := cfg.Note.validateLayers(); err != nil {
+		return nil, fmt.Errorf("config %s: [note] %w", path, err)
+	}
+	if err := cfg.Note.validateFormat(); err != nil {
+		return nil, fmt.Errorf("config %s: [note] %w", path, err)
+	}
+	if err := cfg.Note.validateBackgrounds(); err != nil {
+		return nil, fmt.Errorf("config %s: [note] %w", path, err)
+	}
+	if cfg.Performance.Workers < 0 || cfg.Performance.MemoryMB < 0 {
+		return nil, fmt.Errorf("config %s: [performance] workers and memory_mb must not be negative", path)
+	}
+	if _, err := cfg.PDF.colorSpace(); err != nil {
+		return nil, fmt.Errorf("config %s: [pdf] %w", path, err)
+	}
+	cfg.useDeviceGrays()
+	if err := cfg.PDF.validateBackgroundImage(); err != nil {
+		return nil, fmt.Errorf("config %s: [pdf] %w", path, err)
+	}
+	if err := cfg.PDF.validateEncryption(); err != nil {
+		return nil, fmt.Errorf("config %s: [pdf] %w", path, err)
+	}
+	if _, err := cfg.PDF.pageMargins(); err != nil {
+		return nil, fmt.Errorf("config %s: [pdf] %w", path, err)
+	}
+	switch cfg.PDF.Provenance {
+	case "", "off", "hidden", "visible":
+	default:
+		return nil, fmt.Errorf("config %s: [pdf] provenance must be \"off\", \"hidden\" or \"visible\", got %q", path, cfg.PDF.Provenance)
+	}
+	if err := cfg.Trace.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: [trace] %w", path, err)
+	}
+	if err := cfg.OCR.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: [ocr] %w", path, err)
+	}
+	if err := cfg.Index.validate(); err != nil {
+		return nil, fmt.Errorf("config %s: [index] %w", path, err)
+	}
+	if cfg.Watch.ClassifyWorkers < 0 {
+		return nil, fmt.Errorf("config %s: [watch] classify_workers must not be negative", path)
+	}
+	switch cfg.Watch.Cleanup {
+	case "", "all", "state":
+	default:
+		return nil, fmt.Errorf("config %s: [watch] cleanup must be \"all\" or \"state\", got %q", path, cfg.Watch.Cleanup)
+	}
+	switch cfg.Note.RealtimeMode {
+	case "", "ink", "text":
+	default:
+		return nil, fmt.Errorf("config %s: [note] realtime_mode must be \"ink\" or \"text\", got %q", path, cfg.Note.RealtimeMode)
+	}
+	switch cfg.Note.MarkerBlend {
+	case "", "normal", "multiply":
+	default:
+		return nil, fmt.Errorf("config %s: [note] marker_blend must be \"normal\" or \"multiply\", got %q", path, cfg.Note.MarkerBlend)
+	}
+	if _, err := cfg.Locale.Locale(); err != nil {
+		return nil, fmt.Errorf("config %s: [locale]: %w", path, err)
+	}
+	globs := [][]string{cfg.Filter.Include, cfg.Filter.Ignore, cfg.Watch.Protect}
+	for _, t := range cfg.Watch.Target {
+		globs = append(globs, t.Include, t.Ignore)
+	}
+	for _, g := range globs {
+		if err := checkGlobs(g); err != nil {
+			return nil, fmt.Errorf("config %s: %w", path, err)
+		}
+	}
 
 	return cfg, nil
 }
 
+// warnUnknownKeys logs the keys of the config file at path that no setting
+// reads, typically typos.
+func (cfg *Config) warnUnknownKeys(path string) {
+	for _, key := range cfg.unknownKeys {
+		logger.Warnf("config %s: unknown key %s ignored (see `gosnare config validate`)", path, key)
+	}
+}
+
+// resolveColors parses [colors.codes] and [mark.highlight_colors] and fills in
+// the [note] and [mark] colors from the palette each sets in md; colors md sets
+// explicitly take precedence. Every color must be valid hex and the marker
+// opacity a fraction.
+func (cfg *Config) resolveColors(md toml.MetaData) error {
+	codes, err := cfg.Colors.parseCodes()
+	if err != nil {
+		return fmt.Errorf("[colors.codes] %w", err)
+	}
+	for _, sec := range []struct {
+		name   string
+		colors *ColorConfig
+	}{{"note", &cfg.Note.ColorConfig}, {"mark", &cfg.Mark.ColorConfig}} {
+		sec.colors.codes = codes
+		if md.IsDefined(sec.name, "palette") {
+			isSet := func(key string) bool { return md.IsDefined(sec.name, key) }
+			if err := cfg.Resources.applyPalette(sec.colors, isSet); err != nil {
+				return fmt.Errorf("[%s] %w", sec.name, err)
+			}
+		}
+		if sec.colors.anchors, err = sec.colors.parseAnchors(); err != nil {
+			return fmt.Errorf("[%s] %w", sec.name, err)
+		}
+		for _, c := range sec.colors.fields() {
+			if _, _, _, err := parseHexColor(*c.value); *c.value != "" && err != nil {
+				return fmt.Errorf("[%s] %s: %w", sec.name, c.key, err)
+			}
+		}
+		if o := sec.colors.MarkerOpacity; o < 0 || o > 1 {
+			return fmt.Errorf("[%s] marker_opacity must be between 0 and 1, got %g", sec.name, o)
+		}
+	}
+	if cfg.Mark.highlightColors, err = cfg.Mark.parseHighlightColors(); err != nil {
+		return fmt.Errorf("[mark.highlight_colors] %w", err)
+	}
+	return nil
+}
+
 func parseHexColor(hex string) (r, g, b uint8, err error) {
 	hex = strings.TrimPrefix(hex, "#")
 	if len(hex) != 6 {
@@ -0,0 +1,375 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// configIssue is a problem `config validate` found in a config file. Errors
+// are settings GoSNare rejects or ignores; warnings are settings that work but
+// are likely not what was meant.
+type configIssue struct {
+	Line    int    `json:"line,omitempty"` // 1-indexed; 0 when not tied to a line
+	Key     string `json:"key,omitempty"`
+	Warning bool   `json:"warning,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// configCheck collects the issues of one config file, whose text is data.
+type configCheck struct {
+	data   string
+	issues []configIssue
+}
+
+func (c *configCheck) add(line int, key toml.Key, warning bool, format string, args ...any) {
+	c.issues = append(c.issues, configIssue{Line: line, Key: key.String(), Warning: warning, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (c *configCheck) errorf(key toml.Key, format string, args ...any) {
+	c.add(keyLine(c.data, key), key, false, format, args...)
+}
+
+func (c *configCheck) warnf(key toml.Key, format string, args ...any) {
+	c.add(keyLine(c.data, key), key, true, format, args...)
+}
+
+func (c *configCheck) errors() (n int) {
+	for _, is := range c.issues {
+		if !is.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+// runConfig implements `gosnare config validate [config.toml] [--json]`.
+func runConfig(args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare config validate [--config config.toml] [--json]")
+		return fmt.Errorf("expected a config subcommand: validate")
+	}
+	fs := flag.NewFlagSet("config validate", flag.ExitOnError)
+	var configPath string
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	asJSON := fs.Bool("json", false, "Print the issues as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare config validate [--config config.toml] [--json]")
+		fs.PrintDefaults()
+	}
+	if paths := parseInterspersed(fs, args[1:]); len(paths) == 1 {
+		configPath = paths[0]
+	} else if len(paths) > 1 {
+		fs.Usage()
+		return fmt.Errorf("expected one config file")
+	}
+
+	c, err := checkConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(struct {
+			File   string        `json:"file"`
+			Issues []configIssue `json:"issues"`
+		}{configPath, append([]configIssue{}, c.issues...)}); err != nil {
+			return err
+		}
+	} else {
+		for _, is := range c.issues {
+			where := configPath
+			if is.Line > 0 {
+				where = fmt.Sprintf("%s:%d", configPath, is.Line)
+			}
+			level := "error"
+			if is.Warning {
+				level = "warning"
+			}
+			if is.Key != "" {
+				fmt.Printf("%s: %s: %s: %s\n", where, level, is.Key, is.Problem)
+			} else {
+				fmt.Printf("%s: %s: %s\n", where, level, is.Problem)
+			}
+		}
+		if len(c.issues) == 0 {
+			fmt.Printf("%s: OK\n", configPath)
+		}
+	}
+	if n := c.errors(); n > 0 {
+		return fmt.Errorf("%s: %d error(s)", configPath, n)
+	}
+	return nil
+}
+
+// checkConfig checks the config file at path, collecting every problem found
+// rather than stopping at the first like LoadConfig.
+func checkConfig(path string) (*configCheck, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	c := &configCheck{data: string(data)}
+	cfg := defaultConfig()
+	md, err := toml.Decode(c.data, cfg)
+	if err != nil {
+		// Type mismatches are plain errors, with the line in the message
+		if perr := (toml.ParseError{}); errors.As(err, &perr) {
+			c.add(perr.Position.Line, toml.Key{}, false, "%s", perr.Message)
+		} else {
+			c.add(0, toml.Key{}, false, "%s", strings.TrimPrefix(err.Error(), "toml: "))
+		}
+		return c, nil
+	}
+
+	for _, key := range md.Undecoded() {
+		if s := suggestKey(key); s != "" {
+			c.errorf(key, "unknown key, ignored; did you mean %s?", s)
+		} else {
+			c.errorf(key, "unknown key, ignored")
+		}
+	}
+	c.checkColors(cfg, md)
+	c.checkWatch(cfg.Watch)
+	if dir := cfg.Resources.Dir; dir != "" {
+		if _, err := os.Stat(dir); err != nil {
+			c.warnf(toml.Key{"resources", "dir"}, "%v", err)
+		}
+	}
+
+	// Whatever the checks above do not cover, LoadConfig reports one at a time
+	if c.errors() == 0 {
+		if _, err := LoadConfig(path); err != nil {
+			c.add(0, toml.Key{}, false, "%s", strings.TrimPrefix(err.Error(), fmt.Sprintf("config %s: ", path)))
+		}
+	}
+	if md.IsDefined("watch") {
+		if err := cfg.Watch.Validate(); err != nil {
+			c.warnf(toml.Key{"watch"}, "--watch will not start: %v", err)
+		}
+	}
+	return c, nil
+}
+
+// checkColors checks every color, color code and the marker opacity.
+func (c *configCheck) checkColors(cfg *Config, md toml.MetaData) {
+	for _, sec := range []struct {
+		name   string
+		colors *ColorConfig
+	}{{"note", &cfg.Note.ColorConfig}, {"mark", &cfg.Mark.ColorConfig}} {
+		if md.IsDefined(sec.name, "palette") {
+			if _, err := cfg.Resources.palette(sec.colors.Palette); err != nil {
+				c.errorf(toml.Key{sec.name, "palette"}, "%v", err)
+			}
+		}
+		if _, err := sec.colors.parseAnchors(); err != nil {
+			c.add(keyLine(c.data, toml.Key{sec.name, "anchor"}), toml.Key{sec.name}, false, "%v", err)
+		}
+		for _, f := range sec.colors.fields() {
+			if !md.IsDefined(sec.name, f.key) {
+				continue
+			}
+			if _, _, _, err := parseHexColor(*f.value); err != nil {
+				c.errorf(toml.Key{sec.name, f.key}, "%v; expected \"#RRGGBB\"", err)
+			}
+		}
+		if o := sec.colors.MarkerOpacity; o < 0 || o > 1 {
+			c.errorf(toml.Key{sec.name, "marker_opacity"}, "must be between 0 and 1, got %g", o)
+		}
+	}
+	for _, code := range slices.Sorted(maps.Keys(cfg.Colors.Codes)) {
+		one := ColorsConfig{Codes: map[string]string{code: cfg.Colors.Codes[code]}}
+		if _, err := one.parseCodes(); err != nil {
+			c.errorf(toml.Key{"colors", "codes", code}, "%v", err)
+		}
+	}
+	for _, index := range slices.Sorted(maps.Keys(cfg.Mark.HighlightColors)) {
+		one := MarkConfig{HighlightColors: map[string]string{index: cfg.Mark.HighlightColors[index]}}
+		if _, err := one.parseHighlightColors(); err != nil {
+			c.errorf(toml.Key{"mark", "highlight_colors", index}, "%v", err)
+		}
+	}
+}
+
+// checkWatch checks that the local watch sources exist and that targets do
+// not overlap: the same input twice, an input inside another, or an output
+// inside an input.
+func (c *configCheck) checkWatch(w WatchConfig) {
+	missing := func(key toml.Key, line int, dir string) {
+		if _, err := os.Stat(dir); err != nil {
+			c.add(line, key, true, "input directory %s does not exist (yet); the source is suspended until it does", dir)
+		}
+	}
+	if w.SupernotePrivateCloud != "" {
+		missing(toml.Key{"watch", "supernote_private_cloud"}, keyLine(c.data, toml.Key{"watch", "supernote_private_cloud"}), w.SupernotePrivateCloud)
+	}
+	if w.WebDAV != "" && !isWebDAVURL(w.WebDAV) {
+		missing(toml.Key{"watch", "webdav"}, keyLine(c.data, toml.Key{"watch", "webdav"}), w.WebDAV)
+	}
+	for i, t := range w.Target {
+		if t.Input != "" {
+			missing(toml.Key{"watch", "target", "input"}, arrayTableLine(c.data, "watch.target", i), t.Input)
+		}
+	}
+
+	targets := w.Targets()
+	for i, t := range targets {
+		key := toml.Key{"watch"}
+		line := keyLine(c.data, key)
+		if j := i - (len(targets) - len(w.Target)); j >= 0 {
+			key, line = toml.Key{"watch", "target"}, arrayTableLine(c.data, "watch.target", j)
+		}
+		for _, other := range targets[:i] {
+			switch {
+			case t.Input == "" || other.Input == "":
+			case filepath.Clean(t.Input) == filepath.Clean(other.Input):
+				c.add(line, key, false, "input %s is watched twice", t.Input)
+			case isUnderDir(t.Input, other.Input) || isUnderDir(other.Input, t.Input):
+				c.add(line, key, true, "inputs %s and %s are nested; notes in the inner one are converted only by its target", t.Input, other.Input)
+			}
+		}
+		for _, other := range targets {
+			if t.Output != "" && other.Input != "" && isUnderDir(t.Output, other.Input) {
+				c.add(line, key, true, "output %s is inside the watched input %s", t.Output, other.Input)
+			}
+		}
+	}
+}
+
+// suggestKey returns the known key closest to an unknown one, if one is
+// within two edits of it, or "".
+func suggestKey(key toml.Key) string {
+	t := reflect.TypeFor[Config]()
+	for _, name := range key[:len(key)-1] {
+		f, ok := tomlFields(t)[name]
+		if !ok {
+			return ""
+		}
+		for f.Kind() == reflect.Slice || f.Kind() == reflect.Pointer {
+			f = f.Elem()
+		}
+		if f.Kind() != reflect.Struct {
+			return ""
+		}
+		t = f
+	}
+	best, bestDist := "", 3
+	for _, name := range slices.Sorted(maps.Keys(tomlFields(t))) {
+		if d := editDistance(key[len(key)-1], name); d < bestDist {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return append(slices.Clone(key[:len(key)-1]), best).String()
+}
+
+// tomlFields returns the TOML keys of the struct type t, including those of
+// embedded structs, and their types.
+func tomlFields(t reflect.Type) map[string]reflect.Type {
+	fields := make(map[string]reflect.Type)
+	for i := range t.NumField() {
+		f := t.Field(i)
+		if f.Anonymous {
+			maps.Copy(fields, tomlFields(f.Type))
+			continue
+		}
+		if name, _, _ := strings.Cut(f.Tag.Get("toml"), ","); f.IsExported() && name != "" && name != "-" {
+			fields[name] = f.Type
+		}
+	}
+	return fields
+}
+
+// editDistance is the Levenshtein distance between a and b.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+// tableHeader returns the name of the [table] or [[array table]] a line of
+// TOML opens.
+func tableHeader(line string) (name string, ok bool) {
+	line = strings.TrimSpace(line)
+	if !strings.HasPrefix(line, "[") {
+		return "", false
+	}
+	end := strings.LastIndex(line, "]")
+	if end < 0 {
+		return "", false
+	}
+	return strings.TrimSpace(strings.Trim(line[:end+1], "[]")), true
+}
+
+// keyLine returns the line of the TOML text data where key is set (or its
+// table opened), or 0. It reads tables and key = value lines only, which is
+// enough to point at a setting.
+func keyLine(data string, key toml.Key) int {
+	if len(key) == 0 {
+		return 0
+	}
+	want := key.String()
+	table := ""
+	for i, line := range strings.Split(data, "\n") {
+		if name, ok := tableHeader(line); ok {
+			if table = name; table == want {
+				return i + 1
+			}
+			continue
+		}
+		k, _, ok := strings.Cut(line, "=")
+		if !ok || strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+		k = strings.Trim(strings.TrimSpace(k), `"'`)
+		if table != "" {
+			k = table + "." + k
+		}
+		if k == want {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+// arrayTableLine returns the line of the n-th (0-indexed) [[name]] header of
+// the TOML text data, or 0.
+func arrayTableLine(data, name string, n int) int {
+	for i, line := range strings.Split(data, "\n") {
+		if strings.HasPrefix(strings.TrimSpace(line), "[[") {
+			if got, _ := tableHeader(line); got == name {
+				if n == 0 {
+					return i + 1
+				}
+				n--
+			}
+		}
+	}
+	return 0
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// DeviceConfig controls `device pull`: importing notes straight from a
+// Supernote connected over USB.
+type DeviceConfig struct {
+	Output  string   `toml:"output"`  // default: -o
+	Folders []string `toml:"folders"` // device folders to convert; default: Note, Document
+}
+
+func (c DeviceConfig) folders() []string {
+	if len(c.Folders) > 0 {
+		return c.Folders
+	}
+	return []string{"Note", "Document"}
+}
+
+// isDeviceRoot reports whether dir is the storage root of a Supernote: it
+// holds the Note and Document folders the device creates.
+func isDeviceRoot(dir string) bool {
+	for _, name := range []string{"Note", "Document"} {
+		if info, err := os.Stat(filepath.Join(dir, name)); err != nil || !info.IsDir() {
+			return false
+		}
+	}
+	return true
+}
+
+// findDevices returns the storage roots of the connected Supernotes. The
+// device is read through the filesystem the OS mounts it as: a mass-storage
+// volume, or an MTP mount (gvfs under /run/user/<uid>/gvfs, jmtpfs or
+// go-mtpfs anywhere below the mount roots). Roots are searched two levels
+// deep, as MTP mounts put the storage ("Supernote") below the device.
+func findDevices() []string {
+	var devices []string
+	var search func(dir string, depth int)
+	search = func(dir string, depth int) {
+		if isDeviceRoot(dir) {
+			if !slices.Contains(devices, dir) {
+				devices = append(devices, dir)
+			}
+			return
+		}
+		if depth == 0 {
+			return
+		}
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+		for _, e := range entries {
+			if e.IsDir() {
+				search(filepath.Join(dir, e.Name()), depth-1)
+			}
+		}
+	}
+	for _, root := range deviceMountRoots() {
+		search(root, 2)
+	}
+	return devices
+}
+
+// runDevice is the `device` subcommand: `device list` shows the connected
+// Supernotes, `device pull` converts their new and changed notes.
+func runDevice(args []string) error {
+	usage := func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare device list")
+		fmt.Fprintln(os.Stderr, "       gosnare device pull [--config config.toml] [-o <dir>] [--device <path>] [--no-bg]")
+	}
+	if len(args) == 0 {
+		usage()
+		return fmt.Errorf("device needs list or pull")
+	}
+	switch args[0] {
+	case "list":
+		devices := findDevices()
+		if len(devices) == 0 {
+			return fmt.Errorf("no Supernote found; connect it over USB (on macOS, mount MTP devices with a tool such as go-mtpfs)")
+		}
+		for _, d := range devices {
+			fmt.Println(d)
+		}
+		return nil
+	case "pull":
+		return runDevicePull(args[1:])
+	}
+	usage()
+	return fmt.Errorf("unknown device command %q", args[0])
+}
+
+func runDevicePull(args []string) error {
+	fs := flag.NewFlagSet("device pull", flag.ExitOnError)
+	var output, configPath, device string
+	var noBg bool
+	fs.StringVar(&output, "o", "", "Output directory (default: [device] output from config)")
+	fs.StringVar(&output, "output", "", "Output directory (default: [device] output from config)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	fs.StringVar(&device, "device", "", "Storage root of the device (default: detect the connected Supernote)")
+	fs.BoolVar(&noBg, "no-bg", false, "Exclude the background layer from the PDF output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare device pull [--config config.toml] [-o <dir>] [--device <path>] [--no-bg]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if err := logger.Configure(cfg.Log); err != nil {
+		return fmt.Errorf("config [log]: %w", err)
+	}
+	cfg.Performance.apply()
+	if output == "" {
+		output = cfg.Device.Output
+	}
+	if output == "" {
+		return fmt.Errorf("device pull needs -o or [device] output in config")
+	}
+
+	devices := []string{device}
+	if device == "" {
+		if devices = findDevices(); len(devices) == 0 {
+			return fmt.Errorf("no Supernote found; connect it over USB or pass --device")
+		}
+		if len(devices) > 1 {
+			return fmt.Errorf("%d Supernotes found (%v); choose one with --device", len(devices), devices)
+		}
+	}
+
+	logger.Infof("Pulling from %s", devices[0])
+	for _, folder := range cfg.Device.folders() {
+		in := filepath.Join(devices[0], folder)
+		if _, err := os.Stat(in); err != nil {
+			logger.Debugf("no %s folder on the device", folder)
+			continue
+		}
+		if err := processDirectory(in, filepath.Join(output, folder), noBg, false, false, cfg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// dirConfigName is the per-directory config: placed in an input directory, it
+// overrides the colors, layers and backgrounds of the notebooks below it.
+const dirConfigName = ".gosnare.toml"
+
+// forSource returns the config of the notebook at path, found under the input
+// directory root: cfg with the .gosnare.toml files of root and each directory
+// down to path's applied in turn, so the nearest one wins. noBg is the
+// background setting, which the files may override with no_bg. A path outside
+// root only gets the file of its own directory.
+func (cfg *Config) forSource(root, path string, noBg bool) (*Config, bool, error) {
+	dir := filepath.Dir(path)
+	dirs := []string{dir}
+	if rel, err := filepath.Rel(root, dir); err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		dirs = []string{root}
+		for _, name := range strings.Split(rel, string(filepath.Separator)) {
+			dirs = append(dirs, filepath.Join(dirs[len(dirs)-1], name))
+		}
+	}
+
+	out := cfg
+	for _, dir := range dirs {
+		file := filepath.Join(dir, dirConfigName)
+		data, err := os.ReadFile(file)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if out == cfg {
+			out = cfg.clone()
+		}
+		if noBg, err = out.applyDirConfig(dir, string(data), noBg); err != nil {
+			return nil, false, fmt.Errorf("config %s: %w", file, err)
+		}
+	}
+	return out, noBg, nil
+}
+
+// clone copies cfg deep enough for a .gosnare.toml to be decoded on top of the
+// copy: the maps and slices it can set are not shared.
+func (cfg *Config) clone() *Config {
+	c := *cfg
+	c.Colors.Codes = maps.Clone(cfg.Colors.Codes)
+	c.Mark.HighlightColors = maps.Clone(cfg.Mark.HighlightColors)
+	c.Note.Layers = slices.Clone(cfg.Note.Layers)
+	c.Note.Backgrounds = slices.Clone(cfg.Note.Backgrounds)
+	c.Note.Anchors = slices.Clone(cfg.Note.Anchors)
+	c.Mark.Anchors = slices.Clone(cfg.Mark.Anchors)
+	return &c
+}
+
+// dirConfigKey reports whether a .gosnare.toml may set key.
+func dirConfigKey(key toml.Key) bool {
+	switch key[0] {
+	case "no_bg", "colors", "mark":
+		return true
+	case "note":
+		return len(key) == 1 || key[1] != "format"
+	}
+	return false
+}
+
+// applyDirConfig decodes the .gosnare.toml of dir on top of cfg and returns
+// the background setting it leaves. Relative background files are resolved
+// against dir.
+func (cfg *Config) applyDirConfig(dir, data string, noBg bool) (bool, error) {
+	var top struct {
+		NoBg *bool `toml:"no_bg"`
+	}
+	md, err := toml.Decode(data, &top)
+	if err != nil {
+		return noBg, err
+	}
+	for _, key := range md.Keys() {
+		if !dirConfigKey(key) {
+			return noBg, fmt.Errorf("%s cannot be set per directory; only no_bg, [colors], [mark] and [note] other than format can", key)
+		}
+	}
+	if top.NoBg != nil {
+		noBg = *top.NoBg
+	}
+
+	if _, err := toml.Decode(data, cfg); err != nil {
+		return noBg, err
+	}
+	if md.IsDefined("note", "background") {
+		for i, r := range cfg.Note.Backgrounds {
+			if !filepath.IsAbs(r.File) {
+				cfg.Note.Backgrounds[i].File = filepath.Join(dir, r.File)
+			}
+		}
+	}
+	if err := cfg.resolveColors(md); err != nil {
+		return noBg, err
+	}
+	if err := cfg.Mark.validateAnnotations(); err != nil {
+		return noBg, fmt.Errorf("[mark] %w", err)
+	}
+	if err := cfg.Note.validateLayers(); err != nil {
+		return noBg, fmt.Errorf("[note] %w", err)
+	}
+	if err := cfg.Note.validateBackgrounds(); err != nil {
+		return noBg, fmt.Errorf("[note] %w", err)
+	}
+	switch cfg.Note.RealtimeMode {
+	case "", "ink", "text":
+	default:
+		return noBg, fmt.Errorf("[note] realtime_mode must be \"ink\" or \"text\", got %q", cfg.Note.RealtimeMode)
+	}
+	switch cfg.Note.MarkerBlend {
+	case "", "normal", "multiply":
+	default:
+		return noBg, fmt.Errorf("[note] marker_blend must be \"normal\" or \"multiply\", got %q", cfg.Note.MarkerBlend)
+	}
+	cfg.useDeviceGrays()
+	return noBg, nil
+}
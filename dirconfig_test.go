@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestDirConfigKeepsDeviceGrays(t *testing.T) {
+	root := t.TempDir()
+	dir := filepath.Join(root, "Work")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	data := "[note]\nblack = \"#FF0000\"\n\n[mark]\ndark_gray = \"#00FF00\"\n"
+	if err := os.WriteFile(filepath.Join(dir, dirConfigName), []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	cfg := defaultConfig()
+	cfg.PDF.ColorSpace = "gray"
+
+	out, _, err := cfg.forSource(root, filepath.Join(dir, "a.note"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	def := defaultConfig()
+	if got, want := out.Note.Black, def.Note.Black; got != want {
+		t.Errorf("[note] black: got %q, want the device's %q", got, want)
+	}
+	if got, want := out.Mark.DarkGray, def.Mark.DarkGray; got != want {
+		t.Errorf("[mark] dark_gray: got %q, want the device's %q", got, want)
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// DropboxConfig is the [watch.dropbox] backend: notes are pulled from a
+// Dropbox folder (where the device syncs them) and, with output_folder, the
+// PDFs are pushed back to Dropbox.
+type DropboxConfig struct {
+	Token        string `toml:"token"`         // access token; or refresh_token with app_key
+	RefreshToken string `toml:"refresh_token"` // long-lived; access tokens are refreshed with it
+	AppKey       string `toml:"app_key"`
+	AppSecret    string `toml:"app_secret"`    // not needed for PKCE refresh tokens
+	Folder       string `toml:"folder"`        // Dropbox folder with the notes, e.g. "/Supernote/Note"
+	OutputFolder string `toml:"output_folder"` // Dropbox folder the PDFs are pushed to; default: not pushed
+	Output       string `toml:"output"`        // local output; default: [watch] location, else a cache dir when pushing
+	Mirror       string `toml:"mirror"`        // local copy of the notes; default: <user cache dir>/gosnare/dropbox
+	PollInterval int    `toml:"poll_interval"` // seconds, 0 = default (60s)
+}
+
+func (c DropboxConfig) enabled() bool {
+	return c.Token != "" || c.RefreshToken != ""
+}
+
+// validate checks that the backend can authenticate and knows its folder.
+func (c DropboxConfig) validate() error {
+	if c.Token == "" && c.AppKey == "" {
+		return errors.New("[watch.dropbox] refresh_token requires app_key")
+	}
+	if c.Folder == "" && c.OutputFolder == "" {
+		return errors.New("[watch.dropbox] requires folder and/or output_folder")
+	}
+	return nil
+}
+
+func (c DropboxConfig) mirrorDir() string {
+	return mirrorDir(c.Mirror, "dropbox")
+}
+
+// outputDir returns the local output directory: output, else location,
+// else a cache directory when the PDFs are pushed.
+func (c DropboxConfig) outputDir(location string) string {
+	switch {
+	case c.Output != "":
+		return c.Output
+	case location == "" && c.OutputFolder != "":
+		return mirrorDir("", "dropbox-output")
+	}
+	return location
+}
+
+func (c DropboxConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return time.Minute
+}
+
+const (
+	dropboxAPI     = "https://api.dropboxapi.com/2/"
+	dropboxContent = "https://content.dropboxapi.com/2/"
+	dropboxOAuth   = "https://api.dropbox.com/oauth2/token"
+)
+
+// dropbox is a client of the Dropbox HTTP API rooted at one folder; it is
+// both a remoteSource and a remoteDestination.
+type dropbox struct {
+	root   string // folder, "" for the whole Dropbox
+	token  *oauthToken
+	client *http.Client
+}
+
+func newDropbox(c DropboxConfig, folder string) *dropbox {
+	root := strings.TrimSuffix(folder, "/")
+	if root != "" && !strings.HasPrefix(root, "/") {
+		root = "/" + root
+	}
+	d := &dropbox{root: root, client: &http.Client{Timeout: 5 * time.Minute}}
+	d.token = &oauthToken{token: c.Token, client: d.client}
+	if c.RefreshToken != "" {
+		d.token.endpoint = dropboxOAuth
+		d.token.form = url.Values{"grant_type": {"refresh_token"}, "refresh_token": {c.RefreshToken}, "client_id": {c.AppKey}}
+		if c.AppSecret != "" {
+			d.token.form.Set("client_secret", c.AppSecret)
+		}
+	}
+	return d
+}
+
+func (d *dropbox) name() string { return "Dropbox " + d.root }
+
+// do sends an API request. RPC endpoints take arg as the JSON body; content
+// endpoints take it in the Dropbox-API-Arg header and body as the content.
+func (d *dropbox) do(ctx context.Context, endpoint string, arg any, body io.Reader) (*http.Response, error) {
+	token, err := d.token.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	argJSON, err := json.Marshal(arg)
+	if err != nil {
+		return nil, err
+	}
+	content := endpoint == "files/download" || endpoint == "files/upload"
+	var req *http.Request
+	if content {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, dropboxContent+endpoint, body)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, dropboxAPI+endpoint, bytes.NewReader(argJSON))
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if content {
+		req.Header.Set("Dropbox-API-Arg", asciiJSON(argJSON))
+		if body != nil {
+			req.Header.Set("Content-Type", "application/octet-stream")
+		}
+	} else {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return nil, fmt.Errorf("%s: %s: %s", endpoint, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+// call sends an RPC request and decodes its response into out (if not nil).
+func (d *dropbox) call(ctx context.Context, endpoint string, arg, out any) error {
+	resp, err := d.do(ctx, endpoint, arg, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// asciiJSON escapes the non-ASCII characters of JSON, as required of the
+// Dropbox-API-Arg header.
+func asciiJSON(data []byte) string {
+	var b strings.Builder
+	for _, r := range string(data) {
+		switch {
+		case r < 0x80:
+			b.WriteRune(r)
+		case r > 0xFFFF:
+			r -= 0x10000
+			fmt.Fprintf(&b, `\u%04x\u%04x`, 0xD800+(r>>10), 0xDC00+(r&0x3FF))
+		default:
+			fmt.Fprintf(&b, `\u%04x`, r)
+		}
+	}
+	return b.String()
+}
+
+type dropboxEntry struct {
+	Tag            string `json:".tag"`
+	ID             string `json:"id"`
+	PathDisplay    string `json:"path_display"`
+	Size           int64  `json:"size"`
+	ClientModified string `json:"client_modified"`
+}
+
+func (d *dropbox) list(ctx context.Context) ([]remoteFile, error) {
+	var page struct {
+		Entries []dropboxEntry `json:"entries"`
+		Cursor  string         `json:"cursor"`
+		HasMore bool           `json:"has_more"`
+	}
+	err := d.call(ctx, "files/list_folder", map[string]any{"path": d.root, "recursive": true}, &page)
+	var files []remoteFile
+	for err == nil {
+		for _, e := range page.Entries {
+			if e.Tag != "file" || len(e.PathDisplay) <= len(d.root)+1 {
+				continue
+			}
+			mod, _ := time.Parse(time.RFC3339, e.ClientModified)
+			files = append(files, remoteFile{path: e.PathDisplay[len(d.root)+1:], size: e.Size, modTime: mod, id: e.ID})
+		}
+		if !page.HasMore {
+			return files, nil
+		}
+		cursor := page.Cursor
+		page.Entries = nil
+		err = d.call(ctx, "files/list_folder/continue", map[string]any{"cursor": cursor}, &page)
+	}
+	if strings.Contains(err.Error(), "path/not_found") {
+		return nil, nil // an output folder not created yet
+	}
+	return nil, err
+}
+
+func (d *dropbox) download(ctx context.Context, f remoteFile, w io.Writer) error {
+	resp, err := d.do(ctx, "files/download", map[string]any{"path": f.id}, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+func (d *dropbox) upload(ctx context.Context, rel string, r io.Reader, modTime time.Time) error {
+	resp, err := d.do(ctx, "files/upload", map[string]any{
+		"path":            path.Join(d.root, rel),
+		"mode":            "overwrite",
+		"client_modified": modTime.UTC().Format("2006-01-02T15:04:05Z"),
+		"mute":            true,
+	}, r)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (d *dropbox) remove(ctx context.Context, rel string) error {
+	return d.call(ctx, "files/delete_v2", map[string]any{"path": path.Join(d.root, rel)}, nil)
+}
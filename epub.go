@@ -0,0 +1,240 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const epubCSS = `body { margin: 0; padding: 0; }
+section { page-break-after: always; }
+img { display: block; max-width: 100%; height: auto; margin: 0 auto; }
+.text { margin: 1em; line-height: 1.5; }
+.text p { margin: 0 0 .5em 0; }
+nav ol { list-style: none; }
+`
+
+// ConvertNoteToEPUB exports a .note as an EPUB 3 book: each page is a chapter
+// with the page image followed by the text the device recognized on it, so
+// handwriting can be read (and searched, and resized) on a phone. The table
+// of contents lists the notebook's headings and starred pages, or every page
+// when it has neither. onPage, if non-nil, is called after each page.
+func ConvertNoteToEPUB(ctx context.Context, inputPath, outputPath string, noBg bool, cfg *Config, onPage func()) (*Result, error) {
+	res := &Result{}
+	defer res.sort()
+	src, notebook, err := openNotebook(inputPath)
+	if err != nil {
+		return res, fmt.Errorf("parsing notebook: %w", err)
+	}
+	defer src.Close()
+	res.warnFormatVersion(notebook)
+	notebook.selectLayers(cfg.Note)
+	palette := cfg.Note.palette()
+	res.Starred = starredPages(notebook)
+	ocr, err := cfg.OCR.engine()
+	if err != nil {
+		return res, err
+	}
+	var headings []heading
+	if len(notebook.Titles) > 0 {
+		if headings, err = readHeadings(src, notebook, ocr, false, res); err != nil {
+			return res, fmt.Errorf("reading headings: %w", err)
+		}
+	}
+	toc := headingOutline(headings, 0, 0)
+	if starred := starredOutline(notebook, 0); starred != nil {
+		toc = append(toc, starred)
+	}
+
+	tmpPath := outputPath + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return res, err
+	}
+	defer os.Remove(tmpPath)
+	zw := zip.NewWriter(f)
+	add := func(name string, method uint16, data []byte) error {
+		w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: method, Modified: time.Now()})
+		if err != nil {
+			return err
+		}
+		_, err = w.Write(data)
+		return err
+	}
+	fail := func(err error) (*Result, error) {
+		f.Close()
+		return res, err
+	}
+
+	// The mimetype must be the first entry, uncompressed
+	if err := add("mimetype", zip.Store, []byte("application/epub+zip")); err != nil {
+		return fail(err)
+	}
+	if err := add("META-INF/container.xml", zip.Deflate, []byte(epubContainer)); err != nil {
+		return fail(err)
+	}
+
+	title := strings.TrimSuffix(filepath.Base(inputPath), filepath.Ext(inputPath))
+	width, height := notebook.Width, notebook.Height
+	bgImages := newBackgroundImages(width, height)
+	for i, page := range notebook.Pages {
+		if err := ctx.Err(); err != nil {
+			return fail(err)
+		}
+		res.warnUnknownLayers(page)
+		img, err := renderPageImage(src, page, width, height, noBg, palette, cfg.Note, bgImages)
+		if err != nil {
+			return fail(fmt.Errorf("page %d: %w", i+1, err))
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return fail(err)
+		}
+		// Images are already compressed
+		if err := add(fmt.Sprintf("OEBPS/images/page-%03d.png", i+1), zip.Store, buf.Bytes()); err != nil {
+			return fail(err)
+		}
+		text, err := readRecognizedText(src, page.RecognText)
+		if err != nil {
+			res.warnf(WarnTextFallback, i+1, "recognized text left out: %v", err)
+		}
+		if err := add(fmt.Sprintf("OEBPS/page-%03d.xhtml", i+1), zip.Deflate, epubPage(title, i, text)); err != nil {
+			return fail(err)
+		}
+		if onPage != nil {
+			onPage()
+		}
+	}
+
+	if err := add("OEBPS/style.css", zip.Deflate, []byte(epubCSS)); err != nil {
+		return fail(err)
+	}
+	if err := add("OEBPS/nav.xhtml", zip.Deflate, epubNav(title, toc, len(notebook.Pages))); err != nil {
+		return fail(err)
+	}
+	if err := add("OEBPS/content.opf", zip.Deflate, epubPackage(title, epubIdentifier(notebook, inputPath), cfg.Locale.Language, len(notebook.Pages))); err != nil {
+		return fail(err)
+	}
+	err = zw.Close()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return res, err
+	}
+	return res, os.Rename(tmpPath, outputPath)
+}
+
+const epubContainer = `<?xml version="1.0" encoding="UTF-8"?>
+<container version="1.0" xmlns="urn:oasis:names:tc:opendocument:xmlns:container">
+  <rootfiles>
+    <rootfile full-path="OEBPS/content.opf" media-type="application/oebps-package+xml"/>
+  </rootfiles>
+</container>
+`
+
+// epubIdentifier returns the book's unique identifier: the notebook's file
+// ID, which survives renames on the device, or a hash of its path.
+func epubIdentifier(nb *Notebook, path string) string {
+	if nb.FileID != "" {
+		return "urn:supernote:" + nb.FileID
+	}
+	abs, _ := filepath.Abs(path)
+	return fmt.Sprintf("urn:gosnare:%x", sha256.Sum256([]byte(abs)))
+}
+
+func epubPackage(title, id, language string, pages int) []byte {
+	if language == "" {
+		language = "und"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<?xml version="1.0" encoding="UTF-8"?>
+<package xmlns="http://www.idpf.org/2007/opf" version="3.0" unique-identifier="id">
+  <metadata xmlns:dc="http://purl.org/dc/elements/1.1/">
+    <dc:identifier id="id">%s</dc:identifier>
+    <dc:title>%s</dc:title>
+    <dc:language>%s</dc:language>
+    <meta property="dcterms:modified">%s</meta>
+  </metadata>
+  <manifest>
+    <item id="nav" href="nav.xhtml" media-type="application/xhtml+xml" properties="nav"/>
+    <item id="css" href="style.css" media-type="text/css"/>
+`, html.EscapeString(id), html.EscapeString(title), html.EscapeString(language), time.Now().UTC().Format("2006-01-02T15:04:05Z"))
+	for i := 1; i <= pages; i++ {
+		fmt.Fprintf(&b, "    <item id=\"p%03d\" href=\"page-%03d.xhtml\" media-type=\"application/xhtml+xml\"/>\n", i, i)
+		fmt.Fprintf(&b, "    <item id=\"i%03d\" href=\"images/page-%03d.png\" media-type=\"image/png\"/>\n", i, i)
+	}
+	b.WriteString("  </manifest>\n  <spine>\n")
+	for i := 1; i <= pages; i++ {
+		fmt.Fprintf(&b, "    <itemref idref=\"p%03d\"/>\n", i)
+	}
+	b.WriteString("  </spine>\n</package>\n")
+	return b.Bytes()
+}
+
+const epubXHTMLHead = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE html>
+<html xmlns="http://www.w3.org/1999/xhtml" xmlns:epub="http://www.idpf.org/2007/ops">
+<head><title>%s</title><link rel="stylesheet" type="text/css" href="style.css"/></head>
+<body>
+`
+
+// epubPage is the chapter of page i: its image, then its recognized text
+// one paragraph per line.
+func epubPage(title string, i int, text string) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, epubXHTMLHead, html.EscapeString(fmt.Sprintf("%s – page %d", title, i+1)))
+	fmt.Fprintf(&b, "<section id=\"page-%d\" epub:type=\"chapter\">\n<img src=\"images/page-%03d.png\" alt=\"Page %d\"/>\n", i+1, i+1, i+1)
+	if text != "" {
+		b.WriteString("<div class=\"text\">\n")
+		for _, line := range strings.Split(text, "\n") {
+			fmt.Fprintf(&b, "<p>%s</p>\n", html.EscapeString(line))
+		}
+		b.WriteString("</div>\n")
+	}
+	b.WriteString("</section>\n</body>\n</html>\n")
+	return b.Bytes()
+}
+
+// epubNav is the navigation document: the table of contents (toc, or every
+// page without one) and the page list.
+func epubNav(title string, toc []*outlineItem, pages int) []byte {
+	if len(toc) == 0 {
+		for i := range pages {
+			toc = append(toc, &outlineItem{title: fmt.Sprintf("Page %d", i+1), page: i})
+		}
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, epubXHTMLHead, html.EscapeString(title))
+	var list func(items []*outlineItem, indent string)
+	list = func(items []*outlineItem, indent string) {
+		b.WriteString(indent + "<ol>\n")
+		for _, it := range items {
+			fmt.Fprintf(&b, "%s  <li><a href=\"page-%03d.xhtml\">%s</a>", indent, it.page+1, html.EscapeString(it.title))
+			if len(it.children) > 0 {
+				b.WriteString("\n")
+				list(it.children, indent+"    ")
+				b.WriteString(indent + "  ")
+			}
+			b.WriteString("</li>\n")
+		}
+		b.WriteString(indent + "</ol>\n")
+	}
+	b.WriteString("<nav epub:type=\"toc\" id=\"toc\">\n")
+	fmt.Fprintf(&b, "  <h1>%s</h1>\n", html.EscapeString(title))
+	list(toc, "  ")
+	b.WriteString("</nav>\n<nav epub:type=\"page-list\" hidden=\"\">\n  <ol>\n")
+	for i := 1; i <= pages; i++ {
+		fmt.Fprintf(&b, "    <li><a href=\"page-%03d.xhtml#page-%d\">%d</a></li>\n", i, i, i)
+	}
+	b.WriteString("  </ol>\n</nav>\n</body>\n</html>\n")
+	return b.Bytes()
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+const (
+	// stormRate is the number of events per second above which the watcher
+	// treats a burst as a storm (e.g. a device sync) and defers all work.
+	stormRate = 200
+	// stormQuiet is how long no events must arrive before a storm is over.
+	stormQuiet = 3 * time.Second
+)
+
+// eventBatcher coalesces filesystem events per directory: a directory's pending
+// paths are flushed together once it has been quiet for delay. During an event
+// storm nothing is flushed until events have stopped for stormQuiet, so
+// stat-heavy classification runs once against the settled tree.
+type eventBatcher struct {
+	mu      sync.Mutex
+	dirs    map[string]*pendingDir
+	delay   time.Duration
+	onFlush func(paths []string)
+
+	windowStart time.Time // start of the current one-second rate window
+	windowCount int
+	storm       bool
+	stormEvents int
+	lastEvent   time.Time
+}
+
+// pendingDir holds the changed paths of one directory awaiting a flush.
+type pendingDir struct {
+	paths map[string]bool
+	timer *time.Timer
+}
+
+func newEventBatcher(delay time.Duration, onFlush func(paths []string)) *eventBatcher {
+	return &eventBatcher{
+		dirs:    make(map[string]*pendingDir),
+		delay:   delay,
+		onFlush: onFlush,
+	}
+}
+
+func (b *eventBatcher) trigger(path string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.lastEvent = now
+	if now.Sub(b.windowStart) >= time.Second {
+		b.windowStart, b.windowCount = now, 0
+	}
+	b.windowCount++
+	if b.storm {
+		b.stormEvents++
+	} else if b.windowCount > stormRate {
+		b.storm, b.stormEvents = true, b.windowCount
+		logger.Infof("Event storm (over %d events/s); deferring work until it subsides", stormRate)
+	}
+
+	dir := filepath.Dir(path)
+	pd, ok := b.dirs[dir]
+	if !ok {
+		pd = &pendingDir{paths: make(map[string]bool)}
+		pd.timer = time.AfterFunc(b.delay, func() { b.fire(dir) })
+		b.dirs[dir] = pd
+	} else {
+		pd.timer.Reset(b.delay)
+	}
+	pd.paths[path] = true
+}
+
+// fire flushes dir, unless a storm is still going on.
+func (b *eventBatcher) fire(dir string) {
+	b.mu.Lock()
+	pd, ok := b.dirs[dir]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	if b.storm {
+		if quiet := time.Since(b.lastEvent); quiet < stormQuiet {
+			pd.timer.Reset(stormQuiet - quiet)
+			b.mu.Unlock()
+			return
+		}
+		b.storm = false
+		logger.Infof("Event storm subsided after %d events; processing %d directories", b.stormEvents, len(b.dirs))
+	}
+	delete(b.dirs, dir)
+	b.mu.Unlock()
+
+	paths := make([]string, 0, len(pd.paths))
+	for p := range pd.paths {
+		paths = append(paths, p)
+	}
+	slices.Sort(paths)
+	b.onFlush(paths)
+}
+
+func (b *eventBatcher) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for dir, pd := range b.dirs {
+		pd.timer.Stop()
+		delete(b.dirs, dir)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"math"
+	"os"
+)
+
+// recognitionExport is the `extract recognition` report of one notebook.
+// Page numbers are 1-indexed; word boxes are x, y, w, h in device pixels.
+type recognitionExport struct {
+	File  string            `json:"file"`
+	Error string            `json:"error,omitempty"` // why the file cannot be parsed
+	Pages []recognitionPage `json:"pages"`
+}
+
+type recognitionPage struct {
+	Page  int               `json:"page"`
+	Error string            `json:"error,omitempty"` // why the payload cannot be decoded
+	Text  string            `json:"text"`
+	Words []recognitionWord `json:"words"`
+	// JIIX is the MyScript payload as stored by the device, with its boxes
+	// in millimeters
+	JIIX json.RawMessage `json:"jiix,omitempty"`
+}
+
+type recognitionWord struct {
+	Label      string   `json:"label"`
+	Box        [4]int   `json:"box"`
+	Candidates []string `json:"candidates,omitempty"`
+	Confidence *float64 `json:"confidence,omitempty"` // when the device recorded one
+}
+
+// jiixElement is the part of a JIIX element that words are read from.
+type jiixElement struct {
+	Type  string `json:"type"`
+	Words []struct {
+		Label       string   `json:"label"`
+		Candidates  []string `json:"candidates"`
+		Confidence  *float64 `json:"confidence"`
+		BoundingBox *struct {
+			X      float64 `json:"x"`
+			Y      float64 `json:"y"`
+			Width  float64 `json:"width"`
+			Height float64 `json:"height"`
+		} `json:"bounding-box"`
+	} `json:"words"`
+}
+
+// runExtract implements `gosnare extract <what>`: data stored in notebooks,
+// written out without converting them.
+func runExtract(args []string) error {
+	if len(args) > 0 {
+		switch args[0] {
+		case "recognition":
+			return runExtractRecognition(args[1:])
+		case "thumbs":
+			return runExtractThumbs(args[1:])
+		}
+	}
+	fmt.Fprintln(os.Stderr, "Usage: gosnare extract recognition [--no-jiix] <file.note>...")
+	fmt.Fprintln(os.Stderr, "       gosnare extract thumbs [--config config.toml] [-o <dir>] [--format png|jpeg] [--quality 85] [--no-bg] <file.note|dir>...")
+	return fmt.Errorf("expected an extract subcommand: recognition or thumbs")
+}
+
+// runExtractRecognition implements `gosnare extract recognition`: the
+// handwriting recognition of notebooks' pages as JSON, one object per file
+// (an array for several files). Each recognized page has its text, its words
+// with their boxes, and the raw JIIX payload.
+func runExtractRecognition(args []string) error {
+	fs := flag.NewFlagSet("extract recognition", flag.ExitOnError)
+	noRaw := fs.Bool("no-jiix", false, "Leave out the raw JIIX payloads")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare extract recognition [--no-jiix] <file.note>...")
+		fs.PrintDefaults()
+	}
+	paths := parseInterspersed(fs, args)
+	if len(paths) == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected .note files")
+	}
+
+	var exports []recognitionExport
+	var failed int
+	for _, path := range paths {
+		e := extractRecognition(path, !*noRaw)
+		if e.Error != "" {
+			failed++
+		}
+		exports = append(exports, e)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	var err error
+	if len(exports) == 1 {
+		err = enc.Encode(exports[0])
+	} else {
+		err = enc.Encode(exports)
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be parsed", failed)
+	}
+	return nil
+}
+
+// extractRecognition reads the recognition of every recognized page of the
+// notebook at path; errors are reported in the result.
+func extractRecognition(path string, raw bool) recognitionExport {
+	e := recognitionExport{File: path, Pages: []recognitionPage{}}
+	src, nb, err := openNotebook(path)
+	if err != nil {
+		e.Error = err.Error()
+		return e
+	}
+	defer src.Close()
+
+	px := nb.PPI / 25.4 // JIIX coordinates are in millimeters
+	for i, page := range nb.Pages {
+		if page.RecognText == 0 {
+			continue
+		}
+		p := recognitionPage{Page: i + 1, Words: []recognitionWord{}}
+		data, err := readRecognition(src, page.RecognText)
+		if err == nil {
+			p.Text, err = recognizedText(data)
+		}
+		var doc struct {
+			Elements []jiixElement `json:"elements"`
+		}
+		if err == nil {
+			err = json.Unmarshal(data, &doc)
+		}
+		if err != nil {
+			p.Error = err.Error()
+			e.Pages = append(e.Pages, p)
+			continue
+		}
+		for _, el := range doc.Elements {
+			if el.Type != "Text" {
+				continue
+			}
+			for _, w := range el.Words {
+				// Spaces and line breaks are words without a box
+				if w.BoundingBox == nil {
+					continue
+				}
+				b := w.BoundingBox
+				p.Words = append(p.Words, recognitionWord{
+					Label: w.Label,
+					Box: [4]int{
+						int(math.Round(b.X * px)), int(math.Round(b.Y * px)),
+						int(math.Round(b.Width * px)), int(math.Round(b.Height * px)),
+					},
+					Candidates: w.Candidates,
+					Confidence: w.Confidence,
+				})
+			}
+		}
+		if raw {
+			p.JIIX = data
+		}
+		e.Pages = append(e.Pages, p)
+	}
+	return e
+}
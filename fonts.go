@@ -0,0 +1,474 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strings"
+	"unicode/utf16"
+)
+
+// textFont renders generated text (headings, recognized text) in output PDFs.
+type textFont interface {
+	// width returns the advance width of s at size, in points.
+	width(s string, size float64) float64
+	// appendString appends s as a string operand for Tj.
+	appendString(buf []byte, s string) []byte
+	// objects returns the font dictionary, numbered id, and the objects it
+	// references, numbered from next. It returns the next free object ID.
+	objects(id, next int) ([]pdfObject, int, error)
+}
+
+// freshFont returns f for another part of a document that embeds its own font
+// objects, such as one page: a TrueType font is copied to record its glyphs
+// anew, so each subset holds only the glyphs of its part.
+func freshFont(f textFont) textFont {
+	if t, ok := f.(*trueTypeFont); ok {
+		c := *t
+		c.used = map[uint16]rune{0: 0}
+		return &c
+	}
+	return f
+}
+
+// standardFont is one of the standard 14 PDF fonts, which viewers provide.
+// Text is WinAnsi-encoded, so it covers Western European scripts only.
+type standardFont struct {
+	baseFont string
+}
+
+var (
+	helvetica     = standardFont{"Helvetica"}
+	helveticaBold = standardFont{"Helvetica-Bold"}
+)
+
+func (f standardFont) width(s string, size float64) float64 { return helveticaWidth(s, size) }
+
+func (f standardFont) appendString(buf []byte, s string) []byte { return appendPDFString(buf, s) }
+
+func (f standardFont) objects(id, next int) ([]pdfObject, int, error) {
+	obj := fmt.Appendf(nil, "%d 0 obj\n<< /Type /Font /Subtype /Type1 /BaseFont /%s /Encoding /WinAnsiEncoding >>\nendobj\n", id, f.baseFont)
+	return []pdfObject{{id: id, data: obj}}, next, nil
+}
+
+// trueTypeFont is a user-supplied TrueType font, embedded as a composite
+// (Type0) font so any script it covers can be shown. Only the glyphs used are
+// embedded; glyph IDs are kept, so text is encoded as raw glyph IDs.
+type trueTypeFont struct {
+	name       string
+	tables     map[string][]byte
+	unitsPerEm float64
+	numGlyphs  int
+	advances   []uint16 // by glyph ID
+	cmap       map[rune]uint16
+	bbox       [4]int16
+	ascent     int16
+	descent    int16
+	capHeight  int16
+
+	used map[uint16]rune // glyph ID -> character, for widths and ToUnicode
+}
+
+var errNotTrueType = errors.New("not a TrueType font")
+
+// parseTrueType reads the tables of a .ttf file needed to lay out and embed text.
+func parseTrueType(data []byte, name string) (*trueTypeFont, error) {
+	if len(data) < 12 {
+		return nil, errNotTrueType
+	}
+	switch string(data[:4]) {
+	case "\x00\x01\x00\x00", "true":
+	case "OTTO":
+		return nil, errors.New("CFF-based OpenType fonts are not supported; use a TrueType (.ttf) font")
+	case "ttcf":
+		return nil, errors.New("font collections (.ttc) are not supported; use a single .ttf font")
+	default:
+		return nil, errNotTrueType
+	}
+
+	f := &trueTypeFont{name: name, tables: make(map[string][]byte), used: map[uint16]rune{0: 0}}
+	numTables := int(binary.BigEndian.Uint16(data[4:]))
+	for i := range numTables {
+		rec := 12 + 16*i
+		if rec+16 > len(data) {
+			return nil, errNotTrueType
+		}
+		tag := string(data[rec : rec+4])
+		off := int(binary.BigEndian.Uint32(data[rec+8:]))
+		n := int(binary.BigEndian.Uint32(data[rec+12:]))
+		if off < 0 || n < 0 || off+n > len(data) {
+			return nil, fmt.Errorf("table %q out of range", tag)
+		}
+		f.tables[tag] = data[off : off+n]
+	}
+
+	head, hhea, maxp, hmtx := f.tables["head"], f.tables["hhea"], f.tables["maxp"], f.tables["hmtx"]
+	if len(head) < 54 || len(hhea) < 36 || len(maxp) < 6 || f.tables["glyf"] == nil || f.tables["loca"] == nil {
+		return nil, errors.New("missing or truncated TrueType tables")
+	}
+	f.unitsPerEm = float64(binary.BigEndian.Uint16(head[18:]))
+	if f.unitsPerEm == 0 {
+		return nil, errors.New("invalid unitsPerEm")
+	}
+	for i := range 4 {
+		f.bbox[i] = int16(binary.BigEndian.Uint16(head[36+2*i:]))
+	}
+	f.ascent = int16(binary.BigEndian.Uint16(hhea[4:]))
+	f.descent = int16(binary.BigEndian.Uint16(hhea[6:]))
+	f.capHeight = f.ascent
+	if os2 := f.tables["OS/2"]; len(os2) >= 90 && binary.BigEndian.Uint16(os2) >= 2 {
+		f.capHeight = int16(binary.BigEndian.Uint16(os2[88:]))
+	}
+
+	f.numGlyphs = int(binary.BigEndian.Uint16(maxp[4:]))
+	numHMetrics := int(binary.BigEndian.Uint16(hhea[34:]))
+	if numHMetrics == 0 || len(hmtx) < 4*numHMetrics {
+		return nil, errors.New("truncated hmtx table")
+	}
+	f.advances = make([]uint16, f.numGlyphs)
+	for g := range f.numGlyphs {
+		f.advances[g] = binary.BigEndian.Uint16(hmtx[4*min(g, numHMetrics-1):])
+	}
+
+	cmap, err := parseCmap(f.tables["cmap"])
+	if err != nil {
+		return nil, err
+	}
+	f.cmap = cmap
+	return f, nil
+}
+
+// parseCmap returns the Unicode character map, preferring the full-repertoire
+// format 12 subtable over the BMP-only format 4.
+func parseCmap(t []byte) (map[rune]uint16, error) {
+	if len(t) < 4 {
+		return nil, errors.New("missing cmap table")
+	}
+	var fmt4, fmt12 []byte
+	n := int(binary.BigEndian.Uint16(t[2:]))
+	for i := range n {
+		rec := 4 + 8*i
+		if rec+8 > len(t) {
+			break
+		}
+		platform, encoding := binary.BigEndian.Uint16(t[rec:]), binary.BigEndian.Uint16(t[rec+2:])
+		off := int(binary.BigEndian.Uint32(t[rec+4:]))
+		if off+4 > len(t) || !(platform == 0 || platform == 3 && (encoding == 1 || encoding == 10)) {
+			continue
+		}
+		switch binary.BigEndian.Uint16(t[off:]) {
+		case 4:
+			fmt4 = t[off:]
+		case 12:
+			fmt12 = t[off:]
+		}
+	}
+
+	m := make(map[rune]uint16)
+	switch {
+	case len(fmt12) >= 16:
+		groups := int(binary.BigEndian.Uint32(fmt12[12:]))
+		for i := range groups {
+			g := 16 + 12*i
+			if g+12 > len(fmt12) {
+				break
+			}
+			start, end := binary.BigEndian.Uint32(fmt12[g:]), binary.BigEndian.Uint32(fmt12[g+4:])
+			gid := binary.BigEndian.Uint32(fmt12[g+8:])
+			for c := start; c <= end && c <= unicodeMax; c++ {
+				m[rune(c)] = uint16(gid + c - start)
+			}
+		}
+	case len(fmt4) >= 14:
+		segs := int(binary.BigEndian.Uint16(fmt4[6:])) / 2
+		if len(fmt4) < 16+8*segs {
+			return nil, errors.New("truncated cmap subtable")
+		}
+		ends, starts := fmt4[14:], fmt4[16+2*segs:]
+		deltas, rangeOffs := fmt4[16+4*segs:], fmt4[16+6*segs:]
+		for s := range segs {
+			start, end := binary.BigEndian.Uint16(starts[2*s:]), binary.BigEndian.Uint16(ends[2*s:])
+			delta, ro := binary.BigEndian.Uint16(deltas[2*s:]), int(binary.BigEndian.Uint16(rangeOffs[2*s:]))
+			for c := int(start); c <= int(end) && c != 0xFFFF; c++ {
+				gid := uint16(c) + delta
+				if ro != 0 {
+					// idRangeOffset is relative to its own position in the table
+					p := 16 + 6*segs + 2*s + ro + 2*(c-int(start))
+					if p+2 > len(fmt4) {
+						continue
+					}
+					if gid = binary.BigEndian.Uint16(fmt4[p:]); gid != 0 {
+						gid += delta
+					}
+				}
+				if gid != 0 {
+					m[rune(c)] = gid
+				}
+			}
+		}
+	default:
+		return nil, errors.New("no Unicode cmap subtable")
+	}
+	return m, nil
+}
+
+const unicodeMax = 0x10FFFF
+
+func (f *trueTypeFont) glyph(r rune) uint16 {
+	g := f.cmap[r]
+	if int(g) >= f.numGlyphs {
+		g = 0
+	}
+	return g
+}
+
+func (f *trueTypeFont) width(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		total += int(f.advances[f.glyph(r)])
+	}
+	return float64(total) * size / f.unitsPerEm
+}
+
+// appendString appends s as a hex string of 2-byte glyph IDs (Identity-H).
+func (f *trueTypeFont) appendString(buf []byte, s string) []byte {
+	buf = append(buf, '<')
+	for _, r := range s {
+		g := f.glyph(r)
+		if _, ok := f.used[g]; !ok {
+			f.used[g] = r
+		}
+		buf = fmt.Appendf(buf, "%04X", g)
+	}
+	return append(buf, '>')
+}
+
+// scale converts font units to the 1/1000 em of PDF glyph space.
+func (f *trueTypeFont) scale(v int) int {
+	return int(math.Round(float64(v) * 1000 / f.unitsPerEm))
+}
+
+func (f *trueTypeFont) objects(id, next int) ([]pdfObject, int, error) {
+	subset, err := f.subset()
+	if err != nil {
+		return nil, next, fmt.Errorf("subsetting font %s: %w", f.name, err)
+	}
+	compressed, err := compressZlib(subset)
+	if err != nil {
+		return nil, next, err
+	}
+
+	glyphs := make([]int, 0, len(f.used))
+	for g := range f.used {
+		glyphs = append(glyphs, int(g))
+	}
+	slices.Sort(glyphs)
+
+	// Subset fonts are named with a tag derived from their glyph set
+	sum := sha256.Sum256(fmt.Append(nil, glyphs))
+	var tag [6]byte
+	for i := range tag {
+		tag[i] = 'A' + sum[i]%26
+	}
+	baseFont := string(tag[:]) + "+" + f.name
+
+	cidID, descID, fileID, toUniID := next, next+1, next+2, next+3
+
+	var widths strings.Builder
+	for _, g := range glyphs {
+		fmt.Fprintf(&widths, "%d [%d] ", g, f.scale(int(f.advances[g])))
+	}
+
+	var cmap bytes.Buffer
+	cmap.WriteString("/CIDInit /ProcSet findresource begin\n12 dict begin\nbegincmap\n" +
+		"/CIDSystemInfo << /Registry (Adobe) /Ordering (UCS) /Supplement 0 >> def\n" +
+		"/CMapName /Adobe-Identity-UCS def\n/CMapType 2 def\n" +
+		"1 begincodespacerange\n<0000> <FFFF>\nendcodespacerange\n")
+	var chars []int
+	for _, g := range glyphs {
+		if f.used[uint16(g)] != 0 {
+			chars = append(chars, g)
+		}
+	}
+	for len(chars) > 0 {
+		block := chars[:min(len(chars), 100)]
+		chars = chars[len(block):]
+		fmt.Fprintf(&cmap, "%d beginbfchar\n", len(block))
+		for _, g := range block {
+			fmt.Fprintf(&cmap, "<%04X> <", g)
+			for _, u := range utf16.Encode([]rune{f.used[uint16(g)]}) {
+				fmt.Fprintf(&cmap, "%04X", u)
+			}
+			cmap.WriteString(">\n")
+		}
+		cmap.WriteString("endbfchar\n")
+	}
+	cmap.WriteString("endcmap\nCMapName currentdict /CMap defineresource pop\nend\nend\n")
+
+	objects := []pdfObject{
+		{id: id, data: fmt.Appendf(nil,
+			"%d 0 obj\n<< /Type /Font /Subtype /Type0 /BaseFont /%s /Encoding /Identity-H\n   /DescendantFonts [%d 0 R] /ToUnicode %d 0 R >>\nendobj\n",
+			id, baseFont, cidID, toUniID)},
+		{id: cidID, data: fmt.Appendf(nil,
+			"%d 0 obj\n<< /Type /Font /Subtype /CIDFontType2 /BaseFont /%s\n   /CIDSystemInfo << /Registry (Adobe) /Ordering (Identity) /Supplement 0 >>\n   /FontDescriptor %d 0 R /CIDToGIDMap /Identity\n   /W [ %s] >>\nendobj\n",
+			cidID, baseFont, descID, widths.String())},
+		{id: descID, data: fmt.Appendf(nil,
+			"%d 0 obj\n<< /Type /FontDescriptor /FontName /%s /Flags 32\n   /FontBBox [%d %d %d %d] /ItalicAngle 0\n   /Ascent %d /Descent %d /CapHeight %d /StemV 80\n   /FontFile2 %d 0 R >>\nendobj\n",
+			descID, baseFont,
+			f.scale(int(f.bbox[0])), f.scale(int(f.bbox[1])), f.scale(int(f.bbox[2])), f.scale(int(f.bbox[3])),
+			f.scale(int(f.ascent)), f.scale(int(f.descent)), f.scale(int(f.capHeight)), fileID)},
+		{id: fileID, data: append(fmt.Appendf(nil,
+			"%d 0 obj\n<< /Length %d /Length1 %d /Filter /FlateDecode >>\nstream\n", fileID, len(compressed), len(subset)),
+			append(compressed, "\nendstream\nendobj\n"...)...)},
+		{id: toUniID, data: fmt.Appendf(nil,
+			"%d 0 obj\n<< /Length %d >>\nstream\n%sendstream\nendobj\n", toUniID, cmap.Len(), cmap.Bytes())},
+	}
+	return objects, next + 4, nil
+}
+
+// subset returns a TrueType file with the tables a PDF viewer needs and the
+// outlines of the used glyphs (and their components) only. Unused glyphs
+// become empty, so glyph IDs are unchanged.
+func (f *trueTypeFont) subset() ([]byte, error) {
+	head, loca, glyf := f.tables["head"], f.tables["loca"], f.tables["glyf"]
+	longLoca := binary.BigEndian.Uint16(head[50:]) == 1
+	glyphRange := func(g int) (int, int, bool) {
+		var start, end int
+		if longLoca {
+			if 4*g+8 > len(loca) {
+				return 0, 0, false
+			}
+			start, end = int(binary.BigEndian.Uint32(loca[4*g:])), int(binary.BigEndian.Uint32(loca[4*g+4:]))
+		} else {
+			if 2*g+4 > len(loca) {
+				return 0, 0, false
+			}
+			start, end = 2*int(binary.BigEndian.Uint16(loca[2*g:])), 2*int(binary.BigEndian.Uint16(loca[2*g+2:]))
+		}
+		return start, end, start <= end && end <= len(glyf)
+	}
+
+	// Close the glyph set over composite glyph components
+	keep := make(map[int]bool)
+	queue := make([]int, 0, len(f.used))
+	for g := range f.used {
+		queue = append(queue, int(g))
+	}
+	for len(queue) > 0 {
+		g := queue[len(queue)-1]
+		queue = queue[:len(queue)-1]
+		if keep[g] || g >= f.numGlyphs {
+			continue
+		}
+		keep[g] = true
+		start, end, ok := glyphRange(g)
+		if !ok {
+			return nil, fmt.Errorf("glyph %d out of range", g)
+		}
+		data := glyf[start:end]
+		if len(data) < 10 || int16(binary.BigEndian.Uint16(data)) >= 0 {
+			continue
+		}
+		for p := 10; p+4 <= len(data); {
+			flags := binary.BigEndian.Uint16(data[p:])
+			queue = append(queue, int(binary.BigEndian.Uint16(data[p+2:])))
+			p += 4
+			if flags&0x0001 != 0 { // ARG_1_AND_2_ARE_WORDS
+				p += 4
+			} else {
+				p += 2
+			}
+			switch {
+			case flags&0x0008 != 0: // WE_HAVE_A_SCALE
+				p += 2
+			case flags&0x0040 != 0: // WE_HAVE_AN_X_AND_Y_SCALE
+				p += 4
+			case flags&0x0080 != 0: // WE_HAVE_A_TWO_BY_TWO
+				p += 8
+			}
+			if flags&0x0020 == 0 { // MORE_COMPONENTS
+				break
+			}
+		}
+	}
+
+	var newGlyf []byte
+	newLoca := make([]byte, 4*(f.numGlyphs+1))
+	for g := range f.numGlyphs {
+		binary.BigEndian.PutUint32(newLoca[4*g:], uint32(len(newGlyf)))
+		if keep[g] {
+			start, end, _ := glyphRange(g)
+			newGlyf = append(newGlyf, glyf[start:end]...)
+			for len(newGlyf)%4 != 0 {
+				newGlyf = append(newGlyf, 0)
+			}
+		}
+	}
+	binary.BigEndian.PutUint32(newLoca[4*f.numGlyphs:], uint32(len(newGlyf)))
+
+	newHead := slices.Clone(head)
+	binary.BigEndian.PutUint32(newHead[8:], 0)  // checkSumAdjustment
+	binary.BigEndian.PutUint16(newHead[50:], 1) // indexToLocFormat: long
+
+	tables := map[string][]byte{
+		"head": newHead, "hhea": f.tables["hhea"], "hmtx": f.tables["hmtx"],
+		"maxp": f.tables["maxp"], "loca": newLoca, "glyf": newGlyf,
+	}
+	for _, tag := range []string{"cvt ", "fpgm", "prep"} {
+		if t, ok := f.tables[tag]; ok {
+			tables[tag] = t
+		}
+	}
+	return writeSfnt(tables), nil
+}
+
+// writeSfnt assembles a TrueType file from its tables.
+func writeSfnt(tables map[string][]byte) []byte {
+	tags := make([]string, 0, len(tables))
+	for tag := range tables {
+		tags = append(tags, tag)
+	}
+	slices.Sort(tags)
+
+	n := len(tags)
+	entrySelector := 0
+	for 1<<(entrySelector+1) <= n {
+		entrySelector++
+	}
+	searchRange := 16 << entrySelector
+
+	out := make([]byte, 12+16*n)
+	binary.BigEndian.PutUint32(out, 0x00010000)
+	binary.BigEndian.PutUint16(out[4:], uint16(n))
+	binary.BigEndian.PutUint16(out[6:], uint16(searchRange))
+	binary.BigEndian.PutUint16(out[8:], uint16(entrySelector))
+	binary.BigEndian.PutUint16(out[10:], uint16(16*n-searchRange))
+
+	for i, tag := range tags {
+		t := tables[tag]
+		rec := out[12+16*i:]
+		copy(rec, tag)
+		binary.BigEndian.PutUint32(rec[4:], sfntChecksum(t))
+		binary.BigEndian.PutUint32(rec[8:], uint32(len(out)))
+		binary.BigEndian.PutUint32(rec[12:], uint32(len(t)))
+		out = append(out, t...)
+		for len(out)%4 != 0 {
+			out = append(out, 0)
+		}
+	}
+	return out
+}
+
+func sfntChecksum(t []byte) uint32 {
+	var sum uint32
+	for i := 0; i < len(t); i += 4 {
+		var word [4]byte
+		copy(word[:], t[i:])
+		sum += binary.BigEndian.Uint32(word[:])
+	}
+	return sum
+}
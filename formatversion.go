@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// A Supernote file starts with its type ("note" or "mark") and a signature
+// naming the format version: SN_FILE_VER_ and a date-like number, e.g.
+// SN_FILE_VER_20230015.
+const signaturePrefix = "SN_FILE_VER_"
+
+// Format versions the parser reads. The first X-series firmware wrote
+// SN_FILE_ASA_ signatures at the very start of the file and stored pages in
+// another layout. Versions newer than latestFormatVersion are read like it but
+// flagged, as a layout change would otherwise go unnoticed.
+const (
+	minFormatVersion    = 20200001
+	latestFormatVersion = 20230015
+)
+
+// readFormatVersion returns the signature of the file read by r and the
+// format version it names, or an error if it is not a Supernote file or its
+// format is unsupported.
+func readFormatVersion(r io.ReaderAt) (string, int, error) {
+	var head [24]byte
+	if err := readFullAt(r, head[:], 0); err != nil {
+		return "", 0, fmt.Errorf("reading signature: %w", err)
+	}
+	if old := string(head[:20]); strings.HasPrefix(old, "SN_FILE_ASA_") {
+		return old, 0, fmt.Errorf("unsupported format version %s: written by early X-series firmware; open and save the notebook on an updated device to convert it", old)
+	}
+	sig := string(head[4:])
+	if !strings.HasPrefix(sig, signaturePrefix) {
+		return sig, 0, fmt.Errorf("not a Supernote file (signature %q)", strings.TrimRight(sig, "\x00"))
+	}
+	version, err := strconv.Atoi(strings.TrimPrefix(sig, signaturePrefix))
+	if err != nil || version < minFormatVersion {
+		return sig, 0, fmt.Errorf("unsupported format version %q", strings.TrimRight(sig, "\x00"))
+	}
+	return sig, version, nil
+}
+
+// warnFormatVersion records a warning if nb is in a format newer than the
+// parser knows.
+func (r *Result) warnFormatVersion(nb *Notebook) {
+	if nb.Version > latestFormatVersion {
+		r.warnf(WarnFormatVersion, 0, "format version %d is newer than the latest known (%d); pages may be incomplete", nb.Version, latestFormatVersion)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// geometryVersion is the /Version of the /GoSNare catalog dictionary. Bump it
+// when keys change meaning, so readers can tell exports apart.
+const geometryVersion = 1
+
+// catalogObject returns the document catalog (object 1) of a notebook export.
+// It carries a private /GoSNare dictionary with the notebook's device geometry
+// and layer names, so tools can reconstruct device-accurate pages (e.g. for a
+// PDF to .note round trip) from the export alone:
+//
+//	/GoSNare << /Version 1 /Device (Manta) /Equipment (N5) /FileID (...)
+//	            /Width 1920 /Height 2560 /PPI 300
+//	            /PageLayers [[(MAINLAYER) (BGLAYER)] [...] ...] >>
+//
+// /Device is left out when the equipment code names no known device. Width
+// and Height are native pixels; PageLayers lists each notebook page's
+// layer names in LAYERSEQ order. With [pdf] margins, /Margins [top right
+// bottom left] gives the space around the device page in points.
+func catalogObject(n *Notebook) pdfObject {
+	buf := []byte("1 0 obj\n<< /Type /Catalog /Pages 2 0 R\n   /GoSNare << /Version ")
+	buf = strconv.AppendInt(buf, geometryVersion, 10)
+	if model := n.Model(); model != "" {
+		buf = append(buf, " /Device "...)
+		buf = appendPDFString(buf, model)
+	}
+	if n.Equipment != "" {
+		buf = append(buf, " /Equipment "...)
+		buf = appendPDFString(buf, n.Equipment)
+	}
+	if n.FileID != "" {
+		buf = append(buf, " /FileID "...)
+		buf = appendPDFString(buf, n.FileID)
+	}
+	buf = fmt.Appendf(buf, "\n      /Width %d /Height %d /PPI %s\n      /PageLayers [",
+		n.Width, n.Height, strconv.FormatFloat(n.PPI, 'f', -1, 64))
+	for i, page := range n.Pages {
+		if i > 0 {
+			buf = append(buf, ' ')
+		}
+		buf = append(buf, '[')
+		for j, layer := range page.Layers {
+			if j > 0 {
+				buf = append(buf, ' ')
+			}
+			buf = appendPDFString(buf, layer.Key)
+		}
+		buf = append(buf, ']')
+	}
+	buf = append(buf, "] >>\n>>\nendobj\n"...)
+	return pdfObject{id: 1, data: buf}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// matchGlob reports whether the slash-separated relative path rel matches
+// pattern. Patterns use path.Match syntax per segment, plus "**" which matches
+// zero or more whole segments (e.g. "**/Trash/**", "Work/**", "*.mark").
+func matchGlob(pattern, rel string) bool {
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(rel, "/"))
+}
+
+func matchSegments(pat, segs []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			rest := pat[1:]
+			for i := 0; i <= len(segs); i++ {
+				if matchSegments(rest, segs[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(segs) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], segs[0]); !ok {
+			return false
+		}
+		pat, segs = pat[1:], segs[1:]
+	}
+	return len(segs) == 0
+}
+
+// matchAnyGlob reports whether path, taken relative to root, matches any of patterns.
+func matchAnyGlob(patterns []string, root, p string) bool {
+	if len(patterns) == 0 {
+		return false
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	rel = filepath.ToSlash(rel)
+	for _, pat := range patterns {
+		if matchGlob(pat, rel) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathFilter selects source files below a root by include and ignore globs.
+type pathFilter struct {
+	include []string // if set, a file must match at least one of these
+	ignore  []string // a file is skipped if it or any parent directory matches
+	trash   []string // names of trash folders whose contents are skipped
+	// hidden skips dot-files and the contents of dot-directories, except
+	// folders named like trashDirs, which the trash rules decide on
+	hidden    bool
+	trashDirs []string
+	// followSymlinks descends into symlinked directories (see walk)
+	followSymlinks bool
+}
+
+// skipDir reports whether a directory below root is ignored, so walks can prune it.
+func (f pathFilter) skipDir(root, dir string) bool {
+	if filepath.Clean(dir) == filepath.Clean(root) {
+		return false
+	}
+	return matchAnyGlob(f.ignore, root, dir) || trashSegment(root, dir, f.trash, true) >= 0 ||
+		f.hidden && hiddenPath(root, dir, f.trashDirs)
+}
+
+// allows reports whether the file p below root passes the filter. Ignore
+// patterns are checked against p and each of its parent directories, so
+// "**/RECYCLE" excludes everything inside a RECYCLE folder.
+func (f pathFilter) allows(root, p string) bool {
+	if trashSegment(root, p, f.trash, false) >= 0 || f.hidden && hiddenPath(root, p, f.trashDirs) {
+		return false
+	}
+	if len(f.ignore) > 0 {
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return false
+		}
+		segs := strings.Split(filepath.ToSlash(rel), "/")
+		for i := len(segs); i > 0; i-- {
+			for _, pat := range f.ignore {
+				if matchSegments(strings.Split(pat, "/"), segs[:i]) {
+					return false
+				}
+			}
+		}
+	}
+	return len(f.include) == 0 || matchAnyGlob(f.include, root, p)
+}
+
+// hiddenPath reports whether p, relative to root, is or lies in a file or
+// directory whose name starts with a dot, other than those named like one of
+// except.
+func hiddenPath(root, p string, except []string) bool {
+	rel, err := filepath.Rel(root, p)
+	if err != nil {
+		return false
+	}
+	for _, seg := range strings.Split(filepath.ToSlash(rel), "/") {
+		if strings.HasPrefix(seg, ".") && seg != "." && seg != ".." && !slices.Contains(except, seg) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkGlobs returns an error for the first malformed pattern.
+func checkGlobs(patterns []string) error {
+	for _, pat := range patterns {
+		for _, seg := range strings.Split(pat, "/") {
+			if _, err := path.Match(seg, ""); err != nil {
+				return fmt.Errorf("invalid glob %q: %w", pat, err)
+			}
+		}
+	}
+	return nil
+}
+
+// globList is a repeatable command-line flag collecting glob patterns.
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+
+func (g *globList) Set(v string) error {
+	if err := checkGlobs([]string{v}); err != nil {
+		return err
+	}
+	*g = append(*g, v)
+	return nil
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GoogleDriveConfig is the [watch.google_drive] backend: notes are pulled
+// from a Drive folder (where the device syncs them) and, with output_folder,
+// the PDFs are uploaded to another. Folders are given by their IDs (the last
+// part of the folder's URL).
+type GoogleDriveConfig struct {
+	ClientID     string `toml:"client_id"` // OAuth client of a Google Cloud project with the Drive API enabled
+	ClientSecret string `toml:"client_secret"`
+	RefreshToken string `toml:"refresh_token"` // granted the https://www.googleapis.com/auth/drive scope
+	Folder       string `toml:"folder"`        // ID of the folder with the notes
+	OutputFolder string `toml:"output_folder"` // ID of the folder the PDFs are uploaded to; default: not uploaded
+	Output       string `toml:"output"`        // local output; default: [watch] location, else a cache dir when uploading
+	Mirror       string `toml:"mirror"`        // local copy of the notes; default: <user cache dir>/gosnare/google-drive
+	PollInterval int    `toml:"poll_interval"` // seconds, 0 = default (60s)
+}
+
+func (c GoogleDriveConfig) enabled() bool {
+	return c.RefreshToken != ""
+}
+
+// validate checks that the backend can authenticate and knows its folder.
+func (c GoogleDriveConfig) validate() error {
+	if c.ClientID == "" || c.ClientSecret == "" {
+		return errors.New("[watch.google_drive] requires client_id and client_secret")
+	}
+	if c.Folder == "" && c.OutputFolder == "" {
+		return errors.New("[watch.google_drive] requires folder and/or output_folder")
+	}
+	return nil
+}
+
+func (c GoogleDriveConfig) mirrorDir() string {
+	return mirrorDir(c.Mirror, "google-drive")
+}
+
+// outputDir returns the local output directory: output, else location,
+// else a cache directory when the PDFs are uploaded.
+func (c GoogleDriveConfig) outputDir(location string) string {
+	switch {
+	case c.Output != "":
+		return c.Output
+	case location == "" && c.OutputFolder != "":
+		return mirrorDir("", "google-drive-output")
+	}
+	return location
+}
+
+func (c GoogleDriveConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return time.Minute
+}
+
+const (
+	driveAPI         = "https://www.googleapis.com/drive/v3/"
+	driveUpload      = "https://www.googleapis.com/upload/drive/v3/files"
+	driveOAuth       = "https://oauth2.googleapis.com/token"
+	driveFolderMIME  = "application/vnd.google-apps.folder"
+	driveAllDrives   = "supportsAllDrives=true&includeItemsFromAllDrives=true"
+	driveFileFields  = "id,name,mimeType,size,modifiedTime"
+	drivePageSize    = "1000"
+	driveTimeFormat  = "2006-01-02T15:04:05Z"
+	driveChangeCheck = "nextPageToken,newStartPageToken,changes(fileId,removed,file(parents))"
+)
+
+// googleDrive is a client of the Drive v3 API rooted at one folder; it is
+// both a remoteSource and a remoteDestination. Listing walks the folder
+// tree once, then only again when the changes feed reports a change to a
+// file or folder in it, so polling costs one request while nothing changes.
+type googleDrive struct {
+	root   string // folder ID
+	token  *oauthToken
+	client *http.Client
+
+	mu        sync.Mutex
+	pageToken string            // changes feed position of the listing
+	files     []remoteFile      // last listing
+	known     map[string]bool   // IDs of the listed files and folders
+	folders   map[string]string // folder path -> ID; "" is the root
+	byPath    map[string]string // file path -> ID
+}
+
+func newGoogleDrive(c GoogleDriveConfig, folder string) *googleDrive {
+	d := &googleDrive{root: folder, client: &http.Client{Timeout: 5 * time.Minute}}
+	d.token = &oauthToken{endpoint: driveOAuth, client: d.client, form: url.Values{
+		"grant_type":    {"refresh_token"},
+		"refresh_token": {c.RefreshToken},
+		"client_id":     {c.ClientID},
+		"client_secret": {c.ClientSecret},
+	}}
+	return d
+}
+
+func (d *googleDrive) name() string { return "Google Drive folder " + d.root }
+
+// call sends a request and decodes its JSON response into out (if not nil).
+func (d *googleDrive) call(ctx context.Context, method, u, contentType string, body io.Reader, out any) error {
+	token, err := d.token.get(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("%s %s: %s: %s", method, req.URL.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type driveFile struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	MimeType     string `json:"mimeType"`
+	Size         string `json:"size"`
+	ModifiedTime string `json:"modifiedTime"`
+}
+
+func (d *googleDrive) list(ctx context.Context) ([]remoteFile, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pageToken != "" {
+		changed, next, err := d.changes(ctx)
+		if err != nil {
+			return nil, err
+		}
+		d.pageToken = next
+		if !changed {
+			return d.files, nil
+		}
+	} else {
+		// Taken before the walk, so changes made during it are seen next time
+		var start struct {
+			StartPageToken string `json:"startPageToken"`
+		}
+		if err := d.call(ctx, http.MethodGet, driveAPI+"changes/startPageToken?supportsAllDrives=true", "", nil, &start); err != nil {
+			return nil, err
+		}
+		d.pageToken = start.StartPageToken
+	}
+
+	d.files = nil
+	d.known = map[string]bool{d.root: true}
+	d.folders = map[string]string{"": d.root}
+	d.byPath = make(map[string]string)
+	if err := d.walk(ctx, d.root, ""); err != nil {
+		d.pageToken = "" // walk again next time
+		return nil, err
+	}
+	return d.files, nil
+}
+
+// changes reads the changes feed from the listing's position and reports
+// whether any touches the listed tree, with the feed's new position.
+func (d *googleDrive) changes(ctx context.Context) (bool, string, error) {
+	changed := false
+	token := d.pageToken
+	for {
+		var page struct {
+			NextPageToken     string `json:"nextPageToken"`
+			NewStartPageToken string `json:"newStartPageToken"`
+			Changes           []struct {
+				FileID  string `json:"fileId"`
+				Removed bool   `json:"removed"`
+				File    struct {
+					Parents []string `json:"parents"`
+				} `json:"file"`
+			} `json:"changes"`
+		}
+		u := driveAPI + "changes?" + driveAllDrives + "&pageSize=" + drivePageSize +
+			"&fields=" + url.QueryEscape(driveChangeCheck) + "&pageToken=" + url.QueryEscape(token)
+		if err := d.call(ctx, http.MethodGet, u, "", nil, &page); err != nil {
+			return false, "", err
+		}
+		for _, c := range page.Changes {
+			if d.known[c.FileID] {
+				changed = true
+			}
+			for _, p := range c.File.Parents {
+				if d.known[p] {
+					changed = true
+				}
+			}
+		}
+		if page.NextPageToken == "" {
+			return changed, page.NewStartPageToken, nil
+		}
+		token = page.NextPageToken
+	}
+}
+
+// walk lists the folder id, at path dir, and its subfolders.
+func (d *googleDrive) walk(ctx context.Context, id, dir string) error {
+	q := url.QueryEscape(fmt.Sprintf("'%s' in parents and trashed = false", id))
+	pageToken := ""
+	for {
+		var page struct {
+			NextPageToken string      `json:"nextPageToken"`
+			Files         []driveFile `json:"files"`
+		}
+		u := driveAPI + "files?" + driveAllDrives + "&pageSize=" + drivePageSize + "&q=" + q +
+			"&fields=" + url.QueryEscape("nextPageToken,files("+driveFileFields+")")
+		if pageToken != "" {
+			u += "&pageToken=" + url.QueryEscape(pageToken)
+		}
+		if err := d.call(ctx, http.MethodGet, u, "", nil, &page); err != nil {
+			return err
+		}
+		for _, f := range page.Files {
+			p := path.Join(dir, f.Name)
+			d.known[f.ID] = true
+			if f.MimeType == driveFolderMIME {
+				d.folders[p] = f.ID
+				if err := d.walk(ctx, f.ID, p); err != nil {
+					return err
+				}
+				continue
+			}
+			size, _ := strconv.ParseInt(f.Size, 10, 64)
+			mod, _ := time.Parse(time.RFC3339, f.ModifiedTime)
+			d.byPath[p] = f.ID
+			d.files = append(d.files, remoteFile{path: p, size: size, modTime: mod, id: f.ID})
+		}
+		if page.NextPageToken == "" {
+			return nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+func (d *googleDrive) download(ctx context.Context, f remoteFile, w io.Writer) error {
+	token, err := d.token.get(ctx)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, driveAPI+"files/"+url.PathEscape(f.id)+"?alt=media&supportsAllDrives=true", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download: %s", resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// folder returns the ID of the folder at path dir, creating it (and its
+// parents) if needed.
+func (d *googleDrive) folder(ctx context.Context, dir string) (string, error) {
+	if dir == "." {
+		dir = ""
+	}
+	if id, ok := d.folders[dir]; ok {
+		return id, nil
+	}
+	parent, err := d.folder(ctx, path.Dir(dir))
+	if err != nil {
+		return "", err
+	}
+	meta, _ := json.Marshal(map[string]any{"name": path.Base(dir), "mimeType": driveFolderMIME, "parents": []string{parent}})
+	var created driveFile
+	if err := d.call(ctx, http.MethodPost, driveAPI+"files?supportsAllDrives=true&fields=id", "application/json", bytes.NewReader(meta), &created); err != nil {
+		return "", err
+	}
+	d.folders[dir] = created.ID
+	d.known[created.ID] = true
+	return created.ID, nil
+}
+
+// upload creates or replaces the file at rel with a multipart upload
+// (metadata and content in one request).
+func (d *googleDrive) upload(ctx context.Context, rel string, r io.Reader, modTime time.Time) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	meta := map[string]any{"modifiedTime": modTime.UTC().Format(driveTimeFormat)}
+	method, u := http.MethodPost, driveUpload+"?uploadType=multipart&supportsAllDrives=true&fields=id"
+	if id, ok := d.byPath[rel]; ok {
+		method, u = http.MethodPatch, driveUpload+"/"+url.PathEscape(id)+"?uploadType=multipart&supportsAllDrives=true&fields=id"
+	} else {
+		parent, err := d.folder(ctx, path.Dir(rel))
+		if err != nil {
+			return err
+		}
+		meta["name"], meta["parents"] = path.Base(rel), []string{parent}
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	part, err := mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(meta); err != nil {
+		return err
+	}
+	if part, err = mw.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/pdf"}}); err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	var uploaded driveFile
+	if err := d.call(ctx, method, u, "multipart/related; boundary="+mw.Boundary(), &body, &uploaded); err != nil {
+		return err
+	}
+	d.byPath[rel] = uploaded.ID
+	d.known[uploaded.ID] = true
+	return nil
+}
+
+// remove moves the file at rel to the trash, where it can still be restored.
+func (d *googleDrive) remove(ctx context.Context, rel string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id, ok := d.byPath[rel]
+	if !ok {
+		return nil
+	}
+	if err := d.call(ctx, http.MethodPatch, driveAPI+"files/"+url.PathEscape(id)+"?supportsAllDrives=true&fields=id", "application/json", bytes.NewReader([]byte(`{"trashed":true}`)), nil); err != nil {
+		return err
+	}
+	delete(d.byPath, rel)
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// incrementalUpdate appends the changed pages of a notebook to its existing
+// output as a classic incremental update: new page objects under the old IDs
+// and new content objects, followed by an xref section that supersedes the old
+// ones. The catalog, the page tree and unchanged pages stay where they are, so
+// editing one page of a long notebook writes only that page.
+type incrementalUpdate struct {
+	prev    *prevOutput
+	changed []bool // by page index
+}
+
+// planIncrementalUpdate decides whether the output indexed by prev can be
+// updated in place, given the fingerprints of all pages of the new version.
+// It returns nil when the output must be rewritten: it uses object streams or
+// another layout, its catalog (geometry, layers) or color space changed, or
+// superseded objects would make up more than half the file.
+func planIncrementalUpdate(prev *prevOutput, hashes []string, catalog pdfObject, cs colorSpace, ocgID int) *incrementalUpdate {
+	if prev == nil || !prev.classic || len(prev.order) != len(hashes) || prev.iccID != cs.iccID || prev.ocgID != ocgID {
+		return nil
+	}
+	if prev.sections > maxUpdateSections {
+		logger.Debugf("rewriting output: %d incremental updates", prev.sections-1)
+		return nil
+	}
+	if data, err := prev.object(1); err != nil || !bytes.Equal(data, catalog.data) {
+		return nil
+	}
+	if cs.iccID != 0 {
+		if data, err := prev.object(cs.iccID); err != nil || !bytes.Equal(data, cs.profileObject().data) {
+			return nil
+		}
+	}
+
+	u := &incrementalUpdate{prev: prev, changed: make([]bool, len(hashes))}
+	superseded := prev.xrefStart - prev.live
+	for i, h := range hashes {
+		old := prev.order[i]
+		if old != "" && old == h {
+			continue
+		}
+		u.changed[i] = true
+		superseded += prev.spans[3+i].n
+		for _, id := range prev.pages[old].own {
+			superseded += prev.spans[id].n
+		}
+	}
+	if superseded*2 > prev.size {
+		logger.Debugf("rewriting output: %d of %d bytes would be superseded", superseded, prev.size)
+		return nil
+	}
+	return u
+}
+
+// pageHashes fingerprints every page of notebook (see pageHash).
+func pageHashes(src io.ReaderAt, notebook *Notebook, pageWidthPt, pageHeightPt float64, noBg bool, cfg *Config, cs colorSpace, pageLinks map[int][]pdfLink) ([]string, error) {
+	hashes := make([]string, len(notebook.Pages))
+	for i, page := range notebook.Pages {
+		var err error
+		if hashes[i], err = pageHash(src, page, notebook.Width, notebook.Height, pageWidthPt, pageHeightPt, noBg, cfg, cs, pageLinks[i]); err != nil {
+			return nil, fmt.Errorf("page %d: %w", i+1, err)
+		}
+	}
+	return hashes, nil
+}
+
+// writeXrefUpdate finishes an incremental update: an xref section listing the
+// objects written since the writer started at the end of the previous file,
+// and a trailer pointing back at the previous section. size is the next free
+// object ID.
+func (pw *pdfWriter) writeXrefUpdate(size int, prevXref int64) {
+	xrefStart := pw.offset
+	pw.writeStr("xref\n")
+	for id := 1; id < size; {
+		if id > len(pw.xref) || pw.xref[id-1].offset == 0 {
+			id++
+			continue
+		}
+		end := id
+		for end < size && end <= len(pw.xref) && pw.xref[end-1].offset != 0 {
+			end++
+		}
+		pw.writeStr(fmt.Sprintf("%d %d\n", id, end-id))
+		for _, e := range pw.xref[id-1 : end-1] {
+			pw.writeStr(fmt.Sprintf("%010d 00000 n \n", e.offset))
+		}
+		id = end
+	}
+	pw.writeStr("trailer\n")
+	pw.writeStr(fmt.Sprintf("<< /Size %d /Root 1 0 R /Prev %d /GoSNareUpdate true >>\n", size, prevXref))
+	pw.writeStr("startxref\n")
+	pw.writeStr(fmt.Sprintf("%d\n", xrefStart))
+	pw.writeStr("%%EOF\n")
+}
+
+// finishIncrementalUpdate completes the update written to the spill file by
+// pw and appends it to the output. When no page changed, the output is only
+// marked as up to date.
+func finishIncrementalUpdate(pw *pdfWriter, spill *os.File, u *incrementalUpdate, nextID int, outputPath, inputPath string) error {
+	changed := 0
+	for _, c := range u.changed {
+		if c {
+			changed++
+		}
+	}
+	u.prev.Close()
+	if changed == 0 {
+		now := time.Now()
+		return os.Chtimes(outputPath, now, now)
+	}
+
+	pw.writeXrefUpdate(nextID, u.prev.xrefStart)
+	if err := pw.w.Flush(); err != nil {
+		return err
+	}
+	if err := appendUpdate(outputPath, u.prev.size, spill); err != nil {
+		return err
+	}
+	logger.Debugf("'%s': %d of %d pages changed, appended as an incremental update of %d bytes",
+		filepath.Base(inputPath), changed, len(u.changed), pw.offset-uint64(u.prev.size))
+	return nil
+}
+
+// appendUpdate appends the incremental update in the file update to the file
+// at path, whose size is size. On failure the file is truncated back, so it
+// stays valid.
+func appendUpdate(path string, size int64, update *os.File) error {
+	if _, err := update.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(io.NewOffsetWriter(f, size), update); err == nil {
+		err = f.Sync()
+	}
+	if err != nil {
+		f.Truncate(size)
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"image/png"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// IndexConfig controls the index of converted notebooks written to the
+// output root after directory and watch conversions.
+type IndexConfig struct {
+	Formats []string `toml:"formats"` // "md" and/or "html"; empty = no index
+}
+
+func (c IndexConfig) enabled() bool {
+	return len(c.Formats) > 0
+}
+
+func (c IndexConfig) validate() error {
+	for _, f := range c.Formats {
+		if f != "md" && f != "html" {
+			return fmt.Errorf("formats must be \"md\" or \"html\", got %q", f)
+		}
+	}
+	return nil
+}
+
+// indexThumbDir holds the first-page thumbnails, relative to the output root.
+const indexThumbDir = ".gosnare/thumbs"
+
+// indexEntry is one PDF of the output tree.
+type indexEntry struct {
+	rel     string // slash-separated, relative to the output root
+	pages   int    // 0 when not recorded in the state DB
+	modTime time.Time
+	thumb   string // slash-separated thumbnail path relative to the root, "" if none
+}
+
+// writeIndex writes index.md / index.html to root, listing every PDF below
+// it with its page count (from the state DB entries), modification date and
+// a thumbnail of the first page. Thumbnails are rendered from the source
+// note and reused while newer than the PDF; .mark outputs have none.
+func writeIndex(root string, entries map[string]stateEntry, cfg *Config) error {
+	var list []indexEntry
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if path != root && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !strings.EqualFold(filepath.Ext(path), ".pdf") {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		e := indexEntry{rel: filepath.ToSlash(rel), modTime: info.ModTime()}
+		if s, ok := entries[e.rel]; ok && !s.Quarantined() {
+			e.pages = s.Pages
+			if s.Companion == "" && strings.HasSuffix(s.Source, ".note") {
+				e.thumb = indexThumb(root, e.rel, s.Source, info.ModTime(), cfg)
+			}
+		}
+		list = append(list, e)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	slices.SortFunc(list, func(a, b indexEntry) int { return strings.Compare(a.rel, b.rel) })
+	pruneIndexThumbs(root, list)
+
+	loc, _ := cfg.Locale.Locale()
+	for _, format := range cfg.Index.Formats {
+		var data []byte
+		name := "index." + format
+		if format == "html" {
+			data = indexHTML(list, loc)
+		} else {
+			data = indexMarkdown(list, loc)
+		}
+		tmp := filepath.Join(root, name+".tmp")
+		if err := os.WriteFile(tmp, data, 0644); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, filepath.Join(root, name)); err != nil {
+			return err
+		}
+	}
+	logger.Debugf("Wrote index of %d PDFs to '%s'", len(list), root)
+	return nil
+}
+
+// indexThumb returns the thumbnail of rel's first page, rendering it from
+// source unless an existing one is newer than the PDF.
+func indexThumb(root, rel, source string, pdfTime time.Time, cfg *Config) string {
+	thumb := indexThumbDir + "/" + rel + ".png"
+	path := filepath.Join(root, filepath.FromSlash(thumb))
+	if info, err := os.Stat(path); err == nil && !info.ModTime().Before(pdfTime) {
+		return thumb
+	}
+	data, err := renderFirstPagePNG(source, cfg)
+	if err != nil {
+		logger.Debugf("index thumbnail of '%s': %v", source, err)
+		return ""
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		logger.Warnf("index thumbnail: %v", err)
+		return ""
+	}
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		logger.Warnf("index thumbnail: %v", err)
+		return ""
+	}
+	return thumb
+}
+
+// renderFirstPagePNG renders the thumbnail of a note's first page (see
+// pageThumbnail), background included.
+func renderFirstPagePNG(source string, cfg *Config) ([]byte, error) {
+	src, nb, err := openNotebook(source)
+	if err != nil {
+		return nil, err
+	}
+	defer src.Close()
+	if len(nb.Pages) == 0 {
+		return nil, fmt.Errorf("no pages")
+	}
+	img, err := pageThumbnail(src, nb, 0, false, cfg.Note.palette())
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pruneIndexThumbs removes the thumbnails of PDFs no longer in the index.
+func pruneIndexThumbs(root string, list []indexEntry) {
+	keep := make(map[string]bool, len(list))
+	for _, e := range list {
+		if e.thumb != "" {
+			keep[e.thumb] = true
+		}
+	}
+	dir := filepath.Join(root, filepath.FromSlash(indexThumbDir))
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if !keep[filepath.ToSlash(rel)] {
+			os.Remove(path)
+		}
+		return nil
+	})
+}
+
+// urlPath escapes a slash-separated relative path for a link.
+func urlPath(rel string) string {
+	return (&url.URL{Path: rel}).EscapedPath()
+}
+
+func (e indexEntry) pageCount(loc Locale) string {
+	if e.pages == 0 {
+		return "–"
+	}
+	return loc.Int(e.pages)
+}
+
+func indexMarkdown(list []indexEntry, loc Locale) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Notebooks\n\n%d PDFs, updated %s.\n\n", len(list), loc.DateTime(time.Now()))
+	b.WriteString("| | Notebook | Pages | Modified |\n|---|---|---|---|\n")
+	md := strings.NewReplacer(`|`, `\|`, `[`, `\[`, `]`, `\]`)
+	for _, e := range list {
+		thumb := ""
+		if e.thumb != "" {
+			thumb = fmt.Sprintf("![](<%s>)", urlPath(e.thumb))
+		}
+		fmt.Fprintf(&b, "| %s | [%s](<%s>) | %s | %s |\n", thumb, md.Replace(e.rel), urlPath(e.rel), e.pageCount(loc), loc.DateTime(e.modTime))
+	}
+	return b.Bytes()
+}
+
+func indexHTML(list []indexEntry, loc Locale) []byte {
+	var b bytes.Buffer
+	b.WriteString(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Notebooks</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+ul { list-style: none; padding: 0; display: grid; grid-template-columns: repeat(auto-fill, minmax(180px, 1fr)); gap: 1.5em; }
+li a { color: inherit; text-decoration: none; }
+li img, li .blank { display: block; width: 100%; aspect-ratio: 3 / 4; object-fit: contain; border: 1px solid #ccc; background: #fff; }
+li .name { display: block; margin-top: .4em; font-weight: bold; overflow-wrap: anywhere; }
+li .meta { color: #666; font-size: .85em; }
+</style></head><body>
+`)
+	fmt.Fprintf(&b, "<h1>Notebooks</h1>\n<p>%d PDFs, updated %s.</p>\n<ul>\n", len(list), html.EscapeString(loc.DateTime(time.Now())))
+	for _, e := range list {
+		img := `<span class="blank"></span>`
+		if e.thumb != "" {
+			img = fmt.Sprintf(`<img src="%s" alt="" loading="lazy">`, html.EscapeString(urlPath(e.thumb)))
+		}
+		fmt.Fprintf(&b, "<li><a href=\"%s\">%s<span class=\"name\">%s</span></a><span class=\"meta\">%s pages · %s</span></li>\n",
+			html.EscapeString(urlPath(e.rel)), img, html.EscapeString(e.rel), e.pageCount(loc), html.EscapeString(loc.DateTime(e.modTime)))
+	}
+	b.WriteString("</ul>\n</body></html>\n")
+	return b.Bytes()
+}
+
+// indexDelay is how long the watch daemon waits after the last conversion or
+// removal in an output root before rewriting its index.
+const indexDelay = 10 * time.Second
+
+// indexScheduler rewrites the index of output roots in watch mode, once per
+// burst of changes.
+type indexScheduler struct {
+	mu     sync.Mutex
+	timers map[string]*time.Timer
+}
+
+var indexes = &indexScheduler{timers: map[string]*time.Timer{}}
+
+// touch schedules the index of db's output root to be rewritten.
+func (s *indexScheduler) touch(db *stateDB, cfg *Config) {
+	if db == nil || !cfg.Index.enabled() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if t, ok := s.timers[db.root]; ok {
+		t.Reset(indexDelay)
+		return
+	}
+	s.timers[db.root] = time.AfterFunc(indexDelay, func() {
+		s.mu.Lock()
+		delete(s.timers, db.root)
+		s.mu.Unlock()
+		if err := writeIndex(db.root, db.snapshot(), cfg); err != nil {
+			logger.Warnf("writing index of '%s': %v", db.root, err)
+		}
+	})
+}
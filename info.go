@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+)
+
+// noteInfo is the `info` report of one notebook. Page numbers are 1-indexed;
+// rectangles are x, y, w, h in device pixels.
+type noteInfo struct {
+	File      string        `json:"file"`
+	Error     string        `json:"error,omitempty"` // why the file cannot be parsed
+	Signature string        `json:"signature,omitempty"`
+	Version   int           `json:"version,omitempty"` // format version, e.g. 20230015
+	Device    string        `json:"device,omitempty"`
+	Equipment string        `json:"equipment,omitempty"`
+	FileID    string        `json:"fileId,omitempty"`
+	Width     int           `json:"width,omitempty"`
+	Height    int           `json:"height,omitempty"`
+	PPI       float64       `json:"ppi,omitempty"`
+	Realtime  bool          `json:"realtime,omitempty"`
+	Cover     bool          `json:"cover,omitempty"`
+	PageCount int           `json:"pageCount"`
+	Pages     []pageInfo    `json:"pages"`
+	Links     []linkEntry   `json:"links"`
+	Titles    []titleInfo   `json:"titles"`
+	Keywords  []keywordInfo `json:"keywords"`
+}
+
+type pageInfo struct {
+	Page       int         `json:"page"`
+	Style      string      `json:"style,omitempty"`
+	Starred    bool        `json:"starred,omitempty"`
+	Recognized bool        `json:"recognized,omitempty"` // has RECOGNTEXT
+	Strokes    bool        `json:"strokes,omitempty"`    // has TOTALPATH
+	Layers     []layerInfo `json:"layers"`
+}
+
+type layerInfo struct {
+	Name     string `json:"name"`
+	Protocol string `json:"protocol,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Empty    bool   `json:"empty,omitempty"` // no bitmap
+}
+
+type titleInfo struct {
+	Page  int    `json:"page"`
+	Level int    `json:"level"`
+	Rect  [4]int `json:"rect"`
+}
+
+type keywordInfo struct {
+	Page int    `json:"page"`
+	Text string `json:"text"`
+}
+
+// runInfo implements `gosnare info <file.note>...`: the parsed metadata of
+// notebooks as JSON, one object per file (an array for several files).
+func runInfo(args []string) error {
+	fs := flag.NewFlagSet("info", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare info <file.note|file.mark>...")
+		fs.PrintDefaults()
+	}
+	paths := parseInterspersed(fs, args)
+	if len(paths) == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected .note or .mark files")
+	}
+
+	var infos []noteInfo
+	var failed int
+	for _, path := range paths {
+		info := notebookInfo(path)
+		if info.Error != "" {
+			failed++
+		}
+		infos = append(infos, info)
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	var err error
+	if len(infos) == 1 {
+		err = enc.Encode(infos[0])
+	} else {
+		err = enc.Encode(infos)
+	}
+	if err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d file(s) could not be parsed", failed)
+	}
+	return nil
+}
+
+// notebookInfo parses the notebook at path into its report; parse errors are
+// reported in it.
+func notebookInfo(path string) noteInfo {
+	info := noteInfo{File: path, Pages: []pageInfo{}, Links: []linkEntry{}, Titles: []titleInfo{}, Keywords: []keywordInfo{}}
+	nb, err := ParseNotebook(path)
+	if err != nil {
+		info.Error = err.Error()
+		return info
+	}
+	info.Signature, info.Device, info.Equipment, info.FileID = nb.Signature, nb.Model(), nb.Equipment, nb.FileID
+	info.Version = nb.Version
+	info.Width, info.Height, info.PPI = nb.Width, nb.Height, nb.PPI
+	info.Realtime, info.Cover = nb.Realtime, nb.Cover != 0
+	info.PageCount = len(nb.Pages)
+
+	for i, page := range nb.Pages {
+		p := pageInfo{
+			Page:       i + 1,
+			Style:      page.Style,
+			Starred:    page.Starred,
+			Recognized: page.RecognText != 0,
+			Strokes:    page.TotalPath != 0,
+			Layers:     []layerInfo{},
+		}
+		for _, l := range page.Layers {
+			p.Layers = append(p.Layers, layerInfo{Name: l.Key, Protocol: l.Protocol, Type: l.LayerType, Empty: l.BitmapAddress == 0})
+		}
+		info.Pages = append(info.Pages, p)
+	}
+	info.Links = collectLinks(path, nb)
+	for _, t := range nb.Titles {
+		info.Titles = append(info.Titles, titleInfo{Page: t.Page + 1, Level: t.Level, Rect: [4]int{t.X, t.Y, t.W, t.H}})
+	}
+	for _, k := range nb.Keywords {
+		info.Keywords = append(info.Keywords, keywordInfo{Page: k.Page + 1, Text: k.Text})
+	}
+	return info
+}
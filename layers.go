@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// noteLayers are the ink layers [note] layers can select. The background is
+// controlled by --no-bg instead.
+var noteLayers = []string{"MAINLAYER", "LAYER1", "LAYER2", "LAYER3"}
+
+// validateLayers checks [note] layers: either layer names to render, or names
+// prefixed with "-" to leave out, e.g. ["-LAYER3"].
+func (c NoteConfig) validateLayers() error {
+	excludes := 0
+	for _, l := range c.Layers {
+		name, exclude := strings.CutPrefix(l, "-")
+		if exclude {
+			excludes++
+		}
+		if !slices.Contains(noteLayers, name) {
+			return fmt.Errorf("layers: unknown layer %q (expected %s)", name, strings.Join(noteLayers, ", "))
+		}
+	}
+	if excludes > 0 && excludes < len(c.Layers) {
+		return fmt.Errorf("layers: list layers to render or, prefixed with -, layers to leave out, not both")
+	}
+	return nil
+}
+
+// filtersLayers reports whether some ink layers may be left out.
+func (c NoteConfig) filtersLayers() bool {
+	return len(c.Layers) > 0
+}
+
+// showsLayer reports whether the layer named key is rendered.
+func (c NoteConfig) showsLayer(key string) bool {
+	if key == "BGLAYER" || len(c.Layers) == 0 {
+		return true
+	}
+	if strings.HasPrefix(c.Layers[0], "-") {
+		return !slices.Contains(c.Layers, "-"+key)
+	}
+	return slices.Contains(c.Layers, key)
+}
+
+// selectLayers drops the layers [note] layers leaves out from every page, so
+// all renderers (and page fingerprints) only see the selected ones.
+func (n *Notebook) selectLayers(c NoteConfig) {
+	if !c.filtersLayers() {
+		return
+	}
+	for i := range n.Pages {
+		n.Pages[i].Layers = slices.DeleteFunc(n.Pages[i].Layers, func(l Layer) bool {
+			return !c.showsLayer(l.Key)
+		})
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// linkEntry is one row of the link extraction report.
+type linkEntry struct {
+	Kind       string `json:"kind"`       // internal, file, web
+	SourcePage int    `json:"sourcePage"` // 1-indexed
+	Rect       [4]int `json:"rect"`       // x, y, w, h in device pixels
+	DestPage   int    `json:"destPage,omitempty"`
+	Target     string `json:"target,omitempty"`
+	Resolved   string `json:"resolved,omitempty"` // local path the target was found at
+	Dangling   bool   `json:"dangling"`
+	Reason     string `json:"reason,omitempty"`
+}
+
+// runLinks implements `gosnare links <file.note> [--json]`.
+func runLinks(args []string) error {
+	fs := flag.NewFlagSet("links", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare links <file.note> [--json]")
+		fs.PrintDefaults()
+	}
+	paths := parseInterspersed(fs, args)
+	if len(paths) != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected exactly one .note file")
+	}
+	path := paths[0]
+
+	notebook, err := ParseNotebook(path)
+	if err != nil {
+		return fmt.Errorf("parsing notebook: %w", err)
+	}
+
+	entries := collectLinks(path, notebook)
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			return err
+		}
+	} else {
+		printLinkTable(entries)
+	}
+
+	var dangling int
+	for _, e := range entries {
+		if e.Dangling {
+			dangling++
+		}
+	}
+	if dangling > 0 {
+		return fmt.Errorf("%d dangling link(s) in '%s'", dangling, path)
+	}
+	return nil
+}
+
+func collectLinks(path string, notebook *Notebook) []linkEntry {
+	entries := make([]linkEntry, 0, len(notebook.Links))
+	pageCounts := make(map[string]int)
+
+	for _, nl := range notebook.Links {
+		e := linkEntry{
+			SourcePage: nl.SourcePage + 1,
+			Rect:       [4]int{nl.X, nl.Y, nl.W, nl.H},
+			Target:     nl.Target,
+		}
+
+		switch {
+		case nl.Type == LinkTypeWeb:
+			e.Kind = "web"
+			if nl.Target == "" {
+				e.Dangling, e.Reason = true, "empty URL"
+			}
+
+		case nl.SameFile:
+			e.Kind = "internal"
+			e.DestPage = nl.DestPage + 1
+			e.Target = ""
+			if nl.DestPage < 0 || nl.DestPage >= len(notebook.Pages) {
+				e.Dangling = true
+				e.Reason = fmt.Sprintf("page %d out of range (notebook has %d pages)", e.DestPage, len(notebook.Pages))
+			}
+
+		default:
+			e.Kind = "file"
+			e.DestPage = nl.DestPage + 1
+			resolved := resolveDevicePath(path, nl.Target)
+			if resolved == "" {
+				e.Dangling, e.Reason = true, "target file not found"
+				break
+			}
+			e.Resolved = resolved
+			if !strings.HasSuffix(resolved, ".note") {
+				break
+			}
+			n, ok := pageCounts[resolved]
+			if !ok {
+				if target, err := ParseNotebook(resolved); err == nil {
+					n = len(target.Pages)
+				} else {
+					n = -1
+				}
+				pageCounts[resolved] = n
+			}
+			switch {
+			case n < 0:
+				e.Dangling, e.Reason = true, "target notebook could not be parsed"
+			case nl.DestPage < 0 || nl.DestPage >= n:
+				e.Dangling = true
+				e.Reason = fmt.Sprintf("page %d out of range (target has %d pages)", e.DestPage, n)
+			}
+		}
+
+		entries = append(entries, e)
+	}
+	return entries
+}
+
+// resolveDevicePath maps a device-side path (e.g. /storage/emulated/0/Note/A/b.note)
+// onto the local mirror containing notePath by trying each trailing portion of the
+// device path against each ancestor directory of the note. Returns "" if not found.
+func resolveDevicePath(notePath, devicePath string) string {
+	if devicePath == "" {
+		return ""
+	}
+	parts := strings.FieldsFunc(devicePath, func(r rune) bool { return r == '/' || r == '\\' })
+	if len(parts) == 0 {
+		return ""
+	}
+
+	absNote, err := filepath.Abs(notePath)
+	if err != nil {
+		return ""
+	}
+	for dir := filepath.Dir(absNote); ; dir = filepath.Dir(dir) {
+		for i := range parts {
+			candidate := filepath.Join(append([]string{dir}, parts[i:]...)...)
+			if info, err := os.Stat(candidate); err == nil && !info.IsDir() {
+				return candidate
+			}
+		}
+		if parent := filepath.Dir(dir); parent == dir {
+			return ""
+		}
+	}
+}
+
+func printLinkTable(entries []linkEntry) {
+	if len(entries) == 0 {
+		fmt.Println("No links found.")
+		return
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PAGE\tKIND\tRECT\tDESTINATION\tSTATUS")
+	for _, e := range entries {
+		dest := e.Target
+		if e.Kind != "web" && e.DestPage > 0 {
+			if dest != "" {
+				dest += " "
+			}
+			dest += fmt.Sprintf("p.%d", e.DestPage)
+		}
+		status := "ok"
+		if e.Dangling {
+			status = "DANGLING: " + e.Reason
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d,%d,%d,%d\t%s\t%s\n",
+			e.SourcePage, e.Kind, e.Rect[0], e.Rect[1], e.Rect[2], e.Rect[3], dest, status)
+	}
+	tw.Flush()
+}
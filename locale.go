@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Locale formats dates, times and numbers for text GoSNare generates into
+// output documents (TOC pages, index manifests, provenance notes).
+type Locale struct {
+	dateLayout string
+	timeLayout string
+	decimal    string
+	group      string
+}
+
+type localeDefaults struct {
+	date           string
+	decimal, group string
+	clock24        bool
+}
+
+// knownLocales maps a language (or language-region) tag to its conventions.
+// Layouts are numeric so no month-name translation is needed.
+var knownLocales = map[string]localeDefaults{
+	"en-us": {"01/02/2006", ".", ",", false},
+	"en-ca": {"2006-01-02", ".", ",", false},
+	"en-au": {"02/01/2006", ".", ",", false},
+	"en-in": {"02/01/2006", ".", ",", false},
+	"en":    {"02/01/2006", ".", ",", true},
+	"de":    {"02.01.2006", ",", ".", true},
+	"fr":    {"02/01/2006", ",", " ", true},
+	"it":    {"02/01/2006", ",", ".", true},
+	"es":    {"02/01/2006", ",", ".", true},
+	"pt":    {"02/01/2006", ",", ".", true},
+	"nl":    {"02-01-2006", ",", ".", true},
+	"pl":    {"02.01.2006", ",", " ", true},
+	"ru":    {"02.01.2006", ",", " ", true},
+	"sv":    {"2006-01-02", ",", " ", true},
+	"ja":    {"2006/01/02", ".", ",", true},
+	"zh":    {"2006/01/02", ".", ",", true},
+	"ko":    {"2006. 01. 02.", ".", ",", false},
+}
+
+// isoLocale is used when no locale is configured: ISO 8601 dates, 24-hour clock.
+var isoLocale = Locale{dateLayout: "2006-01-02", timeLayout: "15:04", decimal: ".", group: ","}
+
+// Locale resolves the [locale] config section. Unknown regions fall back to
+// their language (e.g. "de-AT" uses "de"); unknown languages are an error.
+func (c LocaleConfig) Locale() (Locale, error) {
+	loc := isoLocale
+	clock24 := true
+
+	if c.Language != "" {
+		tag := strings.ToLower(strings.ReplaceAll(c.Language, "_", "-"))
+		d, ok := knownLocales[tag]
+		if !ok {
+			lang, _, _ := strings.Cut(tag, "-")
+			d, ok = knownLocales[lang]
+		}
+		if !ok {
+			return loc, fmt.Errorf("unsupported locale %q", c.Language)
+		}
+		loc.dateLayout, loc.decimal, loc.group, clock24 = d.date, d.decimal, d.group, d.clock24
+	}
+
+	switch strings.ToLower(c.Clock) {
+	case "":
+	case "24h", "24":
+		clock24 = true
+	case "12h", "12":
+		clock24 = false
+	default:
+		return loc, fmt.Errorf("invalid clock %q (expected 12h or 24h)", c.Clock)
+	}
+	if clock24 {
+		loc.timeLayout = "15:04"
+	} else {
+		loc.timeLayout = "3:04 PM"
+	}
+
+	if c.DateFormat != "" {
+		loc.dateLayout = c.DateFormat
+	}
+	return loc, nil
+}
+
+func (l Locale) Date(t time.Time) string {
+	return t.Format(l.dateLayout)
+}
+
+func (l Locale) DateTime(t time.Time) string {
+	return t.Format(l.dateLayout + " " + l.timeLayout)
+}
+
+// Int formats n with the locale's digit grouping separator.
+func (l Locale) Int(n int) string {
+	s := strconv.Itoa(n)
+	neg := strings.HasPrefix(s, "-")
+	s = strings.TrimPrefix(s, "-")
+	s = groupDigits(s, l.group)
+	if neg {
+		s = "-" + s
+	}
+	return s
+}
+
+// Float formats f with prec decimals using the locale's separators.
+func (l Locale) Float(f float64, prec int) string {
+	s := strconv.FormatFloat(math.Abs(f), 'f', prec, 64)
+	intPart, frac, hasFrac := strings.Cut(s, ".")
+	s = groupDigits(intPart, l.group)
+	if hasFrac {
+		s += l.decimal + frac
+	}
+	if f < 0 && strings.Trim(s, "0"+l.decimal+l.group) != "" {
+		s = "-" + s
+	}
+	return s
+}
+
+func groupDigits(digits, sep string) string {
+	if len(digits) <= 3 || sep == "" {
+		return digits
+	}
+	var b strings.Builder
+	head := len(digits) % 3
+	if head > 0 {
+		b.WriteString(digits[:head])
+	}
+	for i := head; i < len(digits); i += 3 {
+		if b.Len() > 0 {
+			b.WriteString(sep)
+		}
+		b.WriteString(digits[i : i+3])
+	}
+	return b.String()
+}
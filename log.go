@@ -0,0 +1,300 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	default:
+		return "info"
+	}
+}
+
+func parseLogLevel(s string) (logLevel, error) {
+	switch strings.ToLower(s) {
+	case "debug":
+		return levelDebug, nil
+	case "", "info":
+		return levelInfo, nil
+	case "warn", "warning":
+		return levelWarn, nil
+	case "error":
+		return levelError, nil
+	default:
+		return levelInfo, fmt.Errorf("unknown log level %q (expected debug, info, warn or error)", s)
+	}
+}
+
+// Logger writes leveled messages. Text mode prints human-readable lines (info
+// and debug to stdout, warnings and errors to stderr); JSON mode writes one
+// object per line to stdout for log collectors. Progress lines are redrawn in
+// place with \r only when stdout is a terminal.
+type Logger struct {
+	mu       sync.Mutex
+	out      io.Writer
+	errOut   io.Writer
+	level    atomic.Int32 // logLevel; read without mu so disabled messages cost nothing
+	json     bool
+	tty      bool
+	progress bool // a \r progress line is currently on screen
+}
+
+var logger = NewLogger(os.Stdout, os.Stderr)
+
+func NewLogger(out, errOut io.Writer) *Logger {
+	l := &Logger{out: out, errOut: errOut, tty: isTerminal(out)}
+	l.level.Store(int32(levelInfo))
+	return l
+}
+
+// enabled reports whether messages of the given level are written.
+func (l *Logger) enabled(level logLevel) bool {
+	return level >= logLevel(l.level.Load())
+}
+
+// isTerminal reports whether w is a character device (an interactive terminal).
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return info.Mode()&os.ModeCharDevice != 0
+}
+
+// Configure applies the [log] config section.
+func (l *Logger) Configure(cfg LogConfig) error {
+	level, err := parseLogLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.level.Store(int32(level))
+	switch strings.ToLower(cfg.Format) {
+	case "", "text":
+		l.json = false
+	case "json":
+		l.json = true
+	default:
+		return fmt.Errorf("unknown log format %q (expected text or json)", cfg.Format)
+	}
+	return nil
+}
+
+func (l *Logger) Debugf(format string, args ...any) { l.logf(levelDebug, format, args...) }
+func (l *Logger) Infof(format string, args ...any)  { l.logf(levelInfo, format, args...) }
+func (l *Logger) Warnf(format string, args ...any)  { l.logf(levelWarn, format, args...) }
+func (l *Logger) Errorf(format string, args ...any) { l.logf(levelError, format, args...) }
+
+func (l *Logger) logf(level logLevel, format string, args ...any) {
+	if !l.enabled(level) {
+		return
+	}
+	msg := fmt.Sprintf(format, args...)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.json {
+		l.writeJSON(level, msg)
+		return
+	}
+
+	l.endProgressLocked()
+	w := l.out
+	switch level {
+	case levelWarn:
+		w, msg = l.errOut, "Warning: "+msg
+	case levelError:
+		w, msg = l.errOut, "Error: "+msg
+	}
+	fmt.Fprintln(w, msg)
+}
+
+// Pipeline event names, reported in the "event" field of JSON log lines.
+const (
+	EventScan         = "scan"
+	EventConvertStart = "convert-start"
+	EventConvertDone  = "convert-done"
+	EventError        = "error"
+	EventSourceDown   = "source-down"
+	EventSourceUp     = "source-up"
+)
+
+// Event is a machine-readable pipeline event. Zero-valued fields are omitted,
+// except found, so that a scan with nothing to convert reports 0.
+type Event struct {
+	Name    string  `json:"event"`
+	Input   string  `json:"input,omitempty"`
+	Output  string  `json:"output,omitempty"`
+	Found   int     `json:"found"`             // scan: files needing conversion
+	Skipped int     `json:"skipped,omitempty"` // scan: files already up-to-date
+	Pages   int     `json:"pages,omitempty"`
+	Done    int     `json:"done,omitempty"` // batch progress
+	Total   int     `json:"total,omitempty"`
+	Seconds float64 `json:"seconds,omitempty"`
+	Error   string  `json:"error,omitempty"`
+
+	// scan and convert-done: problems that did not stop the conversion
+	Warnings []Warning `json:"warnings,omitempty"`
+
+	// convert-done: 1-indexed pages of a .note marked with the star
+	Starred []int `json:"starred,omitempty"`
+
+	// convert-done: resource usage of the conversion (see jobUsage)
+	CPUSeconds float64 `json:"cpu_seconds,omitempty"`
+	PeakMemMB  float64 `json:"peak_mem_mb,omitempty"`
+	Bytes      int64   `json:"bytes,omitempty"`
+}
+
+// Event reports a pipeline event. JSON mode writes it as one object with the
+// event fields and the formatted message; text mode prints only the message
+// (as an error for EventError and EventSourceDown), and nothing if format is
+// empty.
+func (l *Logger) Event(e Event, format string, args ...any) {
+	level := levelInfo
+	if e.Name == EventError || e.Name == EventSourceDown {
+		level = levelError
+	}
+	if !l.enabled(level) {
+		return
+	}
+	var msg string
+	if format != "" {
+		msg = fmt.Sprintf(format, args...)
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.json {
+		l.writeJSONEvent(level, msg, &e)
+		return
+	}
+	if msg == "" {
+		return
+	}
+	l.endProgressLocked()
+	if level == levelError {
+		fmt.Fprintln(l.errOut, "Error: "+msg)
+	} else {
+		fmt.Fprintln(l.out, msg)
+	}
+}
+
+// Warnings prints the warnings of a conversion of input in text mode. JSON
+// mode leaves them to the scan or convert-done event that carries them.
+func (l *Logger) Warnings(input string, ws []Warning) {
+	if len(ws) == 0 || !l.enabled(levelWarn) {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.json {
+		return
+	}
+	l.endProgressLocked()
+	for _, w := range ws {
+		if input != "" {
+			fmt.Fprintf(l.errOut, "Warning: '%s' %s\n", input, w)
+		} else {
+			fmt.Fprintf(l.errOut, "Warning: %s\n", w)
+		}
+	}
+}
+
+// Progress reports batch progress. On a terminal the line is redrawn in place;
+// otherwise each update is a regular info line. JSON mode skips it: the
+// matching convert-done event carries done and total.
+func (l *Logger) Progress(done, total int, msg string) {
+	if !l.enabled(levelInfo) {
+		return
+	}
+	line := fmt.Sprintf("[%d/%d] %s", done, total, msg)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	switch {
+	case l.json:
+	case l.tty:
+		fmt.Fprintf(l.out, "\r\033[K%s", line)
+		l.progress = true
+	default:
+		fmt.Fprintln(l.out, line)
+	}
+}
+
+// Interactive reports whether Status lines are shown: stdout is a terminal,
+// the format is text and info messages are enabled.
+func (l *Logger) Interactive() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.tty && !l.json && l.enabled(levelInfo)
+}
+
+// Status redraws the in-place status line. It is a no-op unless Interactive.
+func (l *Logger) Status(line string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.tty || l.json || !l.enabled(levelInfo) {
+		return
+	}
+	fmt.Fprintf(l.out, "\r\033[K%s", line)
+	l.progress = true
+}
+
+// EndProgress terminates an in-place progress line, if any.
+func (l *Logger) EndProgress() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.endProgressLocked()
+}
+
+func (l *Logger) endProgressLocked() {
+	if l.progress {
+		fmt.Fprintln(l.out)
+		l.progress = false
+	}
+}
+
+func (l *Logger) writeJSON(level logLevel, msg string) {
+	l.writeJSONEvent(level, msg, nil)
+}
+
+func (l *Logger) writeJSONEvent(level logLevel, msg string, e *Event) {
+	data, _ := json.Marshal(struct {
+		Time  string `json:"time"`
+		Level string `json:"level"`
+		*Event
+		Msg string `json:"msg,omitempty"`
+	}{time.Now().Format(time.RFC3339Nano), level.String(), e, msg})
+	l.out.Write(append(data, '\n'))
+}
@@ -1,78 +1,236 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"path/filepath"
-	"runtime"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+// commands maps subcommand names to their entry points. Invocations without a
+// known subcommand fall through to the flag-based convert/watch interface.
+var commands = map[string]func(args []string) error{
+	"audit":          runAudit,
+	"config":         runConfig,
+	"device":         runDevice,
+	"extract":        runExtract,
+	"extract-thumbs": runExtractThumbs,
+	"info":           runInfo,
+	"links":          runLinks,
+	"migrate-output": runMigrateOutput,
+	"reanchor":       runReanchor,
+	"stats":          runStats,
+	"validate":       runValidate,
+	"verify":         runVerify,
+}
+
 func main() {
+	if sshAskpass() {
+		return
+	}
+	if len(os.Args) > 1 {
+		if cmd, ok := commands[os.Args[1]]; ok {
+			if err := cmd(os.Args[2:]); err != nil {
+				logger.Errorf("%v", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	var input, output, configPath string
-	var noBg, watch bool
+	var noBg, grayscale, watch, force, followSymlinks, syncOutputs bool
+	var flattenAnnotations, annotationsOnly bool
+	var include, ignore globList
+	var raster rasterMode
+	var layers, format string
+	var logFormat string
+	var verbose, quiet bool
+	var workers int
 
 	flag.StringVar(&input, "i", "", "Input file (.note or .mark) or directory")
 	flag.StringVar(&input, "input", "", "Input file (.note or .mark) or directory")
-	flag.StringVar(&output, "o", "", "Output file (.pdf) or directory")
-	flag.StringVar(&output, "output", "", "Output file (.pdf) or directory")
+	flag.StringVar(&output, "o", "", "Output file (.pdf, .cbz, .epub) or directory")
+	flag.StringVar(&output, "output", "", "Output file (.pdf, .cbz, .epub) or directory")
+	flag.StringVar(&format, "format", "", "Output format of .note files: pdf, cbz (page images in a comic book archive) or epub (page images with the recognized text); overrides [note] format")
 	flag.BoolVar(&noBg, "no-bg", false, "Exclude the background layer from the PDF output")
-	flag.StringVar(&configPath, "config", "config.toml", "Path to config file (TOML)")
+	flag.BoolVar(&grayscale, "grayscale", false, "Write PDF colors and backgrounds in DeviceGray, each code at its device gray level whatever the configured colors (sets [pdf] color_space = \"gray\")")
+	flag.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
 	flag.BoolVar(&watch, "watch", false, "Run as daemon, watching directories from config [watch] section")
+	flag.BoolVar(&force, "force", false, "Reconvert even if outputs are up to date (in watch mode: on the initial scan), e.g. after changing the config")
+	flag.BoolVar(&verbose, "v", false, "Verbose: also log per-page timing, layer and trace statistics")
+	flag.BoolVar(&verbose, "verbose", false, "Verbose: also log per-page timing, layer and trace statistics")
+	flag.BoolVar(&quiet, "q", false, "Quiet: log errors only (overrides [log] level)")
+	flag.BoolVar(&quiet, "quiet", false, "Quiet: log errors only (overrides [log] level)")
+	flag.IntVar(&workers, "j", 0, "Number of files/pages converted concurrently (overrides [performance] workers; default: all CPUs)")
+	flag.StringVar(&logFormat, "log-format", "", "Log format: text or json (one event object per line; overrides [log] format)")
+	flag.Var(&include, "include", "Only convert sources matching this glob (repeatable; adds to [filter] include)")
+	flag.BoolVar(&syncOutputs, "sync", false, "Directory mode: also delete outputs whose sources are gone and prune empty directories ([watch] cleanup and protect apply)")
+	flag.BoolVar(&followSymlinks, "follow-symlinks", false, "Descend into symlinked directories in directory and watch mode (sets [filter] follow_symlinks)")
+	flag.Var(&ignore, "ignore", "Skip sources matching this glob, e.g. '**/RECYCLE/**' (repeatable; adds to [filter] ignore)")
+	flag.StringVar(&layers, "layers", "", "Comma-separated note layers to render, e.g. MAINLAYER,LAYER1, or to leave out, e.g. -LAYER3 (overrides [note] layers)")
+	flag.BoolVar(&flattenAnnotations, "flatten-annotations", false, "Draw .mark highlights and underlines into the page content instead of annotations (overrides [mark] annotations)")
+	flag.BoolVar(&annotationsOnly, "annotations-only", false, "Experimental: emit .mark pen strokes as ink annotations instead of stamping them (overrides [mark] annotations)")
+	flag.Var(&raster, "raster", "Embed note pages as images instead of traced vectors; --raster=auto only pages too complex to trace (overrides [trace] raster)")
 	flag.Parse()
 
+	if workers < 0 {
+		logger.Errorf("-j must not be negative")
+		os.Exit(1)
+	}
+	if verbose && quiet {
+		logger.Errorf("--verbose and --quiet are mutually exclusive")
+		os.Exit(1)
+	}
+	if flattenAnnotations && annotationsOnly {
+		logger.Errorf("--flatten-annotations and --annotations-only are mutually exclusive")
+		os.Exit(1)
+	}
+
+	// overrides applies command-line settings on top of the config file; the
+	// daemon re-applies them after every reload.
+	overrides := func(cfg *Config) {
+		switch {
+		case verbose:
+			cfg.Log.Level = "debug"
+		case quiet:
+			cfg.Log.Level = "error"
+		}
+		if logFormat != "" {
+			cfg.Log.Format = logFormat
+		}
+		if workers > 0 {
+			cfg.Performance.Workers = workers
+		}
+		if raster != "" {
+			cfg.Trace.Raster = string(raster)
+		}
+		if layers != "" {
+			cfg.Note.Layers = strings.Split(layers, ",")
+		}
+		if format != "" {
+			cfg.Note.Format = format
+		}
+		switch {
+		case flattenAnnotations:
+			cfg.Mark.Annotations = markFlatten
+		case annotationsOnly:
+			cfg.Mark.Annotations = markOnly
+		}
+		cfg.Filter.Include = append(cfg.Filter.Include, include...)
+		cfg.Filter.Ignore = append(cfg.Filter.Ignore, ignore...)
+		if followSymlinks {
+			cfg.Filter.FollowSymlinks = true
+		}
+		if grayscale {
+			cfg.PDF.ColorSpace = "gray"
+			cfg.useDeviceGrays()
+		}
+	}
+
 	cfg, err := LoadConfig(configPath)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
+		logger.Errorf("loading config: %v", err)
+		os.Exit(1)
+	}
+	overrides(cfg)
+	if err := cfg.Note.validateLayers(); err != nil {
+		logger.Errorf("--%v", err)
 		os.Exit(1)
 	}
+	if err := cfg.Note.validateFormat(); err != nil {
+		logger.Errorf("--%v", err)
+		os.Exit(1)
+	}
+	if err := logger.Configure(cfg.Log); err != nil {
+		logger.Errorf("config [log]: %v", err)
+		os.Exit(1)
+	}
+	cfg.warnUnknownKeys(configPath)
+	cfg.Performance.apply()
 
 	if watch {
-		if cfg.Watch.Location == "" {
-			fmt.Fprintln(os.Stderr, "Error: [watch] location must be set in config for --watch mode")
+		if err := cfg.Watch.Validate(); err != nil {
+			logger.Errorf("%v", err)
 			os.Exit(1)
 		}
-		if len(cfg.Watch.InputDirs()) == 0 {
-			fmt.Fprintln(os.Stderr, "Error: [watch] requires at least one of supernote_private_cloud or webdav in config")
+		if cfg.Note.outputExt() != ".pdf" {
+			logger.Errorf("watch mode writes PDFs; --format %s is only supported with -i/-o", cfg.Note.Format)
 			os.Exit(1)
 		}
-		if err := runWatchMode(cfg, noBg); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		if err := runWatchMode(cfg, configPath, noBg, force, overrides); err != nil {
+			logger.Errorf("%v", err)
 			os.Exit(1)
 		}
 		return
 	}
 
 	if input == "" || output == "" {
-		fmt.Fprintln(os.Stderr, "Usage: GoSNare -i <input> -o <output> [--no-bg] [--config config.toml]")
-		fmt.Fprintln(os.Stderr, "       GoSNare --watch [--no-bg] [--config config.toml]")
+		fmt.Fprintln(os.Stderr, "Usage: GoSNare -i <input> -o <output> [-v|-q] [-j N] [--no-bg] [--layers <list>] [--format pdf|cbz|epub] [--flatten-annotations|--annotations-only] [--raster[=auto]] [--force] [--sync] [--include <glob>] [--ignore <glob>] [--follow-symlinks] [--config config.toml]")
+		fmt.Fprintln(os.Stderr, "       GoSNare --watch [-v|-q] [-j N] [--no-bg] [--force] [--config config.toml]")
+		fmt.Fprintln(os.Stderr, "       GoSNare info <file.note|file.mark>...")
+		fmt.Fprintln(os.Stderr, "       GoSNare validate <file.note|file.mark|dir>... [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare links <file.note> [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare audit [--config config.toml] [-i <dir> -o <dir>] [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare config validate [--config config.toml] [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare verify [--config config.toml] [-o <dir>] [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare migrate-output --from <old dir> [--config config.toml] [-i <dir> -o <dir>] [--dry-run]")
+		fmt.Fprintln(os.Stderr, "       GoSNare stats [--config config.toml] [-o <dir>] [--sort cpu|cpu-per-page|mem|bytes] [--top N] [--json]")
+		fmt.Fprintln(os.Stderr, "       GoSNare device list | device pull [--config config.toml] [-o <dir>] [--device <path>] [--no-bg]")
+		fmt.Fprintln(os.Stderr, "       GoSNare extract recognition [--no-jiix] <file.note>...")
+		fmt.Fprintln(os.Stderr, "       GoSNare extract-thumbs [--config config.toml] [-o <dir>] [--format png|jpeg] [--quality 85] [--no-bg] <file.note|dir>...")
+		fmt.Fprintln(os.Stderr, "       GoSNare reanchor --mark <file.pdf.mark> --annotated <old.pdf> --pdf <new.pdf> -o <out.pdf>")
 		flag.PrintDefaults()
 		os.Exit(1)
 	}
 
 	info, err := os.Stat(input)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: input path '%s' does not exist.\n", input)
+		logger.Errorf("input path '%s' does not exist.", input)
 		os.Exit(1)
 	}
 
 	if info.IsDir() {
-		err = processDirectory(input, output, noBg, cfg)
+		err = processDirectory(input, output, noBg, force, syncOutputs, cfg)
+	} else if syncOutputs {
+		err = fmt.Errorf("--sync needs an input directory")
 	} else {
-		err = processSingleFile(input, output, noBg, cfg)
+		err = processSingleFile(input, output, noBg, force, cfg)
 	}
 
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-		os.Exit(1)
+		logger.Event(Event{Name: EventError, Input: input, Error: err.Error()}, "%v", err)
+		var batch *batchError
+		if errors.As(err, &batch) {
+			os.Exit(batch.exitCode())
+		}
+		os.Exit(exitError)
+	}
+}
+
+// parseInterspersed parses args with fs, allowing flags to appear after
+// positional arguments (e.g. `links file.note --json`). Returns the positionals.
+func parseInterspersed(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args)
+		args = fs.Args()
+		if len(args) == 0 {
+			return positional
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
 	}
 }
 
-func processSingleFile(inputFile, outputFile string, noBg bool, cfg *Config) error {
+func processSingleFile(inputFile, outputFile string, noBg, force bool, cfg *Config) error {
 	isMark := strings.HasSuffix(inputFile, ".mark")
 	isNote := strings.HasSuffix(inputFile, ".note")
 
@@ -82,8 +240,10 @@ func processSingleFile(inputFile, outputFile string, noBg bool, cfg *Config) err
 	if info, err := os.Stat(outputFile); err == nil && info.IsDir() {
 		return fmt.Errorf("input is a file, but output '%s' is a directory; specify an output file path", outputFile)
 	}
-	if !strings.HasSuffix(outputFile, ".pdf") {
+	if ext := cfg.Note.outputExt(); isMark && !strings.HasSuffix(outputFile, ".pdf") {
 		return fmt.Errorf("output file '%s' must have a .pdf extension", outputFile)
+	} else if isNote && !strings.HasSuffix(outputFile, ext) {
+		return fmt.Errorf("output file '%s' must have a %s extension", outputFile, ext)
 	}
 
 	if dir := filepath.Dir(outputFile); dir != "." {
@@ -91,6 +251,12 @@ func processSingleFile(inputFile, outputFile string, noBg bool, cfg *Config) err
 			return err
 		}
 	}
+	defer lockOutput(outputFile)()
+
+	cfg, noBg, err := cfg.forSource(filepath.Dir(inputFile), inputFile, noBg)
+	if err != nil {
+		return err
+	}
 
 	if isMark {
 		companionPDF := strings.TrimSuffix(inputFile, ".mark")
@@ -98,79 +264,143 @@ func processSingleFile(inputFile, outputFile string, noBg bool, cfg *Config) err
 			return fmt.Errorf("companion PDF '%s' not found for mark file '%s'", companionPDF, inputFile)
 		}
 
-		if isMarkUpToDate(inputFile, companionPDF, outputFile) {
-			fmt.Printf("'%s' is already up-to-date. Skipping.\n", outputFile)
+		if !force && isMarkUpToDate(inputFile, companionPDF, outputFile) {
+			logger.Infof("'%s' is already up-to-date. Skipping.", outputFile)
 			return nil
 		}
 
-		fmt.Println("Converting mark file...")
+		logger.Event(Event{Name: EventConvertStart, Input: inputFile, Output: outputFile}, "Converting mark file...")
 		start := time.Now()
+		meter := startUsage()
 
-		if err := ConvertMarkToPDFVector(inputFile, companionPDF, outputFile, true, cfg); err != nil {
+		res, err := ConvertMarkToPDFVector(context.Background(), inputFile, companionPDF, outputFile, newPagePool(cfg.Performance.WorkerCount()), cfg, nil)
+		u := meter.finish(outputFile)
+		if err != nil {
 			return err
 		}
 
-		fmt.Printf("Successfully converted '%s' to '%s' in %.2fs\n", inputFile, outputFile, time.Since(start).Seconds())
+		secs := time.Since(start).Seconds()
+		logger.Event(u.event(Event{Name: EventConvertDone, Input: inputFile, Output: outputFile, Pages: sourcePageCount(inputFile), Seconds: secs, Warnings: res.Warnings, Starred: res.Starred}),
+			"Successfully converted '%s' to '%s' in %.2fs%s", inputFile, outputFile, secs, warningSummary(len(res.Warnings)))
+		logger.Warnings(inputFile, res.Warnings)
 		return nil
 	}
 
-	if isUpToDate(inputFile, outputFile) {
-		fmt.Printf("'%s' is already up-to-date. Skipping.\n", outputFile)
+	if !force && isUpToDate(inputFile, outputFile) {
+		logger.Infof("'%s' is already up-to-date. Skipping.", outputFile)
 		return nil
 	}
 
-	fmt.Println("Converting single file...")
+	logger.Event(Event{Name: EventConvertStart, Input: inputFile, Output: outputFile}, "Converting single file...")
 	start := time.Now()
+	meter := startUsage()
 
-	if err := ConvertNoteToPDFVector(inputFile, outputFile, noBg, true, cfg); err != nil {
+	res, err := ConvertNote(context.Background(), inputFile, outputFile, noBg, newPagePool(cfg.Performance.WorkerCount()), cfg, nil)
+	u := meter.finish(outputFile)
+	if err != nil {
 		return err
 	}
 
-	fmt.Printf("Successfully converted '%s' to '%s' in %.2fs\n", inputFile, outputFile, time.Since(start).Seconds())
+	secs := time.Since(start).Seconds()
+	logger.Event(u.event(Event{Name: EventConvertDone, Input: inputFile, Output: outputFile, Pages: sourcePageCount(inputFile), Seconds: secs, Warnings: res.Warnings, Starred: res.Starred}),
+		"Successfully converted '%s' to '%s' in %.2fs%s", inputFile, outputFile, secs, warningSummary(len(res.Warnings)))
+	logger.Warnings(inputFile, res.Warnings)
 	return nil
 }
 
+// Exit codes of conversions, for scripts. Directory batches tell partial
+// failures from complete ones; any other error, including a failed
+// single-file conversion, exits with exitError.
+const (
+	exitError   = 1
+	exitPartial = 2 // some files of a batch failed
+	exitFailed  = 3 // every file of a batch failed
+)
+
+// batchFailure is a file a directory batch could not convert.
+type batchFailure struct {
+	input string
+	err   error
+}
+
+// batchError is returned by processDirectory when files failed to convert.
+type batchError struct {
+	failed []batchFailure
+	total  int
+}
+
+func (e *batchError) Error() string {
+	return fmt.Sprintf("%d of %d files failed to convert", len(e.failed), e.total)
+}
+
+func (e *batchError) exitCode() int {
+	if len(e.failed) == e.total {
+		return exitFailed
+	}
+	return exitPartial
+}
+
 type convJob struct {
 	input        string
 	output       string
 	companionPDF string
+	root         string // input directory it was found in, where .gosnare.toml lookup starts
+	noBg         bool   // per-target override; OR-ed with the global --no-bg flag
+	force        bool   // convert even if the output is up to date (--force)
 }
 
-func processDirectory(inputDir, outputDir string, noBg bool, cfg *Config) error {
+// processDirectory converts the stale sources under inputDir into outputDir.
+// With syncOutputs set, outputs whose sources are gone are deleted afterwards, like
+// the watcher's orphan cleanup.
+func processDirectory(inputDir, outputDir string, noBg, force, syncOutputs bool, cfg *Config) error {
 	if info, err := os.Stat(outputDir); err == nil && !info.IsDir() {
 		return fmt.Errorf("input is a directory, but output '%s' is a file; specify an output directory", outputDir)
 	}
+	if syncOutputs && isUnderDir(outputDir, inputDir) {
+		return fmt.Errorf("--sync needs an output directory outside the input directory, or it would delete the PDFs there")
+	}
 
-	fmt.Printf("Scanning for .note and .mark files in '%s'...\n", inputDir)
+	logger.Infof("Scanning for .note and .mark files in '%s'...", inputDir)
 
 	var jobs []convJob
 	var numSkipped int
+	var scanWarnings []Warning
+	filter := cfg.Filter.Paths()
 
-	err := filepath.WalkDir(inputDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+	err := filter.walk(inputDir, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.IsDir() {
+			if filter.skipDir(inputDir, path) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !filter.allows(inputDir, path) {
 			return nil
 		}
 
 		if strings.HasSuffix(path, ".note") {
 			rel, _ := filepath.Rel(inputDir, path)
-			out := filepath.Join(outputDir, strings.TrimSuffix(rel, ".note")+".pdf")
-			if isUpToDate(path, out) {
+			out := filepath.Join(outputDir, strings.TrimSuffix(rel, ".note")+cfg.Note.outputExt())
+			if !force && isUpToDate(path, out) {
 				numSkipped++
 			} else {
-				jobs = append(jobs, convJob{input: path, output: out})
+				jobs = append(jobs, convJob{input: path, output: out, root: inputDir, force: force})
 			}
 		} else if strings.HasSuffix(path, ".mark") {
 			companionPDF := strings.TrimSuffix(path, ".mark")
 			if _, err := os.Stat(companionPDF); err != nil {
-				fmt.Fprintf(os.Stderr, "Warning: companion PDF not found for '%s', skipping.\n", path)
+				scanWarnings = append(scanWarnings, Warning{Kind: WarnCompanionMissing, Source: path, Message: "companion PDF not found, skipped"})
 				return nil
 			}
 			rel, _ := filepath.Rel(inputDir, path)
 			out := filepath.Join(outputDir, strings.TrimSuffix(rel, ".mark"))
-			if isMarkUpToDate(path, companionPDF, out) {
+			if !force && isMarkUpToDate(path, companionPDF, out) {
 				numSkipped++
 			} else {
-				jobs = append(jobs, convJob{input: path, output: out, companionPDF: companionPDF})
+				jobs = append(jobs, convJob{input: path, output: out, companionPDF: companionPDF, root: inputDir, force: force})
 			}
 		}
 
@@ -180,61 +410,157 @@ func processDirectory(inputDir, outputDir string, noBg bool, cfg *Config) error
 		return err
 	}
 
-	if len(jobs) == 0 && numSkipped == 0 {
-		fmt.Println("No .note or .mark files found. Exiting.")
+	scan := Event{Name: EventScan, Input: inputDir, Found: len(jobs), Skipped: numSkipped, Warnings: scanWarnings}
+	logger.Warnings("", scanWarnings)
+	if len(jobs) == 0 && numSkipped == 0 && !syncOutputs {
+		logger.Event(scan, "No .note or .mark files found. Exiting.")
 		return nil
 	}
 
+	state, err := openStateDB(outputDir, "")
+	if err != nil {
+		return fmt.Errorf("opening state DB: %w", err)
+	}
+	if cfg.Index.enabled() {
+		defer func() {
+			if err := writeIndex(outputDir, state.snapshot(), cfg); err != nil {
+				logger.Warnf("writing index: %v", err)
+			}
+		}()
+	}
+	if syncOutputs {
+		defer syncOrphanedOutputsIn(cfg.Watch, outputDir, cfg.Note.outputExt(), []string{inputDir}, &stateSet{dbs: []*stateDB{state}})
+	}
+
 	if len(jobs) == 0 {
-		fmt.Printf("All %d files are already up-to-date. Nothing to do.\n", numSkipped)
+		logger.Event(scan, "All %d files are already up-to-date. Nothing to do.", numSkipped)
 		return nil
 	}
 
-	fmt.Printf("Found %d modified files to convert (%d up-to-date, skipped).\n", len(jobs), numSkipped)
+	logger.Event(scan, "Found %d modified files to convert (%d up-to-date, skipped).", len(jobs), numSkipped)
 	start := time.Now()
 
 	var (
 		completed atomic.Int64
+		warned    atomic.Int64
 		wg        sync.WaitGroup
+		failMu    sync.Mutex
+		failures  []batchFailure
 	)
+	fail := func(j convJob, err error) {
+		failMu.Lock()
+		failures = append(failures, batchFailure{j.input, err})
+		failMu.Unlock()
+	}
 	total := int64(len(jobs))
-	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
-	errCh := make(chan string, len(jobs))
+	sem := make(chan struct{}, cfg.Performance.WorkerCount())
+	// Files share one pool of page workers, so a long notebook converted last
+	// still renders on all of them
+	pool := newPagePool(cfg.Performance.WorkerCount())
+
+	// On a terminal, show page-level progress with throughput and ETA
+	var progress *batchProgress
+	pageCounts := make([]int, len(jobs))
+	if logger.Interactive() {
+		totalPages := 0
+		for i, j := range jobs {
+			pageCounts[i] = sourcePageCount(j.input)
+			totalPages += pageCounts[i]
+		}
+		progress = newBatchProgress(len(jobs), totalPages)
+	}
 
-	for _, j := range jobs {
+	for i, j := range jobs {
 		wg.Add(1)
 		sem <- struct{}{}
 		go func() {
 			defer func() { <-sem; wg.Done() }()
 			if dir := filepath.Dir(j.output); dir != "." {
 				if err := os.MkdirAll(dir, 0755); err != nil {
-					errCh <- fmt.Sprintf("failed to create directory '%s': %v", dir, err)
+					logger.Event(Event{Name: EventError, Input: j.input, Output: j.output, Error: err.Error()},
+						"failed to create directory '%s': %v", dir, err)
+					fail(j, err)
 					return
 				}
 			}
-			var err error
-			if j.companionPDF != "" {
-				err = ConvertMarkToPDFVector(j.input, j.companionPDF, j.output, false, cfg)
+			defer lockOutput(j.output)()
+			var onPage func()
+			if progress != nil {
+				progress.startFile(j.input, pageCounts[i])
+				onPage = func() { progress.page(j.input) }
+			}
+			if j.upToDate() {
+				// Another GoSNare process (e.g. the daemon) converted it meanwhile
+				n := int(completed.Add(1))
+				logger.Infof("'%s' was converted by another process, skipping.", j.output)
+				if progress != nil {
+					progress.fileDone(j.input)
+				} else {
+					logger.Progress(n, int(total), "Skipped "+filepath.Base(j.input))
+				}
+				return
+			}
+			logger.Event(Event{Name: EventConvertStart, Input: j.input, Output: j.output}, "")
+			jobStart := time.Now()
+			meter := startUsage()
+			var res *Result
+			jcfg, jnoBg, err := cfg.forSource(j.root, j.input, noBg)
+			switch {
+			case err != nil:
+			case j.companionPDF != "":
+				res, err = ConvertMarkToPDFVector(context.Background(), j.input, j.companionPDF, j.output, pool, jcfg, onPage)
+			default:
+				res, err = ConvertNote(context.Background(), j.input, j.output, jnoBg, pool, jcfg, onPage)
+			}
+			u := meter.finish(j.output)
+			n := int(completed.Add(1))
+			if err != nil {
+				logger.Event(Event{Name: EventError, Input: j.input, Output: j.output, Done: n, Total: int(total), Error: err.Error()},
+					"failed to convert '%s': %v", j.input, err)
+				fail(j, err)
+				_, err = state.recordFailure(j, err, cfg.Watch.retryPolicy())
 			} else {
-				err = ConvertNoteToPDFVector(j.input, j.output, noBg, false, cfg)
+				pages := sourcePageCount(j.input)
+				logger.Event(u.event(Event{Name: EventConvertDone, Input: j.input, Output: j.output, Pages: pages, Done: n, Total: int(total), Seconds: time.Since(jobStart).Seconds(), Warnings: res.Warnings, Starred: res.Starred}), "")
+				logger.Warnings(j.input, res.Warnings)
+				warned.Add(int64(len(res.Warnings)))
+				err = state.recordSuccess(j, pages, u, res)
 			}
 			if err != nil {
-				errCh <- fmt.Sprintf("failed to convert '%s': %v", j.input, err)
+				logger.Errorf("failed to update state DB for '%s': %v", j.input, err)
+			}
+			if progress != nil {
+				progress.fileDone(j.input)
+			} else {
+				logger.Progress(n, int(total), "Converted "+filepath.Base(j.input))
 			}
-			n := completed.Add(1)
-			fmt.Printf("\r[%d/%d] Converted %s", n, total, filepath.Base(j.input))
 		}()
 	}
 	wg.Wait()
-	close(errCh)
 
-	fmt.Println()
-	for msg := range errCh {
-		fmt.Fprintln(os.Stderr, msg)
+	logger.EndProgress()
+
+	logger.Infof("Converted %d of %d files in %.2fs%s", len(jobs)-len(failures), len(jobs), time.Since(start).Seconds(), warningSummary(int(warned.Load())))
+	if len(failures) == 0 {
+		return nil
+	}
+	slices.SortFunc(failures, func(a, b batchFailure) int { return strings.Compare(a.input, b.input) })
+	logger.Errorf("Failed files:")
+	for _, f := range failures {
+		logger.Errorf("  '%s': %v", f.input, f.err)
 	}
+	return &batchError{failed: failures, total: len(jobs)}
+}
 
-	fmt.Printf("Converted %d files in %.2fs\n", len(jobs), time.Since(start).Seconds())
-	return nil
+// upToDate reports whether j's output is at least as new as its sources.
+func (j convJob) upToDate() bool {
+	if j.force {
+		return false
+	}
+	if j.companionPDF != "" {
+		return isMarkUpToDate(j.input, j.companionPDF, j.output)
+	}
+	return isUpToDate(j.input, j.output)
 }
 
 func isUpToDate(input, output string) bool {
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// pageMargins is the blank space added around the content of notebook pages,
+// in points.
+type pageMargins struct {
+	top, right, bottom, left float64
+}
+
+// lengthUnits maps the units of [pdf] margins to points.
+var lengthUnits = map[string]float64{
+	"pt": 1,
+	"mm": 72 / 25.4,
+	"cm": 72 / 2.54,
+	"in": 72,
+}
+
+// pageMargins parses [pdf] margins: one to four lengths with a unit (pt, mm,
+// cm or in), in the order of CSS margins: "top right bottom left"; "v h" sets
+// top/bottom and right/left; "t h b" sets top, right/left and bottom. A bare
+// 0 needs no unit. Asymmetric margins also offset the content, e.g.
+// "0 0 0 20mm" for a binding margin on the left.
+func (c PDFConfig) pageMargins() (pageMargins, error) {
+	fields := strings.Fields(c.Margins)
+	if len(fields) == 0 {
+		return pageMargins{}, nil
+	}
+	if len(fields) > 4 {
+		return pageMargins{}, fmt.Errorf("margins takes one to four lengths, got %q", c.Margins)
+	}
+	var v [4]float64
+	for i, f := range fields {
+		num, unit := f, ""
+		if i := strings.IndexFunc(f, func(r rune) bool { return r >= 'a' && r <= 'z' }); i >= 0 {
+			num, unit = f[:i], f[i:]
+		}
+		n, err := strconv.ParseFloat(num, 64)
+		if err != nil || n < 0 {
+			return pageMargins{}, fmt.Errorf("margins: invalid length %q", f)
+		}
+		scale, ok := lengthUnits[unit]
+		if !ok && !(unit == "" && n == 0) {
+			return pageMargins{}, fmt.Errorf("margins: length %q needs a unit: pt, mm, cm or in", f)
+		}
+		v[i] = n * scale
+	}
+	switch len(fields) {
+	case 1:
+		v[1], v[2], v[3] = v[0], v[0], v[0]
+	case 2:
+		v[2], v[3] = v[0], v[1]
+	case 3:
+		v[3] = v[1]
+	}
+	return pageMargins{top: v[0], right: v[1], bottom: v[2], left: v[3]}, nil
+}
+
+// size returns the size of a page whose content is w by h points.
+func (m pageMargins) size(w, h float64) (float64, float64) {
+	return w + m.left + m.right, h + m.top + m.bottom
+}
+
+// wrapContent moves a page content stream drawn at the origin onto the area
+// inside the margins.
+func (m pageMargins) wrapContent(content []byte) []byte {
+	if m == (pageMargins{}) {
+		return content
+	}
+	buf := make([]byte, 0, len(content)+32)
+	buf = append(buf, "q\n1 0 0 1 "...)
+	buf = appendFloat2(buf, m.left)
+	buf = append(buf, ' ')
+	buf = appendFloat2(buf, m.bottom)
+	buf = append(buf, " cm\n"...)
+	buf = append(buf, content...)
+	return append(buf, "Q\n"...)
+}
+
+// withMargins records the margins of the pages in the /GoSNare dictionary of a
+// catalog written by catalogObject, as /Margins [top right bottom left].
+func withMargins(catalog pdfObject, m pageMargins) pdfObject {
+	i := bytes.Index(catalog.data, []byte("/PageLayers ["))
+	if i >= 0 {
+		i += bytes.Index(catalog.data[i:], []byte("] >>")) + 1
+	}
+	if m == (pageMargins{}) || i <= 0 {
+		return catalog
+	}
+	data := append(catalog.data[:i:i], fmt.Appendf(nil, "\n      /Margins [%.2f %.2f %.2f %.2f]", m.top, m.right, m.bottom, m.left)...)
+	return pdfObject{id: catalog.id, data: append(data, catalog.data[i:]...)}
+}
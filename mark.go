@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -8,9 +9,9 @@ import (
 	"image/color"
 	"io"
 	"math"
-	"os"
 	"path/filepath"
 	"strconv"
+	"time"
 
 	"github.com/dennwc/gotrace"
 	"github.com/pdfcpu/pdfcpu/pkg/api"
@@ -21,7 +22,7 @@ import (
 
 type MarkAnnotation struct {
 	AnnotationType int         `json:"annotationType"` // 0=Highlight, 1=Underline
-	ColorType      int         `json:"colorType"`      // 0=Yellow, 4=Red
+	ColorType      int         `json:"colorType"`      // 0=Yellow, 4=Red; others per [mark.highlight_colors]
 	Page           int         `json:"page"`
 	MupdfRects     []MupdfRect `json:"mupdfRectList"`
 }
@@ -34,13 +35,7 @@ type MupdfRect struct {
 	Y1 float64 `json:"y1"`
 }
 
-func renderMarkPageRGBA(path string, page Page, width, height int, p *Palette) ([]byte, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
+func renderMarkPageRGBA(src io.ReaderAt, page Page, width, height int, p *Palette) ([]byte, error) {
 	totalPixels := width * height
 	rgba := make([]byte, totalPixels*4)
 
@@ -51,14 +46,14 @@ func renderMarkPageRGBA(path string, page Page, width, height int, p *Palette) (
 
 		switch layer.Protocol {
 		case "RATTA_RLE":
-			data, err := readLayerData(f, layer.BitmapAddress)
+			data, err := readLayerData(src, layer.BitmapAddress)
 			if err != nil {
 				return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
 			}
 			decodeRLEToRGBA(data, rgba, width, height, p)
 
 		case "PNG":
-			img, err := decodePNGLayer(f, layer.BitmapAddress)
+			img, err := decodePNGLayer(src, layer.BitmapAddress)
 			if err != nil {
 				return nil, fmt.Errorf("decoding PNG layer %s: %w", layer.Key, err)
 			}
@@ -141,7 +136,13 @@ func hasVisiblePixels(rgba []byte) bool {
 	return false
 }
 
-func annotationColor(colorType int) pdfcolor.SimpleColor {
+// annotationColor returns the color of a highlight or underline: the
+// [mark.highlight_colors] entry for its colorType, else red for 4 and yellow
+// for anything else.
+func annotationColor(colorType int, colors map[int][3]byte) pdfcolor.SimpleColor {
+	if c, ok := colors[colorType]; ok {
+		return pdfcolor.SimpleColor{R: float32(c[0]) / 255, G: float32(c[1]) / 255, B: float32(c[2]) / 255}
+	}
 	switch colorType {
 	case 4:
 		return pdfcolor.SimpleColor{R: 1, G: 0, B: 0}
@@ -152,50 +153,11 @@ func annotationColor(colorType int) pdfcolor.SimpleColor {
 
 // parseMarkAnnotations reads highlight/underline annotations from a .mark file's
 // HIGHLIGHTINFO metadata (base64-encoded JSON with quad points).
-func parseMarkAnnotations(path string) (map[int][]MarkAnnotation, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
-	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
-		return nil, err
-	}
-	footerAddr, err := readUint32(f)
-	if err != nil {
-		return nil, err
-	}
-
-	footerMap, err := parseMetadataBlock(f, uint64(footerAddr))
-	if err != nil {
-		return nil, err
-	}
-
-	featureStr, ok := footerMap["FILE_FEATURE"]
-	if !ok {
+func parseMarkAnnotations(src io.ReaderAt, nb *Notebook) (map[int][]MarkAnnotation, error) {
+	if nb.Highlight == 0 {
 		return nil, nil
 	}
-	featureAddr, err := strconv.ParseUint(featureStr, 10, 64)
-	if err != nil {
-		return nil, nil
-	}
-	featureMap, err := parseMetadataBlock(f, featureAddr)
-	if err != nil {
-		return nil, err
-	}
-
-	highlightStr, ok := featureMap["HIGHLIGHTINFO"]
-	if !ok {
-		return nil, nil
-	}
-
-	highlightAddr, err := strconv.ParseUint(highlightStr, 10, 64)
-	if err != nil {
-		return nil, nil
-	}
-
-	raw, err := readLayerData(f, highlightAddr)
+	raw, err := readLayerData(src, nb.Highlight)
 	if err != nil {
 		return nil, nil // highlight data corrupt/truncated; skip gracefully
 	}
@@ -221,13 +183,12 @@ func parseMarkAnnotations(path string) (map[int][]MarkAnnotation, error) {
 	return result, nil
 }
 
-// expandPDFMediaBox expands the PDF MediaBox/CropBox to match the notebook aspect ratio.
-func expandPDFMediaBox(pdfPath, outputPath string, dims []types.Dim, width, height int) error {
-	d := dims[0]
+// expandedBox returns the page box of a d-sized companion page grown to the
+// notebook aspect ratio, centered on the original page.
+func expandedBox(d types.Dim, width, height int) (llx, lly, urx, ury float64) {
 	targetAspect := float64(width) / float64(height)
 	currentAspect := d.Width / d.Height
 
-	var llx, lly, urx, ury float64
 	if math.Abs(currentAspect-targetAspect) < 0.001 {
 		llx, lly = 0.0, 0.0
 		urx, ury = d.Width, d.Height
@@ -242,88 +203,143 @@ func expandPDFMediaBox(pdfPath, outputPath string, dims []types.Dim, width, heig
 		llx, lly = -dx, 0.0
 		urx, ury = d.Width+dx, d.Height
 	}
+	return llx, lly, urx, ury
+}
 
-	pb := &model.PageBoundaries{
-		Media: &model.Box{Rect: types.NewRectangle(llx, lly, urx, ury)},
-		Crop:  &model.Box{Rect: types.NewRectangle(llx, lly, urx, ury)},
+// expandPDFMediaBox expands the PDF MediaBox/CropBox of each page to its box,
+// one pass per distinct box (rotated pages are expanded along their other axis).
+func expandPDFMediaBox(doc *memPDF, boxes []markBox) error {
+	selected := make(map[markBox][]string)
+	var order []markBox
+	for i, b := range boxes {
+		b.rot = 0
+		if selected[b] == nil {
+			order = append(order, b)
+		}
+		selected[b] = append(selected[b], strconv.Itoa(i+1))
 	}
 
-	if err := api.AddBoxesFile(pdfPath, outputPath, nil, pb, nil); err != nil {
-		return fmt.Errorf("expanding PDF boundaries: %w", err)
+	for _, b := range order {
+		pb := &model.PageBoundaries{
+			Media: &model.Box{Rect: types.NewRectangle(b.llx, b.lly, b.urx, b.ury)},
+			Crop:  &model.Box{Rect: types.NewRectangle(b.llx, b.lly, b.urx, b.ury)},
+		}
+		pages := selected[b]
+		if len(order) == 1 {
+			pages = nil
+		}
+		if err := doc.apply(func(rs io.ReadSeeker, w io.Writer) error {
+			return api.AddBoxes(rs, w, pages, pb, nil)
+		}); err != nil {
+			return fmt.Errorf("expanding PDF boundaries: %w", err)
+		}
 	}
 	return nil
 }
 
-// traceAndOverlayMask traces a grayscale mask via potrace and stamps the resulting
-// vector overlay onto outputPath at the given page.
-func traceAndOverlayMask(
+// markOverlay is a traced one-page overlay PDF waiting to be stamped onto a
+// page of the output with the watermark description desc.
+type markOverlay struct {
+	pdf  []byte
+	desc string
+}
+
+// traceMaskOverlay traces a grayscale mask via potrace and returns the
+// resulting vector overlay PDF, or nil when the mask traces to nothing.
+func traceMaskOverlay(
 	mask *image.Gray, p *Palette,
 	width, height int,
 	pageWidthPt, pageHeightPt float64,
-	tmpDir string, pageIndex, pageNumber int,
-	outputPath string, pageStr []string,
-	label, wmDesc string,
+	pageNumber int,
+	label string,
 	traceParams *gotrace.Params,
-) error {
+	trace TraceConfig,
+	cs colorSpace,
+	rot int,
+) ([]byte, error) {
+	if mask = rotateMask(mask, rot); rot%180 != 0 {
+		width, height = height, width
+		pageWidthPt, pageHeightPt = pageHeightPt, pageWidthPt
+	}
 	bm := gotrace.NewBitmapFromImage(mask, func(x, y int, cl color.Color) bool {
 		v, _, _, _ := cl.RGBA()
 		return v < 0x8000
 	})
 	paths, err := gotrace.Trace(bm, traceParams)
 	if err != nil {
-		return fmt.Errorf("tracing %s mask page %d: %w", label, pageNumber, err)
+		return nil, fmt.Errorf("tracing %s mask page %d: %w", label, pageNumber, err)
 	}
-	if len(paths) == 0 {
-		return nil
+	if paths = simplifyPaths(paths, trace.Simplify); len(paths) == 0 {
+		return nil, nil
 	}
 
 	cl := colorLayer{
 		r: p.Colors[0][0], g: p.Colors[0][1], b: p.Colors[0][2],
 		alpha: 255, paths: paths,
 	}
+	objStart := 4
+	if cs.mode == "icc" {
+		cs.iccID, objStart = 4, 5
+	}
 	chunk, _ := buildVectorPageChunk(
 		[]colorLayer{cl},
-		nil, width, height,
+		nil,
+		nil, nil, 0, width, height,
 		pageWidthPt, pageHeightPt,
-		nil, 3,
+		nil, nil, nil, 3, objStart,
 		false,
+		trace,
+		cs,
+		bgImageOptions{},
+		pageMargins{},
 	)
-	overlayPath := filepath.Join(tmpDir, fmt.Sprintf("vector_%s_%d.pdf", label, pageIndex))
-	if err := writeOnePageVectorPDF(overlayPath, chunk, pageWidthPt, pageHeightPt); err != nil {
-		return fmt.Errorf("writing %s vector overlay for page %d: %w", label, pageNumber, err)
-	}
-	if err := api.AddPDFWatermarksFile(
-		outputPath, "", pageStr, true,
-		overlayPath, wmDesc, nil,
-	); err != nil {
-		return fmt.Errorf("stamping %s vector page %d: %w", label, pageNumber, err)
+	if cs.iccID != 0 {
+		chunk.objects = append(chunk.objects, cs.profileObject())
 	}
-	return nil
+	return onePageVectorPDF(chunk), nil
 }
 
 // applyHighlightAnnotations parses HIGHLIGHTINFO metadata from the mark file
-// and stamps highlight/underline annotations onto the output PDF.
-func applyHighlightAnnotations(markPath, outputPath string, dims []types.Dim) error {
-	markAnnotations, err := parseMarkAnnotations(markPath)
+// and adds highlight/underline annotations to the output document, together
+// with the ink annotations in annotMap. Each annotation's Contents is the
+// companion text under its quads, so readers show the marked passage in their
+// annotation lists. With flat non-nil, highlights are collected there to be
+// drawn into the page content instead.
+func applyHighlightAnnotations(src io.ReaderAt, notebook *Notebook, pdfPath string, doc *memPDF, pages []companionPage, pageMap map[int]int, colors map[int][3]byte, cs colorSpace, annotMap map[int][]model.AnnotationRenderer, flat map[int][]flatHighlight) error {
+	markAnnotations, err := parseMarkAnnotations(src, notebook)
 	if err != nil {
 		return fmt.Errorf("parsing mark annotations: %w", err)
 	}
 
-	if len(markAnnotations) == 0 {
+	if len(markAnnotations) == 0 && len(annotMap) == 0 {
 		return nil
 	}
 
-	annotMap := make(map[int][]model.AnnotationRenderer)
+	var textPages []int
+	for pageIdx := range markAnnotations {
+		if pageNum := remapPage(pageMap, pageIdx+1); pageNum != 0 {
+			textPages = append(textPages, pageNum)
+		}
+	}
+	texts, err := pageTexts(pdfPath, textPages)
+	if err != nil {
+		logger.Debugf("no text extracted from '%s' for highlights: %v", pdfPath, err)
+	}
+
+	if annotMap == nil {
+		annotMap = make(map[int][]model.AnnotationRenderer)
+	}
 	annID := 0
 
 	for pageIdx, anns := range markAnnotations {
-		pageNum := pageIdx + 1
+		pageNum := remapPage(pageMap, pageIdx+1)
+		if pageNum == 0 {
+			continue
+		}
 
-		var pageHeight float64
-		if pageIdx < len(dims) {
-			pageHeight = dims[pageIdx].Height
-		} else {
-			pageHeight = dims[0].Height
+		cp := pages[0]
+		if pageNum <= len(pages) {
+			cp = pages[pageNum-1]
 		}
 
 		for _, ann := range anns {
@@ -331,21 +347,23 @@ func applyHighlightAnnotations(markPath, outputPath string, dims []types.Dim) er
 				continue
 			}
 
-			col := annotationColor(ann.ColorType)
+			col := cs.annotationColor(annotationColor(ann.ColorType, colors))
 
 			var quadPoints types.QuadPoints
+			var rects []*types.Rectangle
 			minX, minY := math.MaxFloat64, math.MaxFloat64
 			maxX, maxY := -math.MaxFloat64, -math.MaxFloat64
 
 			for _, mr := range ann.MupdfRects {
-				x0 := mr.X0
-				x1 := mr.X1
-				y0 := pageHeight - mr.Y1
-				y1 := pageHeight - mr.Y0
+				ax, ay := cp.user(mr.X0, mr.Y0)
+				bx, by := cp.user(mr.X1, mr.Y1)
+				x0, x1 := min(ax, bx), max(ax, bx)
+				y0, y1 := min(ay, by), max(ay, by)
 
 				rect := types.NewRectangle(x0, y0, x1, y1)
 				ql := types.NewQuadLiteralForRect(rect)
 				quadPoints = append(quadPoints, *ql)
+				rects = append(rects, rect)
 
 				minX = min(minX, x0)
 				maxX = max(maxX, x1)
@@ -353,21 +371,27 @@ func applyHighlightAnnotations(markPath, outputPath string, dims []types.Dim) er
 				maxY = max(maxY, y1)
 			}
 
+			if flat != nil && (ann.AnnotationType == 0 || ann.AnnotationType == 1) {
+				flat[pageNum] = append(flat[pageNum], flatHighlight{underline: ann.AnnotationType == 1, col: col, rects: rects})
+				continue
+			}
+
 			boundingRect := types.NewRectangle(minX, minY, maxX, maxY)
 			annID++
 			id := fmt.Sprintf("sn_%d", annID)
+			contents := textInRects(texts[pageNum], rects)
 
 			var ar model.AnnotationRenderer
 			switch ann.AnnotationType {
 			case 0:
 				ar = model.NewHighlightAnnotation(
-					*boundingRect, 0, "", id, "",
+					*boundingRect, 0, contents, id, "",
 					0, &col, 0, 0, 0, "", nil, nil, "", "",
 					quadPoints,
 				)
 			case 1:
 				ar = model.NewUnderlineAnnotation(
-					*boundingRect, 0, "", id, "",
+					*boundingRect, 0, contents, id, "",
 					0, &col, 0, 0, 0, "", nil, nil, "", "",
 					quadPoints,
 				)
@@ -381,7 +405,9 @@ func applyHighlightAnnotations(markPath, outputPath string, dims []types.Dim) er
 
 	if len(annotMap) > 0 {
 		conf := model.NewDefaultConfiguration()
-		if err := api.AddAnnotationsMapFile(outputPath, "", annotMap, conf, true); err != nil {
+		if err := doc.apply(func(rs io.ReadSeeker, w io.Writer) error {
+			return api.AddAnnotationsMap(rs, w, annotMap, conf)
+		}); err != nil {
 			return fmt.Errorf("adding annotations: %w", err)
 		}
 	}
@@ -389,37 +415,73 @@ func applyHighlightAnnotations(markPath, outputPath string, dims []types.Dim) er
 	return nil
 }
 
+// remapPage translates a mark page number through pageMap. A nil map is the
+// identity; pages missing from a non-nil map are dropped (returns 0).
+func remapPage(pageMap map[int]int, page int) int {
+	if pageMap == nil {
+		return page
+	}
+	return pageMap[page]
+}
+
 // ConvertMarkToPDFVector traces mark annotations as vector paths and stamps them onto the companion PDF.
-func ConvertMarkToPDFVector(markPath, pdfPath, outputPath string, parallel bool, cfg *Config) error {
-	notebook, err := ParseNotebook(markPath)
+// onPage, if non-nil, is called after each mark page is processed. Pages render on the workers
+// of pool, one at a time if it is nil. Cancelling ctx stops the
+// conversion between pages and before stamping and returns ctx's error.
+func ConvertMarkToPDFVector(ctx context.Context, markPath, pdfPath, outputPath string, pool pagePool, cfg *Config, onPage func()) (*Result, error) {
+	res := &Result{}
+	return res, convertMarkToPDFVector(ctx, markPath, pdfPath, outputPath, pool, cfg, nil, onPage, res)
+}
+
+// convertMarkToPDFVector is ConvertMarkToPDFVector with an optional page remap
+// (mark page number -> companion page number), used when re-anchoring a .mark
+// onto a different revision of its companion PDF.
+func convertMarkToPDFVector(ctx context.Context, markPath, pdfPath, outputPath string, pool pagePool, cfg *Config, pageMap map[int]int, onPage func(), res *Result) error {
+	src, notebook, err := openNotebook(markPath)
 	if err != nil {
 		return fmt.Errorf("parsing mark file: %w", err)
 	}
+	defer src.Close()
+	res.warnFormatVersion(notebook)
 
 	width := notebook.Width
 	height := notebook.Height
 	pageWidthPt := float64(width) / notebook.PPI * 72.0
 	pageHeightPt := float64(height) / notebook.PPI * 72.0
 
-	dims, err := api.PageDimsFile(pdfPath)
+	pages, err := readCompanionPages(pdfPath)
 	if err != nil {
-		return fmt.Errorf("reading PDF page dims: %w", err)
+		return fmt.Errorf("reading PDF pages: %w", err)
 	}
-	if len(dims) == 0 {
+	if len(pages) == 0 {
 		return fmt.Errorf("no pages found in PDF")
 	}
 
-	tmpDir, err := os.MkdirTemp("", "supernote-mark-vector-*")
+	nav, err := readCompanionNav(pdfPath)
 	if err != nil {
-		return err
+		return fmt.Errorf("reading PDF navigation: %w", err)
 	}
-	defer os.RemoveAll(tmpDir)
 
-	if err := expandPDFMediaBox(pdfPath, outputPath, dims, width, height); err != nil {
+	// Each page is fitted on its own, so mixed page sizes keep their overlays aligned
+	boxes := make([]markBox, len(pages))
+	for i, cp := range pages {
+		boxes[i] = pageBox(cp, width, height)
+	}
+	doc, err := readMemPDF(pdfPath)
+	if err != nil {
+		return err
+	}
+	if err := expandPDFMediaBox(doc, boxes); err != nil {
 		return err
 	}
 
-	p := BuildPalette(cfg.Mark.ColorConfig, cfg.Mark.MarkerOpacity)
+	p := BuildPalette(cfg.Mark.ColorConfig)
+	cs, err := cfg.PDF.colorSpace()
+	if err != nil {
+		return err
+	}
+	annotMap := make(map[int][]model.AnnotationRenderer)
+	overlays := make(map[int][]markOverlay)
 
 	// .mark files encode marker strokes as regular light gray values (>= 196),
 	// not as special marker codes 0x66-0x68. Use identity palette + grayscale
@@ -428,13 +490,40 @@ func ConvertMarkToPDFVector(markPath, pdfPath, outputPath string, parallel bool,
 	traceParams := gotrace.Defaults
 	traceParams.TurdSize = 2
 
-	for i, page := range notebook.Pages {
-		rgba, err := renderMarkPageRGBA(markPath, page, width, height, IdentityPalette())
+	// preparePage renders and traces one mark page into overlay PDFs (or ink
+	// annotations). Pages are prepared concurrently; the overlays of all
+	// pages are then stamped in a single pass over the document.
+	type markPageResult struct {
+		overlays []markOverlay
+		inks     []model.AnnotationRenderer
+		err      error
+	}
+	preparePage := func(page Page, target int) (r markPageResult) {
+		if r.err = ctx.Err(); r.err != nil {
+			return r
+		}
+		res.warnUnknownLayers(page)
+		box := boxes[0]
+		if target <= len(boxes) {
+			box = boxes[target-1]
+		}
+
+		rgba, err := renderMarkPageRGBA(src, page, width, height, IdentityPalette())
 		if err != nil {
-			return fmt.Errorf("rendering mark page %d: %w", page.Number, err)
+			r.err = fmt.Errorf("rendering mark page %d: %w", page.Number, err)
+			return r
 		}
 		if !hasVisiblePixels(rgba) {
-			continue
+			return r
+		}
+
+		if cfg.Mark.Annotations == markOnly {
+			inks, err := inkAnnotations(src, page, width, height, notebook.PPI, p, cs, box, cfg.Mark.MarkerOpacity, markerThreshold)
+			if err == nil {
+				r.inks = inks
+				return r
+			}
+			res.warnOncef(WarnStrokeFallback, page.Number, "no usable stroke data (%v); ink of pages without it was stamped into the page", err)
 		}
 
 		penMask := image.NewGray(image.Rect(0, 0, width, height))
@@ -459,35 +548,130 @@ func ConvertMarkToPDFVector(markPath, pdfPath, outputPath string, parallel bool,
 			}
 		}
 
-		pageStr := []string{strconv.Itoa(page.Number)}
-
-		if hasPen {
-			if err := traceAndOverlayMask(
-				penMask, p, width, height,
+		if r.err = ctx.Err(); r.err != nil {
+			return r
+		}
+		for _, m := range []struct {
+			has   bool
+			mask  *image.Gray
+			label string
+			desc  string
+		}{
+			{hasPen, penMask, "pen", "pos:c, scale:1 rel, rotation:0"},
+			{hasMarker, markerMask, "marker", fmt.Sprintf("pos:c, scale:1 rel, rotation:0, opacity:%.2f", cfg.Mark.MarkerOpacity)},
+		} {
+			if !m.has {
+				continue
+			}
+			overlay, err := traceMaskOverlay(
+				m.mask, p, width, height,
 				pageWidthPt, pageHeightPt,
-				tmpDir, i, page.Number,
-				outputPath, pageStr,
-				"pen", "pos:c, scale:1 rel, rotation:0",
+				page.Number,
+				m.label,
 				&traceParams,
-			); err != nil {
-				return err
+				cfg.Trace,
+				cs,
+				box.rot,
+			)
+			if err != nil {
+				r.err = err
+				return r
+			}
+			if overlay != nil {
+				r.overlays = append(r.overlays, markOverlay{pdf: overlay, desc: m.desc})
 			}
 		}
-
-		if hasMarker {
-			desc := fmt.Sprintf("pos:c, scale:1 rel, rotation:0, opacity:%.2f", cfg.Mark.MarkerOpacity)
-			if err := traceAndOverlayMask(
-				markerMask, p, width, height,
-				pageWidthPt, pageHeightPt,
-				tmpDir, i, page.Number,
-				outputPath, pageStr,
-				"marker", desc,
-				&traceParams,
-			); err != nil {
-				return err
+		return r
+	}
+
+	pool = pool.orSingle()
+	window := cfg.Performance.pageWindow(width, height)
+
+	results := make([]chan markPageResult, len(notebook.Pages))
+	for i := range results {
+		results[i] = make(chan markPageResult, 1)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	slots := make(chan struct{}, window)
+	go func() {
+		for i, page := range notebook.Pages {
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+			target := remapPage(pageMap, page.Number)
+			if target == 0 {
+				results[i] <- markPageResult{}
+				continue
+			}
+			if !pool.acquire(ctx, quit) {
+				return
 			}
+			go func() {
+				defer pool.release()
+				results[i] <- preparePage(page, target)
+			}()
+		}
+	}()
+
+	for i, page := range notebook.Pages {
+		pageStart := time.Now()
+		var r markPageResult
+		select {
+		case r = <-results[i]:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		<-slots
+		if r.err != nil {
+			return r.err
+		}
+		target := remapPage(pageMap, page.Number)
+		if len(r.inks) > 0 {
+			annotMap[target] = append(annotMap[target], r.inks...)
+		}
+		if len(r.overlays) > 0 {
+			overlays[target] = append(overlays[target], r.overlays...)
+		}
+		logger.Debugf("mark page %d of '%s' traced in %s", page.Number, filepath.Base(markPath), time.Since(pageStart).Round(time.Millisecond))
+		if onPage != nil {
+			onPage()
 		}
 	}
 
-	return applyHighlightAnnotations(markPath, outputPath, dims)
+	var flat map[int][]flatHighlight
+	if cfg.Mark.Annotations == markFlatten {
+		flat = make(map[int][]flatHighlight)
+	}
+	if err := applyHighlightAnnotations(src, notebook, pdfPath, doc, pages, pageMap, cfg.Mark.highlightColors, cs, annotMap, flat); err != nil {
+		return err
+	}
+	for pageNum, hs := range flat {
+		box := boxes[0]
+		if pageNum <= len(boxes) {
+			box = boxes[pageNum-1]
+		}
+		overlays[pageNum] = append(overlays[pageNum], flatHighlightOverlay(hs, box, cs))
+	}
+	stampStart := time.Now()
+	if err := doc.stamp(ctx, overlays); err != nil {
+		return fmt.Errorf("stamping vector overlays: %w", err)
+	}
+	logger.Debugf("%d pages of '%s' stamped in %s", len(overlays), filepath.Base(markPath), time.Since(stampStart).Round(time.Millisecond))
+	if err := nav.restore(doc, res); err != nil {
+		return err
+	}
+	if cfg.PDF.encrypted() {
+		if err := doc.encrypt(cfg.PDF); err != nil {
+			return fmt.Errorf("encrypting: %w", err)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return doc.save(outputPath)
 }
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// memPDF is a mark output being assembled in memory. Each pdfcpu pass reads
+// the current document and replaces it with its output, so overlays need no
+// temp files and the output is written once, when complete. Passes cover all
+// pages at once: one for the boxes, one for the annotations and one for the
+// overlays.
+type memPDF struct {
+	data []byte
+}
+
+// readMemPDF loads a PDF to be edited in memory.
+func readMemPDF(path string) (*memPDF, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &memPDF{data: data}, nil
+}
+
+// reader returns a reader over the current document.
+func (m *memPDF) reader() io.ReadSeeker {
+	return bytes.NewReader(m.data)
+}
+
+// apply runs a pdfcpu pass over the document.
+func (m *memPDF) apply(pass func(rs io.ReadSeeker, w io.Writer) error) error {
+	var out bytes.Buffer
+	out.Grow(len(m.data) + len(m.data)/8)
+	if err := pass(m.reader(), &out); err != nil {
+		return err
+	}
+	m.data = out.Bytes()
+	return nil
+}
+
+// stamp draws the overlays on top of their pages (1-indexed) in one pass,
+// each as described by its desc (see pdfcpu's watermark descriptions).
+func (m *memPDF) stamp(ctx context.Context, overlays map[int][]markOverlay) error {
+	if len(overlays) == 0 {
+		return nil
+	}
+	wms := make(map[int][]*model.Watermark, len(overlays))
+	for page, list := range overlays {
+		for _, o := range list {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			wm, err := api.PDFWatermarkForReadSeeker(bytes.NewReader(o.pdf), 1, o.desc, true, false, types.POINTS)
+			if err != nil {
+				return fmt.Errorf("page %d: %w", page, err)
+			}
+			wms[page] = append(wms[page], wm)
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return m.apply(func(rs io.ReadSeeker, w io.Writer) error {
+		return api.AddWatermarksSliceMap(rs, w, wms, nil)
+	})
+}
+
+// save writes the document to path, replacing it only once fully written.
+func (m *memPDF) save(path string) error {
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, m.data, 0644); err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	pdfcolor "github.com/pdfcpu/pdfcpu/pkg/pdfcpu/color"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// How .mark output represents annotations ([mark] annotations).
+const (
+	markNative  = "native"  // ink stamped into the page, highlights as annotations (default)
+	markFlatten = "flatten" // highlights drawn into the page as well, for e-readers
+	markOnly    = "only"    // ink as ink annotations as well, for annotation managers (experimental, see strokes.go)
+)
+
+// validateAnnotations checks the [mark] annotations mode.
+func (c MarkConfig) validateAnnotations() error {
+	switch c.Annotations {
+	case "", markNative, markFlatten, markOnly:
+		return nil
+	}
+	return fmt.Errorf("annotations must be %q, %q or %q, got %q", markNative, markFlatten, markOnly, c.Annotations)
+}
+
+// flatHighlight is a highlight or underline to draw into the page content.
+type flatHighlight struct {
+	underline bool
+	col       pdfcolor.SimpleColor
+	rects     []*types.Rectangle
+}
+
+// markBox is the expanded companion page box that mark overlays are fitted
+// to, in user space, and the page's rotation.
+type markBox struct {
+	llx, lly, urx, ury float64
+	rot                int
+}
+
+// pageBox returns the box of a page whose displayed size is grown to the
+// notebook aspect ratio.
+func pageBox(p companionPage, width, height int) markBox {
+	llx, lly, urx, ury := expandedBox(p.displayed(), width, height)
+	if p.rot%180 != 0 {
+		llx, lly, urx, ury = lly, llx, ury, urx
+	}
+	return markBox{llx: p.x0 + llx, lly: p.y0 + lly, urx: p.x0 + urx, ury: p.y0 + ury, rot: p.rot}
+}
+
+// scale returns the size in points of one notebook pixel.
+func (b markBox) scale(width int) float64 {
+	if b.rot%180 != 0 {
+		return (b.ury - b.lly) / float64(width)
+	}
+	return (b.urx - b.llx) / float64(width)
+}
+
+// point maps notebook pixel coordinates to companion user space.
+func (b markBox) point(x, y float64, width int) (float64, float64) {
+	s := b.scale(width)
+	ux, uy := toUser(b.rot, b.urx-b.llx, b.ury-b.lly, x*s, y*s)
+	return b.llx + ux, b.lly + uy
+}
+
+// inkAnnotations converts the pen strokes of a mark page into ink
+// annotations, one per stroke color, width and pen/marker kind. Strokes are
+// decoded with the identity palette, so their color is their code in p.
+// It fails when the page has no stroke data that reproduces its ink (see
+// pageStrokes); such pages are stamped instead.
+func inkAnnotations(src io.ReaderAt, page Page, width, height int, ppi float64, p *Palette, cs colorSpace, box markBox, markerOpacity float64, markerThreshold byte) ([]model.AnnotationRenderer, error) {
+	strokes, err := pageStrokes(src, page, width, height, ppi, IdentityPalette())
+	if err != nil {
+		return nil, err
+	}
+
+	type group struct {
+		code   byte
+		marker bool
+		width  float64
+	}
+	type inkGroup struct {
+		paths                  []model.InkPath
+		minX, minY, maxX, maxY float64
+	}
+	scale := box.scale(width)
+	groups := make(map[group]*inkGroup)
+	var order []group
+	for _, s := range strokes {
+		g := group{code: s.r, marker: s.r >= markerThreshold, width: math.Round(s.width*scale*4) / 4}
+		ig, ok := groups[g]
+		if !ok {
+			ig = &inkGroup{minX: math.MaxFloat64, minY: math.MaxFloat64, maxX: -math.MaxFloat64, maxY: -math.MaxFloat64}
+			groups[g] = ig
+			order = append(order, g)
+		}
+		path := make(model.InkPath, 0, 2*len(s.points))
+		for _, pt := range s.points {
+			x, y := box.point(pt.x, pt.y, width)
+			path = append(path, x, y)
+			ig.minX, ig.maxX = min(ig.minX, x), max(ig.maxX, x)
+			ig.minY, ig.maxY = min(ig.minY, y), max(ig.maxY, y)
+		}
+		ig.paths = append(ig.paths, path)
+	}
+
+	var anns []model.AnnotationRenderer
+	for i, g := range order {
+		ig := groups[g]
+		pad := max(g.width, 0.25)
+		rect := types.NewRectangle(ig.minX-pad, ig.minY-pad, ig.maxX+pad, ig.maxY+pad)
+		c := p.Colors[g.code]
+		col := cs.annotationColor(pdfcolor.SimpleColor{R: float32(c[0]) / 255, G: float32(c[1]) / 255, B: float32(c[2]) / 255})
+		var ca *float64
+		if g.marker {
+			ca = &markerOpacity
+		}
+		anns = append(anns, model.NewInkAnnotation(
+			*rect, 0, "", fmt.Sprintf("sn_ink_%d_%d", page.Number, i+1), "",
+			0, &col, "", nil, ca, "", "",
+			ig.paths, max(g.width, 0.25), model.BSSolid,
+		))
+	}
+	return anns, nil
+}
+
+// flatHighlightOverlay returns the overlay that draws the highlights of one
+// output page into its content: highlights as rectangles multiplied over the
+// page, so the text stays legible, underlines as lines along the bottom of
+// each rectangle.
+func flatHighlightOverlay(hs []flatHighlight, box markBox, cs colorSpace) markOverlay {
+	boxW, boxH := box.urx-box.llx, box.ury-box.lly
+	content := []byte("q\n1 0 0 1 ")
+	content = appendFloat4(content, -box.llx)
+	content = append(content, ' ')
+	content = appendFloat4(content, -box.lly)
+	content = append(content, " cm\n"...)
+	for _, h := range hs {
+		r, g, b := byte(h.col.R*255+0.5), byte(h.col.G*255+0.5), byte(h.col.B*255+0.5)
+		content = append(content, "q\n"...)
+		if h.underline {
+			content = cs.appendColor(content, r, g, b, true)
+			for _, rect := range h.rects {
+				// Along the displayed bottom edge, which /Rotate moves
+				lw := max(rect.Height()*0.07, 0.75)
+				if box.rot%180 != 0 {
+					lw = max(rect.Width()*0.07, 0.75)
+				}
+				x0, y0, x1, y1 := rect.LL.X, rect.LL.Y+lw/2, rect.UR.X, rect.LL.Y+lw/2
+				switch box.rot {
+				case 90:
+					x0, y0, x1, y1 = rect.UR.X-lw/2, rect.LL.Y, rect.UR.X-lw/2, rect.UR.Y
+				case 180:
+					y0, y1 = rect.UR.Y-lw/2, rect.UR.Y-lw/2
+				case 270:
+					x0, y0, x1, y1 = rect.LL.X+lw/2, rect.LL.Y, rect.LL.X+lw/2, rect.UR.Y
+				}
+				content = appendFloat2(content, lw)
+				content = append(content, " w\n"...)
+				content = appendFloat2(content, x0)
+				content = append(content, ' ')
+				content = appendFloat2(content, y0)
+				content = append(content, " m "...)
+				content = appendFloat2(content, x1)
+				content = append(content, ' ')
+				content = appendFloat2(content, y1)
+				content = append(content, " l S\n"...)
+			}
+		} else {
+			content = append(content, "/GS1 gs\n"...)
+			content = cs.appendColor(content, r, g, b, false)
+			for _, rect := range h.rects {
+				content = appendFloat2(content, rect.LL.X)
+				content = append(content, ' ')
+				content = appendFloat2(content, rect.LL.Y)
+				content = append(content, ' ')
+				content = appendFloat2(content, rect.Width())
+				content = append(content, ' ')
+				content = appendFloat2(content, rect.Height())
+				content = append(content, " re\n"...)
+			}
+			content = append(content, "f\n"...)
+		}
+		content = append(content, "Q\n"...)
+	}
+	content = append(content, "Q\n"...)
+
+	if cs.mode == "icc" {
+		cs.iccID = 6
+	}
+	pageObj := fmt.Sprintf(
+		"3 0 obj\n<< /Type /Page\n   /Parent 2 0 R\n   /MediaBox [0 0 %.2f %.2f]\n   /Contents 4 0 R\n   /Resources << %s/ExtGState << /GS1 5 0 R >> >>\n>>\nendobj\n",
+		boxW, boxH, cs.resources(),
+	)
+	chunk := vectorPageChunk{objects: []pdfObject{
+		{id: 3, data: []byte(pageObj)},
+		contentStreamObject(4, content),
+		{id: 5, data: []byte("5 0 obj\n<< /Type /ExtGState /BM /Multiply >>\nendobj\n")},
+	}}
+	if cs.iccID != 0 {
+		chunk.objects = append(chunk.objects, cs.profileObject())
+	}
+
+	return markOverlay{pdf: onePageVectorPDF(chunk), desc: "pos:c, scale:1 rel, rotation:0"}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+)
+
+// companionNav is the navigation of a companion PDF that its mark output must
+// keep: the outline (bookmarks) and the link annotations of each page.
+//
+// Expanding the page boxes keeps the companion's user space (the new boxes
+// only grow past the original edges), so link rectangles and destinations
+// stay valid without offsetting; they are only at risk of being dropped when
+// the document is rewritten by the stamping passes.
+type companionNav struct {
+	bookmarks []pdfcpu.Bookmark
+	links     map[int]int // page -> number of link annotations
+}
+
+// readCompanionNav reads the outline and link counts of a PDF. Parts that
+// cannot be read are left empty, so they are neither checked nor restored.
+func readCompanionNav(path string) (*companionNav, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	nav := &companionNav{}
+	if nav.bookmarks, err = api.Bookmarks(f, nil); err != nil {
+		logger.Debugf("no outline read from '%s': %v", path, err)
+		nav.bookmarks = nil
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if nav.links, err = linkCounts(f); err != nil {
+		logger.Debugf("no links read from '%s': %v", path, err)
+		nav.links = nil
+	}
+	return nav, nil
+}
+
+// linkCounts returns the number of link annotations on each page of a PDF.
+func linkCounts(rs io.ReadSeeker) (map[int]int, error) {
+	annots, err := api.Annotations(rs, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	links := make(map[int]int)
+	for page, pa := range annots {
+		if n := len(pa[model.AnnLink].Map); n > 0 {
+			links[page] = n
+		}
+	}
+	return links, nil
+}
+
+// countBookmarks returns the number of entries in an outline, nested ones included.
+func countBookmarks(bms []pdfcpu.Bookmark) int {
+	n := len(bms)
+	for _, bm := range bms {
+		n += countBookmarks(bm.Kids)
+	}
+	return n
+}
+
+// restore checks the mark output doc against the companion's navigation. A
+// lost outline is written back; lost links cannot be rebuilt from their
+// counts and are reported as warnings.
+func (nav *companionNav) restore(doc *memPDF, res *Result) error {
+	bookmarks, bmErr := api.Bookmarks(doc.reader(), nil)
+	links, linkErr := linkCounts(doc.reader())
+
+	if want := countBookmarks(nav.bookmarks); want > 0 && (bmErr != nil || countBookmarks(bookmarks) < want) {
+		logger.Debugf("restoring the %d-entry outline of the companion", want)
+		if err := doc.apply(func(rs io.ReadSeeker, w io.Writer) error {
+			return api.AddBookmarks(rs, w, nav.bookmarks, true, nil)
+		}); err != nil {
+			res.warnf(WarnNavigationLost, 0, "the companion's outline was lost and could not be restored: %v", err)
+		}
+	}
+	if linkErr != nil {
+		return nil
+	}
+	for page, want := range nav.links {
+		if got := links[page]; got < want {
+			res.warnf(WarnNavigationLost, page, "%d of %d links were lost", want-got, want)
+		}
+	}
+	res.sort()
+	return nil
+}
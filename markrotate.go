@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"image"
+	"os"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// companionPage is the geometry of one companion PDF page: its visible area
+// (the CropBox, or the MediaBox without one) and rotation. The device shows
+// pages rotated by /Rotate, so mark ink and highlight coordinates are in the
+// displayed orientation and must be turned back into user space.
+type companionPage struct {
+	x0, y0 float64 // lower-left corner of the box in user space
+	w, h   float64 // box size in user space
+	rot    int     // effective /Rotate: 0, 90, 180 or 270
+}
+
+// readCompanionPages returns the visible box and rotation of every page of a PDF.
+func readCompanionPages(path string) ([]companionPage, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	ctx, err := api.ReadAndValidate(f, model.NewDefaultConfiguration())
+	if err != nil {
+		return nil, err
+	}
+	pbs, err := ctx.PageBoundaries(nil)
+	if err != nil {
+		return nil, err
+	}
+	pages := make([]companionPage, len(pbs))
+	for i, pb := range pbs {
+		box := pb.Crop
+		if box == nil || box.Rect == nil {
+			box = pb.Media
+		}
+		if box == nil || box.Rect == nil {
+			return nil, errors.New("page without MediaBox")
+		}
+		r := box.Rect
+		pages[i] = companionPage{x0: r.LL.X, y0: r.LL.Y, w: r.Width(), h: r.Height(), rot: (pb.Rot%360 + 360) % 360}
+	}
+	return pages, nil
+}
+
+// displayed returns the page size as shown, with width and height swapped on
+// pages turned by a quarter.
+func (p companionPage) displayed() types.Dim {
+	if p.rot%180 != 0 {
+		return types.Dim{Width: p.h, Height: p.w}
+	}
+	return types.Dim{Width: p.w, Height: p.h}
+}
+
+// user maps a point of the displayed page, from its top-left corner with y
+// growing downward, to user space.
+func (p companionPage) user(x, y float64) (float64, float64) {
+	ux, uy := toUser(p.rot, p.w, p.h, x, y)
+	return p.x0 + ux, p.y0 + uy
+}
+
+// toUser maps a point of a w x h (user space) box given in its displayed
+// orientation, from the top-left corner with y growing downward, to user space.
+func toUser(rot int, w, h, x, y float64) (float64, float64) {
+	switch rot {
+	case 90:
+		return y, x
+	case 180:
+		return w - x, y
+	case 270:
+		return w - y, h - x
+	}
+	return x, h - y
+}
+
+// rotateMask turns a mask drawn in a page's displayed orientation into its
+// user space orientation, undoing the /Rotate the viewer applies.
+func rotateMask(m *image.Gray, rot int) *image.Gray {
+	if rot == 0 {
+		return m
+	}
+	w, h := m.Rect.Dx(), m.Rect.Dy()
+	var out *image.Gray
+	if rot == 180 {
+		out = image.NewGray(image.Rect(0, 0, w, h))
+	} else {
+		out = image.NewGray(image.Rect(0, 0, h, w))
+	}
+	for y := range out.Rect.Dy() {
+		row := out.Pix[y*out.Stride:]
+		for x := range out.Rect.Dx() {
+			var sx, sy int
+			switch rot {
+			case 90: // shown turned clockwise: turn back counterclockwise
+				sx, sy = w-1-y, x
+			case 180:
+				sx, sy = w-1-x, h-1-y
+			case 270:
+				sx, sy = y, h-1-x
+			}
+			row[x] = m.Pix[sy*m.Stride+sx]
+		}
+	}
+	return out
+}
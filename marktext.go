@@ -0,0 +1,684 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// maxFormDepth bounds the nesting of form XObjects followed by pageTexts, so
+// that a form drawing itself does not recurse forever.
+const maxFormDepth = 8
+
+// shownChar is one character shown on a PDF page, at the center of its glyph
+// box in user space. unknown marks characters whose text or position could not
+// be derived from the font: composite, Type 3 or re-encoded fonts without a
+// ToUnicode map, and fonts without widths beyond Helvetica and Courier.
+type shownChar struct {
+	x, y, size float64
+	s          string
+	unknown    bool
+}
+
+// matrix is a PDF transformation matrix [a b c d e f].
+type matrix [6]float64
+
+var identity = matrix{1, 0, 0, 1, 0, 0}
+
+func (m matrix) mul(n matrix) matrix {
+	return matrix{
+		m[0]*n[0] + m[1]*n[2], m[0]*n[1] + m[1]*n[3],
+		m[2]*n[0] + m[3]*n[2], m[2]*n[1] + m[3]*n[3],
+		m[4]*n[0] + m[5]*n[2] + n[4], m[4]*n[1] + m[5]*n[3] + n[5],
+	}
+}
+
+func (m matrix) apply(x, y float64) (float64, float64) {
+	return x*m[0] + y*m[2] + m[4], x*m[1] + y*m[3] + m[5]
+}
+
+// pageTexts extracts the characters shown on the given pages of a PDF
+// (1-indexed), keyed by page, following form XObjects.
+func pageTexts(pdfPath string, pages []int) (map[int][]shownChar, error) {
+	ctx, err := api.ReadContextFile(pdfPath)
+	if err != nil {
+		return nil, err
+	}
+	x := &textExtractor{ctx: ctx, fonts: make(map[int]*pageFont)}
+	texts := make(map[int][]shownChar)
+	for _, p := range pages {
+		d, _, inh, err := ctx.PageDict(p, true)
+		if err != nil || d == nil {
+			continue
+		}
+		data, err := ctx.PageContent(d, p)
+		if err != nil {
+			continue
+		}
+		var res types.Dict
+		if inh != nil {
+			res = inh.Resources
+		}
+		x.out = nil
+		x.run(data, res, textState{ctm: identity, scale: 1}, 0)
+		texts[p] = x.out
+	}
+	return texts, nil
+}
+
+// pageFont is what placing and decoding the codes of a font takes: a simple
+// font with single-byte codes, or a composite font with the Identity-H
+// encoding, whose two-byte codes are its CIDs.
+type pageFont struct {
+	twoByte   bool
+	firstChar int
+	widths    []float64           // simple font glyph widths, in thousandths of text space
+	cidWidths map[int]float64     // composite font glyph widths
+	missing   float64             // /MissingWidth, or /DW of a composite font
+	std       func(c int) float64 // widths of a standard 14 font without /Widths
+	toUnicode map[int]string
+	encoding  string // WinAnsiEncoding, or "" for codes readable as ASCII only
+	badWidths bool
+	badText   bool
+}
+
+// width returns the advance of code c in thousandths of text space, and false
+// if the font does not say.
+func (f *pageFont) width(c int) (float64, bool) {
+	switch {
+	case f.badWidths:
+		return 0, false
+	case f.twoByte:
+		if w, ok := f.cidWidths[c]; ok {
+			return w, true
+		}
+	case c-f.firstChar >= 0 && c-f.firstChar < len(f.widths):
+		return f.widths[c-f.firstChar], true
+	case f.std != nil:
+		return f.std(c), true
+	}
+	return f.missing, true
+}
+
+// text returns the Unicode text of code c, and false if it is unknown.
+func (f *pageFont) text(c int) (string, bool) {
+	if f.toUnicode != nil {
+		s, ok := f.toUnicode[c]
+		if ok || f.badText || f.twoByte {
+			return s, ok
+		}
+	}
+	if f.badText || f.twoByte {
+		return "", false
+	}
+	switch {
+	case c >= 0x20 && c < 0x7F:
+		return string(rune(c)), true
+	case f.encoding != "WinAnsiEncoding":
+		return "", false
+	case c >= 0xA0:
+		return string(rune(c)), true
+	}
+	for r, b := range winAnsiSpecials {
+		if int(b) == c {
+			return string(r), true
+		}
+	}
+	return "", false
+}
+
+func helveticaCode(c int) float64 {
+	if c >= 32 && c <= 126 {
+		return float64(helveticaWidths[c-32])
+	}
+	return 556
+}
+
+func courierCode(int) float64 { return 600 }
+
+// textExtractor interprets the content streams of one PDF.
+type textExtractor struct {
+	ctx   *model.Context
+	fonts map[int]*pageFont // by object number
+	out   []shownChar
+}
+
+// font loads the font dictionary o, caching indirect ones.
+func (x *textExtractor) font(o types.Object) *pageFont {
+	ref, isRef := o.(types.IndirectRef)
+	if isRef {
+		if f, ok := x.fonts[ref.ObjectNumber.Value()]; ok {
+			return f
+		}
+	}
+	f := x.loadFont(o)
+	if isRef {
+		x.fonts[ref.ObjectNumber.Value()] = f
+	}
+	return f
+}
+
+func (x *textExtractor) loadFont(o types.Object) *pageFont {
+	f := &pageFont{badWidths: true, badText: true}
+	d, err := x.ctx.DereferenceDict(o)
+	if err != nil || d == nil {
+		return f
+	}
+	subtype := d.Subtype()
+	if subtype == nil {
+		return f
+	}
+	switch *subtype {
+	case "Type1", "TrueType", "MMType1":
+		x.simpleFont(f, d)
+	case "Type0":
+		x.compositeFont(f, d)
+	default:
+		return f // Type 3 glyphs have their own matrix
+	}
+	if sd, _, err := x.ctx.DereferenceStreamDict(d["ToUnicode"]); err == nil && sd != nil && sd.Decode() == nil {
+		codeLen := 1
+		if f.twoByte {
+			codeLen = 2
+		}
+		if m, ok := parseToUnicode(sd.Content, codeLen); ok {
+			f.toUnicode, f.badText = m, false
+		}
+	}
+	return f
+}
+
+// simpleFont reads the widths and encoding of a font with single-byte codes.
+func (x *textExtractor) simpleFont(f *pageFont, d types.Dict) {
+	base := ""
+	if n := d.NameEntry("BaseFont"); n != nil {
+		base = *n
+		if i := strings.IndexByte(base, '+'); i == 6 {
+			base = base[i+1:] // subset tag
+		}
+	}
+	if a, err := x.ctx.DereferenceArray(d["Widths"]); err == nil && len(a) > 0 {
+		if fc, err := x.ctx.DereferenceInteger(d["FirstChar"]); err == nil && fc != nil {
+			f.firstChar = fc.Value()
+		}
+		f.widths = make([]float64, len(a))
+		for i, w := range a {
+			f.widths[i], _ = x.ctx.DereferenceNumber(w)
+		}
+		if fd, err := x.ctx.DereferenceDict(d["FontDescriptor"]); err == nil && fd != nil {
+			f.missing, _ = x.ctx.DereferenceNumber(fd["MissingWidth"])
+		}
+		f.badWidths = false
+	} else {
+		switch base {
+		case "Helvetica", "Helvetica-Oblique", "Arial", "Arial-Italic":
+			f.std, f.badWidths = helveticaCode, false
+		case "Courier", "Courier-Bold", "Courier-Oblique", "Courier-BoldOblique":
+			f.std, f.badWidths = courierCode, false
+		}
+	}
+
+	if base == "Symbol" || base == "ZapfDingbats" {
+		return
+	}
+	enc, _ := x.ctx.Dereference(d["Encoding"])
+	switch enc := enc.(type) {
+	case nil:
+		f.badText = false
+	case types.Name:
+		f.encoding, f.badText = string(enc), false
+	case types.Dict:
+		// Differences rename glyphs, so codes say nothing without ToUnicode
+		if _, ok := enc.Find("Differences"); !ok {
+			if n := enc.NameEntry("BaseEncoding"); n != nil {
+				f.encoding = *n
+			}
+			f.badText = false
+		}
+	}
+}
+
+// compositeFont reads the widths of a Type0 font with the Identity-H encoding.
+// Its text comes from its ToUnicode map only.
+func (x *textExtractor) compositeFont(f *pageFont, d types.Dict) {
+	if n := d.NameEntry("Encoding"); n == nil || *n != "Identity-H" {
+		return
+	}
+	f.twoByte = true
+	desc, err := x.ctx.DereferenceArray(d["DescendantFonts"])
+	if err != nil || len(desc) != 1 {
+		return
+	}
+	cid, err := x.ctx.DereferenceDict(desc[0])
+	if err != nil || cid == nil {
+		return
+	}
+	f.missing = 1000
+	if _, ok := cid.Find("DW"); ok {
+		f.missing, _ = x.ctx.DereferenceNumber(cid["DW"])
+	}
+	f.cidWidths = make(map[int]float64)
+	w, _ := x.ctx.DereferenceArray(cid["W"])
+	// W holds "c [w1 w2 ...]" and "cFirst cLast w" entries
+	for i := 0; i < len(w); {
+		first, err := x.ctx.DereferenceNumber(w[i])
+		if err != nil || i+1 >= len(w) {
+			return
+		}
+		if ws, err := x.ctx.DereferenceArray(w[i+1]); err == nil && ws != nil {
+			for k, v := range ws {
+				f.cidWidths[int(first)+k], _ = x.ctx.DereferenceNumber(v)
+			}
+			i += 2
+			continue
+		}
+		if i+2 >= len(w) {
+			return
+		}
+		last, err1 := x.ctx.DereferenceNumber(w[i+1])
+		width, err2 := x.ctx.DereferenceNumber(w[i+2])
+		if err1 != nil || err2 != nil || last-first > 0xFFFF {
+			return
+		}
+		for c := int(first); c <= int(last); c++ {
+			f.cidWidths[c] = width
+		}
+		i += 3
+	}
+	f.badWidths = false
+}
+
+// parseToUnicode reads the bfchar and bfrange mappings of a ToUnicode CMap
+// for a font whose codes are codeLen bytes long. It reports false if a
+// mapping has a source code of another length.
+func parseToUnicode(data []byte, codeLen int) (map[int]string, bool) {
+	m := make(map[int]string)
+	var (
+		section string
+		vals    [][]byte
+		arr     [][]byte
+		inArray bool
+	)
+	code := func(b []byte) (int, bool) {
+		if len(b) != codeLen {
+			return 0, false
+		}
+		c := 0
+		for _, v := range b {
+			c = c<<8 | int(v)
+		}
+		return c, true
+	}
+	utf16String := func(b []byte) string {
+		u := make([]uint16, len(b)/2)
+		for i := range u {
+			u[i] = uint16(b[2*i])<<8 | uint16(b[2*i+1])
+		}
+		return string(utf16.Decode(u))
+	}
+	for i := 0; i < len(data); {
+		c := data[i]
+		switch {
+		case c == '<' && i+1 < len(data) && data[i+1] == '<', c == '>' && i+1 < len(data) && data[i+1] == '>':
+			i += 2
+		case c == '<':
+			s, end := readHexString(data, i)
+			i = end + 1
+			if inArray {
+				arr = append(arr, s)
+				continue
+			}
+			vals = append(vals, s)
+			switch {
+			case section == "bfchar" && len(vals) == 2:
+				src, ok := code(vals[0])
+				if !ok {
+					return nil, false
+				}
+				m[src] = utf16String(vals[1])
+				vals = vals[:0]
+			case section == "bfrange" && len(vals) == 3:
+				lo, ok1 := code(vals[0])
+				hi, ok2 := code(vals[1])
+				dst := vals[2]
+				if !ok1 || !ok2 || len(dst) < 2 {
+					return nil, false
+				}
+				for c := lo; c <= hi; c++ {
+					d := append([]byte(nil), dst...)
+					d[len(d)-1] += byte(c - lo)
+					m[c] = utf16String(d)
+				}
+				vals = vals[:0]
+			}
+		case c == '[':
+			inArray, arr = true, nil
+			i++
+		case c == ']':
+			inArray = false
+			i++
+			if section == "bfrange" && len(vals) == 2 {
+				lo, ok := code(vals[0])
+				if !ok {
+					return nil, false
+				}
+				for k, s := range arr {
+					m[lo+k] = utf16String(s)
+				}
+			}
+			vals = vals[:0]
+		case c == '(':
+			_, end := readLiteralString(data, i)
+			i = end + 1
+		case isDelimAt(data, i):
+			i++
+		default:
+			j := i + 1
+			for j < len(data) && !isDelimAt(data, j) {
+				j++
+			}
+			switch word := string(data[i:j]); word {
+			case "beginbfchar", "beginbfrange":
+				section, vals = strings.TrimPrefix(word, "begin"), vals[:0]
+			case "endbfchar", "endbfrange":
+				section = ""
+			}
+			i = j
+		}
+	}
+	return m, true
+}
+
+// textState is the part of the graphics state that places text.
+type textState struct {
+	ctm                  matrix
+	font                 *pageFont
+	size                 float64
+	charSpace, wordSpace float64
+	scale, leading, rise float64
+}
+
+// run interprets the text operators of a content stream drawn with resources
+// res, appending each shown character with its position to x.out.
+func (x *textExtractor) run(data []byte, res types.Dict, gs textState, depth int) {
+	var (
+		operands []contentToken
+		stack    []textState
+		tm, tlm  = identity, identity
+		lost     bool // glyph advances since the last line start are unknown
+	)
+	nextLine := func(tx, ty float64) {
+		tlm = matrix{1, 0, 0, 1, tx, ty}.mul(tlm)
+		tm, lost = tlm, false
+	}
+	show := func(s []byte) {
+		f := gs.font
+		if f == nil {
+			f = &pageFont{badWidths: true, badText: true}
+		}
+		step := 1
+		if f.twoByte {
+			step = 2
+		}
+		for i := 0; i+step <= len(s); i += step {
+			c := int(s[i])
+			if f.twoByte {
+				c = c<<8 | int(s[i+1])
+			}
+			w, wok := f.width(c)
+			text, tok := f.text(c)
+			trm := tm.mul(gs.ctm)
+			cx, cy := trm.apply(w/1000*gs.size*gs.scale/2, 0.3*gs.size+gs.rise)
+			x.out = append(x.out, shownChar{
+				x: cx, y: cy, size: math.Hypot(trm[2], trm[3]) * gs.size,
+				s: text, unknown: lost || !wok || !tok,
+			})
+			lost = lost || !wok
+			tx := w/1000*gs.size + gs.charSpace
+			if c == ' ' && !f.twoByte {
+				tx += gs.wordSpace // only for the single-byte code 32
+			}
+			tm = matrix{1, 0, 0, 1, tx * gs.scale, 0}.mul(tm)
+		}
+	}
+	num := func(i int) float64 {
+		if i < len(operands) {
+			return operands[i].num
+		}
+		return 0
+	}
+	resource := func(kind, name string) types.Object {
+		d, err := x.ctx.DereferenceDict(res[kind])
+		if err != nil || d == nil {
+			return nil
+		}
+		return d[name]
+	}
+
+	for tok, i := nextContentToken(data, 0); tok.kind != tokEOF; tok, i = nextContentToken(data, i) {
+		if tok.kind != tokOperator {
+			operands = append(operands, tok)
+			continue
+		}
+		switch tok.op {
+		case "q":
+			stack = append(stack, gs)
+		case "Q":
+			if len(stack) > 0 {
+				gs, stack = stack[len(stack)-1], stack[:len(stack)-1]
+			}
+		case "cm":
+			if len(operands) == 6 {
+				gs.ctm = matrix{num(0), num(1), num(2), num(3), num(4), num(5)}.mul(gs.ctm)
+			}
+		case "BT":
+			tm, tlm, lost = identity, identity, false
+		case "Tf":
+			if len(operands) == 2 && operands[0].kind == tokName {
+				gs.font = nil
+				if o := resource("Font", operands[0].name); o != nil {
+					gs.font = x.font(o)
+				}
+			}
+			gs.size = num(1)
+		case "Tc":
+			gs.charSpace = num(0)
+		case "Tw":
+			gs.wordSpace = num(0)
+		case "Tz":
+			gs.scale = num(0) / 100
+		case "TL":
+			gs.leading = num(0)
+		case "Ts":
+			gs.rise = num(0)
+		case "Tm":
+			if len(operands) == 6 {
+				tlm = matrix{num(0), num(1), num(2), num(3), num(4), num(5)}
+				tm, lost = tlm, false
+			}
+		case "Td":
+			nextLine(num(0), num(1))
+		case "TD":
+			gs.leading = -num(1)
+			nextLine(num(0), num(1))
+		case "T*":
+			nextLine(0, -gs.leading)
+		case "Tj", "'", "\"":
+			if tok.op != "Tj" {
+				if tok.op == "\"" && len(operands) == 3 {
+					gs.wordSpace, gs.charSpace = num(0), num(1)
+				}
+				nextLine(0, -gs.leading)
+			}
+			if n := len(operands); n > 0 && operands[n-1].kind == tokString {
+				show(operands[n-1].str)
+			}
+		case "TJ":
+			for _, el := range operands {
+				switch el.kind {
+				case tokString:
+					show(el.str)
+				case tokNumber:
+					// Large negative kerning separates words
+					if el.num <= -200 {
+						x.out = append(x.out, shownChar{s: " "})
+					}
+					tm = matrix{1, 0, 0, 1, -el.num / 1000 * gs.size * gs.scale, 0}.mul(tm)
+				}
+			}
+		case "Do":
+			if len(operands) == 1 && operands[0].kind == tokName && depth < maxFormDepth {
+				x.form(resource("XObject", operands[0].name), res, gs, depth)
+			}
+		case "BI":
+			i = skipInlineImage(data, i)
+		}
+		operands = operands[:0]
+	}
+}
+
+// form runs the content of the form XObject o, if it is one, with the text
+// state of the Do that draws it. Forms without resources use those of their
+// parent.
+func (x *textExtractor) form(o types.Object, parentRes types.Dict, gs textState, depth int) {
+	if o == nil {
+		return
+	}
+	sd, _, err := x.ctx.DereferenceStreamDict(o)
+	if err != nil || sd == nil {
+		return
+	}
+	if st := sd.Subtype(); st == nil || *st != "Form" || sd.Decode() != nil {
+		return
+	}
+	m := identity
+	if a, err := x.ctx.DereferenceArray(sd.Dict["Matrix"]); err == nil && len(a) == 6 {
+		for i, v := range a {
+			m[i], _ = x.ctx.DereferenceNumber(v)
+		}
+	}
+	res := parentRes
+	if d, err := x.ctx.DereferenceDict(sd.Dict["Resources"]); err == nil && d != nil {
+		res = d
+	}
+	gs.ctm = m.mul(gs.ctm)
+	x.run(sd.Content, res, gs, depth+1)
+}
+
+// textInRects returns the text of the characters whose centers fall inside
+// any of the rectangles, in content order, with runs of whitespace collapsed.
+// Characters that are not adjacent on the page are separated by a space. It
+// returns "" if any character on the page could not be placed or decoded, as
+// the rectangles might then cover text that is missing or misplaced.
+func textInRects(chars []shownChar, rects []*types.Rectangle) string {
+	var b strings.Builder
+	var prev *shownChar
+	for i := range chars {
+		c := &chars[i]
+		if c.unknown {
+			return ""
+		}
+		if c.size == 0 { // word break from TJ kerning
+			if prev != nil {
+				b.WriteByte(' ')
+			}
+			continue
+		}
+		inside := false
+		for _, r := range rects {
+			if c.x >= r.LL.X && c.x <= r.UR.X && c.y >= r.LL.Y && c.y <= r.UR.Y {
+				inside = true
+				break
+			}
+		}
+		if !inside {
+			continue
+		}
+		if prev != nil && (math.Abs(c.y-prev.y) > prev.size/2 || math.Abs(c.x-prev.x) > 2*prev.size) {
+			b.WriteByte(' ')
+		}
+		b.WriteString(c.s)
+		prev = c
+	}
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// Content stream tokens, as far as the text operators need them.
+const (
+	tokEOF = iota
+	tokNumber
+	tokString
+	tokName
+	tokOperator
+	tokOther // arrays delimiters, dictionaries
+)
+
+type contentToken struct {
+	kind int
+	num  float64
+	str  []byte
+	name string
+	op   string
+}
+
+// nextContentToken reads the token starting at or after data[i] and returns
+// it with the index just past it. Array brackets are skipped, so the
+// elements of a TJ array become its operands.
+func nextContentToken(data []byte, i int) (contentToken, int) {
+	for i < len(data) {
+		c := data[i]
+		switch {
+		case c == '%':
+			for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+				i++
+			}
+		case c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0 || c == '[' || c == ']':
+			i++
+		case c == '(':
+			s, end := readLiteralString(data, i)
+			return contentToken{kind: tokString, str: s}, end + 1
+		case c == '<' && i+1 < len(data) && data[i+1] == '<', c == '>' && i+1 < len(data) && data[i+1] == '>':
+			return contentToken{kind: tokOther}, i + 2
+		case c == '<':
+			s, end := readHexString(data, i)
+			return contentToken{kind: tokString, str: s}, end + 1
+		case c == '/':
+			j := i + 1
+			for j < len(data) && !isDelimAt(data, j) {
+				j++
+			}
+			return contentToken{kind: tokName, name: string(data[i+1 : j])}, j
+		default:
+			j := i + 1
+			for j < len(data) && !isDelimAt(data, j) {
+				j++
+			}
+			word := string(data[i:j])
+			if v, err := strconv.ParseFloat(word, 64); err == nil {
+				return contentToken{kind: tokNumber, num: v}, j
+			}
+			if !utf8.ValidString(word) {
+				return contentToken{kind: tokOther}, j
+			}
+			return contentToken{kind: tokOperator, op: word}, j
+		}
+	}
+	return contentToken{kind: tokEOF}, i
+}
+
+// skipInlineImage returns the index just past the EI that ends the inline
+// image whose BI operator ends at data[i].
+func skipInlineImage(data []byte, i int) int {
+	for ; i+2 < len(data); i++ {
+		if data[i] == 'E' && data[i+1] == 'I' && isDelimAt(data, i-1) && isDelimAt(data, i+2) {
+			return i + 2
+		}
+	}
+	return len(data)
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// runMigrateOutput implements `gosnare migrate-output --from <old dir>
+// [--config config.toml] [-i <dir> -o <dir>] [--state file] [--dry-run]`.
+// After the output location changes, it moves every output recorded in the
+// old tree's state DB to where the current configuration would write it, and
+// carries its state entry along, so nothing has to be converted again. The
+// new location comes from -i/-o for directory conversions, or from the
+// [watch] targets. Stop the daemon while migrating.
+func runMigrateOutput(args []string) error {
+	fs := flag.NewFlagSet("migrate-output", flag.ExitOnError)
+	var from, stateFile, input, output, configPath string
+	fs.StringVar(&from, "from", "", "Old output directory, with the state DB of its conversions")
+	fs.StringVar(&stateFile, "state", "", "Old state DB file (default: <from>/.gosnare/state.json)")
+	fs.StringVar(&input, "i", "", "Input directory of a directory conversion (with -o)")
+	fs.StringVar(&input, "input", "", "Input directory of a directory conversion (with -o)")
+	fs.StringVar(&output, "o", "", "New output directory of a directory conversion (with -i)")
+	fs.StringVar(&output, "output", "", "New output directory of a directory conversion (with -i)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	dryRun := fs.Bool("dry-run", false, "Only print the moves")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare migrate-output --from <old dir> [--config config.toml] [-i <dir> -o <dir>] [--state file] [--dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if from == "" {
+		fs.Usage()
+		return errors.New("migrate-output needs --from")
+	}
+	if (input == "") != (output == "") {
+		return errors.New("-i and -o must be given together")
+	}
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if input == "" && len(cfg.Watch.Targets()) == 0 {
+		return errors.New("migrate-output needs -i/-o or a [watch] section with targets")
+	}
+
+	// newOutput returns where the current configuration writes source, and
+	// the output root that holds its state DB.
+	newOutput := func(source, oldExt, newExt string) (string, string) {
+		if input != "" {
+			if !isUnderDir(source, input) {
+				return "", ""
+			}
+			return outputPath(source, input, output, oldExt, newExt), output
+		}
+		t := targetFor(source, cfg)
+		if t == nil {
+			return "", ""
+		}
+		out := cfg.targetOutput(*t, source, oldExt, newExt)
+		if cfg.archivesTrash(*t, source) {
+			return out, cfg.Watch.TrashOutput
+		}
+		return out, t.Output
+	}
+
+	old, err := openStateDB(from, stateFile)
+	if err != nil {
+		return fmt.Errorf("opening state DB: %w", err)
+	}
+	dbs := map[string]*stateDB{filepath.Clean(from): old}
+	stateFor := func(root string) (*stateDB, error) {
+		if db, ok := dbs[filepath.Clean(root)]; ok {
+			return db, nil
+		}
+		db, err := openStateDB(root, "")
+		if err == nil {
+			dbs[filepath.Clean(root)] = db
+		}
+		return db, err
+	}
+
+	var moved, unchanged, missing, skipped, failed int
+	entries := old.snapshot()
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+	for _, k := range keys {
+		e := entries[k]
+		src := old.outputPath(k)
+		var dst, root string
+		if strings.HasSuffix(e.Source, ".mark") {
+			dst, root = newOutput(e.Source, ".mark", "")
+		} else {
+			dst, root = newOutput(e.Source, ".note", filepath.Ext(k))
+		}
+		switch {
+		case dst == "":
+			logger.Warnf("Skipping '%s': source '%s' is not under any input directory", k, e.Source)
+			skipped++
+			continue
+		case filepath.Clean(dst) == filepath.Clean(src):
+			unchanged++
+			continue
+		}
+		if !e.Quarantined() {
+			if _, err := os.Stat(src); err != nil {
+				logger.Warnf("Skipping '%s': %v", k, err)
+				missing++
+				continue
+			}
+		}
+		if _, err := os.Stat(dst); err == nil {
+			logger.Errorf("not moving '%s': '%s' already exists", src, dst)
+			failed++
+			continue
+		}
+		if *dryRun {
+			fmt.Printf("%s -> %s\n", src, dst)
+			moved++
+			continue
+		}
+
+		db, err := stateFor(root)
+		if err != nil {
+			return fmt.Errorf("opening state DB: %w", err)
+		}
+		if !e.Quarantined() {
+			if err := moveFile(src, dst); err != nil {
+				logger.Errorf("moving '%s': %v", src, err)
+				failed++
+				continue
+			}
+			removeEmptyParents(filepath.Dir(src), from)
+		}
+		if err := db.put(dst, e); err != nil {
+			return fmt.Errorf("updating state DB: %w", err)
+		}
+		if err := old.remove(src); err != nil {
+			return fmt.Errorf("updating state DB: %w", err)
+		}
+		logger.Infof("Moved '%s' -> '%s'", src, dst)
+		moved++
+	}
+
+	verb := "Moved"
+	if *dryRun {
+		verb = "Would move"
+	}
+	logger.Infof("%s %d outputs (%d already in place, %d missing, %d without a matching input, %d failed)",
+		verb, moved, unchanged, missing, skipped, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d outputs could not be moved", failed)
+	}
+	return nil
+}
+
+// moveFile renames src to dst, creating dst's directory, and falls back to
+// copying across filesystems.
+func moveFile(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err == nil {
+		err = out.Close()
+	} else {
+		out.Close()
+	}
+	if err == nil {
+		// Keep the mtime: it is what up-to-date checks compare with the source
+		err = os.Chtimes(tmp, info.ModTime(), info.ModTime())
+	}
+	if err == nil {
+		err = os.Rename(tmp, dst)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Remove(src)
+}
@@ -0,0 +1,40 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// isMountPoint reports whether path is the root of a mounted filesystem: it
+// lives on a different device than its parent (or is the root directory).
+func isMountPoint(path string) (bool, error) {
+	var st, parent syscall.Stat_t
+	if err := syscall.Stat(path, &st); err != nil {
+		return false, &os.PathError{Op: "stat", Path: path, Err: err}
+	}
+	up := filepath.Join(path, "..")
+	if err := syscall.Stat(up, &parent); err != nil {
+		return false, &os.PathError{Op: "stat", Path: up, Err: err}
+	}
+	return st.Dev != parent.Dev || st.Ino == parent.Ino, nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "/bin/sh", "-c", command)
+}
+
+// deviceMountRoots returns the directories removable volumes and MTP devices
+// are mounted under: /Volumes (macOS), udisks and gvfs mounts (Linux).
+func deviceMountRoots() []string {
+	roots := []string{"/Volumes", "/media", "/mnt", filepath.Join("/run/user", strconv.Itoa(os.Getuid()), "gvfs")}
+	if u := os.Getenv("USER"); u != "" {
+		roots = append(roots, filepath.Join("/media", u), filepath.Join("/run/media", u))
+	}
+	return roots
+}
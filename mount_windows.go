@@ -0,0 +1,48 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// isMountPoint reports whether path is the root of a volume (a drive or a
+// folder mount point).
+func isMountPoint(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		return false, err
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false, err
+	}
+	p, err := windows.UTF16PtrFromString(abs)
+	if err != nil {
+		return false, err
+	}
+	buf := make([]uint16, windows.MAX_PATH+1)
+	if err := windows.GetVolumePathName(p, &buf[0], uint32(len(buf))); err != nil {
+		return false, &os.PathError{Op: "GetVolumePathName", Path: path, Err: err}
+	}
+	vol := strings.TrimSuffix(windows.UTF16ToString(buf), `\`)
+	return strings.EqualFold(vol, strings.TrimSuffix(abs, `\`)), nil
+}
+
+func shellCommand(ctx context.Context, command string) *exec.Cmd {
+	return exec.CommandContext(ctx, "cmd", "/C", command)
+}
+
+// deviceMountRoots returns the drive roots removable volumes appear as.
+func deviceMountRoots() []string {
+	var roots []string
+	for d := 'D'; d <= 'Z'; d++ {
+		roots = append(roots, string(d)+`:\`)
+	}
+	return roots
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"encoding/base64"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -20,27 +22,73 @@ const (
 	MantaPPI    = 300.0
 )
 
+// Link types as stored in the LINKTYPE metadata key.
+const (
+	LinkTypePage = 0
+	LinkTypeFile = 1
+	LinkTypeWeb  = 4
+)
+
 type NoteLink struct {
 	SourcePage int
 	X, Y, W, H int
 	DestPage   int
 	SameFile   bool
+	Type       int
+	FileID     string // LINKFILEID of the destination notebook
+	Target     string // decoded LINKFILE: device path of the destination file, or URL for web links
+}
+
+// NoteTitle is a heading marked on a page with the title lasso tool.
+type NoteTitle struct {
+	Page       int // 0-indexed
+	X, Y, W, H int
+	Level      int // 1 (top level) to 4
+}
+
+// NoteKeyword is a keyword added to a page on the device.
+type NoteKeyword struct {
+	Page int // 0-indexed
+	Text string
 }
 
 type Notebook struct {
 	Signature string
+	Version   int // format version named by the signature, e.g. 20230015
 	Pages     []Page
 	Links     []NoteLink
+	Titles    []NoteTitle
+	Keywords  []NoteKeyword
+	Cover     uint64 // address of the cover image (COVER_1), 0 if the notebook has none
+	Highlight uint64 // address of the .mark highlight data (HIGHLIGHTINFO), 0 if none
 	FileID    string
 	Width     int
 	Height    int
 	PPI       float64
+	Equipment string // APPLY_EQUIPMENT, e.g. "N5"; empty if the header is missing
+	Realtime  bool   // created in real-time recognition mode (FILE_RECOGN_TYPE 1)
+}
+
+// Model returns the device named by the notebook's APPLY_EQUIPMENT, or "" for
+// equipment codes of other (or unknown) devices.
+func (n *Notebook) Model() string {
+	switch n.Equipment {
+	case "N5":
+		return "Manta"
+	case "N6":
+		return "Nomad"
+	}
+	return ""
 }
 
 type Page struct {
-	Addr   uint64
-	Layers []Layer
-	Number int
+	Addr       uint64
+	Layers     []Layer
+	Number     int
+	RecognText uint64 // address of the RECOGNTEXT block, 0 if the page was not recognized
+	TotalPath  uint64 // address of the TOTALPATH (pen stroke) block, 0 if absent
+	Style      string // PAGESTYLE: template name, e.g. "style_8mm_ruled_line" or "user_..."
+	Starred    bool   // FIVESTAR: marked with the five-pointed star on the device
 }
 
 type Layer struct {
@@ -58,37 +106,27 @@ func readUint32(r io.Reader) (uint32, error) {
 	return binary.LittleEndian.Uint32(buf[:]), nil
 }
 
-func getSignature(f *os.File) (string, error) {
-	if _, err := f.Seek(4, io.SeekStart); err != nil {
-		return "", err
-	}
-	var buf [20]byte
-	if _, err := io.ReadFull(f, buf[:]); err != nil {
-		return "", err
-	}
-	return string(buf[:]), nil
+// readFullAt reads len(buf) bytes at off.
+func readFullAt(r io.ReaderAt, buf []byte, off int64) error {
+	_, err := io.ReadFull(io.NewSectionReader(r, off, int64(len(buf))), buf)
+	return err
 }
 
 // parseMetadataBlock reads a metadata block at the given address.
 // The binary format is: 4-byte length, then <KEY1:VALUE1><KEY2:VALUE2>...
-func parseMetadataBlock(f *os.File, addr uint64) (map[string]string, error) {
+func parseMetadataBlock(r io.ReaderAt, addr uint64) (map[string]string, error) {
 	if addr == 0 {
 		return map[string]string{}, nil
 	}
-	if _, err := f.Seek(int64(addr), io.SeekStart); err != nil {
-		return nil, err
-	}
-
-	blockLen, err := readUint32(f)
+	buf, err := readLayerData(r, addr)
 	if err != nil {
 		return nil, err
 	}
+	return parseMetadata(buf), nil
+}
 
-	buf := make([]byte, blockLen)
-	if _, err := io.ReadFull(f, buf); err != nil {
-		return nil, err
-	}
-
+// parseMetadata parses the <KEY:VALUE> pairs of a metadata block's payload.
+func parseMetadata(buf []byte) map[string]string {
 	result := make(map[string]string)
 	i := 0
 	for i < len(buf) {
@@ -132,15 +170,15 @@ func parseMetadataBlock(f *os.File, addr uint64) (map[string]string, error) {
 		result[key] = value
 		i = closeIdx + 1
 	}
-	return result, nil
+	return result
 }
 
 // detectDeviceDimensions checks the header metadata for the Supernote model.
 // "N5" in APPLY_EQUIPMENT = Manta, otherwise Nomad.
-func detectDeviceDimensions(f *os.File, footerMap map[string]string) (int, int, float64, map[string]string) {
+func detectDeviceDimensions(r io.ReaderAt, footerMap map[string]string) (int, int, float64, map[string]string) {
 	if addrStr, ok := footerMap["FILE_FEATURE"]; ok {
 		if addr, err := strconv.ParseUint(addrStr, 10, 64); err == nil {
-			if headerMap, err := parseMetadataBlock(f, addr); err == nil {
+			if headerMap, err := parseMetadataBlock(r, addr); err == nil {
 				if equip, ok := headerMap["APPLY_EQUIPMENT"]; ok && equip == "N5" {
 					return MantaWidth, MantaHeight, MantaPPI, headerMap
 				}
@@ -151,38 +189,109 @@ func detectDeviceDimensions(f *os.File, footerMap map[string]string) (int, int,
 	return NomadWidth, NomadHeight, NomadPPI, nil
 }
 
+// errLockedNote is returned for notebooks locked with a device passcode. Their
+// encryption is not documented, so they cannot be converted.
+var errLockedNote = errors.New("notebook is locked with a passcode; remove the lock on the device to convert it")
+
+// isLockedHeader reports whether the header carries a passcode or encryption
+// flag that is set.
+func isLockedHeader(header map[string]string) bool {
+	for k, v := range header {
+		if !strings.Contains(k, "PASSWORD") && !strings.Contains(k, "ENCRYPT") {
+			continue
+		}
+		if v != "" && v != "0" && v != "none" {
+			return true
+		}
+	}
+	return false
+}
+
+// lockedNoteError explains a footer that cannot be read in a file with a
+// Supernote signature: the notebook is either still being written or locked,
+// whose layout differs. Such files are retried like other failures.
+func lockedNoteError(err error) error {
+	return fmt.Errorf("%w; if the notebook is locked with a passcode, remove the lock on the device to convert it", err)
+}
+
 var defaultLayerOrder = []string{"BGLAYER", "MAINLAYER", "LAYER1", "LAYER2", "LAYER3"}
 
+// ParseNotebook parses the .note or .mark file at path.
 func ParseNotebook(path string) (*Notebook, error) {
 	f, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
 	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return ParseNotebookReader(f, info.Size())
+}
 
-	sig, err := getSignature(f)
+// openNotebook opens and parses the notebook at path. The file is left open
+// for the renderers to read page data from; the caller closes it.
+func openNotebook(path string) (*os.File, *Notebook, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	nb, err := ParseNotebookReader(f, info.Size())
 	if err != nil {
-		return nil, fmt.Errorf("reading signature: %w", err)
+		f.Close()
+		return nil, nil, err
 	}
+	return f, nb, nil
+}
 
-	// Footer address is stored in the last 4 bytes of the file
-	if _, err := f.Seek(-4, io.SeekEnd); err != nil {
+// ParseNotebookReader parses a notebook of size bytes read from r, e.g. an
+// open file, a bytes.Reader over a download or a zip entry. Block addresses
+// in the Notebook refer to r, which the renderers read the page data from.
+func ParseNotebookReader(r io.ReaderAt, size int64) (*Notebook, error) {
+	sig, version, err := readFormatVersion(r)
+	if err != nil {
 		return nil, err
 	}
-	footerAddr, err := readUint32(f)
-	if err != nil {
+
+	// Footer address is stored in the last 4 bytes of the file
+	if size < 4 {
+		return nil, fmt.Errorf("file is too short")
+	}
+	var tail [4]byte
+	if err := readFullAt(r, tail[:], size-4); err != nil {
 		return nil, err
 	}
+	footerAddr := binary.LittleEndian.Uint32(tail[:])
+	if int64(footerAddr) >= size-4 {
+		return nil, lockedNoteError(fmt.Errorf("footer address %d is past the end of the file", footerAddr))
+	}
 
-	footerMap, err := parseMetadataBlock(f, uint64(footerAddr))
+	footerMap, err := parseMetadataBlock(r, uint64(footerAddr))
 	if err != nil {
-		return nil, fmt.Errorf("reading footer: %w", err)
+		return nil, lockedNoteError(fmt.Errorf("reading footer: %w", err))
 	}
 
-	width, height, ppi, headerMap := detectDeviceDimensions(f, footerMap)
-	var fileID string
+	width, height, ppi, headerMap := detectDeviceDimensions(r, footerMap)
+	if headerMap == nil && len(footerMap) == 0 {
+		return nil, lockedNoteError(fmt.Errorf("footer is empty"))
+	}
+	if isLockedHeader(headerMap) {
+		return nil, errLockedNote
+	}
+	var fileID, equipment string
+	var realtime bool
+	var highlight uint64
 	if headerMap != nil {
 		fileID = headerMap["FILE_ID"]
+		equipment = headerMap["APPLY_EQUIPMENT"]
+		realtime = headerMap["FILE_RECOGN_TYPE"] == "1"
+		highlight, _ = strconv.ParseUint(headerMap["HIGHLIGHTINFO"], 10, 64)
 	}
 
 	type pageEntry struct {
@@ -210,7 +319,7 @@ func ParseNotebook(path string) (*Notebook, error) {
 
 	var pages []Page
 	for _, pe := range pageEntries {
-		pageMap, err := parseMetadataBlock(f, pe.addr)
+		pageMap, err := parseMetadataBlock(r, pe.addr)
 		if err != nil {
 			return nil, fmt.Errorf("reading page at %d: %w", pe.addr, err)
 		}
@@ -230,7 +339,7 @@ func ParseNotebook(path string) (*Notebook, error) {
 			if err != nil {
 				continue
 			}
-			data, err := parseMetadataBlock(f, layerAddr)
+			data, err := parseMetadataBlock(r, layerAddr)
 			if err != nil {
 				continue
 			}
@@ -248,23 +357,47 @@ func ParseNotebook(path string) (*Notebook, error) {
 			})
 		}
 
-		pages = append(pages, Page{Addr: pe.addr, Layers: layers, Number: pe.index})
+		var recognText uint64
+		if s, ok := pageMap["RECOGNTEXT"]; ok {
+			recognText, _ = strconv.ParseUint(s, 10, 64)
+		}
+
+		var totalPath uint64
+		if s, ok := pageMap["TOTALPATH"]; ok {
+			totalPath, _ = strconv.ParseUint(s, 10, 64)
+		}
+
+		// FIVESTAR lists the page's stars; unstarred pages have none or "0"
+		star := pageMap["FIVESTAR"]
+		starred := star != "" && star != "0" && star != "none"
+
+		pages = append(pages, Page{Addr: pe.addr, Layers: layers, Number: pe.index, RecognText: recognText, TotalPath: totalPath, Style: pageMap["PAGESTYLE"], Starred: starred})
 	}
 
-	links := parseLinks(f, footerMap, fileID)
+	links := parseLinks(r, footerMap, fileID)
+	titles := parseTitles(r, footerMap)
+	keywords := parseKeywords(r, footerMap)
+	cover, _ := strconv.ParseUint(footerMap["COVER_1"], 10, 64)
 
 	return &Notebook{
 		Signature: sig,
+		Version:   version,
 		Pages:     pages,
 		Links:     links,
+		Titles:    titles,
+		Keywords:  keywords,
+		Cover:     cover,
+		Highlight: highlight,
 		FileID:    fileID,
 		Width:     width,
 		Height:    height,
 		PPI:       ppi,
+		Equipment: equipment,
+		Realtime:  realtime,
 	}, nil
 }
 
-func parseLinks(f *os.File, footerMap map[string]string, fileID string) []NoteLink {
+func parseLinks(r io.ReaderAt, footerMap map[string]string, fileID string) []NoteLink {
 	var links []NoteLink
 outer:
 	for k, v := range footerMap {
@@ -279,7 +412,7 @@ outer:
 		if err != nil {
 			continue
 		}
-		linkMap, err := parseMetadataBlock(f, addr)
+		linkMap, err := parseMetadataBlock(r, addr)
 		if err != nil {
 			continue
 		}
@@ -301,13 +434,26 @@ outer:
 		}
 		x, y, w, h := nums[0], nums[1], nums[2], nums[3]
 
-		// Destination page is 1-indexed in the file format
-		destPageStr, ok := linkMap["OBJPAGE"]
-		if !ok {
-			continue
+		linkType, _ := strconv.Atoi(linkMap["LINKTYPE"])
+
+		// LINKFILE holds the base64-encoded destination path (or URL for web links)
+		var target string
+		if raw, ok := linkMap["LINKFILE"]; ok {
+			if decoded, err := base64.StdEncoding.DecodeString(raw); err == nil {
+				target = string(decoded)
+			} else {
+				target = raw
+			}
 		}
-		destPage, err := strconv.Atoi(destPageStr)
-		if err != nil {
+
+		// Destination page is 1-indexed in the file format; web links have none
+		destPage := 0
+		if destPageStr, ok := linkMap["OBJPAGE"]; ok {
+			destPage, err = strconv.Atoi(destPageStr)
+			if err != nil {
+				continue
+			}
+		} else if linkType != LinkTypeWeb {
 			continue
 		}
 
@@ -321,7 +467,120 @@ outer:
 			H:          h,
 			DestPage:   destPage - 1,
 			SameFile:   sameFile,
+			Type:       linkType,
+			FileID:     linkMap["LINKFILEID"],
+			Target:     target,
 		})
 	}
+
+	slices.SortFunc(links, func(a, b NoteLink) int {
+		if a.SourcePage != b.SourcePage {
+			return a.SourcePage - b.SourcePage
+		}
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
 	return links
 }
+
+// titleStyleLevels maps the TITLESTYLE of headings without a TITLELEVEL to
+// outline levels, in the order the device offers the title styles.
+var titleStyleLevels = map[string]int{"1000254": 1, "1201000": 2, "1000255": 3, "1000000": 4}
+
+// parseTitles reads the headings of the notebook: footer keys TITLE_PPPP...
+// (PPPP the 1-indexed page) point to blocks with the heading's TITLERECT and
+// TITLELEVEL. Headings are returned in reading order.
+func parseTitles(r io.ReaderAt, footerMap map[string]string) []NoteTitle {
+	var titles []NoteTitle
+outer:
+	for k, v := range footerMap {
+		if !strings.HasPrefix(k, "TITLE_") || len(k) < 10 {
+			continue
+		}
+		page, err := strconv.Atoi(k[6:10])
+		if err != nil || page < 1 {
+			continue
+		}
+		addr, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		titleMap, err := parseMetadataBlock(r, addr)
+		if err != nil {
+			continue
+		}
+
+		rectStr, ok := titleMap["TITLERECT"]
+		if !ok {
+			rectStr = titleMap["TITLERECTORI"]
+		}
+		parts := strings.Split(rectStr, ",")
+		if len(parts) != 4 {
+			continue
+		}
+		var nums [4]int
+		for i, p := range parts {
+			if nums[i], err = strconv.Atoi(p); err != nil {
+				continue outer
+			}
+		}
+
+		level, err := strconv.Atoi(titleMap["TITLELEVEL"])
+		if err != nil || level < 1 {
+			level = titleStyleLevels[titleMap["TITLESTYLE"]]
+		}
+		titles = append(titles, NoteTitle{
+			Page:  page - 1,
+			X:     nums[0],
+			Y:     nums[1],
+			W:     nums[2],
+			H:     nums[3],
+			Level: min(max(level, 1), 4),
+		})
+	}
+
+	slices.SortFunc(titles, func(a, b NoteTitle) int {
+		if a.Page != b.Page {
+			return a.Page - b.Page
+		}
+		if a.Y != b.Y {
+			return a.Y - b.Y
+		}
+		return a.X - b.X
+	})
+	return titles
+}
+
+// parseKeywords reads the keywords of the notebook: footer keys KEYWORD_PPPP...
+// (PPPP the 1-indexed page) point to blocks with the keyword's text in
+// KEYWORD. Keywords are returned by page.
+func parseKeywords(r io.ReaderAt, footerMap map[string]string) []NoteKeyword {
+	var keywords []NoteKeyword
+	for k, v := range footerMap {
+		if !strings.HasPrefix(k, "KEYWORD_") || len(k) < 12 {
+			continue
+		}
+		page, err := strconv.Atoi(k[8:12])
+		if err != nil || page < 1 {
+			continue
+		}
+		addr, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			continue
+		}
+		keywordMap, err := parseMetadataBlock(r, addr)
+		if err != nil || keywordMap["KEYWORD"] == "" {
+			continue
+		}
+		keywords = append(keywords, NoteKeyword{Page: page - 1, Text: keywordMap["KEYWORD"]})
+	}
+	slices.SortFunc(keywords, func(a, b NoteKeyword) int {
+		if a.Page != b.Page {
+			return a.Page - b.Page
+		}
+		return strings.Compare(a.Text, b.Text)
+	})
+	return keywords
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// notifyDelay is how long notifications are collected before they are shown,
+// so a burst of conversions (e.g. after a device sync) makes one summary
+// instead of a notification per file.
+const notifyDelay = 2 * time.Second
+
+// notifier shows desktop notifications for watch mode conversions
+// ([watch] notify): notify-send on Linux, osascript on macOS.
+type notifier struct {
+	mu        sync.Mutex
+	converted []string // "Meeting Notes.note (12 pages)"
+	failed    []string // "Meeting Notes.note: <error>"
+	warnings  int
+	timer     *time.Timer
+}
+
+// desktop is the notifier of the watch daemon.
+var desktop = &notifier{}
+
+// conversionDone queues the notification of a finished conversion.
+func (n *notifier) conversionDone(source string, pages, warnings int) {
+	n.queue(func() {
+		n.converted = append(n.converted, fmt.Sprintf("%s (%d pages)", source, pages))
+		n.warnings += warnings
+	})
+}
+
+// conversionFailed queues the notification of a failed conversion.
+func (n *notifier) conversionFailed(source string, err error) {
+	n.queue(func() {
+		n.failed = append(n.failed, fmt.Sprintf("%s: %v", source, err))
+	})
+}
+
+func (n *notifier) queue(add func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	add()
+	if n.timer == nil {
+		n.timer = time.AfterFunc(notifyDelay, n.flush)
+	}
+}
+
+// flush shows the queued events: failures as their own notification, since
+// they need attention, and conversions one by one or summarized.
+func (n *notifier) flush() {
+	n.mu.Lock()
+	converted, failed, warnings := n.converted, n.failed, n.warnings
+	n.converted, n.failed, n.warnings, n.timer = nil, nil, 0, nil
+	n.mu.Unlock()
+
+	switch len(failed) {
+	case 0:
+	case 1:
+		showNotification("GoSNare: conversion failed", failed[0])
+	default:
+		showNotification(fmt.Sprintf("GoSNare: %d conversions failed", len(failed)), listSome(failed, "\n"))
+	}
+
+	var msg string
+	switch len(converted) {
+	case 0:
+		return
+	case 1:
+		msg = "Converted " + converted[0]
+	default:
+		msg = fmt.Sprintf("Converted %d notes: %s", len(converted), listSome(converted, ", "))
+	}
+	if warnings > 0 {
+		msg += fmt.Sprintf(", %d warning(s)", warnings)
+	}
+	showNotification("GoSNare", msg)
+}
+
+// listSome joins the first few items, noting how many were left out.
+func listSome(items []string, sep string) string {
+	const shown = 5
+	if len(items) <= shown {
+		return strings.Join(items, sep)
+	}
+	return strings.Join(items[:shown], sep) + fmt.Sprintf("%sand %d more", sep, len(items)-shown)
+}
+
+// showNotification shows a desktop notification. Failures (no notification
+// daemon, headless server) are only logged at debug level.
+func showNotification(title, body string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "darwin":
+		script := fmt.Sprintf("display notification %s with title %s", appleScriptString(body), appleScriptString(title))
+		cmd = exec.CommandContext(ctx, "osascript", "-e", script)
+	case "windows":
+		logger.Debugf("desktop notifications are not supported on Windows")
+		return
+	default:
+		cmd = exec.CommandContext(ctx, "notify-send", "--app-name=GoSNare", title, body)
+	}
+	if out, err := cmd.CombinedOutput(); err != nil {
+		logger.Debugf("desktop notification: %v %s", err, strings.TrimSpace(string(out)))
+	}
+}
+
+// appleScriptString quotes s as an AppleScript string literal.
+func appleScriptString(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
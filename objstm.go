@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+)
+
+// objStreamSize is the number of objects packed into one object stream.
+// Viewers decompress a whole object stream to read any object in it.
+const objStreamSize = 100
+
+// objectBody returns obj without its "N 0 obj" header and "endobj" trailer,
+// as stored in object streams.
+func objectBody(obj pdfObject) []byte {
+	header := len(fmt.Sprintf("%d 0 obj\n", obj.id))
+	return obj.data[header : len(obj.data)-len("endobj\n")]
+}
+
+// writeXrefStream writes the held-back objects into object streams, numbered
+// after totalObjects, followed by a cross-reference stream and the trailer.
+func (pw *pdfWriter) writeXrefStream(totalObjects int) {
+	nextID := totalObjects + 1
+	for start := 0; start < len(pw.packed); start += objStreamSize {
+		batch := pw.packed[start:min(start+objStreamSize, len(pw.packed))]
+		stmID := nextID
+		nextID++
+
+		var index, body bytes.Buffer
+		for i, obj := range batch {
+			fmt.Fprintf(&index, "%d %d ", obj.id, body.Len())
+			body.Write(objectBody(obj))
+			pw.setEntry(obj.id, xrefEntry{stream: stmID, index: i})
+		}
+		index.WriteByte('\n')
+		first := index.Len()
+		index.Write(body.Bytes())
+
+		compressed, err := compressZlib(index.Bytes())
+		if err != nil {
+			// Fall back to writing the objects directly
+			for _, obj := range batch {
+				pw.setEntry(obj.id, xrefEntry{offset: pw.offset})
+				pw.write(obj.data)
+			}
+			continue
+		}
+		pw.setEntry(stmID, xrefEntry{offset: pw.offset})
+		pw.writeStr(fmt.Sprintf("%d 0 obj\n<< /Type /ObjStm /N %d /First %d /Filter /FlateDecode /Length %d >>\nstream\n",
+			stmID, len(batch), first, len(compressed)))
+		pw.write(compressed)
+		pw.writeStr("\nendstream\nendobj\n")
+	}
+	pw.packed = nil
+
+	// The cross-reference stream is the last object and lists itself
+	xrefID := nextID
+	xrefStart := pw.offset
+	pw.setEntry(xrefID, xrefEntry{offset: xrefStart})
+
+	// Fields: type (1 byte), offset or object stream ID, generation or index (2 bytes)
+	offsetWidth := 4
+	if xrefStart > 0xFFFFFFFF {
+		offsetWidth = 8
+	}
+	rowLen := 1 + offsetWidth + 2
+	rows := make([]byte, rowLen*(xrefID+1))
+	rows[1+offsetWidth], rows[2+offsetWidth] = 0xFF, 0xFF // object 0: free, generation 65535
+	for i, e := range pw.xref[:xrefID] {
+		row := rows[rowLen*(i+1):]
+		field := make([]byte, 8)
+		if e.stream != 0 {
+			row[0] = 2
+			binary.BigEndian.PutUint64(field, uint64(e.stream))
+			binary.BigEndian.PutUint16(row[1+offsetWidth:], uint16(e.index))
+		} else {
+			row[0] = 1
+			binary.BigEndian.PutUint64(field, e.offset)
+		}
+		copy(row[1:], field[8-offsetWidth:])
+	}
+	filter := " /Filter /FlateDecode"
+	data, err := compressZlib(rows)
+	if err != nil {
+		data, filter = rows, ""
+	}
+
+	pw.writeStr(fmt.Sprintf("%d 0 obj\n<< /Type /XRef /Size %d /W [1 %d 2] /Root 1 0 R%s /Length %d >>\nstream\n",
+		xrefID, xrefID+1, offsetWidth, filter, len(data)))
+	pw.write(data)
+	pw.writeStr("\nendstream\nendobj\n")
+	pw.writeStr("startxref\n")
+	pw.writeStr(fmt.Sprintf("%d\n", xrefStart))
+	pw.writeStr("%%EOF\n")
+}
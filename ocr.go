@@ -0,0 +1,193 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// OCRConfig selects an OCR backend that adds an invisible, positioned text
+// layer to note pages, so handwriting is searchable and selectable in any
+// viewer. Off by default.
+type OCRConfig struct {
+	Engine        string  `toml:"engine"`         // "" (off) or "tesseract"
+	Command       string  `toml:"command"`        // engine executable; default: "tesseract" on PATH
+	Languages     string  `toml:"languages"`      // engine language codes, e.g. "eng+ita"; default: "eng"
+	MinConfidence float64 `toml:"min_confidence"` // words recognized with lower confidence (0-100) are dropped
+}
+
+func (c OCRConfig) validate() error {
+	switch c.Engine {
+	case "", "tesseract":
+	default:
+		return fmt.Errorf("engine must be \"tesseract\" or empty, got %q", c.Engine)
+	}
+	if c.MinConfidence < 0 || c.MinConfidence > 100 {
+		return fmt.Errorf("min_confidence must be between 0 and 100, got %g", c.MinConfidence)
+	}
+	return nil
+}
+
+// engine returns the configured OCR engine, or nil if OCR is off.
+func (c OCRConfig) engine() (ocrEngine, error) {
+	if c.Engine == "" {
+		return nil, nil
+	}
+	command := c.Command
+	if command == "" {
+		command = "tesseract"
+	}
+	path, err := exec.LookPath(command)
+	if err != nil {
+		return nil, fmt.Errorf("ocr: %w", err)
+	}
+	languages := c.Languages
+	if languages == "" {
+		languages = "eng"
+	}
+	return tesseractEngine{command: path, languages: languages, minConfidence: c.MinConfidence}, nil
+}
+
+// ocrEngine recognizes the words on a page image of the given resolution.
+type ocrEngine interface {
+	recognize(img *image.Gray, ppi float64) ([]ocrWord, error)
+}
+
+// ocrWord is a recognized word and its bounding box in image pixels.
+type ocrWord struct {
+	text       string
+	x, y, w, h int
+}
+
+// tesseractEngine runs the Tesseract CLI, reading its word boxes from TSV
+// output.
+type tesseractEngine struct {
+	command       string
+	languages     string
+	minConfidence float64
+}
+
+func (t tesseractEngine) recognize(img *image.Gray, ppi float64) ([]ocrWord, error) {
+	var in bytes.Buffer
+	if err := png.Encode(&in, img); err != nil {
+		return nil, err
+	}
+	var out, stderr bytes.Buffer
+	cmd := exec.Command(t.command, "stdin", "stdout", "-l", t.languages, "--dpi", strconv.Itoa(int(ppi)), "tsv")
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = &in, &out, &stderr
+	// Pages are already recognized in parallel; keep each run single-threaded
+	cmd.Env = append(os.Environ(), "OMP_THREAD_LIMIT=1")
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("tesseract: %w: %s", err, msg)
+		}
+		return nil, fmt.Errorf("tesseract: %w", err)
+	}
+	return parseTesseractTSV(out.Bytes(), t.minConfidence)
+}
+
+// parseTesseractTSV returns the words (level 5 rows) of Tesseract TSV output:
+// level, page_num, block_num, par_num, line_num, word_num, left, top, width,
+// height, conf, text.
+func parseTesseractTSV(data []byte, minConfidence float64) ([]ocrWord, error) {
+	var words []ocrWord
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	header := true
+	for sc.Scan() {
+		if header {
+			header = false
+			if !strings.HasPrefix(sc.Text(), "level\t") {
+				return nil, errors.New("tesseract: unexpected TSV output")
+			}
+			continue
+		}
+		fields := strings.Split(sc.Text(), "\t")
+		if len(fields) != 12 || fields[0] != "5" {
+			continue
+		}
+		text := strings.TrimSpace(fields[11])
+		conf, err := strconv.ParseFloat(fields[10], 64)
+		if text == "" || err != nil || conf < minConfidence {
+			continue
+		}
+		var box [4]int
+		for i := range box {
+			if box[i], err = strconv.Atoi(fields[6+i]); err != nil {
+				return nil, fmt.Errorf("tesseract: bad word box %q", sc.Text())
+			}
+		}
+		if box[2] <= 0 || box[3] <= 0 {
+			continue
+		}
+		words = append(words, ocrWord{text: text, x: box[0], y: box[1], w: box[2], h: box[3]})
+	}
+	return words, sc.Err()
+}
+
+// renderInkGray rasterizes a page's ink layers (without the background) in
+// device grays on white, as input for OCR.
+func renderInkGray(src io.ReaderAt, page Page, width, height int) (*image.Gray, error) {
+	rgb := make([]byte, width*height*3)
+	rgb[0] = 0xFF
+	for filled := 1; filled < len(rgb); filled *= 2 {
+		copy(rgb[filled:], rgb[:filled])
+	}
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
+			continue
+		}
+		switch layer.Protocol {
+		case "RATTA_RLE":
+			data, err := readLayerData(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
+			}
+			decodeRLEToRGB(data, rgb, width, height, IdentityPalette())
+		case "PNG":
+			img, err := decodePNGLayer(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("decoding PNG layer %s: %w", layer.Key, err)
+			}
+			compositePNGToRGB(img, rgb, width, height)
+		}
+	}
+
+	gray := image.NewGray(image.Rect(0, 0, width, height))
+	for i := range gray.Pix {
+		gray.Pix[i] = luminance(rgb[3*i], rgb[3*i+1], rgb[3*i+2])
+	}
+	return gray, nil
+}
+
+// appendOCRText appends an invisible text layer (rendering mode 3) with each
+// word scaled to its box, shown in font as font resource /OCR.
+func appendOCRText(buf []byte, words []ocrWord, font textFont, sx, sy, pageHeightPt float64) []byte {
+	buf = append(buf, "BT\n3 Tr\n"...)
+	for _, w := range words {
+		size := float64(w.h) * sy
+		textWidth := font.width(w.text, size)
+		if size <= 0 || textWidth <= 0 {
+			continue
+		}
+		buf = append(buf, "/OCR "...)
+		buf = appendFloat2(buf, size)
+		buf = append(buf, " Tf\n"...)
+		buf = appendFloat2(buf, float64(w.w)*sx/textWidth*100)
+		buf = append(buf, " Tz\n1 0 0 1 "...)
+		buf = appendFloat2(buf, float64(w.x)*sx)
+		buf = append(buf, ' ')
+		buf = appendFloat2(buf, pageHeightPt-float64(w.y+w.h)*sy)
+		buf = append(buf, " Tm\n"...)
+		buf = font.appendString(buf, w.text)
+		buf = append(buf, " Tj\n"...)
+	}
+	return append(buf, "ET\n"...)
+}
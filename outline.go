@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"io"
+	"strings"
+)
+
+// Layout of the contents page, in points (margins and text sizes are those
+// of text-mode exports).
+const (
+	tocTitleSize   = 16.0
+	tocIndent      = 18.0 // per heading level
+	tocNumberWidth = 36.0 // page number column
+	tocInkScale    = 0.6  // headings are shown at 60% of their size on the page
+	tocMaxInkH     = 40.0
+	tocRowGap      = 8.0
+)
+
+// outlineItem is an entry of the PDF outline (bookmarks).
+type outlineItem struct {
+	title    string
+	page     int     // 0-indexed notebook page
+	top      float64 // destination: top of the view, in points from the bottom of the page
+	children []*outlineItem
+}
+
+// heading is a title of the notebook with what is known of its content.
+type heading struct {
+	NoteTitle
+	text string      // recognized by the OCR engine; "" without one
+	ink  *image.Gray // the heading's ink, when needed for the contents page
+}
+
+// readHeadings returns the headings of notebook's pages. With an OCR engine
+// their text is recognized, and with withInk their ink is cropped from the
+// page; pages are rendered once for all their headings. Headings the engine
+// fails on are left without text, with a warning in res.
+func readHeadings(src io.ReaderAt, nb *Notebook, ocr ocrEngine, withInk bool, res *Result) ([]heading, error) {
+	var headings []heading
+	var page *image.Gray
+	pageNum := -1
+	for _, t := range nb.Titles {
+		if t.Page >= len(nb.Pages) {
+			continue
+		}
+		headings = append(headings, heading{NoteTitle: t})
+		if ocr == nil && !withInk {
+			continue
+		}
+		if t.Page != pageNum {
+			var err error
+			if page, err = renderInkGray(src, nb.Pages[t.Page], nb.Width, nb.Height); err != nil {
+				return nil, fmt.Errorf("page %d: %w", t.Page+1, err)
+			}
+			pageNum = t.Page
+		}
+		r := image.Rect(t.X, t.Y, t.X+t.W, t.Y+t.H).Intersect(page.Rect)
+		if r.Empty() {
+			continue
+		}
+		ink := image.NewGray(image.Rect(0, 0, r.Dx(), r.Dy()))
+		for y := range r.Dy() {
+			copy(ink.Pix[y*ink.Stride:], page.Pix[page.PixOffset(r.Min.X, r.Min.Y+y):][:r.Dx()])
+		}
+		h := &headings[len(headings)-1]
+		if withInk {
+			h.ink = ink
+		}
+		if ocr != nil {
+			words, err := ocr.recognize(ink, nb.PPI)
+			if err != nil {
+				res.warnf(WarnOCRFailed, t.Page+1, "heading not recognized: %v", err)
+				continue
+			}
+			var text []string
+			for _, w := range words {
+				text = append(text, w.text)
+			}
+			h.text = strings.Join(text, " ")
+		}
+	}
+	return headings, nil
+}
+
+// headingOutline nests headings by level into outline items titled with
+// their recognized text, or with their page number. scale converts device
+// pixels to points.
+func headingOutline(headings []heading, pageHeightPt, scale float64) []*outlineItem {
+	type open struct {
+		level int
+		item  *outlineItem
+	}
+	var roots []*outlineItem
+	var stack []open
+	unnamed := make(map[int]int) // headings without text per page
+	for _, h := range headings {
+		item := &outlineItem{title: h.text, page: h.Page, top: pageHeightPt - float64(h.Y)*scale}
+		if item.title == "" {
+			unnamed[h.Page]++
+			item.title = fmt.Sprintf("Page %d", h.Page+1)
+			if n := unnamed[h.Page]; n > 1 {
+				item.title += fmt.Sprintf(" (%d)", n)
+			}
+		}
+		for len(stack) > 0 && stack[len(stack)-1].level >= h.Level {
+			stack = stack[:len(stack)-1]
+		}
+		if len(stack) == 0 {
+			roots = append(roots, item)
+		} else {
+			parent := stack[len(stack)-1].item
+			parent.children = append(parent.children, item)
+		}
+		stack = append(stack, open{h.Level, item})
+	}
+	return roots
+}
+
+// starredOutline returns a "Starred" outline item listing the pages marked
+// with the star on the device, or nil if there are none.
+func starredOutline(nb *Notebook, pageHeightPt float64) *outlineItem {
+	var starred *outlineItem
+	for i, page := range nb.Pages {
+		if !page.Starred {
+			continue
+		}
+		item := &outlineItem{title: fmt.Sprintf("Page %d", i+1), page: i, top: pageHeightPt}
+		if starred == nil {
+			starred = &outlineItem{title: "Starred", page: i, top: pageHeightPt}
+		}
+		starred.children = append(starred.children, item)
+	}
+	return starred
+}
+
+// starredPages returns the 1-indexed pages marked with the star.
+func starredPages(nb *Notebook) []int {
+	var pages []int
+	for i, page := range nb.Pages {
+		if page.Starred {
+			pages = append(pages, i+1)
+		}
+	}
+	return pages
+}
+
+// withOutlines adds the outline (root object outlinesID) to the catalog.
+func withOutlines(catalog pdfObject, outlinesID int) pdfObject {
+	i := bytes.LastIndex(catalog.data, []byte("\n>>\nendobj"))
+	if outlinesID == 0 || i < 0 {
+		return catalog
+	}
+	data := append(catalog.data[:i:i], fmt.Appendf(nil, "\n   /Outlines %d 0 R", outlinesID)...)
+	return pdfObject{id: catalog.id, data: append(data, catalog.data[i:]...)}
+}
+
+// outlineObjects returns the outline root, numbered rootID, and its items,
+// numbered from next, linking to the page objects pageObjIDs. Items are
+// open. It returns the next free object ID.
+func outlineObjects(items []*outlineItem, rootID, next int, pageObjIDs []int) ([]pdfObject, int) {
+	ids := make(map[*outlineItem]int)
+	var number func([]*outlineItem)
+	number = func(list []*outlineItem) {
+		for _, it := range list {
+			ids[it] = next
+			next++
+			number(it.children)
+		}
+	}
+	number(items)
+
+	var count func([]*outlineItem) int
+	count = func(list []*outlineItem) int {
+		n := len(list)
+		for _, it := range list {
+			n += count(it.children)
+		}
+		return n
+	}
+
+	objects := []pdfObject{{id: rootID, data: fmt.Appendf(nil, "%d 0 obj\n<< /Type /Outlines /First %d 0 R /Last %d 0 R /Count %d >>\nendobj\n",
+		rootID, ids[items[0]], ids[items[len(items)-1]], count(items))}}
+	var emit func(list []*outlineItem, parent int)
+	emit = func(list []*outlineItem, parent int) {
+		for i, it := range list {
+			id := ids[it]
+			buf := fmt.Appendf(nil, "%d 0 obj\n<< /Title ", id)
+			buf = appendPDFTextString(buf, it.title)
+			buf = fmt.Appendf(buf, "\n   /Parent %d 0 R", parent)
+			if i > 0 {
+				buf = fmt.Appendf(buf, " /Prev %d 0 R", ids[list[i-1]])
+			}
+			if i < len(list)-1 {
+				buf = fmt.Appendf(buf, " /Next %d 0 R", ids[list[i+1]])
+			}
+			if len(it.children) > 0 {
+				buf = fmt.Appendf(buf, "\n   /First %d 0 R /Last %d 0 R /Count %d",
+					ids[it.children[0]], ids[it.children[len(it.children)-1]], count(it.children))
+			}
+			buf = fmt.Appendf(buf, "\n   /Dest [%d 0 R /XYZ null %.2f null] >>\nendobj\n", pageObjIDs[it.page], it.top)
+			objects = append(objects, pdfObject{id: id, data: buf})
+			emit(it.children, id)
+		}
+	}
+	emit(items, rootID)
+	return objects, next
+}
+
+// contentsPages lays out [pdf] toc_page: the headings' ink, indented by level,
+// with their page numbers, each row linking to its heading. Objects are
+// numbered from next; it returns them, the IDs of the contents pages in
+// order and the next free object ID.
+func contentsPages(headings []heading, nb *Notebook, pageW, pageH float64, pageObjIDs []int, next int, cfg *Config) ([]pdfObject, []int, int, error) {
+	regular, bold, err := cfg.Resources.textFonts()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	regularID, boldID := next, next+1
+	next += 2
+	scale := 72.0 / nb.PPI
+
+	var (
+		objects  []pdfObject
+		pageIDs  []int
+		content  []byte
+		xobjects strings.Builder
+		annots   strings.Builder
+		y        float64
+	)
+	flush := func() {
+		pageID, contentsID := next, next+1
+		next += 2
+		pageIDs = append(pageIDs, pageID)
+		objects = append(objects,
+			pdfObject{id: pageID, data: fmt.Appendf(nil,
+				"%d 0 obj\n<< /Type /Page\n   /Parent 2 0 R\n   /MediaBox [0 0 %.2f %.2f]\n   /Contents %d 0 R\n   /Resources << /Font << /F1 %d 0 R /F2 %d 0 R >> /XObject << %s>> >>\n   /Annots [\n%s   ]\n>>\nendobj\n",
+				pageID, pageW, pageH, contentsID, regularID, boldID, xobjects.String(), annots.String())},
+			contentStreamObject(contentsID, content),
+		)
+		content = nil
+		xobjects.Reset()
+		annots.Reset()
+		y = pageH - textMargin
+	}
+
+	y = pageH - textMargin - tocTitleSize
+	content = fmt.Appendf(content, "BT\n/F2 %.1f Tf\n%.2f %.2f Td\n", tocTitleSize, textMargin, y)
+	content = bold.appendString(content, "Contents")
+	content = append(content, " Tj\nET\n"...)
+	y -= 2 * tocRowGap
+
+	for i, h := range headings {
+		indent := float64(h.Level-1) * tocIndent
+		maxW := pageW - 2*textMargin - indent - tocNumberWidth
+		var imgW, imgH float64
+		if h.ink != nil {
+			imgW, imgH = float64(h.ink.Rect.Dx())*scale*tocInkScale, float64(h.ink.Rect.Dy())*scale*tocInkScale
+			if f := min(1, maxW/imgW, tocMaxInkH/imgH); f < 1 {
+				imgW, imgH = imgW*f, imgH*f
+			}
+		}
+		rowH := max(imgH, textFontSize)
+		if y-rowH < textMargin && content != nil {
+			flush()
+		}
+		x := textMargin + indent
+		if h.ink != nil {
+			compressed, err := compressZlib(h.ink.Pix)
+			if err != nil {
+				return nil, nil, 0, err
+			}
+			imgID := next
+			next++
+			var obj bytes.Buffer
+			fmt.Fprintf(&obj, "%d 0 obj\n<< /Type /XObject\n   /Subtype /Image\n   /Width %d\n   /Height %d\n   /ColorSpace /DeviceGray\n   /BitsPerComponent 8\n   /Filter /FlateDecode\n   /Length %d >>\nstream\n",
+				imgID, h.ink.Rect.Dx(), h.ink.Rect.Dy(), len(compressed))
+			obj.Write(compressed)
+			obj.WriteString("\nendstream\nendobj\n")
+			objects = append(objects, pdfObject{id: imgID, data: obj.Bytes()})
+			fmt.Fprintf(&xobjects, "/H%d %d 0 R ", i+1, imgID)
+			content = fmt.Appendf(content, "q\n%.2f 0 0 %.2f %.2f %.2f cm\n/H%d Do\nQ\n", imgW, imgH, x, y-imgH, i+1)
+		} else {
+			content = fmt.Appendf(content, "BT\n/F1 %.1f Tf\n%.2f %.2f Td\n", textFontSize, x, y-textFontSize)
+			content = regular.appendString(content, fmt.Sprintf("Page %d", h.Page+1))
+			content = append(content, " Tj\nET\n"...)
+		}
+		num := fmt.Sprint(h.Page + 1)
+		content = fmt.Appendf(content, "BT\n/F1 %.1f Tf\n%.2f %.2f Td\n", textFontSize, pageW-textMargin-regular.width(num, textFontSize), y-rowH/2-textFontSize/3)
+		content = regular.appendString(content, num)
+		content = append(content, " Tj\nET\n"...)
+		fmt.Fprintf(&annots, "     << /Type /Annot /Subtype /Link /Rect [%.2f %.2f %.2f %.2f] /Border [0 0 0] /A << /S /GoTo /D [%d 0 R /XYZ null %.2f null] >> >>\n",
+			x, y-rowH, pageW-textMargin, y, pageObjIDs[h.Page], pageH-float64(h.Y)*scale)
+		y -= rowH + tocRowGap
+	}
+	flush()
+
+	// Fonts are built once all text is laid out: embedded fonts only include
+	// the glyphs used
+	regularObjs, next, err := regular.objects(regularID, next)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	boldObjs, next, err := bold.objects(boldID, next)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	return append(append(objects, regularObjs...), boldObjs...), pageIDs, next, nil
+}
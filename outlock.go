@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// fileLock is an exclusive advisory lock shared with other GoSNare processes,
+// held on a lock file that is removed again on unlock.
+type fileLock struct {
+	f    *os.File
+	path string
+}
+
+// lockPath acquires the lock file at path, creating it if needed. If wait is
+// false and another process holds the lock, it returns (nil, nil).
+func lockPath(path string, wait bool) (*fileLock, error) {
+	for {
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+		if err != nil {
+			return nil, err
+		}
+		ok, err := lockFile(f, wait)
+		if err != nil || !ok {
+			f.Close()
+			return nil, err
+		}
+		// The previous holder removes the file on unlock; if that happened
+		// while we waited, we locked an unlinked file and must start over.
+		held, err1 := f.Stat()
+		cur, err2 := os.Stat(path)
+		if err1 == nil && err2 == nil && os.SameFile(held, cur) {
+			return &fileLock{f: f, path: path}, nil
+		}
+		f.Close()
+	}
+}
+
+// lockOutput serializes writers of output across processes, so a batch run
+// started while the daemon is active never writes the same PDF concurrently.
+// It waits while another process holds the output. If the filesystem does not
+// support locking, the conversion proceeds unlocked.
+func lockOutput(output string) (unlock func()) {
+	path := filepath.Join(filepath.Dir(output), "."+filepath.Base(output)+".lock")
+	l, err := lockPath(path, false)
+	if err == nil && l == nil {
+		logger.Infof("Waiting for another GoSNare process writing '%s'...", filepath.Base(output))
+		l, err = lockPath(path, true)
+	}
+	if err != nil {
+		logger.Warnf("locking '%s': %v (continuing without lock)", output, err)
+		return func() {}
+	}
+	return l.unlock
+}
+
+// lockDaemon makes sure only one daemon watches into each output directory:
+// two would race on the same PDFs and state DB. It takes
+// <output>/.gosnare/daemon.lock for every directory, holding its PID, and
+// fails naming the running daemon if one is held. Output directories that
+// cannot be locked (unavailable, or locking unsupported) are skipped with a
+// warning.
+func lockDaemon(outDirs []string) (unlock func(), err error) {
+	var held []*fileLock
+	unlock = func() {
+		for _, l := range held {
+			l.unlock()
+		}
+	}
+	for _, dir := range outDirs {
+		path := filepath.Join(dir, ".gosnare", "daemon.lock")
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			logger.Warnf("locking '%s': %v (continuing without lock)", dir, err)
+			continue
+		}
+		l, err := lockPath(path, false)
+		if err != nil {
+			logger.Warnf("locking '%s': %v (continuing without lock)", dir, err)
+			continue
+		}
+		if l == nil {
+			unlock()
+			pid, _ := os.ReadFile(path)
+			if p := strings.TrimSpace(string(pid)); p != "" {
+				return nil, fmt.Errorf("another GoSNare daemon (pid %s) is already watching into '%s'", p, dir)
+			}
+			return nil, fmt.Errorf("another GoSNare daemon is already watching into '%s'", dir)
+		}
+		l.f.Truncate(0)
+		fmt.Fprintf(l.f, "%d\n", os.Getpid())
+		held = append(held, l)
+	}
+	return unlock, nil
+}
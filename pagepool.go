@@ -0,0 +1,39 @@
+package main
+
+import "context"
+
+// pagePool bounds how many pages render at once. Directory mode converts
+// several files concurrently and hands them all one pool, so once only a large
+// notebook is left its pages take over the workers the finished files freed
+// instead of rendering one at a time. Converters given a nil pool render one
+// page at a time.
+type pagePool chan struct{}
+
+func newPagePool(workers int) pagePool {
+	return make(pagePool, max(1, workers))
+}
+
+// orSingle returns p, or a pool of one worker if p is nil.
+func (p pagePool) orSingle() pagePool {
+	if p == nil {
+		return newPagePool(1)
+	}
+	return p
+}
+
+// acquire blocks until the pool has a free worker and takes it. It reports
+// false, without taking one, if quit is closed or ctx is done first.
+func (p pagePool) acquire(ctx context.Context, quit <-chan struct{}) bool {
+	select {
+	case p <- struct{}{}:
+		return true
+	case <-quit:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+// release gives back a worker taken by acquire.
+func (p pagePool) release() {
+	<-p
+}
@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// pageHashVersion is hashed into every page fingerprint. Bump it whenever the
+// objects written for a note page change, so pages of older outputs are
+// re-rendered instead of copied.
+const pageHashVersion = "gosnare-page-6"
+
+// pageHash fingerprints everything that determines the PDF objects of a note
+// page: its layers, the page size, the render settings and its links. It is
+// stored in the page dictionary as /GoSNareHash.
+func pageHash(src io.ReaderAt, page Page, width, height int, pageWidthPt, pageHeightPt float64, noBg bool, cfg *Config, cs colorSpace, links []pdfLink) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %dx%d %.2fx%.2f nobg=%t %s\n%+v\n%+v\n%v\n", pageHashVersion,
+		width, height, pageWidthPt, pageHeightPt, noBg, cs.key(), cfg.Note, cfg.Trace, links)
+	if cfg.OCR.Engine != "" {
+		fmt.Fprintf(h, "ocr %+v\n", cfg.OCR)
+		if cfg.Resources.Font != "" {
+			fmt.Fprintf(h, "ocr font %s\n", cfg.Resources.Font)
+		}
+	}
+	if cfg.PDF.provenance() {
+		// Pages written with a provenance note must not be copied without one
+		fmt.Fprintf(h, "provenance %s\n", cfg.PDF.Provenance)
+	}
+	if cfg.PDF.backgroundLayer(noBg) {
+		h.Write([]byte("background layer\n"))
+	}
+	if m, _ := cfg.PDF.pageMargins(); m != (pageMargins{}) {
+		fmt.Fprintf(h, "margins %+v\n", m)
+	}
+	if o := cfg.PDF.backgroundImage(float64(width) / pageWidthPt * 72); o != (bgImageOptions{}) {
+		fmt.Fprintf(h, "background %+v\n", o)
+	}
+	if cfg.Note.VectorTemplates {
+		fmt.Fprintf(h, "style %s\n", page.Style)
+	}
+	if rule := cfg.Note.backgroundFor(page.Style); rule != nil && !noBg {
+		// The substitute may be edited in place
+		if info, err := os.Stat(rule.File); err == nil {
+			fmt.Fprintf(h, "background %s %d %d\n", rule.File, info.Size(), info.ModTime().UnixNano())
+		}
+	}
+	for _, layer := range page.Layers {
+		fmt.Fprintf(h, "%s %s %s\n", layer.Key, layer.Protocol, layer.LayerType)
+		if layer.BitmapAddress == 0 {
+			continue
+		}
+		data, err := readLayerData(src, layer.BitmapAddress)
+		if err != nil {
+			return "", fmt.Errorf("reading layer %s: %w", layer.Key, err)
+		}
+		fmt.Fprintf(h, "%d\n", len(data))
+		h.Write(data)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// objSpan locates one object of a previous output.
+type objSpan struct {
+	id     int
+	off, n int64
+}
+
+// prevPage is a page of a previous output: its page object and the objects
+// only it references (contents, graphics states, image), by object ID.
+type prevPage struct {
+	page int
+	own  []int
+}
+
+// prevOutput gives access to the pages of an earlier GoSNare output, so pages
+// whose fingerprint did not change are copied instead of re-rendered.
+type prevOutput struct {
+	f      *os.File
+	spans  map[int]objSpan     // objects stored directly in the file
+	packed map[int][]byte      // bodies of objects stored in object streams
+	pages  map[string]prevPage // by page hash
+	order  []string            // page hashes in page order
+	iccID  int                 // shared ICC profile stream, 0 if none
+	ocgID  int                 // shared background layer (OCG), 0 if none
+
+	// Classic xref layout, for incremental updates
+	classic   bool
+	sections  int   // xref sections: 1 plus one per incremental update
+	size      int64 // file size
+	xrefStart int64 // offset of the last xref section
+	nextID    int   // trailer /Size: the next free object ID
+	live      int64 // bytes of the objects in use
+}
+
+var (
+	startxrefRe = regexp.MustCompile(`startxref\s+(\d+)\s*%%EOF\s*$`)
+	pageHashRe  = regexp.MustCompile(`/GoSNareHash <([0-9a-f]+)>`)
+	objRefRe    = regexp.MustCompile(`(\d+) 0 R\b`)
+	xrefStmRe   = regexp.MustCompile(`^(\d+) 0 obj\n<< /Type /XRef /Size (\d+) /W \[1 ([48]) 2\] /Root 1 0 R /Filter /FlateDecode /Length (\d+) >>\nstream\n`)
+	iccObjRe    = regexp.MustCompile(`^\d+ 0 obj\n<< /N [13] /Alternate /Device`)
+	objStmRe    = regexp.MustCompile(`^\d+ 0 obj\n<< /Type /ObjStm /N (\d+) /First (\d+) /Filter /FlateDecode /Length (\d+) >>\nstream\n`)
+	trailerRe   = regexp.MustCompile(`^<< /Size (\d+) /Root 1 0 R(?: /Prev (\d+) /GoSNareUpdate true)? >>$`)
+)
+
+// openPrevOutput indexes the pages of the PDF at path. It returns nil if there
+// is no such file or it was not written by ConvertNoteToPDFVector (including
+// outputs edited by other tools, which append an xref section of their own).
+// Both classic xref tables, with GoSNare's incremental updates, and
+// xref/object streams are understood.
+func openPrevOutput(path string) *prevOutput {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	p, err := indexPrevOutput(f)
+	if err != nil {
+		logger.Debugf("not reusing pages of '%s': %v", path, err)
+		f.Close()
+		return nil
+	}
+	return p
+}
+
+func indexPrevOutput(f *os.File) (*prevOutput, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	size := info.Size()
+
+	tail := make([]byte, min(size, 64))
+	if _, err := f.ReadAt(tail, size-int64(len(tail))); err != nil {
+		return nil, err
+	}
+	m := startxrefRe.FindSubmatch(tail)
+	if m == nil {
+		return nil, fmt.Errorf("no startxref")
+	}
+	xrefStart, _ := strconv.ParseInt(string(m[1]), 10, 64)
+	if xrefStart <= 0 || xrefStart >= size {
+		return nil, fmt.Errorf("bad startxref")
+	}
+
+	xref, err := io.ReadAll(io.NewSectionReader(f, xrefStart, size-xrefStart))
+	if err != nil {
+		return nil, err
+	}
+	p := &prevOutput{f: f, spans: make(map[int]objSpan), packed: make(map[int][]byte), pages: make(map[string]prevPage),
+		size: size, xrefStart: xrefStart}
+
+	// Objects written directly are back to back, so each ends where the next
+	// begins; packed objects are located by object stream and index
+	var spans []objSpan
+	type packedRef struct{ id, stream, index int }
+	var packed []packedRef
+	if bytes.HasPrefix(xref, []byte("xref\n")) {
+		if err := p.indexXrefTables(); err != nil {
+			return nil, err
+		}
+	} else {
+		rows, width, err := readXrefStream(xref)
+		if err != nil {
+			return nil, err
+		}
+		for id := 1; id < len(rows)/width; id++ {
+			row := rows[id*width:]
+			field := int64(0)
+			for _, b := range row[1 : width-2] {
+				field = field<<8 | int64(b)
+			}
+			switch idx := int(row[width-2])<<8 | int(row[width-1]); row[0] {
+			case 1:
+				if field <= 0 || field > xrefStart {
+					return nil, fmt.Errorf("bad xref entry %d", id)
+				}
+				if field < xrefStart {
+					spans = append(spans, objSpan{id: id, off: field})
+				}
+			case 2:
+				packed = append(packed, packedRef{id, int(field), idx})
+			default:
+				return nil, fmt.Errorf("bad xref entry %d", id)
+			}
+		}
+	}
+	slices.SortFunc(spans, func(a, b objSpan) int { return int(a.off - b.off) })
+	for i := range spans {
+		end := xrefStart
+		if i+1 < len(spans) {
+			end = spans[i+1].off
+		}
+		spans[i].n = end - spans[i].off
+		p.spans[spans[i].id] = spans[i]
+	}
+
+	streams := make(map[int][][]byte)
+	for _, pr := range packed {
+		bodies, ok := streams[pr.stream]
+		if !ok {
+			if bodies, err = p.readObjStream(pr.stream); err != nil {
+				return nil, fmt.Errorf("object stream %d: %w", pr.stream, err)
+			}
+			streams[pr.stream] = bodies
+		}
+		if pr.index >= len(bodies) {
+			return nil, fmt.Errorf("object %d: bad object stream index", pr.id)
+		}
+		p.packed[pr.id] = bodies[pr.index]
+	}
+
+	// Page objects are numbered 3..n+2, followed by the objects they own
+	type pageRefs struct {
+		id   int
+		hash string
+		refs []int
+	}
+	var pages []pageRefs
+	for id := 3; ; id++ {
+		data, err := p.object(id)
+		if err != nil || len(data) > 64<<10 {
+			break
+		}
+		if !bytes.HasPrefix(data, fmt.Appendf(nil, "%d 0 obj\n<< /Type /Page\n", id)) {
+			break
+		}
+		pr := pageRefs{id: id}
+		if m := pageHashRe.FindSubmatch(data); m != nil {
+			pr.hash = string(m[1])
+		}
+		for _, m := range objRefRe.FindAllSubmatch(data, -1) {
+			ref, _ := strconv.Atoi(string(m[1]))
+			pr.refs = append(pr.refs, ref)
+		}
+		pages = append(pages, pr)
+		p.order = append(p.order, pr.hash)
+	}
+
+	// A shared ICC profile and background layer follow the page objects; the
+	// rest is owned by pages
+	firstOwned := 3 + len(pages)
+	if data, err := p.object(firstOwned); err == nil && iccObjRe.Match(data) {
+		p.iccID = firstOwned
+		firstOwned++
+	}
+	if data, err := p.object(firstOwned); err == nil && ocgObjRe.Match(data) {
+		p.ocgID = firstOwned
+		firstOwned++
+	}
+	for _, pr := range pages {
+		if pr.hash == "" {
+			continue
+		}
+		pp := prevPage{page: pr.id}
+		for _, ref := range pr.refs {
+			if p.has(ref) && ref >= firstOwned {
+				pp.own = append(pp.own, ref)
+			}
+		}
+		slices.Sort(pp.own)
+		p.pages[pr.hash] = pp
+	}
+	return p, nil
+}
+
+// maxUpdateSections bounds the incremental updates appended to an output; past
+// it the output is rewritten, which also drops superseded objects.
+const maxUpdateSections = 32
+
+// indexXrefTables indexes classic xref tables, starting with the last section
+// and following /Prev through the incremental updates GoSNare appended.
+// Objects are written back to back, so each one ends where the next object
+// (in use or superseded) or xref section begins.
+func (p *prevOutput) indexXrefTables() error {
+	p.classic = true
+	live := make(map[int]int64)
+	var bounds []int64
+	for off := p.xrefStart; ; {
+		entries, trailer, err := readXrefSection(p.f, off, p.size)
+		if err != nil {
+			return err
+		}
+		m := trailerRe.FindStringSubmatch(trailer)
+		if m == nil {
+			return fmt.Errorf("unexpected trailer")
+		}
+		p.sections++
+		if p.sections == 1 {
+			p.nextID, _ = strconv.Atoi(m[1])
+		}
+		bounds = append(bounds, off)
+		for id, o := range entries {
+			if o <= 0 || o >= off {
+				return fmt.Errorf("bad xref entry %d", id)
+			}
+			bounds = append(bounds, o)
+			if _, ok := live[id]; !ok {
+				live[id] = o
+			}
+		}
+		if m[2] == "" {
+			break
+		}
+		prev, _ := strconv.ParseInt(m[2], 10, 64)
+		if prev <= 0 || prev >= off || p.sections > maxUpdateSections*2 {
+			return fmt.Errorf("bad /Prev")
+		}
+		off = prev
+	}
+	if p.nextID < 3 {
+		return fmt.Errorf("unexpected xref table")
+	}
+
+	slices.Sort(bounds)
+	for id := 1; id < p.nextID; id++ {
+		off, ok := live[id]
+		if !ok {
+			return fmt.Errorf("object %d missing from the xref table", id)
+		}
+		next, _ := slices.BinarySearch(bounds, off+1)
+		p.spans[id] = objSpan{id: id, off: off, n: bounds[next] - off}
+		p.live += bounds[next] - off
+	}
+	return nil
+}
+
+// readXrefSection parses the classic xref section at off, returning the offsets
+// of the objects in use by ID and the trailer dictionary.
+func readXrefSection(f *os.File, off, size int64) (map[int]int64, string, error) {
+	br := bufio.NewReader(io.NewSectionReader(f, off, size-off))
+	line := func() string {
+		l, _ := br.ReadString('\n')
+		return strings.TrimRight(l, " \r\n")
+	}
+	if line() != "xref" {
+		return nil, "", fmt.Errorf("unexpected xref table")
+	}
+	entries := make(map[int]int64)
+	for {
+		l := line()
+		if l == "trailer" {
+			break
+		}
+		var start, count int
+		if _, err := fmt.Sscanf(l, "%d %d", &start, &count); err != nil || start < 0 || count <= 0 {
+			return nil, "", fmt.Errorf("unexpected xref table")
+		}
+		for i := range count {
+			row := line()
+			if len(row) != 18 {
+				return nil, "", fmt.Errorf("unexpected xref table")
+			}
+			if row[17] != 'n' {
+				continue
+			}
+			o, err := strconv.ParseInt(row[:10], 10, 64)
+			if err != nil {
+				return nil, "", fmt.Errorf("bad xref entry %d", start+i)
+			}
+			entries[start+i] = o
+		}
+	}
+	return entries, line(), nil
+}
+
+// readXrefStream decodes a cross-reference stream as written by
+// pdfWriter.writeXrefStream, returning its rows and the row width.
+func readXrefStream(xref []byte) ([]byte, int, error) {
+	m := xrefStmRe.FindSubmatch(xref)
+	if m == nil {
+		return nil, 0, fmt.Errorf("unexpected xref section")
+	}
+	count, _ := strconv.Atoi(string(m[2]))
+	width, _ := strconv.Atoi(string(m[3]))
+	width += 3
+	n, _ := strconv.Atoi(string(m[4]))
+	data := xref[len(m[0]):]
+	if n > len(data) || bytes.Contains(data[n:], []byte("/Prev")) {
+		return nil, 0, fmt.Errorf("unexpected xref stream")
+	}
+	rows, err := inflate(data[:n])
+	if err != nil || len(rows) != count*width || count < 3 {
+		return nil, 0, fmt.Errorf("unexpected xref stream")
+	}
+	return rows, width, nil
+}
+
+// readObjStream returns the bodies of the objects in object stream id.
+func (p *prevOutput) readObjStream(id int) ([][]byte, error) {
+	s, ok := p.spans[id]
+	if !ok {
+		return nil, fmt.Errorf("not found")
+	}
+	data := make([]byte, s.n)
+	if _, err := p.f.ReadAt(data, s.off); err != nil {
+		return nil, err
+	}
+	m := objStmRe.FindSubmatch(data)
+	if m == nil {
+		return nil, fmt.Errorf("unexpected object stream")
+	}
+	count, _ := strconv.Atoi(string(m[1]))
+	first, _ := strconv.Atoi(string(m[2]))
+	n, _ := strconv.Atoi(string(m[3]))
+	if len(m[0])+n > len(data) {
+		return nil, fmt.Errorf("truncated object stream")
+	}
+	content, err := inflate(data[len(m[0]) : len(m[0])+n])
+	if err != nil || first > len(content) {
+		return nil, fmt.Errorf("unexpected object stream")
+	}
+
+	index := strings.Fields(string(content[:first]))
+	if len(index) != 2*count {
+		return nil, fmt.Errorf("unexpected object stream index")
+	}
+	offsets := make([]int, count+1)
+	offsets[count] = len(content) - first
+	for i := range count {
+		offsets[i], err = strconv.Atoi(index[2*i+1])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected object stream index")
+		}
+	}
+	bodies := make([][]byte, count)
+	for i := range count {
+		if offsets[i] > offsets[i+1] {
+			return nil, fmt.Errorf("unexpected object stream index")
+		}
+		bodies[i] = content[first+offsets[i] : first+offsets[i+1]]
+	}
+	return bodies, nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
+
+func (p *prevOutput) has(id int) bool {
+	_, direct := p.spans[id]
+	_, packed := p.packed[id]
+	return direct || packed
+}
+
+// object returns object id as written, "<id> 0 obj" through "endobj". Packed
+// objects are reassembled from their object stream body.
+func (p *prevOutput) object(id int) ([]byte, error) {
+	header := fmt.Appendf(nil, "%d 0 obj\n", id)
+	if body, ok := p.packed[id]; ok {
+		return append(append(header, body...), "endobj\n"...), nil
+	}
+	s, ok := p.spans[id]
+	if !ok {
+		return nil, fmt.Errorf("object %d not found", id)
+	}
+	data := make([]byte, s.n)
+	if _, err := p.f.ReadAt(data, s.off); err != nil {
+		return nil, err
+	}
+	if !bytes.HasPrefix(data, header) {
+		return nil, fmt.Errorf("object %d not found at offset %d", id, s.off)
+	}
+	return data, nil
+}
+
+// page returns the previous page with the given fingerprint. A nil
+// *prevOutput has no pages.
+func (p *prevOutput) page(hash string) (prevPage, bool) {
+	if p == nil {
+		return prevPage{}, false
+	}
+	pp, ok := p.pages[hash]
+	return pp, ok
+}
+
+func (p *prevOutput) Close() {
+	if p != nil {
+		p.f.Close()
+	}
+}
+
+// copyPage reads a previous page's objects and renumbers them: the page object
+// becomes pageObjID, the objects it owns objStart, objStart+1, ..., the
+// shared ICC profile iccID and the background layer ocgID. Links keep pointing
+// at the same page numbers, which are part of the fingerprint.
+func (p *prevOutput) copyPage(pp prevPage, pageObjID, objStart, iccID, ocgID int) ([]pdfObject, error) {
+	renumber := make(map[int]int, len(pp.own)+2)
+	for i, id := range pp.own {
+		renumber[id] = objStart + i
+	}
+	if p.iccID != 0 {
+		renumber[p.iccID] = iccID
+	}
+	if p.ocgID != 0 {
+		renumber[p.ocgID] = ocgID
+	}
+
+	// References are rewritten in dictionaries only, never in stream data
+	read := func(id, newID int) ([]byte, error) {
+		data, err := p.object(id)
+		if err != nil {
+			return nil, err
+		}
+		header := fmt.Appendf(nil, "%d 0 obj\n", id)
+		dict, stream := data[len(header):], []byte(nil)
+		if i := bytes.Index(dict, []byte(">>\nstream\n")); i >= 0 {
+			dict, stream = dict[:i], dict[i:]
+		}
+		dict = objRefRe.ReplaceAllFunc(dict, func(ref []byte) []byte {
+			id, _ := strconv.Atoi(string(ref[:bytes.IndexByte(ref, ' ')]))
+			if n, ok := renumber[id]; ok {
+				return fmt.Appendf(nil, "%d 0 R", n)
+			}
+			return ref
+		})
+		out := fmt.Appendf(make([]byte, 0, len(data)+8), "%d 0 obj\n", newID)
+		return append(append(out, dict...), stream...), nil
+	}
+
+	pageData, err := read(pp.page, pageObjID)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := []pdfObject{{id: pageObjID, data: pageData}}
+	for _, id := range pp.own {
+		data, err := read(id, renumber[id])
+		if err != nil {
+			return nil, err
+		}
+		objects = append(objects, pdfObject{id: renumber[id], data: data})
+	}
+	return objects, nil
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// codeColor is a [colors.codes] entry: the output color and opacity of one
+// RLE code, overriding the interpolated palette.
+type codeColor struct {
+	code       byte
+	r, g, b, a byte
+}
+
+// parseCodes parses the [colors.codes] table, sorted by code. Keys are RLE
+// codes in hex ("0x9d") or decimal; values are "#RRGGBB" or "#RRGGBBAA".
+func (c ColorsConfig) parseCodes() ([]codeColor, error) {
+	var codes []codeColor
+	for key, value := range c.Codes {
+		code, err := strconv.ParseUint(key, 0, 8)
+		if err != nil {
+			return nil, fmt.Errorf("%s: not an RLE code (expected e.g. 0x9d)", key)
+		}
+		cc := codeColor{code: byte(code)}
+		if cc.r, cc.g, cc.b, cc.a, err = parseHexRGBA(value); err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		codes = append(codes, cc)
+	}
+	slices.SortFunc(codes, func(a, b codeColor) int { return cmp.Compare(a.code, b.code) })
+	for i := 1; i < len(codes); i++ {
+		if codes[i].code == codes[i-1].code {
+			return nil, fmt.Errorf("code 0x%02x is set twice", codes[i].code)
+		}
+	}
+	return codes, nil
+}
+
+// parseHexRGBA parses "#RRGGBB" (opaque) or "#RRGGBBAA".
+func parseHexRGBA(value string) (r, g, b, a uint8, err error) {
+	a = 0xFF
+	hex := strings.TrimPrefix(value, "#")
+	if len(hex) == 8 {
+		alpha, err := strconv.ParseUint(hex[6:], 16, 8)
+		if err != nil {
+			return 0, 0, 0, 0, fmt.Errorf("invalid alpha in %q", value)
+		}
+		a, hex = byte(alpha), hex[:6]
+	}
+	r, g, b, err = parseHexColor(hex)
+	return r, g, b, a, err
+}
+
+// parseAnchors parses the [[note.anchor]] / [[mark.anchor]] gradient anchors,
+// sorted by position. Positions are RLE codes; colors are "#RRGGBB" or
+// "#RRGGBBAA".
+func (c ColorConfig) parseAnchors() ([]codeColor, error) {
+	if len(c.Anchors) == 0 {
+		return nil, nil
+	}
+	if len(c.Anchors) < 2 {
+		return nil, fmt.Errorf("anchor: a gradient needs at least 2 anchors")
+	}
+	var anchors []codeColor
+	for i, a := range c.Anchors {
+		if a.Position < 0 || a.Position > 255 {
+			return nil, fmt.Errorf("anchor %d: position must be between 0 and 255, got %d", i+1, a.Position)
+		}
+		cc := codeColor{code: byte(a.Position)}
+		var err error
+		if cc.r, cc.g, cc.b, cc.a, err = parseHexRGBA(a.Color); err != nil {
+			return nil, fmt.Errorf("anchor %d: %w", i+1, err)
+		}
+		anchors = append(anchors, cc)
+	}
+	slices.SortFunc(anchors, func(a, b codeColor) int { return cmp.Compare(a.code, b.code) })
+	for i := 1; i < len(anchors); i++ {
+		if anchors[i].code == anchors[i-1].code {
+			return nil, fmt.Errorf("anchor: position %d is set twice", anchors[i].code)
+		}
+	}
+	return anchors, nil
+}
+
+// parseHighlightColors parses the [mark.highlight_colors] table. Keys are the
+// colorType indices of .mark highlights; values are "#RRGGBB".
+func (c MarkConfig) parseHighlightColors() (map[int][3]byte, error) {
+	if len(c.HighlightColors) == 0 {
+		return nil, nil
+	}
+	colors := make(map[int][3]byte, len(c.HighlightColors))
+	for key, value := range c.HighlightColors {
+		colorType, err := strconv.Atoi(key)
+		if err != nil || colorType < 0 {
+			return nil, fmt.Errorf("%s: not a colorType index (expected e.g. 0)", key)
+		}
+		r, g, b, err := parseHexColor(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		colors[colorType] = [3]byte{r, g, b}
+	}
+	return colors, nil
+}
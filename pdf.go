@@ -3,10 +3,12 @@ package main
 import (
 	"bytes"
 	"compress/zlib"
+	"encoding/binary"
 	"image"
+	"image/draw"
 	"image/png"
 	"io"
-	"os"
+	"math"
 	"sync"
 )
 
@@ -23,36 +25,76 @@ var zlibWriterPool = sync.Pool{
 	},
 }
 
-func readLayerData(f *os.File, addr uint64) ([]byte, error) {
-	if _, err := f.Seek(int64(addr), io.SeekStart); err != nil {
+// readLayerData reads the length-prefixed block at addr.
+func readLayerData(r io.ReaderAt, addr uint64) ([]byte, error) {
+	var lenBuf [4]byte
+	if err := readFullAt(r, lenBuf[:], int64(addr)); err != nil {
 		return nil, err
 	}
-	blockLen, err := readUint32(f)
-	if err != nil {
-		return nil, err
-	}
-	data := make([]byte, blockLen)
-	if _, err := io.ReadFull(f, data); err != nil {
+	data := make([]byte, binary.LittleEndian.Uint32(lenBuf[:]))
+	if err := readFullAt(r, data, int64(addr)+4); err != nil {
 		return nil, err
 	}
 	return data, nil
 }
 
-func decodePNGLayer(f *os.File, addr uint64) (image.Image, error) {
-	if _, err := f.Seek(int64(addr), io.SeekStart); err != nil {
-		return nil, err
-	}
-	blockLen, err := readUint32(f)
+func decodePNGLayer(r io.ReaderAt, addr uint64) (image.Image, error) {
+	buf, err := readLayerData(r, addr)
 	if err != nil {
 		return nil, err
 	}
-	buf := make([]byte, blockLen)
-	if _, err := io.ReadFull(f, buf); err != nil {
-		return nil, err
-	}
 	return png.Decode(bytes.NewReader(buf))
 }
 
+// fitBackground maps a background image rendered for a different page size
+// (e.g. a custom template kept after changing the page size on device) onto
+// the width x height canvas: it is scaled uniformly to fit and centered.
+// This is a fallback, not the device's placement: notes are not known to
+// store a template scale or offset, so none is read. Images that already
+// match are returned as-is.
+func fitBackground(img image.Image, width, height int) image.Image {
+	b := img.Bounds()
+	sw, sh := b.Dx(), b.Dy()
+	if (sw == width && sh == height) || sw == 0 || sh == 0 {
+		return img
+	}
+
+	scale := min(float64(width)/float64(sw), float64(height)/float64(sh))
+	dw := max(1, int(math.Round(float64(sw)*scale)))
+	dh := max(1, int(math.Round(float64(sh)*scale)))
+	offX, offY := (width-dw)/2, (height-dh)/2
+
+	src := image.NewNRGBA(image.Rect(0, 0, sw, sh))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+
+	// Bilinear resampling; the destination is positioned at the centering offset
+	dst := image.NewNRGBA(image.Rect(offX, offY, offX+dw, offY+dh))
+	for y := range dh {
+		fy := (float64(y)+0.5)/scale - 0.5
+		y0 := max(0, int(math.Floor(fy)))
+		y1 := min(sh-1, y0+1)
+		wy := min(1, max(0, fy-float64(y0)))
+		for x := range dw {
+			fx := (float64(x)+0.5)/scale - 0.5
+			x0 := max(0, int(math.Floor(fx)))
+			x1 := min(sw-1, x0+1)
+			wx := min(1, max(0, fx-float64(x0)))
+
+			o00 := y0*src.Stride + x0*4
+			o01 := y0*src.Stride + x1*4
+			o10 := y1*src.Stride + x0*4
+			o11 := y1*src.Stride + x1*4
+			d := y*dst.Stride + x*4
+			for c := range 4 {
+				top := float64(src.Pix[o00+c])*(1-wx) + float64(src.Pix[o01+c])*wx
+				bot := float64(src.Pix[o10+c])*(1-wx) + float64(src.Pix[o11+c])*wx
+				dst.Pix[d+c] = byte(top*(1-wy) + bot*wy + 0.5)
+			}
+		}
+	}
+	return dst
+}
+
 // compositePNGToRGB composites a decoded PNG image onto an RGB buffer.
 // Handles NRGBA fast path and generic image fallback.
 func compositePNGToRGB(img image.Image, rgb []byte, width, height int) {
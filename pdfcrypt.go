@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+	"github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+)
+
+// pdfPermissions maps the [pdf] permissions values to the permission bits
+// they grant, for both revisions of the standard security handler.
+var pdfPermissions = map[string]model.PermissionFlags{
+	"print":    model.PermissionPrintRev2 | model.PermissionPrintRev3,
+	"copy":     model.PermissionExtract | model.PermissionExtractRev3,
+	"annotate": model.PermissionModAnnFillForm | model.PermissionFillRev3,
+	"modify":   model.PermissionModify | model.PermissionAssembleRev3,
+}
+
+// encrypted reports whether outputs are password-protected.
+func (c PDFConfig) encrypted() bool {
+	return c.UserPassword != "" || c.OwnerPassword != ""
+}
+
+func (c PDFConfig) validateEncryption() error {
+	for _, p := range c.Permissions {
+		if _, ok := pdfPermissions[p]; !ok && p != "all" {
+			return fmt.Errorf("permissions must be \"print\", \"copy\", \"annotate\", \"modify\" or \"all\", got %q", p)
+		}
+	}
+	if len(c.Permissions) > 0 && !c.encrypted() {
+		return fmt.Errorf("permissions need user_password or owner_password")
+	}
+	return nil
+}
+
+// encryptionConfig returns the pdfcpu configuration that encrypts with AES-256.
+// Without an owner password the user password is used for both, so readers
+// cannot lift the permissions without knowing it.
+func (c PDFConfig) encryptionConfig() *model.Configuration {
+	owner := c.OwnerPassword
+	if owner == "" {
+		owner = c.UserPassword
+	}
+	conf := model.NewAESConfiguration(c.UserPassword, owner, 256)
+	conf.Permissions = model.PermissionsAll
+	if len(c.Permissions) > 0 && !slices.Contains(c.Permissions, "all") {
+		conf.Permissions = model.PermissionsNone
+		for _, p := range c.Permissions {
+			conf.Permissions |= pdfPermissions[p]
+		}
+	}
+	return conf
+}
+
+// encrypt encrypts the document as configured in [pdf].
+func (m *memPDF) encrypt(c PDFConfig) error {
+	return m.apply(func(rs io.ReadSeeker, w io.Writer) error {
+		return api.Encrypt(rs, w, c.encryptionConfig())
+	})
+}
+
+// encryptPDF encrypts the PDF written at path in place, if [pdf] sets a
+// password. Encrypted outputs cannot be reused page by page or updated
+// incrementally by the next conversion.
+func encryptPDF(path string, c PDFConfig) error {
+	if !c.encrypted() {
+		return nil
+	}
+	doc, err := readMemPDF(path)
+	if err != nil {
+		return err
+	}
+	if err := doc.encrypt(c); err != nil {
+		return fmt.Errorf("encrypting: %w", err)
+	}
+	return doc.save(path)
+}
+
+// pdfPageDims returns the page sizes of an output, opening it with the
+// configured passwords when outputs are encrypted.
+func pdfPageDims(path string, c PDFConfig) ([]types.Dim, error) {
+	if !c.encrypted() {
+		return api.PageDimsFile(path)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	conf := model.NewDefaultConfiguration()
+	conf.UserPW, conf.OwnerPW = c.UserPassword, c.OwnerPassword
+	return api.PageDims(f, conf)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// progressRedraw is the minimum interval between redraws of the status line.
+const progressRedraw = 100 * time.Millisecond
+
+// batchProgress drives the interactive status line of a directory conversion:
+// files and pages done, the file currently being converted, throughput and ETA.
+// ETA is estimated from page throughput, since notebook sizes vary widely.
+type batchProgress struct {
+	mu        sync.Mutex
+	start     time.Time
+	lastDraw  time.Time
+	files     int
+	filesDone int
+	pages     int
+	pagesDone int
+	active    map[string]*fileProgress
+	current   string // most recently updated file
+}
+
+type fileProgress struct {
+	done, total int
+}
+
+func newBatchProgress(files, pages int) *batchProgress {
+	return &batchProgress{
+		start:  time.Now(),
+		files:  files,
+		pages:  pages,
+		active: make(map[string]*fileProgress),
+	}
+}
+
+// startFile registers a file (keyed by path) about to be converted with its page count.
+func (b *batchProgress) startFile(name string, pages int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.active[name] = &fileProgress{total: pages}
+	b.current = name
+	b.drawLocked(false)
+}
+
+// page records one rendered page of name. Safe for concurrent use.
+func (b *batchProgress) page(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	fp := b.active[name]
+	if fp == nil || fp.done >= fp.total {
+		return
+	}
+	fp.done++
+	b.pagesDone++
+	b.current = name
+	b.drawLocked(false)
+}
+
+// fileDone completes name, crediting any pages the converter did not report.
+func (b *batchProgress) fileDone(name string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if fp := b.active[name]; fp != nil {
+		b.pagesDone += fp.total - fp.done
+		delete(b.active, name)
+	}
+	b.filesDone++
+	if b.current == name {
+		b.current = ""
+		for n := range b.active {
+			b.current = n
+			break
+		}
+	}
+	b.drawLocked(b.filesDone == b.files)
+}
+
+func (b *batchProgress) drawLocked(force bool) {
+	now := time.Now()
+	if !force && now.Sub(b.lastDraw) < progressRedraw {
+		return
+	}
+	b.lastDraw = now
+	logger.Status(b.lineLocked(now))
+}
+
+func (b *batchProgress) lineLocked(now time.Time) string {
+	const barWidth = 20
+	frac := 0.0
+	if b.pages > 0 {
+		frac = float64(b.pagesDone) / float64(b.pages)
+	} else if b.files > 0 {
+		frac = float64(b.filesDone) / float64(b.files)
+	}
+	filled := int(frac * barWidth)
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", barWidth-filled)
+
+	elapsed := now.Sub(b.start)
+	rate := 0.0
+	if s := elapsed.Seconds(); s > 0 {
+		rate = float64(b.pagesDone) / s
+	}
+	eta := "--"
+	if b.pagesDone > 0 && b.pagesDone < b.pages {
+		remaining := time.Duration(float64(elapsed) / float64(b.pagesDone) * float64(b.pages-b.pagesDone))
+		eta = formatETA(remaining)
+	} else if b.pagesDone >= b.pages {
+		eta = "0s"
+	}
+
+	line := fmt.Sprintf("[%d/%d] %s %3.0f%%  %d/%d pages  %.1f pages/s  ETA %s",
+		b.filesDone, b.files, bar, frac*100, b.pagesDone, b.pages, rate, eta)
+	if fp := b.active[b.current]; fp != nil {
+		line += fmt.Sprintf("  %s (%d/%d)", filepath.Base(b.current), fp.done, fp.total)
+	}
+	return truncateRunes(line, terminalWidth()-1)
+}
+
+// formatETA renders d compactly: 42s, 5m07s, 1h02m.
+func formatETA(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d >= time.Hour:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	case d >= time.Minute:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	}
+}
+
+// terminalWidth returns $COLUMNS, or 100 if unset.
+func terminalWidth() int {
+	if n, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && n > 20 {
+		return n
+	}
+	return 100
+}
+
+func truncateRunes(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	r := []rune(s)
+	return string(r[:n-1]) + "…"
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"path/filepath"
+	"runtime/debug"
+	"time"
+	"unicode/utf16"
+)
+
+// provenance describes how an output was produced. With [pdf] provenance set
+// it is added to the first page as a text annotation, so whoever receives the
+// PDF can trace it back to its source notebook and settings.
+type provenance struct {
+	source    string // source file name
+	converted time.Time
+	version   string
+	settings  string // hash of the settings that shape the output
+}
+
+// newProvenance returns the provenance of converting inputPath with cfg, or
+// nil if [pdf] provenance is off.
+func newProvenance(inputPath string, noBg bool, cfg *Config) *provenance {
+	if !cfg.PDF.provenance() {
+		return nil
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "nobg=%t\n%+v\n%+v\n%+v\n%+v\n", noBg, cfg.Note, cfg.Trace, cfg.PDF, cfg.OCR)
+	return &provenance{
+		source:    filepath.Base(inputPath),
+		converted: time.Now().UTC().Truncate(time.Second),
+		version:   gosnareVersion(),
+		settings:  hex.EncodeToString(h.Sum(nil))[:16],
+	}
+}
+
+// provenance reports whether outputs get a provenance note.
+func (c PDFConfig) provenance() bool {
+	return c.Provenance == "hidden" || c.Provenance == "visible"
+}
+
+// gosnareVersion returns the module version of the running binary, with the
+// VCS revision for development builds.
+func gosnareVersion() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	version := info.Main.Version
+	if version == "" || version == "(devel)" {
+		version = "devel"
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && len(s.Value) >= 12 {
+				version += "+" + s.Value[:12]
+			}
+		}
+	}
+	return version
+}
+
+func (p *provenance) String() string {
+	return fmt.Sprintf("Converted from %s by GoSNare %s on %s (settings %s)",
+		p.source, p.version, p.converted.Format(time.RFC3339), p.settings)
+}
+
+// annotation returns the /Text annotation dictionary placed in the top-left
+// corner of a page of the given height. Hidden annotations are not shown or
+// printed by viewers but remain readable by PDF tools. The fields are also
+// repeated in a /GoSNare dictionary for programs.
+func (p *provenance) annotation(pageHeightPt float64, visible bool) []byte {
+	flags := 2 // Hidden
+	if visible {
+		flags = 0
+	}
+	buf := fmt.Appendf(nil, "<< /Type /Annot /Subtype /Text /Rect [4.00 %.2f 24.00 %.2f] /F %d /Open false /Name /Note\n       /T (GoSNare) /M (%s) /Contents ",
+		pageHeightPt-24, pageHeightPt-4, flags, p.converted.Format("D:20060102150405Z"))
+	buf = appendPDFTextString(buf, p.String())
+	buf = append(buf, "\n       /GoSNare << /Source "...)
+	buf = appendPDFTextString(buf, p.source)
+	buf = fmt.Appendf(buf, " /Converted (%s) /Version ", p.converted.Format(time.RFC3339))
+	buf = appendPDFString(buf, p.version)
+	buf = fmt.Appendf(buf, " /Settings (%s) >> >>", p.settings)
+	return buf
+}
+
+// addAnnotation adds annot to the /Annots array of a page object written by
+// buildVectorPageChunk, creating the array if the page has none.
+func addAnnotation(pageObj, annot []byte) []byte {
+	if i := bytes.Index(pageObj, []byte("/Annots [\n")); i >= 0 {
+		i += len("/Annots [\n")
+		out := append(pageObj[:i:i], "     "...)
+		out = append(out, annot...)
+		out = append(out, '\n')
+		return append(out, pageObj[i:]...)
+	}
+	i := bytes.LastIndex(pageObj, []byte("\n>>\nendobj"))
+	if i < 0 {
+		return pageObj
+	}
+	out := append(pageObj[:i:i], "\n   /Annots [\n     "...)
+	out = append(out, annot...)
+	out = append(out, "\n   ]"...)
+	return append(out, pageObj[i:]...)
+}
+
+// appendPDFTextString appends s as a PDF text string: a literal string when
+// it is plain ASCII, UTF-16BE with a byte order mark otherwise.
+func appendPDFTextString(buf []byte, s string) []byte {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] < 32 || s[i] > 126 {
+			ascii = false
+			break
+		}
+	}
+	if ascii {
+		return appendPDFString(buf, s)
+	}
+	buf = append(buf, "<FEFF"...)
+	for _, u := range utf16.Encode([]rune(s)) {
+		buf = fmt.Appendf(buf, "%04X", u)
+	}
+	return append(buf, '>')
+}
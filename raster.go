@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/dennwc/gotrace"
+)
+
+// defaultRasterThreshold is the number of traced path segments above which
+// raster = "auto" embeds a page as an image. Heavy shading and pencil
+// texture trace into hundreds of thousands of segments, handwriting into a
+// few thousand.
+const defaultRasterThreshold = 100000
+
+// rasterThreshold returns the segment count above which a page is rasterized
+// in auto mode.
+func (t TraceConfig) rasterThreshold() int {
+	if t.RasterThreshold > 0 {
+		return t.RasterThreshold
+	}
+	return defaultRasterThreshold
+}
+
+// rasterize reports whether a page traced into layers is embedded as an image
+// instead of vectors.
+func (t TraceConfig) rasterize(layers []colorLayer) bool {
+	switch t.Raster {
+	case "always":
+		return true
+	case "auto":
+		return pathSegments(layers) > t.rasterThreshold()
+	}
+	return false
+}
+
+// pathSegments counts the curve segments of all traced paths, holes and
+// islands included: it is what the content stream size grows with.
+func pathSegments(layers []colorLayer) int {
+	var count func(paths []gotrace.Path) int
+	count = func(paths []gotrace.Path) int {
+		n := 0
+		for _, p := range paths {
+			n += len(p.Curve) + count(p.Childs)
+		}
+		return n
+	}
+	n := 0
+	for _, l := range layers {
+		n += count(l.paths)
+	}
+	return n
+}
+
+// renderRasterPage composites a page's ink layers over bgRGB (or white when
+// nil) into one RGB image, drawn with the same colors as the traced vectors:
+// markers are blended at their opacity and white ink is left out.
+func renderRasterPage(src io.ReaderAt, page Page, width, height int, p *Palette, bgRGB []byte) ([]byte, error) {
+	rgb := make([]byte, width*height*3)
+	if bgRGB != nil {
+		copy(rgb, bgRGB)
+	} else {
+		rgb[0] = 0xFF
+		for filled := 1; filled < len(rgb); filled *= 2 {
+			copy(rgb[filled:], rgb[:filled])
+		}
+	}
+
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
+			continue
+		}
+		switch layer.Protocol {
+		case "RATTA_RLE":
+			data, err := readLayerData(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
+			}
+			compositeRLEToRGB(data, rgb, width, height, p)
+		case "PNG":
+			img, err := decodePNGLayer(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("decoding PNG layer %s: %w", layer.Key, err)
+			}
+			compositePNGToRGB(img, rgb, width, height)
+		}
+	}
+	return rgb, nil
+}
+
+// renderPageImage renders a page at the device resolution, background
+// included unless noBg, for the image-based output formats. PNG background
+// substitutes apply; PDF ones cannot be rasterized, so such pages keep the
+// device's background.
+func renderPageImage(src io.ReaderAt, page Page, width, height int, noBg bool, p *Palette, cfg NoteConfig, images *backgroundImages) (image.Image, error) {
+	var bgRGB []byte
+	if !noBg {
+		var pdfFile string
+		var err error
+		if bgRGB, pdfFile, err = pageBackground(src, page, width, height, p, cfg, images); err == nil && pdfFile != "" {
+			bgRGB, err = renderBGLayerRGB(src, page, width, height, p)
+			bgRGB = cfg.fadeBackground(bgRGB)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("rendering background: %w", err)
+		}
+	}
+	rgb, err := renderRasterPage(src, page, width, height, p, bgRGB)
+	if err != nil {
+		return nil, err
+	}
+	return rgbImage(rgb, width, height), nil
+}
+
+// rgbImage wraps a packed RGB buffer as an image, gray when every pixel is
+// neutral so that black-and-white pages encode to a third of the size.
+func rgbImage(rgb []byte, width, height int) image.Image {
+	gray := true
+	for j := 0; j < len(rgb); j += 3 {
+		if rgb[j] != rgb[j+1] || rgb[j] != rgb[j+2] {
+			gray = false
+			break
+		}
+	}
+	if gray {
+		img := image.NewGray(image.Rect(0, 0, width, height))
+		for j := range img.Pix {
+			img.Pix[j] = rgb[j*3]
+		}
+		return img
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	for j := range width * height {
+		copy(img.Pix[j*4:], rgb[j*3:j*3+3])
+		img.Pix[j*4+3] = 0xFF
+	}
+	return img
+}
+
+// rasterMode is the --raster flag: "--raster" embeds every page as an image,
+// "--raster=auto" only pages that trace into too many paths.
+type rasterMode string
+
+func (m *rasterMode) String() string { return string(*m) }
+
+func (m *rasterMode) Set(v string) error {
+	switch v {
+	case "true", "always":
+		*m = "always"
+	case "auto":
+		*m = "auto"
+	case "false", "never":
+		*m = "never"
+	default:
+		return fmt.Errorf("must be always, auto or never")
+	}
+	return nil
+}
+
+func (m *rasterMode) IsBoolFlag() bool { return true }
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// shingleSize is the number of bytes per text shingle used for page similarity.
+const shingleSize = 5
+
+// pageFingerprint is a set of hashed shingles describing one PDF page.
+type pageFingerprint map[uint64]struct{}
+
+// runReanchor implements `gosnare reanchor`: it maps the pages of the PDF a
+// .mark was exported against onto a newer revision of the companion PDF and
+// re-stamps overlays and highlights onto the matching pages.
+func runReanchor(args []string) error {
+	fs := flag.NewFlagSet("reanchor", flag.ExitOnError)
+	var markPath, annotated, revision, output, configPath string
+	var threshold float64
+	var dryRun bool
+	fs.StringVar(&markPath, "mark", "", "The .mark file holding the annotations")
+	fs.StringVar(&annotated, "annotated", "", "Previously exported annotated PDF (or the old companion PDF)")
+	fs.StringVar(&revision, "pdf", "", "New revision of the companion PDF")
+	fs.StringVar(&output, "o", "", "Output PDF")
+	fs.StringVar(&output, "output", "", "Output PDF")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	fs.Float64Var(&threshold, "threshold", 0.5, "Minimum page similarity (0-1) to carry annotations over")
+	fs.BoolVar(&dryRun, "dry-run", false, "Print the page mapping without writing output")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare reanchor --mark <file.pdf.mark> --annotated <old.pdf> --pdf <new.pdf> -o <out.pdf> [--threshold 0.5] [--dry-run]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if markPath == "" || annotated == "" || revision == "" || (output == "" && !dryRun) {
+		fs.Usage()
+		return fmt.Errorf("--mark, --annotated, --pdf and -o are required")
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	oldPages, err := pdfPageFingerprints(annotated)
+	if err != nil {
+		return fmt.Errorf("fingerprinting '%s': %w", annotated, err)
+	}
+	newPages, err := pdfPageFingerprints(revision)
+	if err != nil {
+		return fmt.Errorf("fingerprinting '%s': %w", revision, err)
+	}
+
+	pageMap, scores := alignPages(oldPages, newPages, threshold)
+
+	src, notebook, err := openNotebook(markPath)
+	if err != nil {
+		return fmt.Errorf("parsing mark file: %w", err)
+	}
+	annotations, err := parseMarkAnnotations(src, notebook)
+	src.Close()
+	if err != nil {
+		return fmt.Errorf("parsing mark annotations: %w", err)
+	}
+	hasMarks := make(map[int]bool)
+	for _, p := range notebook.Pages {
+		hasMarks[p.Number] = true
+	}
+	for idx := range annotations {
+		hasMarks[idx+1] = true
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OLD PAGE\tNEW PAGE\tSIMILARITY")
+	var orphaned []int
+	for page := 1; page <= len(oldPages); page++ {
+		if !hasMarks[page] {
+			continue
+		}
+		if target, ok := pageMap[page]; ok {
+			fmt.Fprintf(tw, "%d\t%d\t%.2f\n", page, target, scores[page])
+		} else {
+			fmt.Fprintf(tw, "%d\t-\t-\n", page)
+			orphaned = append(orphaned, page)
+		}
+	}
+	tw.Flush()
+
+	if len(orphaned) > 0 {
+		logger.Warnf("%d annotated page(s) have no match in the new revision and will be dropped: %v", len(orphaned), orphaned)
+	}
+	if dryRun {
+		return nil
+	}
+
+	res := &Result{}
+	if err := convertMarkToPDFVector(context.Background(), markPath, revision, output, newPagePool(cfg.Performance.WorkerCount()), cfg, pageMap, nil, res); err != nil {
+		return err
+	}
+	for _, w := range res.Warnings {
+		logger.Warnf("'%s' %s", markPath, w)
+	}
+	logger.Infof("Re-anchored '%s' onto '%s' -> '%s'", markPath, revision, output)
+	return nil
+}
+
+var contentPageRe = regexp.MustCompile(`_page_(\d+)\.txt$`)
+
+// pdfPageFingerprints extracts each page's content stream via pdfcpu and
+// fingerprints it. Pages with text are fingerprinted by their shown strings;
+// text-less pages fall back to their raw content stream.
+func pdfPageFingerprints(path string) ([]pageFingerprint, error) {
+	dims, err := api.PageDimsFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "gosnare-reanchor-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err := api.ExtractContentFile(path, tmpDir, nil, nil); err != nil {
+		return nil, err
+	}
+
+	pages := make([]pageFingerprint, len(dims))
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return nil, err
+	}
+	for _, e := range entries {
+		m := contentPageRe.FindStringSubmatch(e.Name())
+		if m == nil {
+			continue
+		}
+		n, _ := strconv.Atoi(m[1])
+		if n < 1 || n > len(pages) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(tmpDir, e.Name()))
+		if err != nil {
+			return nil, err
+		}
+		text := contentStreamText(data)
+		if len(text) < shingleSize {
+			text = data
+		}
+		pages[n-1] = shingles(text)
+	}
+	return pages, nil
+}
+
+// contentStreamText concatenates the string operands inside BT/ET text objects
+// of a PDF content stream (literal and hex strings), dropping whitespace so
+// TJ kerning splits do not affect the result.
+func contentStreamText(data []byte) []byte {
+	var out []byte
+	inText := false
+	for i := 0; i < len(data); i++ {
+		c := data[i]
+		switch {
+		case c == '%':
+			for i < len(data) && data[i] != '\n' && data[i] != '\r' {
+				i++
+			}
+		case c == 'B' && i+1 < len(data) && data[i+1] == 'T' && isDelimAt(data, i-1) && isDelimAt(data, i+2):
+			inText = true
+			i++
+		case c == 'E' && i+1 < len(data) && data[i+1] == 'T' && isDelimAt(data, i-1) && isDelimAt(data, i+2):
+			inText = false
+			i++
+		case c == '(':
+			var s []byte
+			s, i = readLiteralString(data, i)
+			if inText {
+				out = appendNonSpace(out, s)
+			}
+		case c == '<' && i+1 < len(data) && data[i+1] != '<':
+			var s []byte
+			s, i = readHexString(data, i)
+			if inText {
+				out = appendNonSpace(out, s)
+			}
+		case c == '<' || c == '>':
+			i++ // dictionary delimiters << >>
+		}
+	}
+	return out
+}
+
+func isDelimAt(data []byte, i int) bool {
+	if i < 0 || i >= len(data) {
+		return true
+	}
+	switch data[i] {
+	case ' ', '\n', '\r', '\t', '\f', 0, '[', ']', '(', ')', '<', '>', '/', '%':
+		return true
+	}
+	return false
+}
+
+// readLiteralString reads a (...) string starting at data[start] == '('.
+// Returns the decoded bytes and the index of the closing parenthesis.
+func readLiteralString(data []byte, start int) ([]byte, int) {
+	var s []byte
+	depth := 0
+	for i := start; i < len(data); i++ {
+		c := data[i]
+		switch c {
+		case '\\':
+			if i+1 < len(data) {
+				i++
+				switch data[i] {
+				case 'n':
+					s = append(s, '\n')
+				case 'r':
+					s = append(s, '\r')
+				case 't':
+					s = append(s, '\t')
+				case 'b', 'f':
+				case '0', '1', '2', '3', '4', '5', '6', '7':
+					v := 0
+					j := i
+					for ; j < len(data) && j < i+3 && data[j] >= '0' && data[j] <= '7'; j++ {
+						v = v*8 + int(data[j]-'0')
+					}
+					s = append(s, byte(v))
+					i = j - 1
+				default:
+					s = append(s, data[i])
+				}
+			}
+		case '(':
+			if depth > 0 {
+				s = append(s, c)
+			}
+			depth++
+		case ')':
+			depth--
+			if depth == 0 {
+				return s, i
+			}
+			s = append(s, c)
+		default:
+			s = append(s, c)
+		}
+	}
+	return s, len(data)
+}
+
+// readHexString reads a <...> string starting at data[start] == '<'.
+func readHexString(data []byte, start int) ([]byte, int) {
+	var s []byte
+	var hi byte
+	half := false
+	for i := start + 1; i < len(data); i++ {
+		c := data[i]
+		var v byte
+		switch {
+		case c == '>':
+			if half {
+				s = append(s, hi<<4)
+			}
+			return s, i
+		case c >= '0' && c <= '9':
+			v = c - '0'
+		case c >= 'a' && c <= 'f':
+			v = c - 'a' + 10
+		case c >= 'A' && c <= 'F':
+			v = c - 'A' + 10
+		default:
+			continue
+		}
+		if half {
+			s = append(s, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	return s, len(data)
+}
+
+func appendNonSpace(dst, src []byte) []byte {
+	for _, c := range src {
+		if c != ' ' && c != '\n' && c != '\r' && c != '\t' {
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
+
+func shingles(data []byte) pageFingerprint {
+	fp := make(pageFingerprint)
+	if len(data) < shingleSize {
+		if len(data) > 0 {
+			h := fnv.New64a()
+			h.Write(data)
+			fp[h.Sum64()] = struct{}{}
+		}
+		return fp
+	}
+	for i := 0; i+shingleSize <= len(data); i++ {
+		h := fnv.New64a()
+		h.Write(data[i : i+shingleSize])
+		fp[h.Sum64()] = struct{}{}
+	}
+	return fp
+}
+
+// similarity is the Jaccard index of two fingerprints.
+func similarity(a, b pageFingerprint) float64 {
+	if len(a) == 0 && len(b) == 0 {
+		return 1
+	}
+	if len(a) > len(b) {
+		a, b = b, a
+	}
+	inter := 0
+	for k := range a {
+		if _, ok := b[k]; ok {
+			inter++
+		}
+	}
+	union := len(a) + len(b) - inter
+	if union == 0 {
+		return 0
+	}
+	return float64(inter) / float64(union)
+}
+
+// alignPages computes an order-preserving mapping from old pages to new pages
+// (both 1-indexed) maximizing total similarity, accepting only pairs at or above
+// threshold. Unmatched old pages are absent from the map.
+func alignPages(oldPages, newPages []pageFingerprint, threshold float64) (map[int]int, map[int]float64) {
+	n, m := len(oldPages), len(newPages)
+	sim := make([][]float64, n)
+	for i := range n {
+		sim[i] = make([]float64, m)
+		for j := range m {
+			sim[i][j] = similarity(oldPages[i], newPages[j])
+		}
+	}
+
+	score := make([][]float64, n+1)
+	for i := range score {
+		score[i] = make([]float64, m+1)
+	}
+	for i := 1; i <= n; i++ {
+		for j := 1; j <= m; j++ {
+			best := max(score[i-1][j], score[i][j-1])
+			if s := sim[i-1][j-1]; s >= threshold {
+				best = max(best, score[i-1][j-1]+s)
+			}
+			score[i][j] = best
+		}
+	}
+
+	pageMap := make(map[int]int)
+	scores := make(map[int]float64)
+	for i, j := n, m; i > 0 && j > 0; {
+		s := sim[i-1][j-1]
+		switch {
+		case s >= threshold && score[i][j] == score[i-1][j-1]+s:
+			pageMap[i] = j
+			scores[i] = s
+			i--
+			j--
+		case score[i][j] == score[i-1][j]:
+			i--
+		default:
+			j--
+		}
+	}
+	return pageMap, scores
+}
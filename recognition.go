@@ -0,0 +1,486 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"unicode/utf8"
+)
+
+// Layout of text-mode exports for real-time recognition notebooks, in points.
+const (
+	textMargin      = 42.0
+	textFontSize    = 11.0
+	textLeading     = 15.0
+	textHeadingSize = 9.0
+	thumbCols       = 2
+	thumbRows       = 2
+	thumbGap        = 18.0
+	thumbDownscale  = 4 // thumbnails are rendered at 1/4 device resolution
+)
+
+// recognElement is one entry of the RECOGNTEXT JSON written by the device.
+type recognElement struct {
+	Type  string `json:"type"`
+	Label string `json:"label"`
+}
+
+// readRecognizedText decodes a page's RECOGNTEXT block and returns the labels
+// of its text elements, one per line.
+func readRecognizedText(r io.ReaderAt, addr uint64) (string, error) {
+	if addr == 0 {
+		return "", nil
+	}
+	data, err := readRecognition(r, addr)
+	if err != nil {
+		return "", err
+	}
+	return recognizedText(data)
+}
+
+// readRecognition returns the JSON (MyScript JIIX) of the RECOGNTEXT block at
+// addr, which the device stores base64-encoded.
+func readRecognition(r io.ReaderAt, addr uint64) ([]byte, error) {
+	raw, err := readLayerData(r, addr)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(raw)))
+	if err != nil {
+		return nil, fmt.Errorf("decoding RECOGNTEXT: %w", err)
+	}
+	return data, nil
+}
+
+// recognizedText returns the labels of the text elements of a RECOGNTEXT
+// payload, one per line.
+func recognizedText(data []byte) (string, error) {
+	var doc struct {
+		Elements []recognElement `json:"elements"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return "", fmt.Errorf("parsing RECOGNTEXT: %w", err)
+	}
+	var lines []string
+	for _, e := range doc.Elements {
+		if e.Type == "Text" && strings.TrimSpace(e.Label) != "" {
+			lines = append(lines, e.Label)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// convertRealtimeNoteToTextPDF exports a real-time recognition notebook as a
+// text document: the recognized text of every page flows across as many PDF
+// pages as needed, followed by thumbnail pages of the original ink.
+func convertRealtimeNoteToTextPDF(src io.ReaderAt, outputPath string, notebook *Notebook, noBg bool, cfg *Config, res *Result) error {
+	pageW := float64(notebook.Width) / notebook.PPI * 72.0
+	pageH := float64(notebook.Height) / notebook.PPI * 72.0
+
+	regular, bold, err := cfg.Resources.textFonts()
+	if err != nil {
+		return err
+	}
+
+	// Objects 3 and 4 are the shared fonts; page objects follow
+	doc := &textDocument{nextID: 5, pageW: pageW, pageH: pageH, regular: regular, bold: bold,
+		objStreams: cfg.PDF.ObjectStreams, catalog: catalogObject(notebook)}
+	// A page whose recognized text cannot be read keeps its place in the
+	// text, drawn as ink on a page of its own
+	palette := cfg.Note.palette()
+	for i, page := range notebook.Pages {
+		text, err := readRecognizedText(src, page.RecognText)
+		if err == nil {
+			doc.layoutText(i, text)
+			continue
+		}
+		res.warnf(WarnTextFallback, i+1, "rendered as ink: %v", err)
+		doc.flushTextPage()
+		if err := doc.addInkPage(src, notebook, i, noBg, palette); err != nil {
+			return err
+		}
+	}
+	doc.flushTextPage()
+
+	perPage := thumbCols * thumbRows
+	for start := 0; start < len(notebook.Pages); start += perPage {
+		end := min(start+perPage, len(notebook.Pages))
+		if err := doc.addThumbnailPage(src, notebook, start, end, noBg, palette); err != nil {
+			return err
+		}
+	}
+
+	if err := doc.write(outputPath); err != nil {
+		return err
+	}
+	return encryptPDF(outputPath, cfg.PDF)
+}
+
+// textDocument accumulates the pages of a text-mode export.
+type textDocument struct {
+	pageW, pageH  float64
+	regular, bold textFont // /F1 and /F2
+	nextID        int
+	objStreams    bool
+	catalog       pdfObject
+	pageIDs       []int
+	objects       []pdfObject
+
+	content []byte  // content stream of the text page being laid out
+	y       float64 // baseline of the next text line
+}
+
+// layoutText flows the recognized text of notebook page i, under a heading,
+// into the text pages. Pages without text are skipped.
+func (d *textDocument) layoutText(i int, text string) {
+	if strings.TrimSpace(text) == "" {
+		return
+	}
+	maxWidth := d.pageW - 2*textMargin
+	d.ensureSpace(2 * textLeading)
+	d.showLine(d.bold, "/F2", textHeadingSize, 0.45, fmt.Sprintf("Page %d", i+1))
+
+	for _, para := range strings.Split(text, "\n") {
+		for _, line := range wrapText(d.regular, para, maxWidth, textFontSize) {
+			d.ensureSpace(textLeading)
+			d.showLine(d.regular, "/F1", textFontSize, 0, line)
+		}
+	}
+	d.y -= textLeading / 2
+}
+
+// ensureSpace starts a new text page if fewer than h points remain.
+func (d *textDocument) ensureSpace(h float64) {
+	if d.content != nil && d.y-h >= textMargin {
+		return
+	}
+	d.flushTextPage()
+	d.content = make([]byte, 0, 4096)
+	d.y = d.pageH - textMargin - textFontSize
+}
+
+func (d *textDocument) showLine(font textFont, name string, size, gray float64, s string) {
+	d.content = append(d.content, "BT\n"...)
+	d.content = appendFloat4(d.content, gray)
+	d.content = append(d.content, " g\n"...)
+	d.content = fmt.Appendf(d.content, "%s %.1f Tf\n", name, size)
+	d.content = appendFloat2(d.content, textMargin)
+	d.content = append(d.content, ' ')
+	d.content = appendFloat2(d.content, d.y)
+	d.content = append(d.content, " Td\n"...)
+	d.content = font.appendString(d.content, s)
+	d.content = append(d.content, " Tj\nET\n"...)
+	d.y -= textLeading
+}
+
+func (d *textDocument) flushTextPage() {
+	if d.content == nil {
+		return
+	}
+	d.addPage(d.content, "/Font << /F1 3 0 R /F2 4 0 R >>", nil)
+	d.content = nil
+}
+
+// addPage appends a page with the given content stream, resources and extra objects.
+func (d *textDocument) addPage(content []byte, resources string, extra []pdfObject) {
+	pageID, contentsID := d.nextID, d.nextID+1
+	d.nextID += 2
+	d.pageIDs = append(d.pageIDs, pageID)
+	d.objects = append(d.objects,
+		pdfObject{id: pageID, data: fmt.Appendf(nil,
+			"%d 0 obj\n<< /Type /Page\n   /Parent 2 0 R\n   /MediaBox [0 0 %.2f %.2f]\n   /Contents %d 0 R\n   /Resources << %s >>\n>>\nendobj\n",
+			pageID, d.pageW, d.pageH, contentsID, resources)},
+		contentStreamObject(contentsID, content),
+	)
+	d.objects = append(d.objects, extra...)
+}
+
+// addThumbnailPage renders notebook pages [start, end) as a grid of reduced
+// raster images with page captions.
+func (d *textDocument) addThumbnailPage(src io.ReaderAt, notebook *Notebook, start, end int, noBg bool, p *Palette) error {
+	cellW := (d.pageW - 2*textMargin - float64(thumbCols-1)*thumbGap) / thumbCols
+	cellH := (d.pageH - 2*textMargin - float64(thumbRows-1)*thumbGap) / thumbRows
+	captionH := textLeading
+	aspect := float64(notebook.Height) / float64(notebook.Width)
+	imgW := min(cellW, (cellH-captionH)/aspect)
+	imgH := imgW * aspect
+
+	var content []byte
+	var xobjects strings.Builder
+	var extra []pdfObject
+
+	for i := start; i < end; i++ {
+		rgb, tw, th, err := renderThumbnailRGB(src, notebook.Pages[i], notebook.Width, notebook.Height, noBg, p)
+		if err != nil {
+			return fmt.Errorf("rendering thumbnail of page %d: %w", i+1, err)
+		}
+		img, err := d.imageObject(rgb, tw, th)
+		if err != nil {
+			return err
+		}
+		imgID := img.id
+		extra = append(extra, img)
+
+		name := fmt.Sprintf("/Th%d", i-start+1)
+		fmt.Fprintf(&xobjects, "%s %d 0 R ", name, imgID)
+
+		col, row := (i-start)%thumbCols, (i-start)/thumbCols
+		x := textMargin + float64(col)*(cellW+thumbGap) + (cellW-imgW)/2
+		top := d.pageH - textMargin - float64(row)*(cellH+thumbGap)
+		y := top - captionH - imgH
+
+		content = fmt.Appendf(content, "q\n%.2f 0 0 %.2f %.2f %.2f cm\n%s Do\nQ\n", imgW, imgH, x, y, name)
+		content = fmt.Appendf(content, "q\n0.6 G\n0.5 w\n%.2f %.2f %.2f %.2f re\nS\nQ\n", x, y, imgW, imgH)
+		content = fmt.Appendf(content, "BT\n0.45 g\n/F2 %.1f Tf\n%.2f %.2f Td\n", textHeadingSize, x, top-textHeadingSize)
+		content = d.bold.appendString(content, fmt.Sprintf("Page %d", i+1))
+		content = append(content, " Tj\nET\n"...)
+	}
+
+	resources := fmt.Sprintf("/Font << /F2 4 0 R >> /XObject << %s>>", xobjects.String())
+	d.addPage(content, resources, extra)
+	return nil
+}
+
+// addInkPage adds notebook page i, rendered at device resolution, as a page
+// of its own.
+func (d *textDocument) addInkPage(src io.ReaderAt, notebook *Notebook, i int, noBg bool, p *Palette) error {
+	rgb, err := renderPageRGB(src, notebook.Pages[i], notebook.Width, notebook.Height, noBg, p)
+	if err != nil {
+		return fmt.Errorf("rendering page %d: %w", i+1, err)
+	}
+	img, err := d.imageObject(rgb, notebook.Width, notebook.Height)
+	if err != nil {
+		return err
+	}
+	content := fmt.Appendf(nil, "q\n%.2f 0 0 %.2f 0 0 cm\n/Im1 Do\nQ\n", d.pageW, d.pageH)
+	d.addPage(content, fmt.Sprintf("/XObject << /Im1 %d 0 R >>", img.id), []pdfObject{img})
+	return nil
+}
+
+// imageObject returns a Flate-compressed RGB image XObject for rgb, with the
+// next free object ID.
+func (d *textDocument) imageObject(rgb []byte, width, height int) (pdfObject, error) {
+	compressed, err := compressZlib(rgb)
+	if err != nil {
+		return pdfObject{}, err
+	}
+	id := d.nextID
+	d.nextID++
+	var obj bytes.Buffer
+	fmt.Fprintf(&obj, "%d 0 obj\n<< /Type /XObject\n   /Subtype /Image\n   /Width %d\n   /Height %d\n   /ColorSpace /DeviceRGB\n   /BitsPerComponent 8\n   /Filter /FlateDecode\n   /Length %d >>\nstream\n",
+		id, width, height, len(compressed))
+	obj.Write(compressed)
+	obj.WriteString("\nendstream\nendobj\n")
+	return pdfObject{id: id, data: obj.Bytes()}, nil
+}
+
+func (d *textDocument) write(outputPath string) error {
+	// Font objects are built once all text is laid out: embedded fonts only
+	// include the glyphs used
+	regularObjs, next, err := d.regular.objects(3, d.nextID)
+	if err != nil {
+		return err
+	}
+	boldObjs, next, err := d.bold.objects(4, next)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer outFile.Close()
+
+	pw := &pdfWriter{w: bufio.NewWriter(outFile), objStreams: d.objStreams}
+	pw.writeHeader()
+	pw.writeObject(d.catalog)
+
+	var kids strings.Builder
+	for i, id := range d.pageIDs {
+		if i > 0 {
+			kids.WriteByte(' ')
+		}
+		fmt.Fprintf(&kids, "%d 0 R", id)
+	}
+	pw.writeObject(pdfObject{id: 2, data: fmt.Appendf(nil, "2 0 obj\n<< /Type /Pages /Kids [ %s ] /Count %d >>\nendobj\n", kids.String(), len(d.pageIDs))})
+
+	objects := append(append(regularObjs, boldObjs...), d.objects...)
+	for _, obj := range objects {
+		pw.writeObject(obj)
+	}
+
+	pw.writeXrefTrailer(next - 1)
+	return pw.w.Flush()
+}
+
+// renderThumbnailRGB composites a page's background and ink layers and
+// box-filters the result down by thumbDownscale.
+func renderThumbnailRGB(src io.ReaderAt, page Page, width, height int, noBg bool, p *Palette) ([]byte, int, int, error) {
+	rgb, err := renderPageRGB(src, page, width, height, noBg, p)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return downscaleRGB(rgb, width, height, thumbDownscale), width / thumbDownscale, height / thumbDownscale, nil
+}
+
+// renderPageRGB composites a page's background and ink layers.
+func renderPageRGB(src io.ReaderAt, page Page, width, height int, noBg bool, p *Palette) ([]byte, error) {
+	var rgb []byte
+	if noBg {
+		rgb = make([]byte, width*height*3)
+		rgb[0] = 0xFF
+		for filled := 1; filled < len(rgb); filled *= 2 {
+			copy(rgb[filled:], rgb[:filled])
+		}
+	} else {
+		var err error
+		if rgb, err = renderBGLayerRGB(src, page, width, height, p); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
+			continue
+		}
+		switch layer.Protocol {
+		case "RATTA_RLE":
+			data, err := readLayerData(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
+			}
+			decodeRLEToRGB(data, rgb, width, height, p)
+		case "PNG":
+			img, err := decodePNGLayer(src, layer.BitmapAddress)
+			if err != nil {
+				return nil, fmt.Errorf("decoding PNG layer %s: %w", layer.Key, err)
+			}
+			compositePNGToRGB(img, rgb, width, height)
+		}
+	}
+
+	return rgb, nil
+}
+
+// downscaleRGB box-filters an RGB image down by k.
+func downscaleRGB(rgb []byte, width, height, k int) []byte {
+	tw, th := width/k, height/k
+	out := make([]byte, tw*th*3)
+	for ty := range th {
+		for tx := range tw {
+			var sum [3]int
+			for y := ty * k; y < ty*k+k; y++ {
+				off := (y*width + tx*k) * 3
+				for x := 0; x < k*3; x += 3 {
+					sum[0] += int(rgb[off+x])
+					sum[1] += int(rgb[off+x+1])
+					sum[2] += int(rgb[off+x+2])
+				}
+			}
+			o := (ty*tw + tx) * 3
+			out[o], out[o+1], out[o+2] = byte(sum[0]/(k*k)), byte(sum[1]/(k*k)), byte(sum[2]/(k*k))
+		}
+	}
+	return out
+}
+
+// wrapText breaks s into lines no wider than maxWidth points in font at size,
+// splitting on spaces and hard-breaking words that do not fit.
+func wrapText(font textFont, s string, maxWidth, size float64) []string {
+	words := strings.Fields(s)
+	if len(words) == 0 {
+		return []string{""}
+	}
+	var lines []string
+	var line string
+	for _, w := range words {
+		candidate := w
+		if line != "" {
+			candidate = line + " " + w
+		}
+		if font.width(candidate, size) <= maxWidth {
+			line = candidate
+			continue
+		}
+		if line != "" {
+			lines = append(lines, line)
+		}
+		for font.width(w, size) > maxWidth && utf8.RuneCountInString(w) > 1 {
+			cut := len(w)
+			for cut > 0 && font.width(w[:cut], size) > maxWidth {
+				_, n := utf8.DecodeLastRuneInString(w[:cut])
+				cut -= n
+			}
+			cut = max(cut, len(string([]rune(w)[0])))
+			lines = append(lines, w[:cut])
+			w = w[cut:]
+		}
+		line = w
+	}
+	return append(lines, line)
+}
+
+// helveticaWidths holds the standard Helvetica advance widths (1/1000 em) for
+// ASCII 32..126; other characters use the width of a digit.
+var helveticaWidths = [95]uint16{
+	278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+	556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+	1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+	667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+	333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+	556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+}
+
+func helveticaWidth(s string, size float64) float64 {
+	total := 0
+	for _, r := range s {
+		if r >= 32 && r <= 126 {
+			total += int(helveticaWidths[r-32])
+		} else {
+			total += 556
+		}
+	}
+	return float64(total) * size / 1000
+}
+
+// winAnsiSpecials maps the non-Latin-1 characters of WinAnsiEncoding (0x80-0x9F).
+var winAnsiSpecials = map[rune]byte{
+	'€': 0x80, '‚': 0x82, 'ƒ': 0x83, '„': 0x84, '…': 0x85, '†': 0x86, '‡': 0x87,
+	'ˆ': 0x88, '‰': 0x89, 'Š': 0x8A, '‹': 0x8B, 'Œ': 0x8C, 'Ž': 0x8E, '‘': 0x91,
+	'’': 0x92, '“': 0x93, '”': 0x94, '•': 0x95, '–': 0x96, '—': 0x97, '˜': 0x98,
+	'™': 0x99, 'š': 0x9A, '›': 0x9B, 'œ': 0x9C, 'ž': 0x9E, 'Ÿ': 0x9F,
+}
+
+// appendPDFString appends s as a WinAnsi-encoded PDF literal string.
+// Characters outside WinAnsiEncoding are replaced by '?'.
+func appendPDFString(buf []byte, s string) []byte {
+	buf = append(buf, '(')
+	for _, r := range s {
+		var c byte
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			buf = append(buf, '\\', byte(r))
+			continue
+		case r >= 32 && r <= 126, r >= 0xA0 && r <= 0xFF:
+			c = byte(r)
+		default:
+			if b, ok := winAnsiSpecials[r]; ok {
+				c = b
+			} else {
+				c = '?'
+			}
+		}
+		if c >= 0x80 {
+			buf = fmt.Appendf(buf, "\\%03o", c)
+		} else {
+			buf = append(buf, c)
+		}
+	}
+	return append(buf, ')')
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"slices"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// liveConfig holds the daemon's current configuration. Readers take a snapshot
+// with Load at the start of each unit of work; reloads swap it atomically.
+type liveConfig struct {
+	path      string
+	overrides func(*Config) // command-line flags, re-applied on every reload
+	atomic.Pointer[Config]
+}
+
+// reloadLoop re-reads the config file on SIGHUP or when the file changes on
+// disk. Colors, opacity, logging, workers and watch settings take effect for
+// subsequent conversions (a changed worker count as running ones finish); onAdded is called with targets that were not watched
+// before so only those need an initial scan. Invalid configs are rejected and
+// the previous settings stay active.
+func reloadLoop(ctx context.Context, live *liveConfig, onAdded func(added []WatchTarget)) {
+	reloadCh := make(chan struct{}, 1)
+	request := func() {
+		select {
+		case reloadCh <- struct{}{}:
+		default:
+		}
+	}
+
+	hupCh := make(chan os.Signal, 1)
+	signal.Notify(hupCh, syscall.SIGHUP)
+	defer signal.Stop(hupCh)
+
+	if stop := watchConfigFile(live.path, request); stop != nil {
+		defer stop()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hupCh:
+			logger.Infof("Received SIGHUP, reloading config...")
+		case <-reloadCh:
+			logger.Infof("Config file changed, reloading...")
+		}
+
+		cfg, err := LoadConfig(live.path)
+		if err == nil {
+			err = cfg.Watch.Validate()
+		}
+		if err != nil {
+			logger.Errorf("reloading config: %v (keeping previous settings)", err)
+			continue
+		}
+		if live.overrides != nil {
+			live.overrides(cfg)
+		}
+		if err := logger.Configure(cfg.Log); err != nil {
+			logger.Errorf("reloading config [log]: %v (keeping previous settings)", err)
+			continue
+		}
+		cfg.warnUnknownKeys(live.path)
+		cfg.Performance.apply()
+
+		added := addedTargets(live.Load().Watch.Targets(), cfg.Watch.Targets())
+		live.Store(cfg)
+		logger.Infof("Config reloaded from '%s' (%d new watch target(s))", live.path, len(added))
+		if len(added) > 0 {
+			onAdded(added)
+		}
+	}
+}
+
+// watchConfigFile calls onChange (debounced) whenever the config file is
+// written, created or atomically replaced. Returns a stop function, or nil if
+// the containing directory cannot be watched.
+func watchConfigFile(path string, onChange func()) func() {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return nil
+	}
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil
+	}
+	// Watch the directory: editors often replace the file via rename
+	if err := w.Add(filepath.Dir(absPath)); err != nil {
+		w.Close()
+		return nil
+	}
+
+	db := newDebouncer(500*time.Millisecond, func(string) { onChange() })
+	go func() {
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if ev.Name == absPath && ev.Has(fsnotify.Write|fsnotify.Create|fsnotify.Rename) {
+					db.trigger(absPath)
+				}
+			case _, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+			}
+		}
+	}()
+
+	return func() {
+		db.stop()
+		w.Close()
+	}
+}
+
+// addedTargets returns the targets in next that are not present in prev.
+func addedTargets(prev, next []WatchTarget) []WatchTarget {
+	var added []WatchTarget
+	for _, t := range next {
+		if !slices.ContainsFunc(prev, func(p WatchTarget) bool {
+			return p.Input == t.Input && p.Output == t.Output
+		}) {
+			added = append(added, t)
+		}
+	}
+	return added
+}
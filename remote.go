@@ -0,0 +1,339 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// remoteFile is a file listed by a remote source.
+type remoteFile struct {
+	path    string // slash-separated, relative to the source root
+	size    int64
+	modTime time.Time
+	id      string // backend handle for downloads
+}
+
+// remoteSource is a service notes are synced to (e.g. Supernote Cloud, a
+// WebDAV server). The watcher mirrors its .note and .mark files, with the
+// companion PDFs of the marks, into a local directory that is then watched
+// like any other input.
+type remoteSource interface {
+	name() string
+	list(ctx context.Context) ([]remoteFile, error)
+	download(ctx context.Context, f remoteFile, w io.Writer) error
+}
+
+// remoteDestination is a service the PDFs of an output directory are pushed
+// to (e.g. a Dropbox or Google Drive folder); list returns the files pushed so far.
+type remoteDestination interface {
+	remoteSource
+	upload(ctx context.Context, rel string, r io.Reader, modTime time.Time) error
+	remove(ctx context.Context, rel string) error
+}
+
+// remoteMirror pairs a remote source with its local copy.
+type remoteMirror struct {
+	src      remoteSource
+	dir      string
+	interval time.Duration
+}
+
+// remoteMirrors returns the remote sources configured in [watch].
+func (w WatchConfig) remoteMirrors() ([]remoteMirror, error) {
+	var ms []remoteMirror
+	if isWebDAVURL(w.WebDAV) {
+		c, err := newWebDAVClient(w.WebDAV, w.WebDAVUser, w.WebDAVPassword)
+		if err != nil {
+			return nil, err
+		}
+		ms = append(ms, remoteMirror{src: c, dir: mirrorDir(w.WebDAVMirror, "webdav"), interval: w.PollDuration()})
+	}
+	if c := w.SupernoteCloud; c.enabled() {
+		ms = append(ms, remoteMirror{src: newSupernoteCloud(c), dir: c.mirrorDir(), interval: c.pollInterval()})
+	}
+	if c := w.Dropbox; c.enabled() && c.Folder != "" {
+		ms = append(ms, remoteMirror{src: newDropbox(c, c.Folder), dir: c.mirrorDir(), interval: c.pollInterval()})
+	}
+	if c := w.SFTP; c.enabled() && c.Folder != "" {
+		ms = append(ms, remoteMirror{src: newSSHRemote(c, c.Folder), dir: c.mirrorDir(), interval: c.pollInterval()})
+	}
+	if c := w.GoogleDrive; c.enabled() && c.Folder != "" {
+		ms = append(ms, remoteMirror{src: newGoogleDrive(c, c.Folder), dir: c.mirrorDir(), interval: c.pollInterval()})
+	}
+	return ms, nil
+}
+
+// remoteOutput pairs a local output directory with the destination its PDFs
+// are pushed to.
+type remoteOutput struct {
+	dst      remoteDestination
+	dir      string
+	interval time.Duration
+}
+
+// remoteOutputs returns the remote destinations configured in [watch].
+func (w WatchConfig) remoteOutputs() []remoteOutput {
+	var outs []remoteOutput
+	if c := w.Dropbox; c.enabled() && c.OutputFolder != "" {
+		outs = append(outs, remoteOutput{dst: newDropbox(c, c.OutputFolder), dir: c.outputDir(w.Location), interval: c.pollInterval()})
+	}
+	if c := w.SFTP; c.enabled() && c.OutputFolder != "" {
+		outs = append(outs, remoteOutput{dst: newSSHRemote(c, c.OutputFolder), dir: c.outputDir(w.Location), interval: c.pollInterval()})
+	}
+	if c := w.GoogleDrive; c.enabled() && c.OutputFolder != "" {
+		outs = append(outs, remoteOutput{dst: newGoogleDrive(c, c.OutputFolder), dir: c.outputDir(w.Location), interval: c.pollInterval()})
+	}
+	return outs
+}
+
+// mirrorDir returns the directory a remote source is mirrored into: dir if
+// set, else <user cache dir>/gosnare/<name>.
+func mirrorDir(dir, name string) string {
+	if dir != "" {
+		return dir
+	}
+	base, err := os.UserCacheDir()
+	if err != nil {
+		base = os.TempDir()
+	}
+	return filepath.Join(base, "gosnare", name)
+}
+
+// mirrored reports whether a remote file is copied: sources, and the
+// companion PDFs of .mark sources.
+func mirrored(f remoteFile, all map[string]bool) bool {
+	if isSourceName(f.path) {
+		return true
+	}
+	return strings.EqualFold(filepath.Ext(f.path), ".pdf") && all[f.path+".mark"]
+}
+
+// sync brings the mirror up to date: new and changed files are downloaded
+// (written aside and renamed into place, so the watcher never sees a partial
+// file) and files gone from the source are removed, which removes their
+// outputs like any deleted source. It returns the number of files changed.
+func (m remoteMirror) sync(ctx context.Context) (int, error) {
+	files, err := m.src.list(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("listing %s: %w", m.src.name(), err)
+	}
+	all := make(map[string]bool, len(files))
+	for _, f := range files {
+		all[f.path] = true
+	}
+
+	changed := 0
+	keep := make(map[string]bool)
+	for _, f := range files {
+		if !mirrored(f, all) {
+			continue
+		}
+		local := filepath.Join(m.dir, filepath.FromSlash(f.path))
+		keep[local] = true
+		if info, err := os.Stat(local); err == nil && info.Size() == f.size && info.ModTime().Equal(f.modTime) {
+			continue
+		}
+		if err := m.fetch(ctx, f, local); err != nil {
+			return changed, fmt.Errorf("downloading %s from %s: %w", f.path, m.src.name(), err)
+		}
+		logger.Debugf("%s: downloaded %s", m.src.name(), f.path)
+		changed++
+	}
+
+	err = filepath.WalkDir(m.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || keep[path] {
+			return err
+		}
+		if strings.HasSuffix(path, ".part") || isSourceName(path) || strings.EqualFold(filepath.Ext(path), ".pdf") {
+			changed++
+			return os.Remove(path)
+		}
+		return nil
+	})
+	return changed, err
+}
+
+// fetch downloads f to local, with f's modification time.
+func (m remoteMirror) fetch(ctx context.Context, f remoteFile, local string) error {
+	if err := os.MkdirAll(filepath.Dir(local), 0755); err != nil {
+		return err
+	}
+	tmp := local + ".part"
+	out, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	err = m.src.download(ctx, f, out)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Chtimes(tmp, f.modTime, f.modTime)
+	}
+	if err == nil {
+		err = os.Rename(tmp, local)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+// loop syncs the mirror every interval until ctx is done.
+func (m remoteMirror) loop(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := m.sync(ctx); err != nil {
+				logger.Warnf("%v", err)
+			} else if n > 0 {
+				logger.Infof("%s: %d file(s) synced into %s", m.src.name(), n, m.dir)
+			}
+		}
+	}
+}
+
+// push brings the destination up to date with the PDFs of the output
+// directory: new and changed ones are uploaded, ones no longer in the output
+// (their note was deleted) are removed. Modification times are compared to
+// the second, the precision destinations keep. It returns the number of
+// files changed.
+func (o remoteOutput) push(ctx context.Context) (int, error) {
+	files, err := o.dst.list(ctx)
+	if errors.Is(err, fs.ErrNotExist) {
+		files, err = nil, nil // an output folder not created yet
+	}
+	if err != nil {
+		return 0, fmt.Errorf("listing %s: %w", o.dst.name(), err)
+	}
+	pushed := make(map[string]remoteFile, len(files))
+	for _, f := range files {
+		pushed[f.path] = f
+	}
+
+	changed := 0
+	err = filepath.WalkDir(o.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.EqualFold(filepath.Ext(path), ".pdf") {
+			return err
+		}
+		rel, err := filepath.Rel(o.dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		info, err := d.Info()
+		if err != nil {
+			return nil // removed meanwhile
+		}
+		f, ok := pushed[rel]
+		delete(pushed, rel)
+		if ok && f.size == info.Size() && f.modTime.Equal(info.ModTime().Truncate(time.Second)) {
+			return nil
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return nil
+		}
+		defer in.Close()
+		if err := o.dst.upload(ctx, rel, in, info.ModTime()); err != nil {
+			return fmt.Errorf("uploading %s to %s: %w", rel, o.dst.name(), err)
+		}
+		logger.Debugf("%s: uploaded %s", o.dst.name(), rel)
+		changed++
+		return nil
+	})
+	if err != nil {
+		return changed, err
+	}
+
+	for rel := range pushed {
+		if !strings.EqualFold(filepath.Ext(rel), ".pdf") {
+			continue
+		}
+		if err := o.dst.remove(ctx, rel); err != nil {
+			return changed, fmt.Errorf("removing %s from %s: %w", rel, o.dst.name(), err)
+		}
+		logger.Debugf("%s: removed %s", o.dst.name(), rel)
+		changed++
+	}
+	return changed, nil
+}
+
+// loop pushes the output every interval until ctx is done.
+func (o remoteOutput) loop(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if n, err := o.push(ctx); err != nil {
+				logger.Warnf("%v", err)
+			} else if n > 0 {
+				logger.Infof("%s: %d file(s) pushed from %s", o.dst.name(), n, o.dir)
+			}
+		}
+	}
+}
+
+// oauthToken is the access token of a remote backend: a fixed token, or one
+// refreshed from a long-lived refresh token (form holds the refresh request
+// fields) before it expires.
+type oauthToken struct {
+	endpoint string
+	form     url.Values
+	client   *http.Client
+
+	mu      sync.Mutex
+	token   string
+	expires time.Time
+}
+
+// get returns a valid access token.
+func (t *oauthToken) get(ctx context.Context) (string, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.form == nil || (t.token != "" && time.Until(t.expires) > time.Minute) {
+		return t.token, nil
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, strings.NewReader(t.form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := t.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return "", fmt.Errorf("refreshing the access token: %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	t.token, t.expires = tok.AccessToken, time.Now().Add(time.Duration(tok.ExpiresIn)*time.Second)
+	return t.token, nil
+}
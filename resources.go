@@ -0,0 +1,163 @@
+package main
+
+import (
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+)
+
+// builtinPalettes are the palette presets shipped with GoSNare. A file of the
+// same name in <resources dir>/palettes overrides a built-in preset.
+//
+//go:embed palettes/*.toml
+var builtinPalettes embed.FS
+
+// ResourcesConfig locates user-supplied fonts and palette presets. Built-in
+// Helvetica and the embedded presets are used when nothing is supplied.
+type ResourcesConfig struct {
+	Dir      string `toml:"dir"`       // default: <user config dir>/gosnare
+	Font     string `toml:"font"`      // TrueType font for generated text, relative to <dir>/fonts; default: Helvetica
+	BoldFont string `toml:"bold_font"` // headings; default: font, or Helvetica-Bold
+}
+
+// path resolves name relative to the sub directory of the resources directory.
+// Absolute names are returned unchanged.
+func (r ResourcesConfig) path(sub, name string) (string, error) {
+	if filepath.IsAbs(name) {
+		return name, nil
+	}
+	dir := r.Dir
+	if dir == "" {
+		base, err := os.UserConfigDir()
+		if err != nil {
+			return "", fmt.Errorf("no resources directory: %w", err)
+		}
+		dir = filepath.Join(base, "gosnare")
+	}
+	return filepath.Join(dir, sub, name), nil
+}
+
+// textFonts returns the fonts for generated text: regular (body) and bold
+// (headings). Each call loads fresh fonts, since they record the glyphs used
+// by one document.
+func (r ResourcesConfig) textFonts() (regular, bold textFont, err error) {
+	regular, bold = helvetica, helveticaBold
+	boldName := r.BoldFont
+	if boldName == "" {
+		boldName = r.Font
+	}
+	if r.Font != "" {
+		if regular, err = r.loadFont(r.Font); err != nil {
+			return nil, nil, err
+		}
+	}
+	if boldName != "" {
+		if bold, err = r.loadFont(boldName); err != nil {
+			return nil, nil, err
+		}
+	}
+	return regular, bold, nil
+}
+
+func (r ResourcesConfig) loadFont(name string) (textFont, error) {
+	p, err := r.path("fonts", name)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, fmt.Errorf("loading font: %w", err)
+	}
+	f, err := parseTrueType(data, pdfFontName(p))
+	if err != nil {
+		return nil, fmt.Errorf("loading font %s: %w", p, err)
+	}
+	return f, nil
+}
+
+// pdfFontName derives a PDF base font name from a font file name, keeping only
+// characters that need no escaping.
+func pdfFontName(file string) string {
+	base := strings.TrimSuffix(filepath.Base(file), filepath.Ext(file))
+	name := strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return -1
+	}, base)
+	if name == "" {
+		name = "Font"
+	}
+	return name
+}
+
+// palette returns the named preset: <dir>/palettes/<name>.toml if it exists,
+// else the built-in preset of that name.
+func (r ResourcesConfig) palette(name string) (ColorConfig, error) {
+	var c ColorConfig
+	if name == "" || strings.ContainsAny(name, `/\.`) {
+		return c, fmt.Errorf("invalid palette name %q", name)
+	}
+	file := name + ".toml"
+
+	var data []byte
+	p, err := r.path("palettes", file)
+	if err == nil {
+		data, err = os.ReadFile(p)
+	}
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) && p != "" {
+			return c, fmt.Errorf("loading palette: %w", err)
+		}
+		if data, err = builtinPalettes.ReadFile(path.Join("palettes", file)); err != nil {
+			return c, fmt.Errorf("unknown palette %q (built-in: %s)", name, strings.Join(builtinPaletteNames(), ", "))
+		}
+		p = "built-in " + name
+	}
+
+	if _, err := toml.Decode(string(data), &c); err != nil {
+		return c, fmt.Errorf("palette %s: %w", p, err)
+	}
+	if c.Palette != "" {
+		return c, fmt.Errorf("palette %s: presets cannot select another palette", p)
+	}
+	return c, nil
+}
+
+func builtinPaletteNames() []string {
+	entries, _ := builtinPalettes.ReadDir("palettes")
+	names := make([]string, 0, len(entries))
+	for _, e := range entries {
+		names = append(names, strings.TrimSuffix(e.Name(), ".toml"))
+	}
+	return names
+}
+
+// applyPalette fills in the colors of c from its palette preset, if any.
+// Colors set explicitly (isSet reports the TOML key) take precedence.
+func (r ResourcesConfig) applyPalette(c *ColorConfig, isSet func(key string) bool) error {
+	if c.Palette == "" {
+		return nil
+	}
+	preset, err := r.palette(c.Palette)
+	if err != nil {
+		return err
+	}
+	from := preset.fields()
+	for i, color := range c.fields() {
+		if *from[i].value != "" && !isSet(color.key) {
+			*color.value = *from[i].value
+		}
+	}
+	if len(preset.Anchors) > 0 && !isSet("anchor") {
+		c.Anchors = preset.Anchors
+	}
+	return nil
+}
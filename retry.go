@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// retryPolicy decides when a failed conversion is tried again. Failures are
+// often transient in watch mode (a note read while the sync client is still
+// writing it), so a source is retried with exponentially growing delays
+// before it stays quarantined until it changes.
+type retryPolicy struct {
+	attempts int           // conversion attempts in total, the first included
+	delay    time.Duration // before the first retry; doubled for each further one
+}
+
+// maxRetryDelay caps the delay between two attempts.
+const maxRetryDelay = time.Hour
+
+func (w WatchConfig) retryPolicy() retryPolicy {
+	p := retryPolicy{attempts: w.RetryAttempts, delay: time.Duration(w.RetryDelay) * time.Second}
+	if p.attempts <= 0 {
+		p.attempts = 5
+	}
+	if p.delay <= 0 {
+		p.delay = 30 * time.Second
+	}
+	return p
+}
+
+// next returns when attempt number attempt+1 is due after attempt failed at
+// now, or the zero time if no attempts are left.
+func (p retryPolicy) next(attempt int, now time.Time) time.Time {
+	if attempt >= p.attempts {
+		return time.Time{}
+	}
+	d := p.delay
+	for i := 1; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+	return now.Add(min(d, maxRetryDelay))
+}
+
+// retryStatus describes where a quarantined entry stands in its retries.
+func (e stateEntry) retryStatus() string {
+	attempts := max(e.Attempts, 1)
+	if e.RetryAt.IsZero() {
+		return fmt.Sprintf("gave up after %d attempt(s); waiting for the file to change", attempts)
+	}
+	return fmt.Sprintf("attempt %d failed, retrying at %s", attempts, e.RetryAt.Format("2006-01-02 15:04:05"))
+}
+
+// dueRetries returns the sources whose next conversion attempt is due.
+func (s *stateSet) dueRetries(now time.Time) map[string]time.Time {
+	s.mu.RLock()
+	dbs := s.dbs
+	s.mu.RUnlock()
+	due := make(map[string]time.Time)
+	for _, db := range dbs {
+		for _, e := range db.snapshot() {
+			if e.Quarantined() && !e.RetryAt.IsZero() && !now.Before(e.RetryAt) {
+				due[e.Source] = e.RetryAt
+			}
+		}
+	}
+	return due
+}
+
+// retryLoop hands sources whose retry is due to trigger, as if they had
+// changed, until ctx is done. Each scheduled retry is triggered once: if the
+// source no longer converts (e.g. it was deleted), it is not triggered again.
+func retryLoop(ctx context.Context, state *stateSet, trigger func(path string)) {
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	triggered := make(map[string]time.Time)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			for source, at := range state.dueRetries(now) {
+				if triggered[source].Equal(at) {
+					continue
+				}
+				triggered[source] = at
+				logger.Infof("Retrying '%s'", source)
+				trigger(source)
+			}
+		}
+	}
+}
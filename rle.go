@@ -1,53 +1,86 @@
 package main
 
+// RLE codes that firmware with blue and red ballpoint pens writes for them.
+// On other firmware they are anti-aliasing grays between black and dark gray,
+// so they are only treated as pens when [colors] blue or red is set.
+const (
+	codeBluePen = 0x69
+	codeRedPen  = 0x6a
+)
+
 type Palette struct {
-	Colors [256][3]byte
-	Alphas [256]byte
+	Colors   [256][3]byte
+	Alphas   [256]byte
+	Multiply bool     // blend translucent codes (markers) with Multiply rather than over
+	bg       *Palette // palette of background layers, if it differs
+	base     *Palette // palette before [colors.codes], if they are set
 }
 
-// BuildPalette constructs a palette by interpolating between four anchor colors.
-// Anchors: Black (0), Dark Gray (157), Light Gray (201), White (255).
-func BuildPalette(cfg ColorConfig, markerOpacity float64) *Palette {
-	p := &Palette{}
+// fixed returns the palette without the [colors.codes] overrides, which the
+// fixed color groups of traced ink are drawn in.
+func (p *Palette) fixed() *Palette {
+	if p.base != nil {
+		return p.base
+	}
+	return p
+}
+
+// background returns the palette background layers are decoded with: p
+// without the colored pens, which templates do not use.
+func (p *Palette) background() *Palette {
+	if p.bg != nil {
+		return p.bg
+	}
+	return p
+}
 
-	bR, bG, bB, _ := parseHexColor(cfg.Black)
-	dgR, dgG, dgB, _ := parseHexColor(cfg.DarkGray)
-	lgR, lgG, lgB, _ := parseHexColor(cfg.LightGray)
-	wR, wG, wB, _ := parseHexColor(cfg.White)
+// BuildPalette constructs a palette by interpolating between anchor colors:
+// Black (0), Dark Gray (157), Light Gray (201) and White (255), or the
+// configured anchors, whose opacity is interpolated too. Codes outside the
+// anchors take the nearest one.
+func BuildPalette(cfg ColorConfig) *Palette {
+	p := &Palette{}
 
-	anchors := []struct {
-		pos     int
-		r, g, b byte
-	}{
-		{0, bR, bG, bB},
-		{157, dgR, dgG, dgB},
-		{201, lgR, lgG, lgB},
-		{255, wR, wG, wB},
+	anchors := cfg.anchors
+	if len(anchors) == 0 {
+		for _, a := range []struct {
+			pos int
+			hex string
+		}{{0, cfg.Black}, {157, cfg.DarkGray}, {201, cfg.LightGray}, {255, cfg.White}} {
+			r, g, b, _ := parseHexColor(a.hex)
+			anchors = append(anchors, codeColor{code: byte(a.pos), r: r, g: g, b: b, a: 0xFF})
+		}
 	}
 
+	lerp := func(from, to byte, f float64) byte {
+		return byte(float64(from) + f*float64(int(to)-int(from)))
+	}
+	first, last := anchors[0], anchors[len(anchors)-1]
+	for j := 0; j <= int(first.code); j++ {
+		p.Colors[j], p.Alphas[j] = [3]byte{first.r, first.g, first.b}, first.a
+	}
+	for j := int(last.code); j <= 255; j++ {
+		p.Colors[j], p.Alphas[j] = [3]byte{last.r, last.g, last.b}, last.a
+	}
 	for i := 0; i < len(anchors)-1; i++ {
 		start := anchors[i]
 		end := anchors[i+1]
-		dist := end.pos - start.pos
-		for j := start.pos; j <= end.pos; j++ {
-			f := float64(j-start.pos) / float64(dist)
-			p.Colors[j][0] = byte(float64(start.r) + f*float64(int(end.r)-int(start.r)))
-			p.Colors[j][1] = byte(float64(start.g) + f*float64(int(end.g)-int(start.g)))
-			p.Colors[j][2] = byte(float64(start.b) + f*float64(int(end.b)-int(start.b)))
+		dist := int(end.code) - int(start.code)
+		for j := int(start.code); j <= int(end.code); j++ {
+			f := float64(j-int(start.code)) / float64(dist)
+			p.Colors[j][0] = lerp(start.r, end.r, f)
+			p.Colors[j][1] = lerp(start.g, end.g, f)
+			p.Colors[j][2] = lerp(start.b, end.b, f)
+			p.Alphas[j] = lerp(start.a, end.a, f)
 		}
 	}
 
-	for i := range p.Alphas {
-		p.Alphas[i] = 0xFF
+	// Specialized pen codes and the alternate grays map to their anchor colors
+	for code, pos := range map[byte]byte{0x61: 0, 0x63: 157, 0x64: 201, 0x65: 255, 0x9d: 157, 0x9e: 157, 0xc9: 201, 0xca: 201} {
+		p.Colors[code], p.Alphas[code] = p.Colors[pos], p.Alphas[pos]
 	}
 
-	// Specialized pen codes map to their anchor colors
-	p.Colors[0x61] = p.Colors[0]   // Black
-	p.Colors[0x63] = p.Colors[157] // Dark Gray
-	p.Colors[0x64] = p.Colors[201] // Light Gray
-	p.Colors[0x65] = p.Colors[255] // White
-
-	mOpacity := byte(markerOpacity * 255)
+	mOpacity := byte(cfg.MarkerOpacity * 255)
 	if mOpacity == 0 {
 		mOpacity = 0x26 // ~15% default
 	}
@@ -60,11 +93,44 @@ func BuildPalette(cfg ColorConfig, markerOpacity float64) *Palette {
 	p.Alphas[0x67] = mOpacity
 	p.Alphas[0x68] = mOpacity
 
-	// Compatibility entries for alternate dark/light gray codes
-	p.Colors[0x9d] = p.Colors[157]
-	p.Colors[0x9e] = p.Colors[157]
-	p.Colors[0xc9] = p.Colors[201]
-	p.Colors[0xca] = p.Colors[201]
+	// Alternate dark/light gray codes as configured
+	if r, g, b, err := parseHexColor(cfg.DarkGrayAlt); cfg.DarkGrayAlt != "" && err == nil {
+		p.Colors[0x9d] = [3]byte{r, g, b}
+		p.Colors[0x9e] = [3]byte{r, g, b}
+	}
+	if r, g, b, err := parseHexColor(cfg.LightGrayAlt); cfg.LightGrayAlt != "" && err == nil {
+		p.Colors[0xc9] = [3]byte{r, g, b}
+		p.Colors[0xca] = [3]byte{r, g, b}
+	}
+
+	// Colored pens, when configured. Background layers keep the interpolated
+	// grays at their codes
+	for _, pen := range []struct {
+		code  byte
+		color string
+	}{{codeBluePen, cfg.Blue}, {codeRedPen, cfg.Red}} {
+		r, g, b, err := parseHexColor(pen.color)
+		if pen.color == "" || err != nil {
+			continue
+		}
+		if p.bg == nil {
+			bg := *p
+			p.bg = &bg
+		}
+		p.Colors[pen.code], p.Alphas[pen.code] = [3]byte{r, g, b}, 0xFF
+	}
+
+	if len(cfg.codes) > 0 {
+		base := *p
+		p.base = &base
+	}
+	for _, c := range cfg.codes {
+		p.Colors[c.code] = [3]byte{c.r, c.g, c.b}
+		p.Alphas[c.code] = c.a
+		if p.bg != nil {
+			p.bg.Colors[c.code], p.bg.Alphas[c.code] = p.Colors[c.code], c.a
+		}
+	}
 
 	return p
 }
@@ -94,91 +160,148 @@ func IdentityPalette() *Palette {
 	return identityPalette
 }
 
-// decodeRLE runs the RATTA_RLE state machine and calls emit for each non-transparent run.
-// emit receives the pixel position, run length, and raw color code.
-func decodeRLE(data []byte, width, height int, emit func(pos, length int, colorCode byte)) {
-	expected := width * height
-	pos := 0
+// rleReader walks a RATTA_RLE stream run by run. Each target (color codes,
+// RGB, RGBA) drives it from its own loop so the per-run fill is inlined
+// rather than dispatched through a callback.
+type rleReader struct {
+	data     []byte
+	i        int
+	pos      int
+	expected int
 
-	var heldColor, heldLength byte
-	var hasHolder bool
+	heldColor, heldLength byte
+	hasHolder             bool
 
-	i := 0
-	for i+1 < len(data) && pos < expected {
-		colorCode := data[i]
-		lengthCode := data[i+1]
-		i += 2
+	// A held run that is not continued is flushed before the pair that ended
+	// it; that pair is returned by the following call.
+	pendingColor byte
+	pendingLen   int
+}
 
-		var length int
+func newRLEReader(data []byte, width, height int) rleReader {
+	return rleReader{data: data, expected: width * height}
+}
 
-		if hasHolder {
-			prevColor, prevLength := heldColor, heldLength
-			hasHolder = false
+// next returns the next non-transparent run: its pixel position, length and
+// raw color code. ok is false once the stream or the bitmap is exhausted.
+func (r *rleReader) next() (pos, length int, colorCode byte, ok bool) {
+	for r.pos < r.expected {
+		switch {
+		case r.pendingLen > 0:
+			length, colorCode = r.pendingLen, r.pendingColor
+			r.pendingLen = 0
 
-			if colorCode == prevColor {
-				length = 1 + int(lengthCode) + ((int(prevLength&0x7f) + 1) << 7)
-			} else {
-				heldLen := (int(prevLength&0x7f) + 1) << 7
-				if pos+heldLen > expected {
-					heldLen = expected - pos
-				}
-				if prevColor != 0x62 {
-					emit(pos, heldLen, prevColor)
+		case r.i+1 < len(r.data):
+			code, lengthCode := r.data[r.i], r.data[r.i+1]
+			r.i += 2
+
+			if r.hasHolder {
+				r.hasHolder = false
+				if code == r.heldColor {
+					length, colorCode = 1+int(lengthCode)+((int(r.heldLength&0x7f)+1)<<7), code
+				} else {
+					length, colorCode = (int(r.heldLength&0x7f)+1)<<7, r.heldColor
+					r.pendingLen, r.pendingColor = int(lengthCode)+1, code
 				}
-				pos += heldLen
-				length = int(lengthCode) + 1
+			} else if lengthCode == 0xff {
+				length, colorCode = 0x4000, code
+			} else if lengthCode&0x80 != 0 {
+				r.heldColor, r.heldLength = code, lengthCode
+				r.hasHolder = true
+				continue
+			} else {
+				length, colorCode = int(lengthCode)+1, code
 			}
-		} else if lengthCode == 0xff {
-			length = 0x4000
-		} else if lengthCode&0x80 != 0 {
-			heldColor, heldLength = colorCode, lengthCode
-			hasHolder = true
-			continue
-		} else {
-			length = int(lengthCode) + 1
-		}
 
-		if pos+length > expected {
-			length = expected - pos
+		case r.hasHolder:
+			// Stream ends on a held run
+			r.hasHolder = false
+			length, colorCode = (int(r.heldLength&0x7f)+1)<<7, r.heldColor
+
+		default:
+			return 0, 0, 0, false
 		}
 
+		length = min(length, r.expected-r.pos)
+		pos = r.pos
+		r.pos += length
 		if colorCode != 0x62 {
-			emit(pos, length, colorCode)
+			return pos, length, colorCode, true
 		}
-		pos += length
 	}
+	return 0, 0, 0, false
+}
 
-	if hasHolder && pos < expected {
-		tailLen := (int(heldLength&0x7f) + 1) << 7
-		if remaining := expected - pos; tailLen > remaining {
-			tailLen = remaining
-		}
-		if tailLen > 0 && heldColor != 0x62 {
-			emit(pos, tailLen, heldColor)
+func decodeRLEToRGB(data []byte, rgb []byte, width, height int, p *Palette) {
+	r := newRLEReader(data, width, height)
+	for {
+		pos, length, code, ok := r.next()
+		if !ok {
+			return
 		}
+		c := p.Colors[code]
+		fillRGB(rgb, pos, length, c[0], c[1], c[2])
 	}
 }
 
-func decodeRLEToRGB(data []byte, rgb []byte, width, height int, p *Palette) {
-	decodeRLE(data, width, height, func(pos, length int, colorCode byte) {
-		c := p.Colors[colorCode]
-		fillRGB(rgb, pos, length, c[0], c[1], c[2])
-	})
+// compositeRLEToRGB draws RATTA_RLE ink over an existing RGB image, blending
+// translucent codes (markers) at their palette alpha, multiplied with the image
+// if p.Multiply. White ink is skipped, as it is when tracing.
+func compositeRLEToRGB(data []byte, rgb []byte, width, height int, p *Palette) {
+	r := newRLEReader(data, width, height)
+	for {
+		pos, length, code, ok := r.next()
+		if !ok {
+			return
+		}
+		if canonicalGroup(code) == 3 {
+			continue
+		}
+		c, a := p.Colors[code], uint32(p.Alphas[code])
+		if a == 0xFF {
+			fillRGB(rgb, pos, length, c[0], c[1], c[2])
+			continue
+		}
+		end := min((pos+length)*3, len(rgb))
+		for i := pos * 3; i < end; i++ {
+			src, dst := uint32(c[i%3]), uint32(rgb[i])
+			if p.Multiply {
+				src = src * dst / 255
+			}
+			rgb[i] = byte((src*a + dst*(255-a)) / 255)
+		}
+	}
 }
 
 func decodeRLEToRGBA(data []byte, rgba []byte, width, height int, p *Palette) {
-	decodeRLE(data, width, height, func(pos, length int, colorCode byte) {
-		c := p.Colors[colorCode]
-		fillRGBA(rgba, pos, length, c[0], c[1], c[2], p.Alphas[colorCode])
-	})
+	r := newRLEReader(data, width, height)
+	for {
+		pos, length, code, ok := r.next()
+		if !ok {
+			return
+		}
+		c := p.Colors[code]
+		fillRGBA(rgba, pos, length, c[0], c[1], c[2], p.Alphas[code])
+	}
 }
 
+// shortRun is the run length below which fills write pixels directly; handwriting
+// is mostly runs of a few pixels, where the doubling copy costs more than it saves.
+const shortRun = 16
+
 func fillRGBA(rgba []byte, pos, count int, r, g, b byte, alpha byte) {
 	start := pos * 4
 	end := min(start+count*4, len(rgba))
 	if start >= end {
 		return
 	}
+	if count <= shortRun {
+		px := rgba[start:end]
+		for i := 0; i+3 < len(px); i += 4 {
+			px[i], px[i+1], px[i+2], px[i+3] = r, g, b, alpha
+		}
+		return
+	}
 	rgba[start] = r
 	rgba[start+1] = g
 	rgba[start+2] = b
@@ -195,6 +318,13 @@ func fillRGB(rgb []byte, pos, count int, r, g, b byte) {
 	if n <= 0 {
 		return
 	}
+	if count <= shortRun {
+		px := rgb[start:end]
+		for i := 0; i+2 < len(px); i += 3 {
+			px[i], px[i+1], px[i+2] = r, g, b
+		}
+		return
+	}
 	rgb[start] = r
 	rgb[start+1] = g
 	rgb[start+2] = b
@@ -208,6 +338,13 @@ func fillCodes(buf []byte, pos, count int, code byte) {
 	if pos >= end {
 		return
 	}
+	if count <= shortRun {
+		px := buf[pos:end]
+		for i := range px {
+			px[i] = code
+		}
+		return
+	}
 	buf[pos] = code
 	for filled := 1; filled < end-pos; filled *= 2 {
 		copy(buf[pos+filled:end], buf[pos:pos+filled])
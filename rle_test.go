@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"math/rand/v2"
+	"testing"
+)
+
+// Manta page size, at which the fixtures are decoded.
+const (
+	fixtureWidth  = 1920
+	fixtureHeight = 2560
+)
+
+// referenceDecodeRLE is the callback decoder rleReader replaced, kept to check
+// that both read RATTA_RLE the same way.
+func referenceDecodeRLE(data []byte, width, height int, emit func(pos, length int, colorCode byte)) {
+	expected := width * height
+	pos := 0
+
+	var heldColor, heldLength byte
+	var hasHolder bool
+
+	i := 0
+	for i+1 < len(data) && pos < expected {
+		colorCode := data[i]
+		lengthCode := data[i+1]
+		i += 2
+
+		var length int
+
+		if hasHolder {
+			prevColor, prevLength := heldColor, heldLength
+			hasHolder = false
+
+			if colorCode == prevColor {
+				length = 1 + int(lengthCode) + ((int(prevLength&0x7f) + 1) << 7)
+			} else {
+				heldLen := (int(prevLength&0x7f) + 1) << 7
+				if pos+heldLen > expected {
+					heldLen = expected - pos
+				}
+				if prevColor != 0x62 {
+					emit(pos, heldLen, prevColor)
+				}
+				pos += heldLen
+				length = int(lengthCode) + 1
+			}
+		} else if lengthCode == 0xff {
+			length = 0x4000
+		} else if lengthCode&0x80 != 0 {
+			heldColor, heldLength = colorCode, lengthCode
+			hasHolder = true
+			continue
+		} else {
+			length = int(lengthCode) + 1
+		}
+
+		if pos+length > expected {
+			length = expected - pos
+		}
+
+		if colorCode != 0x62 {
+			emit(pos, length, colorCode)
+		}
+		pos += length
+	}
+
+	if hasHolder && pos < expected {
+		tailLen := (int(heldLength&0x7f) + 1) << 7
+		if remaining := expected - pos; tailLen > remaining {
+			tailLen = remaining
+		}
+		if tailLen > 0 && heldColor != 0x62 {
+			emit(pos, tailLen, heldColor)
+		}
+	}
+}
+
+// encodeRLE encodes a code map as RATTA_RLE, using holder pairs for runs
+// longer than 128 pixels and 0xff for runs of exactly 0x4000.
+func encodeRLE(codes []byte) []byte {
+	var out []byte
+	for i := 0; i < len(codes); {
+		j := i + 1
+		for j < len(codes) && codes[j] == codes[i] {
+			j++
+		}
+		for n := j - i; n > 0; {
+			switch {
+			case n == 0x4000:
+				out = append(out, codes[i], 0xff)
+				n = 0
+			case n <= 128:
+				out = append(out, codes[i], byte(n-1))
+				n = 0
+			default:
+				run := min(n, 127<<7)
+				q := (run - 1) >> 7
+				out = append(out, codes[i], 0x80|byte(q-1), codes[i], byte(run-1-q<<7))
+				n -= run
+			}
+		}
+		i = j
+	}
+	return out
+}
+
+// handwritingPage returns the RLE of a synthetic page of handwriting: lines
+// of jittery words in black, with anti-aliasing grays around the pen, on a
+// transparent background. It is about 220 KB of RLE holding 270k ink pixels.
+func handwritingPage() []byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	codes := bytes.Repeat([]byte{0x62}, fixtureWidth*fixtureHeight)
+	set := func(x, y int, code byte) {
+		if x >= 0 && x < fixtureWidth && y >= 0 && y < fixtureHeight && codes[y*fixtureWidth+x] != 0x61 {
+			codes[y*fixtureWidth+x] = code
+		}
+	}
+	for line := 200; line < fixtureHeight-150; line += 60 {
+		for x := 120; x < fixtureWidth-200; {
+			// One word: a random walk drawn with a 3 px pen
+			px, py := float64(x), float64(line+rng.IntN(20))
+			for range 90 + rng.IntN(100) {
+				px += rng.Float64()*3 - 1.2
+				py += rng.Float64()*4 - 2
+				for dy := -1; dy <= 1; dy++ {
+					for dx := -1; dx <= 1; dx++ {
+						set(int(px)+dx, int(py)+dy, 0x61)
+					}
+				}
+				set(int(px)-2, int(py), 0x9d)
+				set(int(px)+2, int(py), 0xc9)
+				set(int(px), int(py)-2, 0x9e)
+				set(int(px), int(py)+2, 0xca)
+			}
+			x = int(px) + 30 + rng.IntN(40)
+		}
+	}
+	return encodeRLE(codes)
+}
+
+// randomStreams returns RLE streams of random pairs for a small bitmap, over
+// a few codes so that holders are often continued, with 0xff lengths and
+// streams cut in the middle of a pair.
+func randomStreams() [][]byte {
+	rng := rand.New(rand.NewPCG(3, 4))
+	codes := []byte{0x61, 0x62, 0x63, 0x66, 0x9d}
+	streams := make([][]byte, 300)
+	for i := range streams {
+		s := make([]byte, 2*(1+rng.IntN(200)))
+		for j := 0; j < len(s); j += 2 {
+			s[j] = codes[rng.IntN(len(codes))]
+			switch rng.IntN(6) {
+			case 0:
+				s[j+1] = 0xff
+			case 1, 2:
+				s[j+1] = 0x80 | byte(rng.IntN(0x7f))
+			default:
+				s[j+1] = byte(rng.IntN(0x80))
+			}
+		}
+		if i%3 == 0 {
+			s = s[:len(s)-1] // truncated pair
+		}
+		streams[i] = s
+	}
+	return streams
+}
+
+func TestRLEReaderMatchesReference(t *testing.T) {
+	type fixture struct {
+		data          []byte
+		width, height int
+	}
+	fixtures := []fixture{{handwritingPage(), fixtureWidth, fixtureHeight}}
+	for _, s := range randomStreams() {
+		fixtures = append(fixtures, fixture{s, 160, 120})
+	}
+	p := BuildPalette(ColorConfig{Black: "#000000", DarkGray: "#9D9D9D", LightGray: "#C9C9C9", White: "#FFFFFF"})
+
+	for i, f := range fixtures {
+		n := f.width * f.height
+		wantCodes := bytes.Repeat([]byte{0xff}, n)
+		wantRGB := make([]byte, n*3)
+		wantRGBA := make([]byte, n*4)
+		referenceDecodeRLE(f.data, f.width, f.height, func(pos, length int, code byte) {
+			c := p.Colors[code]
+			for k := pos; k < pos+length; k++ {
+				wantCodes[k] = code
+				copy(wantRGB[k*3:], c[:])
+				copy(wantRGBA[k*4:], []byte{c[0], c[1], c[2], p.Alphas[code]})
+			}
+		})
+
+		codes := bytes.Repeat([]byte{0xff}, n)
+		decodeRLEToCodeMap(f.data, codes, f.width, f.height)
+		rgb := make([]byte, n*3)
+		decodeRLEToRGB(f.data, rgb, f.width, f.height, p)
+		rgba := make([]byte, n*4)
+		decodeRLEToRGBA(f.data, rgba, f.width, f.height, p)
+
+		if !bytes.Equal(codes, wantCodes) {
+			t.Errorf("fixture %d: code map differs from the reference decoder", i)
+		}
+		if !bytes.Equal(rgb, wantRGB) {
+			t.Errorf("fixture %d: RGB differs from the reference decoder", i)
+		}
+		if !bytes.Equal(rgba, wantRGBA) {
+			t.Errorf("fixture %d: RGBA differs from the reference decoder", i)
+		}
+	}
+}
+
+// BenchmarkReferenceDecode is the replaced callback decoder filling a code
+// map, the baseline of BenchmarkDecodeCodes.
+func BenchmarkReferenceDecode(b *testing.B) {
+	data := handwritingPage()
+	codes := make([]byte, fixtureWidth*fixtureHeight)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		referenceDecodeRLE(data, fixtureWidth, fixtureHeight, func(pos, length int, code byte) {
+			for k := pos; k < pos+length; k++ {
+				codes[k] = code
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeCodes(b *testing.B) {
+	data := handwritingPage()
+	codes := make([]byte, fixtureWidth*fixtureHeight)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		decodeRLEToCodeMap(data, codes, fixtureWidth, fixtureHeight)
+	}
+}
+
+func BenchmarkDecodeRGB(b *testing.B) {
+	data := handwritingPage()
+	p := IdentityPalette()
+	rgb := make([]byte, fixtureWidth*fixtureHeight*3)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		decodeRLEToRGB(data, rgb, fixtureWidth, fixtureHeight, p)
+	}
+}
+
+func BenchmarkDecodeRGBA(b *testing.B) {
+	data := handwritingPage()
+	p := IdentityPalette()
+	rgba := make([]byte, fixtureWidth*fixtureHeight*4)
+	b.SetBytes(int64(len(data)))
+	for b.Loop() {
+		decodeRLEToRGBA(data, rgba, fixtureWidth, fixtureHeight, p)
+	}
+}
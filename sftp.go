@@ -0,0 +1,715 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SFTPConfig is the [watch.sftp] backend: notes are pulled from a directory
+// on an SSH server and, with output_folder, the PDFs are pushed to another.
+// It runs the system OpenSSH client (ssh) with the server's sftp subsystem,
+// so ~/.ssh/config, known_hosts and ssh-agent apply as usual and the server
+// needs no shell (SFTP-only accounts work).
+type SFTPConfig struct {
+	Host         string `toml:"host"`          // host name or ~/.ssh/config alias
+	Port         int    `toml:"port"`          // default: 22 (or ~/.ssh/config)
+	User         string `toml:"user"`          // default: ~/.ssh/config or the local user
+	IdentityFile string `toml:"identity_file"` // private key; default: ssh-agent and ssh's defaults
+	Password     string `toml:"password"`      // password login instead of a key
+	Folder       string `toml:"folder"`        // remote directory with the notes
+	OutputFolder string `toml:"output_folder"` // remote directory the PDFs are pushed to; default: not pushed
+	Output       string `toml:"output"`        // local output; default: [watch] location, else a cache dir when pushing
+	Mirror       string `toml:"mirror"`        // local copy of the notes; default: <user cache dir>/gosnare/sftp
+	PollInterval int    `toml:"poll_interval"` // seconds, 0 = default (60s)
+}
+
+func (c SFTPConfig) enabled() bool {
+	return c.Host != ""
+}
+
+// validate checks that the backend knows its folders.
+func (c SFTPConfig) validate() error {
+	if c.Folder == "" && c.OutputFolder == "" {
+		return errors.New("[watch.sftp] requires folder and/or output_folder")
+	}
+	return nil
+}
+
+func (c SFTPConfig) mirrorDir() string {
+	return mirrorDir(c.Mirror, "sftp")
+}
+
+// outputDir returns the local output directory: output, else location,
+// else a cache directory when the PDFs are pushed.
+func (c SFTPConfig) outputDir(location string) string {
+	switch {
+	case c.Output != "":
+		return c.Output
+	case location == "" && c.OutputFolder != "":
+		return mirrorDir("", "sftp-output")
+	}
+	return location
+}
+
+func (c SFTPConfig) pollInterval() time.Duration {
+	if c.PollInterval > 0 {
+		return time.Duration(c.PollInterval) * time.Second
+	}
+	return time.Minute
+}
+
+// Passwords reach ssh through SSH_ASKPASS: ssh runs this executable again,
+// which then only prints the password (see sshAskpass). The password itself
+// is in a private temporary file, named in the environment, rather than in
+// the environment of ssh and every process it starts.
+const (
+	askpassEnv      = "GOSNARE_ASKPASS"
+	passwordFileEnv = "GOSNARE_SSH_PASSWORD_FILE"
+)
+
+// sshAskpass answers ssh's password prompt when this process was started as
+// its SSH_ASKPASS program, and reports whether it was.
+func sshAskpass() bool {
+	if os.Getenv(askpassEnv) != "1" {
+		return false
+	}
+	password, err := os.ReadFile(os.Getenv(passwordFileEnv))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(string(password))
+	return true
+}
+
+// sshRemote is a directory on an SSH server; it is both a remoteSource and
+// a remoteDestination. Each call opens an sftp session; sessions share one
+// connection (ControlMaster), so a listing or download does not log in again.
+type sshRemote struct {
+	cfg  SFTPConfig
+	root string
+}
+
+func newSSHRemote(c SFTPConfig, folder string) *sshRemote {
+	return &sshRemote{cfg: c, root: strings.TrimSuffix(folder, "/")}
+}
+
+func (s *sshRemote) name() string { return "SFTP " + s.cfg.Host + ":" + s.root }
+
+// command returns ssh running the server's sftp subsystem; passwordFile
+// holds the password, if any.
+func (s *sshRemote) command(ctx context.Context, passwordFile string) *exec.Cmd {
+	args := []string{
+		"-o", "ControlMaster=auto",
+		"-o", "ControlPath=" + filepath.Join(os.TempDir(), "gosnare-%C"),
+		"-o", "ControlPersist=120",
+		"-o", "ServerAliveInterval=30",
+		"-s",
+	}
+	if s.cfg.Port != 0 {
+		args = append(args, "-p", strconv.Itoa(s.cfg.Port))
+	}
+	if s.cfg.User != "" {
+		args = append(args, "-l", s.cfg.User)
+	}
+	if s.cfg.IdentityFile != "" {
+		args = append(args, "-i", s.cfg.IdentityFile, "-o", "IdentitiesOnly=yes")
+	}
+	if s.cfg.Password == "" {
+		args = append(args, "-o", "BatchMode=yes") // never prompt
+	}
+	cmd := exec.CommandContext(ctx, "ssh", append(args, "--", s.cfg.Host, "sftp")...)
+	if passwordFile != "" {
+		exe, _ := os.Executable()
+		cmd.Env = append(os.Environ(), "SSH_ASKPASS="+exe, "SSH_ASKPASS_REQUIRE=force", askpassEnv+"=1", passwordFileEnv+"="+passwordFile)
+	}
+	return cmd
+}
+
+// session runs fn with an sftp session to the server, then ends it.
+func (s *sshRemote) session(ctx context.Context, fn func(c *sftpConn) error) error {
+	var passwordFile string
+	if s.cfg.Password != "" {
+		f, err := os.CreateTemp("", "gosnare-askpass-*") // mode 0600
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(s.cfg.Password)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		passwordFile = f.Name()
+	}
+	cmd := s.command(ctx, passwordFile)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	c := &sftpConn{w: stdin, r: bufio.NewReader(stdout)}
+	err = c.init()
+	if err == nil {
+		err = fn(c)
+	}
+	stdin.Close()
+	werr := cmd.Wait()
+	if err != nil && (werr != nil || errors.Is(err, io.ErrUnexpectedEOF)) {
+		// The connection failed rather than a request: ssh says why
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("%w: %s", err, msg)
+		}
+	}
+	return err
+}
+
+func (s *sshRemote) remotePath(rel string) string {
+	return path.Join(s.root, rel)
+}
+
+// list walks the remote folder; like find -type f, it skips symlinks and
+// other special files.
+func (s *sshRemote) list(ctx context.Context) ([]remoteFile, error) {
+	var files []remoteFile
+	err := s.session(ctx, func(c *sftpConn) error {
+		var err error
+		files, err = s.walk(c)
+		return err
+	})
+	return files, err
+}
+
+// walk lists the files under the folder. A missing folder is an error, not
+// an empty listing: mirroring that would delete every local copy.
+func (s *sshRemote) walk(c *sftpConn) ([]remoteFile, error) {
+	var files []remoteFile
+	var walk func(rel string) error
+	walk = func(rel string) error {
+		entries, err := c.readDir(s.remotePath(rel))
+		if err != nil {
+			if rel == "" {
+				return fmt.Errorf("remote folder %s: %w", s.root, err)
+			}
+			return err
+		}
+		for _, e := range entries {
+			p := path.Join(rel, e.name)
+			switch e.mode & sftpTypeMask {
+			case sftpTypeDir:
+				if err := walk(p); err != nil {
+					return err
+				}
+			case sftpTypeRegular:
+				files = append(files, remoteFile{path: p, size: e.size, modTime: e.modTime, id: p})
+			}
+		}
+		return nil
+	}
+	err := walk("")
+	return files, err
+}
+
+func (s *sshRemote) download(ctx context.Context, f remoteFile, w io.Writer) error {
+	return s.session(ctx, func(c *sftpConn) error {
+		return c.get(s.remotePath(f.id), w)
+	})
+}
+
+// upload writes the file aside and renames it into place, so readers on the
+// server never see it partial; modTime is kept to the second.
+func (s *sshRemote) upload(ctx context.Context, rel string, r io.Reader, modTime time.Time) error {
+	p := s.remotePath(rel)
+	return s.session(ctx, func(c *sftpConn) error {
+		if err := c.mkdirAll(path.Dir(p)); err != nil {
+			return err
+		}
+		tmp := p + ".part"
+		if err := c.put(tmp, r); err != nil {
+			return err
+		}
+		if err := c.setModTime(tmp, modTime); err != nil {
+			return err
+		}
+		return c.rename(tmp, p)
+	})
+}
+
+func (s *sshRemote) remove(ctx context.Context, rel string) error {
+	return s.session(ctx, func(c *sftpConn) error {
+		if err := c.remove(s.remotePath(rel)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	})
+}
+
+// SFTP version 3 (draft-ietf-secsh-filexfer-02), the version OpenSSH speaks,
+// as far as sshRemote needs it.
+const (
+	sftpInit     = 1
+	sftpVersion  = 2
+	sftpOpen     = 3
+	sftpClose    = 4
+	sftpRead     = 5
+	sftpWrite    = 6
+	sftpSetstat  = 9
+	sftpOpendir  = 11
+	sftpReaddir  = 12
+	sftpRemove   = 13
+	sftpMkdir    = 14
+	sftpStat     = 17
+	sftpRename   = 18
+	sftpExtended = 200
+	sftpStatus   = 101
+	sftpHandle   = 102
+	sftpData     = 103
+	sftpName     = 104
+	sftpAttrs    = 105
+
+	sftpOK               = 0
+	sftpEOF              = 1
+	sftpNoSuchFile       = 2
+	sftpPermissionDenied = 3
+
+	sftpAttrSize        = 0x1
+	sftpAttrUIDGID      = 0x2
+	sftpAttrPermissions = 0x4
+	sftpAttrACModTime   = 0x8
+	sftpAttrExtended    = 0x80000000
+
+	sftpFlagRead  = 0x1
+	sftpFlagWrite = 0x2
+	sftpFlagCreat = 0x8
+	sftpFlagTrunc = 0x10
+
+	sftpTypeMask    = 0o170000
+	sftpTypeDir     = 0o040000
+	sftpTypeRegular = 0o100000
+
+	// sftpChunk is the size of reads and writes, and sftpWindow how many of
+	// them are in flight at once, so transfers are not bound by latency.
+	sftpChunk  = 32 << 10
+	sftpWindow = 16
+)
+
+// sftpConn is one sftp session. Requests are answered in order, which
+// OpenSSH's server does, so pipelined reads and writes need no reordering.
+type sftpConn struct {
+	w           io.Writer
+	r           *bufio.Reader
+	nextID      uint32
+	posixRename bool // the server has posix-rename@openssh.com
+}
+
+// sftpStatusError is a failed request.
+type sftpStatusError struct {
+	code uint32
+	msg  string
+}
+
+func (e *sftpStatusError) Error() string {
+	if e.msg != "" {
+		return "sftp: " + e.msg
+	}
+	return fmt.Sprintf("sftp: status %d", e.code)
+}
+
+func (e *sftpStatusError) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.code == sftpNoSuchFile
+	case fs.ErrPermission:
+		return e.code == sftpPermissionDenied
+	}
+	return false
+}
+
+// sftpPacket builds a packet payload.
+type sftpPacket []byte
+
+func (p sftpPacket) u32(v uint32) sftpPacket { return binary.BigEndian.AppendUint32(p, v) }
+func (p sftpPacket) u64(v uint64) sftpPacket { return binary.BigEndian.AppendUint64(p, v) }
+func (p sftpPacket) str(s []byte) sftpPacket { return append(p.u32(uint32(len(s))), s...) }
+
+// sftpReply parses a reply payload; reads past its end yield zeros and set
+// short.
+type sftpReply struct {
+	data  []byte
+	short bool
+}
+
+func (r *sftpReply) u32() uint32 {
+	if len(r.data) < 4 {
+		r.short, r.data = true, nil
+		return 0
+	}
+	v := binary.BigEndian.Uint32(r.data)
+	r.data = r.data[4:]
+	return v
+}
+
+func (r *sftpReply) u64() uint64 {
+	return uint64(r.u32())<<32 | uint64(r.u32())
+}
+
+func (r *sftpReply) str() []byte {
+	n := r.u32()
+	if uint32(len(r.data)) < n {
+		r.short, r.data = true, nil
+		return nil
+	}
+	s := r.data[:n]
+	r.data = r.data[n:]
+	return s
+}
+
+// sftpFileAttrs is what sshRemote reads of file attributes.
+type sftpFileAttrs struct {
+	name    string
+	size    int64
+	mode    uint32
+	modTime time.Time
+}
+
+func (r *sftpReply) attrs() sftpFileAttrs {
+	var a sftpFileAttrs
+	flags := r.u32()
+	if flags&sftpAttrSize != 0 {
+		a.size = int64(r.u64())
+	}
+	if flags&sftpAttrUIDGID != 0 {
+		r.u32()
+		r.u32()
+	}
+	if flags&sftpAttrPermissions != 0 {
+		a.mode = r.u32()
+	}
+	if flags&sftpAttrACModTime != 0 {
+		r.u32() // atime
+		a.modTime = time.Unix(int64(r.u32()), 0)
+	}
+	if flags&sftpAttrExtended != 0 {
+		for n := r.u32(); n > 0 && !r.short; n-- {
+			r.str()
+			r.str()
+		}
+	}
+	return a
+}
+
+// send writes a packet of type typ; requests get the next id, returned.
+func (c *sftpConn) send(typ byte, payload sftpPacket) (uint32, error) {
+	var id uint32
+	pkt := sftpPacket{0, 0, 0, 0, typ}
+	if typ != sftpInit {
+		c.nextID++
+		id = c.nextID
+		pkt = pkt.u32(id)
+	}
+	pkt = append(pkt, payload...)
+	binary.BigEndian.PutUint32(pkt, uint32(len(pkt)-4))
+	_, err := c.w.Write(pkt)
+	return id, err
+}
+
+// recv reads the reply to request id, returning its type and payload.
+func (c *sftpConn) recv(id uint32) (byte, *sftpReply, error) {
+	var hdr [5]byte
+	if _, err := io.ReadFull(c.r, hdr[:]); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	if n < 1 || n > 1<<24 {
+		return 0, nil, fmt.Errorf("sftp: bad packet length %d", n)
+	}
+	data := make([]byte, n-1)
+	if _, err := io.ReadFull(c.r, data); err != nil {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+	r := &sftpReply{data: data}
+	if hdr[4] == sftpVersion {
+		return hdr[4], r, nil
+	}
+	if got := r.u32(); got != id {
+		return 0, nil, fmt.Errorf("sftp: reply to request %d, expected %d", got, id)
+	}
+	return hdr[4], r, nil
+}
+
+// call sends a request and reads its reply. A STATUS reply other than OK is
+// returned as an error, unless the caller expects STATUS.
+func (c *sftpConn) call(typ byte, payload sftpPacket, want byte) (*sftpReply, error) {
+	id, err := c.send(typ, payload)
+	if err != nil {
+		return nil, err
+	}
+	return c.reply(id, want)
+}
+
+func (c *sftpConn) reply(id uint32, want byte) (*sftpReply, error) {
+	typ, r, err := c.recv(id)
+	if err != nil {
+		return nil, err
+	}
+	if typ == sftpStatus {
+		code, msg := r.u32(), r.str()
+		if code != sftpOK || want != sftpStatus {
+			return nil, &sftpStatusError{code: code, msg: string(msg)}
+		}
+		return r, nil
+	}
+	if typ != want {
+		return nil, fmt.Errorf("sftp: unexpected reply type %d", typ)
+	}
+	return r, nil
+}
+
+func (c *sftpConn) init() error {
+	if _, err := c.send(sftpInit, sftpPacket{}.u32(3)); err != nil {
+		return err
+	}
+	typ, r, err := c.recv(0)
+	if err != nil {
+		return err
+	}
+	if typ != sftpVersion {
+		return fmt.Errorf("sftp: unexpected reply type %d to init", typ)
+	}
+	r.u32() // version
+	for len(r.data) > 0 && !r.short {
+		name, data := r.str(), r.str()
+		if string(name) == "posix-rename@openssh.com" && string(data) == "1" {
+			c.posixRename = true
+		}
+	}
+	return nil
+}
+
+func (c *sftpConn) open(p string, flags uint32) ([]byte, error) {
+	r, err := c.call(sftpOpen, sftpPacket{}.str([]byte(p)).u32(flags).u32(0), sftpHandle)
+	if err != nil {
+		return nil, err
+	}
+	return r.str(), nil
+}
+
+func (c *sftpConn) close(handle []byte) error {
+	_, err := c.call(sftpClose, sftpPacket{}.str(handle), sftpStatus)
+	return err
+}
+
+// readDir lists the entries of directory p, without . and ..
+func (c *sftpConn) readDir(p string) ([]sftpFileAttrs, error) {
+	r, err := c.call(sftpOpendir, sftpPacket{}.str([]byte(p)), sftpHandle)
+	if err != nil {
+		return nil, err
+	}
+	handle := r.str()
+	var entries []sftpFileAttrs
+	for {
+		r, err := c.call(sftpReaddir, sftpPacket{}.str(handle), sftpName)
+		var se *sftpStatusError
+		if errors.As(err, &se) && se.code == sftpEOF {
+			break
+		}
+		if err != nil {
+			c.close(handle)
+			return nil, err
+		}
+		for n := r.u32(); n > 0 && !r.short; n-- {
+			name := string(r.str())
+			r.str() // long name
+			a := r.attrs()
+			if name != "." && name != ".." {
+				a.name = name
+				entries = append(entries, a)
+			}
+		}
+	}
+	return entries, c.close(handle)
+}
+
+// get copies file p to w, with up to sftpWindow reads in flight.
+func (c *sftpConn) get(p string, w io.Writer) error {
+	handle, err := c.open(p, sftpFlagRead)
+	if err != nil {
+		return err
+	}
+	type read struct {
+		id     uint32
+		offset uint64
+	}
+	var (
+		offset  uint64
+		pending []read
+	)
+	drain := func() {
+		for _, rd := range pending {
+			c.recv(rd.id)
+		}
+		pending = nil
+	}
+	fail := func(err error) error {
+		drain()
+		c.close(handle)
+		return err
+	}
+	for {
+		for len(pending) < sftpWindow {
+			id, err := c.send(sftpRead, sftpPacket{}.str(handle).u64(offset).u32(sftpChunk))
+			if err != nil {
+				return err
+			}
+			pending = append(pending, read{id, offset})
+			offset += sftpChunk
+		}
+		rd := pending[0]
+		pending = pending[1:]
+		r, err := c.reply(rd.id, sftpData)
+		var se *sftpStatusError
+		if errors.As(err, &se) && se.code == sftpEOF {
+			drain()
+			return c.close(handle)
+		}
+		if err != nil {
+			return fail(err)
+		}
+		data := r.str()
+		if _, err := w.Write(data); err != nil {
+			return fail(err)
+		}
+		if len(data) < sftpChunk {
+			// A short read: the reads after it would leave a gap, so
+			// drop them and continue where this one ended
+			drain()
+			offset = rd.offset + uint64(len(data))
+		}
+	}
+}
+
+// put creates or truncates file p with the contents of r, with up to
+// sftpWindow writes in flight.
+func (c *sftpConn) put(p string, r io.Reader) error {
+	handle, err := c.open(p, sftpFlagWrite|sftpFlagCreat|sftpFlagTrunc)
+	if err != nil {
+		return err
+	}
+	var (
+		offset  uint64
+		pending []uint32
+		buf     = make([]byte, sftpChunk)
+		rerr    error
+	)
+	for rerr == nil || len(pending) > 0 {
+		for rerr == nil && len(pending) < sftpWindow {
+			var n int
+			n, rerr = io.ReadFull(r, buf)
+			if n > 0 {
+				id, err := c.send(sftpWrite, sftpPacket{}.str(handle).u64(offset).str(buf[:n]))
+				if err != nil {
+					return err
+				}
+				pending = append(pending, id)
+				offset += uint64(n)
+			}
+		}
+		if len(pending) == 0 {
+			break
+		}
+		id := pending[0]
+		pending = pending[1:]
+		if _, err := c.reply(id, sftpStatus); err != nil {
+			c.drain(pending)
+			c.close(handle)
+			return err
+		}
+	}
+	if rerr != io.EOF && rerr != io.ErrUnexpectedEOF {
+		c.close(handle)
+		return rerr
+	}
+	return c.close(handle)
+}
+
+// drain reads the replies to requests abandoned after an error.
+func (c *sftpConn) drain(ids []uint32) {
+	for _, id := range ids {
+		c.recv(id)
+	}
+}
+
+func (c *sftpConn) stat(p string) (sftpFileAttrs, error) {
+	r, err := c.call(sftpStat, sftpPacket{}.str([]byte(p)), sftpAttrs)
+	if err != nil {
+		return sftpFileAttrs{}, err
+	}
+	return r.attrs(), nil
+}
+
+// mkdirAll creates directory p and its missing parents.
+func (c *sftpConn) mkdirAll(p string) error {
+	if a, err := c.stat(p); err == nil {
+		if a.mode&sftpTypeMask != sftpTypeDir {
+			return fmt.Errorf("sftp: %s is not a directory", p)
+		}
+		return nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if parent := path.Dir(p); parent != p {
+		if err := c.mkdirAll(parent); err != nil {
+			return err
+		}
+	}
+	_, err := c.call(sftpMkdir, sftpPacket{}.str([]byte(p)).u32(0), sftpStatus)
+	return err
+}
+
+func (c *sftpConn) setModTime(p string, t time.Time) error {
+	sec := uint32(t.Unix())
+	_, err := c.call(sftpSetstat, sftpPacket{}.str([]byte(p)).u32(sftpAttrACModTime).u32(sec).u32(sec), sftpStatus)
+	return err
+}
+
+// rename moves oldpath over newpath. Plain SFTP v3 rename fails if newpath
+// exists, so without posix-rename the target is removed first.
+func (c *sftpConn) rename(oldpath, newpath string) error {
+	if c.posixRename {
+		_, err := c.call(sftpExtended, sftpPacket{}.str([]byte("posix-rename@openssh.com")).str([]byte(oldpath)).str([]byte(newpath)), sftpStatus)
+		return err
+	}
+	if err := c.remove(newpath); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	_, err := c.call(sftpRename, sftpPacket{}.str([]byte(oldpath)).str([]byte(newpath)), sftpStatus)
+	return err
+}
+
+func (c *sftpConn) remove(p string) error {
+	_, err := c.call(sftpRemove, sftpPacket{}.str([]byte(p)), sftpStatus)
+	return err
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+// sftpReplies is a server's side of a session: the packets it answers with,
+// in order.
+func sftpReplies(packets ...sftpPacket) *bufio.Reader {
+	var b bytes.Buffer
+	for _, p := range packets {
+		b.Write(binary.BigEndian.AppendUint32(nil, uint32(len(p))))
+		b.Write(p)
+	}
+	return bufio.NewReader(&b)
+}
+
+func TestSFTPListMissingFolder(t *testing.T) {
+	s := newSSHRemote(SFTPConfig{Host: "nas.local"}, "/srv/supernote/Note")
+	noSuchFile := sftpPacket{sftpStatus}.u32(1).u32(sftpNoSuchFile).str([]byte("No such file")).str(nil)
+	c := &sftpConn{w: io.Discard, r: sftpReplies(noSuchFile)}
+
+	files, err := s.walk(c)
+	if err == nil {
+		t.Fatalf("got %d files and no error, want an error", len(files))
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("got %v, want a not-exist error", err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"math"
+
+	"github.com/dennwc/gotrace"
+)
+
+// maxMergedSegments bounds how many traced segments simplification merges into
+// one, which bounds its cost on long runs.
+const maxMergedSegments = 16
+
+// simplifyPaths reduces the segments of traced paths ([trace] simplify):
+// shapes no larger than tol device pixels either way are dropped, runs of
+// Bezier segments are merged into single curves and runs of corners thinned
+// (Douglas-Peucker) while every point stays within tol of the original
+// outline. Paths are modified in place.
+func simplifyPaths(paths []gotrace.Path, tol float64) []gotrace.Path {
+	if tol <= 0 {
+		return paths
+	}
+	out := paths[:0]
+	for _, p := range paths {
+		if pathSmallerThan(p, tol) {
+			continue
+		}
+		p.Curve = simplifyCurve(p.Curve, tol)
+		p.Childs = simplifyPaths(p.Childs, tol)
+		out = append(out, p)
+	}
+	return out
+}
+
+// pathSmallerThan reports whether the control points of p fit in a tol-sized
+// box.
+func pathSmallerThan(p gotrace.Path, tol float64) bool {
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for _, seg := range p.Curve {
+		for _, pt := range seg.Pnt {
+			minX, maxX = min(minX, pt.X), max(maxX, pt.X)
+			minY, maxY = min(minY, pt.Y), max(maxY, pt.Y)
+		}
+	}
+	return maxX-minX <= tol && maxY-minY <= tol
+}
+
+// simplifyCurve simplifies one closed curve. It starts (and ends) at the end
+// point of its last segment, which is kept.
+func simplifyCurve(curve []gotrace.Segment, tol float64) []gotrace.Segment {
+	if len(curve) < 3 {
+		return curve
+	}
+	out := make([]gotrace.Segment, 0, len(curve))
+	start := curve[len(curve)-1].Pnt[2]
+	for i := 0; i < len(curve); {
+		j := i + 1
+		for j < len(curve) && j-i < maxMergedSegments && curve[j].Type == curve[i].Type {
+			j++
+		}
+		if curve[i].Type == gotrace.TypeBezier {
+			out = mergeBeziers(out, start, curve[i:j], tol)
+		} else {
+			out = thinCorners(out, start, curve[i:j], tol)
+		}
+		start = curve[j-1].Pnt[2]
+		i = j
+	}
+	return out
+}
+
+// mergeBeziers appends the Bezier run to out, starting at start, merging
+// segments into one curve for as long as it fits them within tol.
+func mergeBeziers(out []gotrace.Segment, start gotrace.Point, run []gotrace.Segment, tol float64) []gotrace.Segment {
+	for len(run) > 0 {
+		n := 1
+		merged := run[0]
+		for k := 2; k <= len(run); k++ {
+			seg, ok := fitBezier(start, run[:k], tol)
+			if !ok {
+				break
+			}
+			n, merged = k, seg
+		}
+		out = append(out, merged)
+		start = merged.Pnt[2]
+		run = run[n:]
+	}
+	return out
+}
+
+// fitBezier returns one Bezier segment from start to the end of run that
+// keeps the tangents at both ends, if every sampled point of run lies within
+// tol of it.
+func fitBezier(start gotrace.Point, run []gotrace.Segment, tol float64) (gotrace.Segment, bool) {
+	end := run[len(run)-1].Pnt[2]
+	chord := pointDist(start, end)
+	if chord == 0 {
+		return gotrace.Segment{}, false
+	}
+	t0 := unitVector(subPoint(run[0].Pnt[0], start), subPoint(end, start))
+	t1 := unitVector(subPoint(end, run[len(run)-1].Pnt[1]), subPoint(end, start))
+	seg := gotrace.Segment{Type: gotrace.TypeBezier, Pnt: [3]gotrace.Point{
+		{X: start.X + t0.X*chord/3, Y: start.Y + t0.Y*chord/3},
+		{X: end.X - t1.X*chord/3, Y: end.Y - t1.Y*chord/3},
+		end,
+	}}
+
+	const samples = 24
+	var poly [samples + 1]gotrace.Point
+	for k := range poly {
+		poly[k] = bezierAt(start, seg, float64(k)/samples)
+	}
+	from := start
+	for _, s := range run {
+		for _, t := range []float64{0.25, 0.5, 0.75, 1} {
+			if distToPolyline(bezierAt(from, s, t), poly[:]) > tol {
+				return gotrace.Segment{}, false
+			}
+		}
+		from = s.Pnt[2]
+	}
+	return seg, true
+}
+
+// thinCorners appends the corner run to out, starting at start, dropping the
+// vertices of its polyline that lie within tol of the simplified line.
+func thinCorners(out []gotrace.Segment, start gotrace.Point, run []gotrace.Segment, tol float64) []gotrace.Segment {
+	pts := []gotrace.Point{start}
+	for _, s := range run {
+		pts = append(pts, s.Pnt[1], s.Pnt[2])
+	}
+	keep := douglasPeucker(pts, tol)
+	// Corners are drawn as two lines; pair up the kept points, splitting a
+	// leftover line at its midpoint
+	for i := 1; i < len(keep); i += 2 {
+		if i+1 < len(keep) {
+			out = append(out, gotrace.Segment{Type: gotrace.TypeCorner, Pnt: [3]gotrace.Point{{}, keep[i], keep[i+1]}})
+			continue
+		}
+		a, b := keep[i-1], keep[i]
+		mid := gotrace.Point{X: (a.X + b.X) / 2, Y: (a.Y + b.Y) / 2}
+		out = append(out, gotrace.Segment{Type: gotrace.TypeCorner, Pnt: [3]gotrace.Point{{}, mid, b}})
+	}
+	return out
+}
+
+// douglasPeucker returns the points of the polyline pts that the
+// Douglas-Peucker algorithm keeps at tolerance tol, ends included.
+func douglasPeucker(pts []gotrace.Point, tol float64) []gotrace.Point {
+	if len(pts) < 3 {
+		return pts
+	}
+	far, farDist := 0, 0.0
+	for i := 1; i < len(pts)-1; i++ {
+		if d := distToSegment(pts[i], pts[0], pts[len(pts)-1]); d > farDist {
+			far, farDist = i, d
+		}
+	}
+	if farDist <= tol {
+		return []gotrace.Point{pts[0], pts[len(pts)-1]}
+	}
+	left := douglasPeucker(pts[:far+1], tol)
+	return append(left[:len(left)-1:len(left)-1], douglasPeucker(pts[far:], tol)...)
+}
+
+// bezierAt returns the point at t of a segment starting at from; corners are
+// the two lines through their vertex.
+func bezierAt(from gotrace.Point, s gotrace.Segment, t float64) gotrace.Point {
+	if s.Type == gotrace.TypeCorner {
+		if t < 0.5 {
+			return lerpPoint(from, s.Pnt[1], t*2)
+		}
+		return lerpPoint(s.Pnt[1], s.Pnt[2], t*2-1)
+	}
+	u := 1 - t
+	a, b, c, d := u*u*u, 3*u*u*t, 3*u*t*t, t*t*t
+	return gotrace.Point{
+		X: a*from.X + b*s.Pnt[0].X + c*s.Pnt[1].X + d*s.Pnt[2].X,
+		Y: a*from.Y + b*s.Pnt[0].Y + c*s.Pnt[1].Y + d*s.Pnt[2].Y,
+	}
+}
+
+func lerpPoint(a, b gotrace.Point, t float64) gotrace.Point {
+	return gotrace.Point{X: a.X + (b.X-a.X)*t, Y: a.Y + (b.Y-a.Y)*t}
+}
+
+func subPoint(a, b gotrace.Point) gotrace.Point {
+	return gotrace.Point{X: a.X - b.X, Y: a.Y - b.Y}
+}
+
+func pointDist(a, b gotrace.Point) float64 {
+	return math.Hypot(a.X-b.X, a.Y-b.Y)
+}
+
+// unitVector returns v scaled to length 1, or fallback's direction if v is zero.
+func unitVector(v, fallback gotrace.Point) gotrace.Point {
+	l := math.Hypot(v.X, v.Y)
+	if l == 0 {
+		v, l = fallback, math.Hypot(fallback.X, fallback.Y)
+	}
+	return gotrace.Point{X: v.X / l, Y: v.Y / l}
+}
+
+func distToSegment(p, a, b gotrace.Point) float64 {
+	ab := subPoint(b, a)
+	l2 := ab.X*ab.X + ab.Y*ab.Y
+	if l2 == 0 {
+		return pointDist(p, a)
+	}
+	t := max(0, min(1, ((p.X-a.X)*ab.X+(p.Y-a.Y)*ab.Y)/l2))
+	return pointDist(p, lerpPoint(a, b, t))
+}
+
+func distToPolyline(p gotrace.Point, poly []gotrace.Point) float64 {
+	d := math.Inf(1)
+	for i := 1; i < len(poly); i++ {
+		d = min(d, distToSegment(p, poly[i-1], poly[i]))
+	}
+	return d
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// remountRetry is how often the remount command is re-run while a source
+	// stays unavailable.
+	remountRetry = time.Minute
+	// remountTimeout bounds a single run of the remount command.
+	remountTimeout = 2 * time.Minute
+)
+
+// sourceHealth tracks whether each watch source (input directory) is
+// reachable. A source is down when its directory cannot be read, when its
+// configured mount point is not mounted, or when it suddenly reads empty after
+// holding files. While a source is down nothing is converted from it and no
+// outputs are removed on its behalf, so a dropped WebDAV or FUSE mount does not
+// look like every note being deleted.
+type sourceHealth struct {
+	mu          sync.Mutex
+	sources     map[string]*sourceStatus // by input directory
+	onRecovered func(t WatchTarget)
+}
+
+type sourceStatus struct {
+	down        bool
+	since       time.Time
+	entries     int // top-level entries at the last healthy check
+	lastRemount time.Time
+	remounting  bool
+}
+
+func newSourceHealth(onRecovered func(t WatchTarget)) *sourceHealth {
+	return &sourceHealth{sources: make(map[string]*sourceStatus), onRecovered: onRecovered}
+}
+
+// available reports the last known state of the source at input. Sources not
+// checked yet count as available.
+func (h *sourceHealth) available(input string) bool {
+	if h == nil {
+		return true
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	s, ok := h.sources[input]
+	return !ok || !s.down
+}
+
+// probe checks t's source now, reporting outages and recoveries, and returns
+// whether it is available. A recovered source is handed to onRecovered.
+func (h *sourceHealth) probe(t WatchTarget, w WatchConfig) bool {
+	if h == nil {
+		return true
+	}
+	entries, reason := sourceProblem(t)
+
+	h.mu.Lock()
+	s, ok := h.sources[t.Input]
+	if !ok {
+		s = &sourceStatus{}
+		h.sources[t.Input] = s
+	}
+	if reason == "" && entries == 0 && s.entries > 0 {
+		reason = "directory became empty; the mount may have dropped"
+	}
+
+	switch {
+	case reason == "" && s.down:
+		downFor := time.Since(s.since).Round(time.Second)
+		s.down, s.entries = false, entries
+		h.mu.Unlock()
+		logger.Event(Event{Name: EventSourceUp, Input: t.Input, Seconds: downFor.Seconds()},
+			"Source '%s' is available again after %s; resuming", t.Input, downFor)
+		if h.onRecovered != nil {
+			go h.onRecovered(t)
+		}
+		return true
+
+	case reason == "":
+		s.entries = entries
+		h.mu.Unlock()
+		return true
+
+	case !s.down:
+		s.down, s.since = true, time.Now()
+		logger.Event(Event{Name: EventSourceDown, Input: t.Input, Error: reason},
+			"Source '%s' is unavailable (%s); suspending conversion and cleanup for it", t.Input, reason)
+	}
+
+	remount := w.RemountCommand != "" && !s.remounting && time.Since(s.lastRemount) >= remountRetry
+	if remount {
+		s.remounting, s.lastRemount = true, time.Now()
+	}
+	h.mu.Unlock()
+
+	if remount {
+		go h.remount(t, w.RemountCommand)
+	}
+	return false
+}
+
+// outputAvailable probes every source writing into outDir and reports whether
+// all of them are available, i.e. whether orphans in outDir can be trusted.
+func (h *sourceHealth) outputAvailable(w WatchConfig, outDir string) bool {
+	ok := true
+	for _, t := range w.Targets() {
+		if t.Output == outDir && !h.probe(t, w) {
+			ok = false
+		}
+	}
+	return ok
+}
+
+// remount runs the configured remount command for t's source. The source is
+// picked up again by the next check once the command has restored it.
+func (h *sourceHealth) remount(t WatchTarget, command string) {
+	defer func() {
+		h.mu.Lock()
+		h.sources[t.Input].remounting = false
+		h.mu.Unlock()
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), remountTimeout)
+	defer cancel()
+	cmd := shellCommand(ctx, command)
+	cmd.Env = append(os.Environ(), "GOSNARE_SOURCE="+t.Input, "GOSNARE_MOUNT="+t.Mount)
+
+	logger.Infof("Running remount command for '%s'", t.Input)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Errorf("remount command for '%s': %v: %s", t.Input, err, strings.TrimSpace(string(out)))
+		return
+	}
+	logger.Debugf("remount command for '%s' finished: %s", t.Input, strings.TrimSpace(string(out)))
+}
+
+// sourceProblem checks that t's input directory can be read and, if t.Mount
+// is set, that it is mounted. It returns the number of top-level entries and
+// a description of the problem, if any.
+func sourceProblem(t WatchTarget) (int, string) {
+	if t.Mount != "" {
+		mounted, err := isMountPoint(t.Mount)
+		if err != nil {
+			return 0, err.Error()
+		}
+		if !mounted {
+			return 0, t.Mount + " is not mounted"
+		}
+	}
+	entries, err := os.ReadDir(t.Input)
+	if err != nil {
+		return 0, err.Error()
+	}
+	return len(entries), ""
+}
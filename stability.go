@@ -0,0 +1,103 @@
+package main
+
+import (
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// maxStabilityDeferrals bounds how often an unchanged source that never looks
+// complete is deferred; it is then converted anyway, so a corrupt file
+// fails (and is retried or quarantined) instead of waiting forever.
+const maxStabilityDeferrals = 10
+
+// stabilityGate holds back watch jobs whose files may still be written: sync
+// clients write large notes in chunks over many seconds, and a conversion
+// started in between reads a truncated file.
+type stabilityGate struct {
+	window time.Duration
+
+	mu       sync.Mutex
+	deferred map[string]stabilityState // by source path
+}
+
+// stabilityState is the source's size and modification time when it was last
+// deferred, and how often it was deferred unchanged.
+type stabilityState struct {
+	size    int64
+	modTime time.Time
+	count   int
+}
+
+func newStabilityGate(window time.Duration) *stabilityGate {
+	return &stabilityGate{window: window, deferred: make(map[string]stabilityState)}
+}
+
+// ready reports whether j's files look complete: neither the source nor the
+// companion PDF was modified within the window, and the source's footer
+// parses. Otherwise it returns how long to wait before checking again.
+func (g *stabilityGate) ready(j convJob, now time.Time) (bool, time.Duration) {
+	info, err := os.Stat(j.input)
+	if err != nil {
+		return true, 0 // gone; the job fails or is dropped as usual
+	}
+	wait := g.window - now.Sub(info.ModTime())
+	if j.companionPDF != "" {
+		if ci, err := os.Stat(j.companionPDF); err == nil {
+			wait = max(wait, g.window-now.Sub(ci.ModTime()))
+		}
+	}
+	if wait <= 0 && footerComplete(j.input) {
+		g.mu.Lock()
+		delete(g.deferred, j.input)
+		g.mu.Unlock()
+		return true, 0
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	s := g.deferred[j.input]
+	if s.size == info.Size() && s.modTime.Equal(info.ModTime()) {
+		s.count++
+	} else {
+		s = stabilityState{size: info.Size(), modTime: info.ModTime()}
+	}
+	if s.count >= maxStabilityDeferrals {
+		delete(g.deferred, j.input)
+		logger.Warnf("'%s' still looks incomplete after %d checks; converting it anyway", j.input, s.count)
+		return true, 0
+	}
+	g.deferred[j.input] = s
+	if wait <= 0 {
+		wait = g.window // settled, but the footer is not written yet
+	}
+	return false, wait
+}
+
+// footerComplete reports whether a .note/.mark file ends in a footer: its
+// last 4 bytes address a metadata block that lies within the file and
+// parses. A file still being written ends in arbitrary data instead.
+func footerComplete(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	size, err := f.Seek(-4, io.SeekEnd)
+	if err != nil {
+		return false
+	}
+	addr, err := readUint32(f)
+	if err != nil || addr == 0 || int64(addr)+4 > size {
+		return false
+	}
+	if _, err := f.Seek(int64(addr), io.SeekStart); err != nil {
+		return false
+	}
+	if n, err := readUint32(f); err != nil || int64(addr)+4+int64(n) > size {
+		return false
+	}
+	footer, err := parseMetadataBlock(f, uint64(addr))
+	return err == nil && len(footer) > 0
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// stateFileName is the default location of the state DB, relative to the output root.
+const stateFileName = ".gosnare/state.json"
+
+// stateEntry records the outcome of the last conversion of one output file.
+type stateEntry struct {
+	Source        string    `json:"source"`
+	Companion     string    `json:"companion,omitempty"`
+	SourceHash    string    `json:"sourceHash"`
+	SourceSize    int64     `json:"sourceSize"`
+	SourceModTime time.Time `json:"sourceModTime"`
+	OutputHash    string    `json:"outputHash,omitempty"`
+	Pages         int       `json:"pages,omitempty"`
+	ExtraPages    int       `json:"extraPages,omitempty"` // contents pages in front of the source's
+	ConvertedAt   time.Time `json:"convertedAt"`
+	Error         string    `json:"error,omitempty"`    // set while the source is quarantined
+	Attempts      int       `json:"attempts,omitempty"` // failed conversions of the unchanged source
+	RetryAt       time.Time `json:"retryAt,omitzero"`   // next attempt while quarantined; zero once attempts ran out
+	Usage         *jobUsage `json:"usage,omitempty"`    // resources used by the last conversion
+	Warnings      []Warning `json:"warnings,omitempty"`
+}
+
+// Quarantined reports whether the last conversion of this entry failed.
+func (e stateEntry) Quarantined() bool {
+	return e.Error != ""
+}
+
+// stateDB is a small JSON-backed record of every conversion GoSNare performed
+// into an output tree, keyed by output path relative to that tree's root.
+type stateDB struct {
+	mu      sync.Mutex
+	path    string
+	root    string
+	entries map[string]stateEntry
+	modTime time.Time // of the file when entries were last read or written
+}
+
+// openStateDB loads the state DB for the given output root. override, if set,
+// replaces the default <root>/.gosnare/state.json location. A missing file
+// yields an empty DB.
+func openStateDB(root, override string) (*stateDB, error) {
+	path := override
+	if path == "" {
+		path = filepath.Join(root, stateFileName)
+	}
+	db := &stateDB{path: path, root: root, entries: make(map[string]stateEntry)}
+	if err := db.readLocked(); err != nil {
+		return nil, err
+	}
+	return db, nil
+}
+
+// readLocked loads the file into entries. A missing file leaves them unchanged.
+func (db *stateDB) readLocked() error {
+	info, err := os.Stat(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(db.path)
+	if err != nil {
+		return err
+	}
+	entries := make(map[string]stateEntry)
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return fmt.Errorf("parsing state DB %s: %w", db.path, err)
+	}
+	db.entries, db.modTime = entries, info.ModTime()
+	return nil
+}
+
+// refreshLocked re-reads the file if another process (a batch run next to the
+// daemon) has written it since. db.mu must be held.
+func (db *stateDB) refreshLocked() {
+	if info, err := os.Stat(db.path); err == nil && !info.ModTime().Equal(db.modTime) {
+		if err := db.readLocked(); err != nil {
+			logger.Warnf("reloading state DB: %v", err)
+		}
+	}
+}
+
+func (db *stateDB) key(output string) string {
+	rel, err := filepath.Rel(db.root, output)
+	if err != nil {
+		return filepath.ToSlash(output)
+	}
+	return filepath.ToSlash(rel)
+}
+
+// outputPath converts a DB key back into a path under the output root.
+func (db *stateDB) outputPath(key string) string {
+	return filepath.Join(db.root, filepath.FromSlash(key))
+}
+
+func (db *stateDB) lookup(output string) (stateEntry, bool) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.refreshLocked()
+	e, ok := db.entries[db.key(output)]
+	return e, ok
+}
+
+// snapshot returns a copy of all entries keyed by output path relative to the root.
+func (db *stateDB) snapshot() map[string]stateEntry {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.refreshLocked()
+	out := make(map[string]stateEntry, len(db.entries))
+	for k, v := range db.entries {
+		out[k] = v
+	}
+	return out
+}
+
+// recordSuccess stores hashes, page count, resource usage and warnings for a
+// completed conversion.
+func (db *stateDB) recordSuccess(j convJob, pages int, u jobUsage, res *Result) error {
+	e, err := newStateEntry(j)
+	if err != nil {
+		return err
+	}
+	if e.OutputHash, err = hashFile(j.output); err != nil {
+		return err
+	}
+	e.Pages, e.ExtraPages, e.Usage, e.Warnings = pages, res.ExtraPages, &u, res.Warnings
+	return db.put(j.output, e)
+}
+
+// recordFailure quarantines the source until it changes on disk or, while
+// the policy has attempts left, until its next retry is due. It returns the
+// recorded entry.
+func (db *stateDB) recordFailure(j convJob, convErr error, policy retryPolicy) (stateEntry, error) {
+	e, err := newStateEntry(j)
+	if err != nil {
+		return e, err
+	}
+	e.Error, e.Attempts = convErr.Error(), 1
+	if prev, ok := db.lookup(j.output); ok && prev.Quarantined() && prev.SourceSize == e.SourceSize && prev.SourceModTime.Equal(e.SourceModTime) {
+		e.Attempts = max(prev.Attempts, 1) + 1
+	}
+	// Retrying a locked notebook cannot help before it changes
+	if !errors.Is(convErr, errLockedNote) {
+		e.RetryAt = policy.next(e.Attempts, e.ConvertedAt)
+	}
+	return e, db.put(j.output, e)
+}
+
+// isQuarantined reports whether the job's source failed to convert before,
+// has not changed since (same size and modification time) and is not due
+// for a retry.
+func (db *stateDB) isQuarantined(j convJob) (stateEntry, bool) {
+	e, ok := db.lookup(j.output)
+	if !ok || !e.Quarantined() {
+		return e, false
+	}
+	if !e.RetryAt.IsZero() && !time.Now().Before(e.RetryAt) {
+		return e, false
+	}
+	info, err := os.Stat(j.input)
+	if err != nil {
+		return e, false
+	}
+	return e, info.Size() == e.SourceSize && info.ModTime().Equal(e.SourceModTime)
+}
+
+// outputModified reports whether output was changed by something other than
+// GoSNare since it was last converted: it exists, but its hash differs from
+// the one recorded then.
+func (db *stateDB) outputModified(output string) (stateEntry, bool) {
+	e, ok := db.lookup(output)
+	if !ok || e.Quarantined() || e.OutputHash == "" {
+		return e, false
+	}
+	h, err := hashFile(output)
+	return e, err == nil && h != e.OutputHash
+}
+
+func (db *stateDB) remove(output string) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.refreshLocked()
+	k := db.key(output)
+	if _, ok := db.entries[k]; !ok {
+		return nil
+	}
+	return db.commitLocked(k, nil)
+}
+
+func (db *stateDB) put(output string, e stateEntry) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.commitLocked(db.key(output), &e)
+}
+
+// commitLocked sets (or, if e is nil, deletes) one entry and saves the DB. A
+// daemon and a batch run may share the file, so the change is applied on top
+// of the file's current contents under a cross-process lock. db.mu must be held.
+func (db *stateDB) commitLocked(key string, e *stateEntry) error {
+	if err := os.MkdirAll(filepath.Dir(db.path), 0755); err != nil {
+		return err
+	}
+	lock, err := lockPath(db.path+".lock", true)
+	if err != nil {
+		return err
+	}
+	defer lock.unlock()
+
+	if err := db.readLocked(); err != nil {
+		return err
+	}
+	if e == nil {
+		delete(db.entries, key)
+	} else {
+		db.entries[key] = *e
+	}
+	return db.saveLocked()
+}
+
+// saveLocked writes the DB atomically via a temp file and rename. db.mu must be held.
+func (db *stateDB) saveLocked() error {
+	data, err := json.MarshalIndent(db.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := db.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, db.path); err != nil {
+		return err
+	}
+	if info, err := os.Stat(db.path); err == nil {
+		db.modTime = info.ModTime()
+	}
+	return nil
+}
+
+func newStateEntry(j convJob) (stateEntry, error) {
+	info, err := os.Stat(j.input)
+	if err != nil {
+		return stateEntry{}, err
+	}
+	hash, err := hashSource(j)
+	if err != nil {
+		return stateEntry{}, err
+	}
+	return stateEntry{
+		Source:        j.input,
+		Companion:     j.companionPDF,
+		SourceHash:    hash,
+		SourceSize:    info.Size(),
+		SourceModTime: info.ModTime(),
+		ConvertedAt:   time.Now(),
+	}, nil
+}
+
+// hashSource hashes the job's source file, followed by its companion PDF for .mark jobs.
+func hashSource(j convJob) (string, error) {
+	h := sha256.New()
+	for _, path := range []string{j.input, j.companionPDF} {
+		if path == "" {
+			continue
+		}
+		if err := hashInto(h, path); err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashFile(path string) (string, error) {
+	h := sha256.New()
+	if err := hashInto(h, path); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashInto(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// sourcePageCount returns the number of pages in a .note/.mark source, or 0 if
+// it cannot be parsed.
+func sourcePageCount(path string) int {
+	nb, err := ParseNotebook(path)
+	if err != nil {
+		return 0
+	}
+	return len(nb.Pages)
+}
+
+// stateSet holds one state DB per output root, for watch configurations that
+// mirror several targets into different output directories.
+type stateSet struct {
+	mu  sync.RWMutex
+	dbs []*stateDB
+}
+
+// openStateSet opens the state DB of every output root. override replaces the
+// default location and is only honored when there is a single output root.
+func openStateSet(roots []string, override string) (*stateSet, error) {
+	if len(roots) > 1 {
+		override = ""
+	}
+	s := &stateSet{}
+	for _, root := range roots {
+		db, err := openStateDB(root, override)
+		if err != nil {
+			return nil, err
+		}
+		s.dbs = append(s.dbs, db)
+	}
+	s.sortLocked()
+	return s, nil
+}
+
+// add opens the state DB for a new output root, if not already present.
+func (s *stateSet) add(root string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, db := range s.dbs {
+		if db.root == root {
+			return nil
+		}
+	}
+	db, err := openStateDB(root, "")
+	if err != nil {
+		return err
+	}
+	s.dbs = append(s.dbs, db)
+	s.sortLocked()
+	return nil
+}
+
+// sortLocked orders DBs deepest root first so nested output directories
+// resolve to their own DB. s.mu must be held (or s not yet shared).
+func (s *stateSet) sortLocked() {
+	slices.SortFunc(s.dbs, func(a, b *stateDB) int { return len(b.root) - len(a.root) })
+}
+
+// forOutput returns the DB whose root contains output, or nil.
+func (s *stateSet) forOutput(output string) *stateDB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, db := range s.dbs {
+		if isUnderDir(output, db.root) {
+			return db
+		}
+	}
+	return nil
+}
+
+func (s *stateSet) recordSuccess(j convJob, pages int, u jobUsage, res *Result) error {
+	if db := s.forOutput(j.output); db != nil {
+		return db.recordSuccess(j, pages, u, res)
+	}
+	return nil
+}
+
+func (s *stateSet) recordFailure(j convJob, convErr error, policy retryPolicy) (stateEntry, error) {
+	if db := s.forOutput(j.output); db != nil {
+		return db.recordFailure(j, convErr, policy)
+	}
+	return stateEntry{}, nil
+}
+
+func (s *stateSet) isQuarantined(j convJob) (stateEntry, bool) {
+	if db := s.forOutput(j.output); db != nil {
+		return db.isQuarantined(j)
+	}
+	return stateEntry{}, false
+}
+
+func (s *stateSet) lookup(output string) (stateEntry, bool) {
+	if db := s.forOutput(output); db != nil {
+		return db.lookup(output)
+	}
+	return stateEntry{}, false
+}
+
+func (s *stateSet) outputModified(output string) (stateEntry, bool) {
+	if db := s.forOutput(output); db != nil {
+		return db.outputModified(output)
+	}
+	return stateEntry{}, false
+}
+
+// all returns the state DB of every output root.
+func (s *stateSet) all() []*stateDB {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return slices.Clone(s.dbs)
+}
+
+func (s *stateSet) remove(output string) error {
+	if db := s.forOutput(output); db != nil {
+		return db.remove(output)
+	}
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+	"text/tabwriter"
+	"time"
+)
+
+// statsItem is the recorded cost of the last conversion of one output.
+type statsItem struct {
+	Output      string    `json:"output"`
+	Source      string    `json:"source"`
+	Pages       int       `json:"pages,omitempty"`
+	ConvertedAt time.Time `json:"convertedAt"`
+	jobUsage
+	CPUPerPage float64 `json:"cpuPerPage,omitempty"`
+}
+
+// runStats implements `gosnare stats [--config config.toml] [-o dir]
+// [--sort cpu|cpu-per-page|mem|bytes] [--top N] [--json]`. It lists the
+// resources used by the last conversion of each output, as recorded in the
+// state DB, most expensive first.
+func runStats(args []string) error {
+	fs := flag.NewFlagSet("stats", flag.ExitOnError)
+	var output, configPath, sortBy string
+	var top int
+	fs.StringVar(&output, "o", "", "Output directory (default: [watch] output directories from config)")
+	fs.StringVar(&output, "output", "", "Output directory (default: [watch] output directories from config)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	fs.StringVar(&sortBy, "sort", "cpu", "Sort by cpu, cpu-per-page, mem or bytes")
+	fs.IntVar(&top, "top", 20, "Show the N most expensive outputs (0 = all)")
+	asJSON := fs.Bool("json", false, "Print the list as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare stats [--config config.toml] [-o <dir>] [--sort cpu|cpu-per-page|mem|bytes] [--top N] [--json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	key := map[string]func(statsItem) float64{
+		"cpu":          func(it statsItem) float64 { return it.CPUSeconds },
+		"cpu-per-page": func(it statsItem) float64 { return it.CPUPerPage },
+		"mem":          func(it statsItem) float64 { return it.PeakMemMB },
+		"bytes":        func(it statsItem) float64 { return float64(it.BytesWritten) },
+	}[sortBy]
+	if key == nil {
+		return fmt.Errorf("--sort must be cpu, cpu-per-page, mem or bytes, got %q", sortBy)
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	outDirs, stateOverride := []string{output}, ""
+	if output == "" {
+		outDirs, stateOverride = cfg.Watch.OutputDirs(), cfg.Watch.StateDB
+		if len(outDirs) == 0 {
+			return fmt.Errorf("stats needs -o or a [watch] section with a location")
+		}
+	}
+	if len(outDirs) > 1 {
+		stateOverride = ""
+	}
+
+	items := []statsItem{}
+	for _, outDir := range outDirs {
+		state, err := openStateDB(outDir, stateOverride)
+		if err != nil {
+			return fmt.Errorf("opening state DB: %w", err)
+		}
+		for k, e := range state.snapshot() {
+			if e.Quarantined() || e.Usage == nil {
+				continue
+			}
+			it := statsItem{Output: state.outputPath(k), Source: e.Source, Pages: e.Pages, ConvertedAt: e.ConvertedAt, jobUsage: *e.Usage}
+			if e.Pages > 0 {
+				it.CPUPerPage = e.Usage.CPUSeconds / float64(e.Pages)
+			}
+			items = append(items, it)
+		}
+	}
+	slices.SortFunc(items, func(a, b statsItem) int {
+		if c := cmp.Compare(key(b), key(a)); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.Output, b.Output)
+	})
+	if top > 0 && len(items) > top {
+		items = items[:top]
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(items)
+	}
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "CPU\tCPU/PAGE\tPEAK MEM\tBYTES\tPAGES\tCONVERTED\tOUTPUT")
+	for _, it := range items {
+		fmt.Fprintf(tw, "%.2fs\t%.3fs\t%.0f MB\t%d\t%d\t%s\t%s\n",
+			it.CPUSeconds, it.CPUPerPage, it.PeakMemMB, it.BytesWritten, it.Pages,
+			it.ConvertedAt.Format("2006-01-02 15:04"), it.Output)
+	}
+	return tw.Flush()
+}
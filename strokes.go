@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// Pen stroke data (TOTALPATH) of a note page, as far as GoSNare reads it. The
+// block is length-prefixed like layer bitmaps; all integers are little-endian:
+//
+//	u32 stroke count
+//	per stroke: u32 size, followed by size bytes:
+//	    u32 pen type, u32 color code, u32 pen weight (0.01 mm)
+//	    u32 n, n × (u32 y, u32 x) point coordinates
+//	    u32 n, n × u16 pressure
+//	    further attributes, skipped
+//
+// The layout is inferred from sample notes, not from a published format, and
+// is experimental, as is everything built on it ([trace] strokes and [mark]
+// annotations = "only"). Coordinates are digitizer units whose scale and
+// orientation differ between devices and firmware, so they are matched
+// against the page's ink bitmap (see pageStrokes) instead of being trusted.
+
+// maxPressure is the full-scale pen pressure.
+const maxPressure = 4095
+
+// digitizerScale is the number of digitizer units per screen pixel, as measured
+// on sample notes; strokeTransforms also tries 1 in case it is wrong.
+const digitizerScale = 8.45
+
+// rawStroke is one stroke as stored in TOTALPATH.
+type rawStroke struct {
+	pen, color, weight uint32
+	points             [][2]uint32 // (y, x)
+	pressures          []uint16
+}
+
+// penStroke is a stroke ready to be drawn: page pixel coordinates, its
+// palette color and a base width in pixels that pressure scales down.
+type penStroke struct {
+	r, g, b  byte
+	alpha    byte
+	multiply bool // blend with /BM /Multiply (translucent markers)
+	width    float64
+	points   []strokePoint
+	pressure bool // vary the width with pressure (not for markers)
+}
+
+type strokePoint struct {
+	x, y     float64
+	pressure uint16
+}
+
+// parseTotalPath decodes a TOTALPATH block.
+func parseTotalPath(data []byte) ([]rawStroke, error) {
+	r := byteReader{data: data}
+	count := r.u32()
+	if r.err != nil || uint64(count)*16 > uint64(len(data)) {
+		return nil, errors.New("bad stroke count")
+	}
+	strokes := make([]rawStroke, 0, count)
+	for range count {
+		size := r.u32()
+		rec := byteReader{data: r.bytes(int(size))}
+		if r.err != nil {
+			return nil, fmt.Errorf("stroke %d: truncated", len(strokes)+1)
+		}
+		s := rawStroke{pen: rec.u32(), color: rec.u32(), weight: rec.u32()}
+		n := rec.u32()
+		if rec.err != nil || uint64(n)*8 > uint64(len(rec.data)) {
+			return nil, fmt.Errorf("stroke %d: bad point count", len(strokes)+1)
+		}
+		s.points = make([][2]uint32, n)
+		for i := range s.points {
+			s.points[i] = [2]uint32{rec.u32(), rec.u32()}
+		}
+		if m := rec.u32(); m != n {
+			return nil, fmt.Errorf("stroke %d: %d pressures for %d points", len(strokes)+1, m, n)
+		}
+		s.pressures = make([]uint16, n)
+		for i := range s.pressures {
+			s.pressures[i] = rec.u16()
+		}
+		if rec.err != nil {
+			return nil, fmt.Errorf("stroke %d: truncated", len(strokes)+1)
+		}
+		strokes = append(strokes, s)
+	}
+	return strokes, nil
+}
+
+// byteReader reads little-endian integers, remembering the first overrun.
+type byteReader struct {
+	data []byte
+	err  error
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || n > len(r.data) {
+		r.err = errors.New("truncated")
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *byteReader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return binary.LittleEndian.Uint32(b)
+	}
+	return 0
+}
+
+func (r *byteReader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return binary.LittleEndian.Uint16(b)
+	}
+	return 0
+}
+
+// strokeTransform maps a stored (y, x) point to page pixels.
+type strokeTransform func(y, x float64) (float64, float64)
+
+// strokeTransforms are the candidate mappings from stored coordinates to page
+// pixels: pixel or digitizer units, upright or with the digitizer's axes
+// rotated against the screen.
+func strokeTransforms(width, height int) []strokeTransform {
+	w, h := float64(width), float64(height)
+	var ts []strokeTransform
+	for _, s := range []float64{1, digitizerScale} {
+		ts = append(ts,
+			func(y, x float64) (float64, float64) { return x / s, y / s },
+			func(y, x float64) (float64, float64) { return w - y/s, x / s },
+			func(y, x float64) (float64, float64) { return y / s, h - x/s },
+		)
+	}
+	return ts
+}
+
+// pageStrokes reads the stroke data of page and returns its strokes in page
+// pixels. The strokes are only used if they reproduce the page's ink: nearly
+// all points must land on ink, and nearly all ink must lie near a stroke, so
+// erased, moved or pasted content that the stroke data does not describe
+// makes the page fall back to tracing. Pages with PNG ink layers always do.
+func pageStrokes(src io.ReaderAt, page Page, width, height int, ppi float64, p *Palette) ([]penStroke, error) {
+	if page.TotalPath == 0 {
+		return nil, errors.New("no stroke data")
+	}
+	data, err := readLayerData(src, page.TotalPath)
+	if err != nil {
+		return nil, fmt.Errorf("reading stroke data: %w", err)
+	}
+	raw, err := parseTotalPath(data)
+	if err != nil {
+		return nil, err
+	}
+
+	codeMap := make([]byte, width*height)
+	codeMap[0] = 0xFF
+	for filled := 1; filled < len(codeMap); filled *= 2 {
+		copy(codeMap[filled:], codeMap[:filled])
+	}
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
+			continue
+		}
+		if layer.Protocol != "RATTA_RLE" {
+			return nil, fmt.Errorf("%s layer %s", layer.Protocol, layer.Key)
+		}
+		data, err := readLayerData(src, layer.BitmapAddress)
+		if err != nil {
+			return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
+		}
+		decodeRLEToCodeMap(data, codeMap, width, height)
+	}
+	ink := make([]bool, len(codeMap))
+	for i, code := range codeMap {
+		ink[i] = canonicalGroup(code) != 3
+	}
+
+	var best strokeTransform
+	bestHits := -1.0
+	for _, t := range strokeTransforms(width, height) {
+		if hits := strokeHits(raw, t, ink, width, height); hits > bestHits {
+			best, bestHits = t, hits
+		}
+	}
+	if bestHits < 0.9 {
+		return nil, fmt.Errorf("strokes do not match the ink (%.0f%% of points on ink)", max(bestHits, 0)*100)
+	}
+
+	var strokes []penStroke
+	for _, s := range raw {
+		code := byte(s.color)
+		if canonicalGroup(code) == 3 {
+			continue // white ink is not drawn, as when tracing
+		}
+		widthPx := float64(s.weight) / 100 / 25.4 * ppi
+		if widthPx < 0.2 || widthPx > 200 {
+			return nil, fmt.Errorf("implausible pen weight %d", s.weight)
+		}
+		c := p.Colors[code]
+		ps := penStroke{r: c[0], g: c[1], b: c[2], alpha: p.Alphas[code], multiply: p.Multiply && p.Alphas[code] < 0xFF, width: widthPx, pressure: p.Alphas[code] == 0xFF}
+		for i, pt := range s.points {
+			x, y := best(float64(pt[0]), float64(pt[1]))
+			ps.points = append(ps.points, strokePoint{x: x, y: y, pressure: s.pressures[i]})
+		}
+		strokes = append(strokes, ps)
+	}
+
+	if covered := strokeCoverage(strokes, ink, width, height); covered < 0.98 {
+		return nil, fmt.Errorf("strokes cover %.1f%% of the ink", covered*100)
+	}
+	return strokes, nil
+}
+
+// strokeHits returns the fraction of stroke points, mapped by t, that land
+// within 2 pixels of ink, or -1 if a point falls off the page.
+func strokeHits(raw []rawStroke, t strokeTransform, ink []bool, width, height int) float64 {
+	total, hits := 0, 0
+	for _, s := range raw {
+		for _, pt := range s.points {
+			x, y := t(float64(pt[0]), float64(pt[1]))
+			if x < -2 || y < -2 || x > float64(width)+2 || y > float64(height)+2 {
+				return -1
+			}
+			total++
+			if inkNear(ink, width, height, int(x), int(y), 2) {
+				hits++
+			}
+		}
+	}
+	if total == 0 {
+		return -1
+	}
+	return float64(hits) / float64(total)
+}
+
+func inkNear(ink []bool, width, height, x, y, r int) bool {
+	for yy := max(y-r, 0); yy <= min(y+r, height-1); yy++ {
+		for xx := max(x-r, 0); xx <= min(x+r, width-1); xx++ {
+			if ink[yy*width+xx] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// strokeCoverage returns the fraction of ink pixels within reach of a stroke,
+// measured on a grid of 8-pixel cells.
+func strokeCoverage(strokes []penStroke, ink []bool, width, height int) float64 {
+	const cell = 8
+	cw, ch := (width+cell-1)/cell, (height+cell-1)/cell
+	reached := make([]bool, cw*ch)
+	mark := func(x, y, r float64) {
+		for cy := int((y - r) / cell); cy <= int((y+r)/cell); cy++ {
+			for cx := int((x - r) / cell); cx <= int((x+r)/cell); cx++ {
+				if cx >= 0 && cy >= 0 && cx < cw && cy < ch {
+					reached[cy*cw+cx] = true
+				}
+			}
+		}
+	}
+	for _, s := range strokes {
+		r := s.width/2 + cell
+		for i, pt := range s.points {
+			mark(pt.x, pt.y, r)
+			if i == 0 {
+				continue
+			}
+			prev := s.points[i-1]
+			steps := int(math.Hypot(pt.x-prev.x, pt.y-prev.y) / (cell / 2))
+			for k := 1; k < steps; k++ {
+				f := float64(k) / float64(steps)
+				mark(prev.x+f*(pt.x-prev.x), prev.y+f*(pt.y-prev.y), r)
+			}
+		}
+	}
+
+	total, covered := 0, 0
+	for i, on := range ink {
+		if !on {
+			continue
+		}
+		total++
+		if reached[(i/width/cell)*cw+(i%width)/cell] {
+			covered++
+		}
+	}
+	if total == 0 {
+		return 1
+	}
+	return float64(covered) / float64(total)
+}
+
+// appendStrokes draws strokes as stroked paths with round caps and joins.
+// Pressure-sensitive strokes are split into runs of equal width, so the line
+// thins and thickens along the stroke. gsNames maps translucent states to
+// graphics state resources.
+func appendStrokes(buf []byte, strokes []penStroke, sx, sy, pageHeightPt float64, prec int, cs colorSpace, gsNames map[graphicsState]string) []byte {
+	buf = append(buf, "q\n1 J\n1 j\n"...)
+	for _, s := range strokes {
+		if len(s.points) == 0 {
+			continue
+		}
+		buf = append(buf, "q\n"...)
+		if s.alpha < 255 {
+			buf = append(buf, gsNames[graphicsState{s.alpha, s.multiply}]...)
+			buf = append(buf, " gs\n"...)
+		}
+		buf = cs.appendColor(buf, s.r, s.g, s.b, true)
+
+		widthAt := func(i int) float64 {
+			w := s.width * sx
+			if s.pressure {
+				w *= 0.4 + 0.6*float64(min(s.points[i].pressure, maxPressure))/maxPressure
+			}
+			return math.Round(w*20) / 20
+		}
+		if len(s.points) == 1 {
+			// A dot is drawn as a zero-length line
+			buf = appendFloat2(buf, widthAt(0))
+			buf = append(buf, " w\n"...)
+			buf = appendStrokePoint(buf, s.points[0], sx, sy, pageHeightPt, prec)
+			buf = append(buf, " m\n"...)
+			buf = appendStrokePoint(buf, s.points[0], sx, sy, pageHeightPt, prec)
+			buf = append(buf, " l\nS\n"...)
+		}
+		// Segment i ends at point i and takes its width; consecutive segments
+		// of equal width form one path
+		for start := 1; start < len(s.points); {
+			w := widthAt(start)
+			end := start + 1
+			for end < len(s.points) && widthAt(end) == w {
+				end++
+			}
+			buf = appendFloat2(buf, w)
+			buf = append(buf, " w\n"...)
+			buf = appendStrokePoint(buf, s.points[start-1], sx, sy, pageHeightPt, prec)
+			buf = append(buf, " m\n"...)
+			for _, pt := range s.points[start:end] {
+				buf = appendStrokePoint(buf, pt, sx, sy, pageHeightPt, prec)
+				buf = append(buf, " l\n"...)
+			}
+			buf = append(buf, "S\n"...)
+			start = end
+		}
+		buf = append(buf, "Q\n"...)
+	}
+	return append(buf, "Q\n"...)
+}
+
+func appendStrokePoint(buf []byte, pt strokePoint, sx, sy, pageHeightPt float64, prec int) []byte {
+	buf = appendFloatPrec(buf, pt.x*sx, prec)
+	buf = append(buf, ' ')
+	return appendFloatPrec(buf, pageHeightPt-pt.y*sy, prec)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+// walk is filepath.WalkDir over the sources below root, descending into
+// symlinked directories when the filter follows symlinks ([filter]
+// follow_symlinks, --follow-symlinks).
+func (f pathFilter) walk(root string, fn fs.WalkDirFunc) error {
+	if !f.followSymlinks {
+		return filepath.WalkDir(root, fn)
+	}
+	return walkFollow(root, fn)
+}
+
+// walkFollow is filepath.WalkDir, except that symlinked directories (root
+// included) are walked as if they were directories of their own: their
+// entries are reported below the link. A link to a directory the walk is
+// already inside of is reported as a file instead, so cycles end.
+func walkFollow(root string, fn fs.WalkDirFunc) error {
+	return walkLinked(root, root, nil, fn)
+}
+
+// walkLinked walks the directory dir resolves to, reporting its entries below
+// logical. outer holds the resolved directories of the links being walked.
+func walkLinked(logical, dir string, outer []string, fn fs.WalkDirFunc) error {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return fn(logical, nil, err)
+	}
+	outer = append(slices.Clip(outer), real)
+	return filepath.WalkDir(real, func(p string, d fs.DirEntry, err error) error {
+		rel, _ := filepath.Rel(real, p)
+		path := filepath.Join(logical, rel)
+		if err != nil || d.Type()&fs.ModeSymlink == 0 {
+			return fn(path, d, err)
+		}
+		target, err := filepath.EvalSymlinks(p)
+		if err != nil {
+			return fn(path, d, nil)
+		}
+		if info, err := os.Stat(target); err != nil || !info.IsDir() {
+			return fn(path, d, nil)
+		}
+		if isUnderDir(filepath.Dir(p), target) || slices.ContainsFunc(outer, func(o string) bool { return isUnderDir(o, target) }) {
+			logger.Debugf("not following '%s': it links to '%s', which contains it", path, target)
+			return fn(path, d, nil)
+		}
+		return walkLinked(path, target, outer, fn)
+	})
+}
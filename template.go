@@ -0,0 +1,139 @@
+package main
+
+import (
+	"slices"
+	"strings"
+)
+
+// maxTemplateRects and maxTemplateColors bound a vectorized template. Beyond
+// them (photos, shaded or anti-aliased custom art) the image is smaller.
+const (
+	maxTemplateRects  = 4000
+	maxTemplateColors = 4
+)
+
+// standardTemplate reports whether a PAGESTYLE names one of the device's
+// built-in templates (e.g. "style_white", "style_8mm_ruled_line"): blank,
+// ruled, grid or dotted paper made of flat-colored lines and dots. Custom
+// templates ("user_...") may be arbitrary images and are always embedded.
+func standardTemplate(style string) bool {
+	if !strings.HasPrefix(style, "style_") {
+		return false
+	}
+	for _, kind := range []string{"white", "blank", "line", "ruled", "grid", "dot"} {
+		if strings.Contains(style, kind) {
+			return true
+		}
+	}
+	return false
+}
+
+// templateLayer is one ink color of a vectorized template.
+type templateLayer struct {
+	r, g, b byte
+	rects   [][4]int // x, y, width, height in device pixels
+}
+
+// vectorTemplate is a page template drawn as filled rectangles instead of a
+// full-page image.
+type vectorTemplate struct {
+	paper  [3]byte // filled behind the layers unless white
+	layers []templateLayer
+}
+
+// vectorizeTemplate converts a rendered background into rectangles: runs of
+// same-colored pixels on a row, merged with identical runs on the rows below.
+// The result reproduces the bitmap exactly, so it is only returned when it
+// stays small (see maxTemplateRects); otherwise nil.
+func vectorizeTemplate(rgb []byte, width, height int) *vectorTemplate {
+	color := func(i int) [3]byte { return [3]byte{rgb[i*3], rgb[i*3+1], rgb[i*3+2]} }
+
+	// The paper is the most common color
+	counts := make(map[[3]byte]int)
+	for i := 0; i < width*height; i += 7 {
+		counts[color(i)]++
+	}
+	var t vectorTemplate
+	best := -1
+	for c, n := range counts {
+		if n > best {
+			t.paper, best = c, n
+		}
+	}
+
+	type run struct{ x, w int }
+	open := make(map[[3]byte]map[run]int) // run -> index in layer rects, for runs on the previous row
+	layerIdx := make(map[[3]byte]int)
+	total := 0
+	for y := range height {
+		cur := make(map[[3]byte]map[run]int)
+		for x := 0; x < width; {
+			c := color(y*width + x)
+			end := x + 1
+			for end < width && color(y*width+end) == c {
+				end++
+			}
+			if c != t.paper {
+				li, ok := layerIdx[c]
+				if !ok {
+					if len(t.layers) == maxTemplateColors {
+						return nil
+					}
+					li = len(t.layers)
+					layerIdx[c] = li
+					t.layers = append(t.layers, templateLayer{r: c[0], g: c[1], b: c[2]})
+				}
+				rn := run{x, end - x}
+				if cur[c] == nil {
+					cur[c] = make(map[run]int)
+				}
+				if ri, ok := open[c][rn]; ok {
+					t.layers[li].rects[ri][3]++
+					cur[c][rn] = ri
+				} else {
+					if total++; total > maxTemplateRects {
+						return nil
+					}
+					cur[c][rn] = len(t.layers[li].rects)
+					t.layers[li].rects = append(t.layers[li].rects, [4]int{x, y, end - x, 1})
+				}
+			}
+			x = end
+		}
+		open = cur
+	}
+	// Darkest first, so the output does not depend on map order
+	slices.SortStableFunc(t.layers, func(a, b templateLayer) int {
+		return int(luminance(a.r, a.g, a.b)) - int(luminance(b.r, b.g, b.b))
+	})
+	return &t
+}
+
+// appendContent draws the template: the paper fill, then each color's
+// rectangles, in PDF coordinates scaled by sx, sy.
+func (t *vectorTemplate) appendContent(buf []byte, pageWidthPt, pageHeightPt, sx, sy float64, cs colorSpace) []byte {
+	buf = append(buf, "q\n"...)
+	if t.paper != [3]byte{0xFF, 0xFF, 0xFF} {
+		buf = cs.appendColor(buf, t.paper[0], t.paper[1], t.paper[2], false)
+		buf = append(buf, "0 0 "...)
+		buf = appendFloat2(buf, pageWidthPt)
+		buf = append(buf, ' ')
+		buf = appendFloat2(buf, pageHeightPt)
+		buf = append(buf, " re f\n"...)
+	}
+	for _, l := range t.layers {
+		buf = cs.appendColor(buf, l.r, l.g, l.b, false)
+		for _, r := range l.rects {
+			buf = appendFloat2(buf, float64(r[0])*sx)
+			buf = append(buf, ' ')
+			buf = appendFloat2(buf, pageHeightPt-float64(r[1]+r[3])*sy)
+			buf = append(buf, ' ')
+			buf = appendFloat2(buf, float64(r[2])*sx)
+			buf = append(buf, ' ')
+			buf = appendFloat2(buf, float64(r[3])*sy)
+			buf = append(buf, " re\n"...)
+		}
+		buf = append(buf, "f\n"...)
+	}
+	return append(buf, "Q\n"...)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// pageThumbnail composites the bitmaps the device stored for page i of nb
+// (background and ink layers) at 1/thumbDownscale of the device resolution.
+// No tracing is involved, so it is much cheaper than a conversion.
+func pageThumbnail(src io.ReaderAt, nb *Notebook, i int, noBg bool, p *Palette) (*image.NRGBA, error) {
+	rgb, w, h, err := renderThumbnailRGB(src, nb.Pages[i], nb.Width, nb.Height, noBg, p)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for j := range w * h {
+		copy(img.Pix[j*4:], rgb[j*3:j*3+3])
+		img.Pix[j*4+3] = 0xFF
+	}
+	return img, nil
+}
+
+// noteCover decodes the cover image stored in nb, or returns nil if it has
+// none.
+func noteCover(src io.ReaderAt, nb *Notebook) (image.Image, error) {
+	if nb.Cover == 0 {
+		return nil, nil
+	}
+	data, err := readLayerData(src, nb.Cover)
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("decoding cover: %w", err)
+	}
+	return img, nil
+}
+
+// encodeImage writes img as PNG or, with format "jpeg", as JPEG of the given
+// quality (1-100).
+func encodeImage(w io.Writer, img image.Image, format string, quality int) error {
+	if format == "jpeg" {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: quality})
+	}
+	return png.Encode(w, img)
+}
+
+// runExtractThumbs implements `gosnare extract-thumbs`: the page thumbnails
+// and cover of notebooks written as image files, without converting them.
+func runExtractThumbs(args []string) error {
+	fs := flag.NewFlagSet("extract-thumbs", flag.ExitOnError)
+	var output, configPath, format string
+	var quality int
+	var noBg bool
+	fs.StringVar(&output, "o", ".", "Output directory")
+	fs.StringVar(&output, "output", ".", "Output directory")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	fs.StringVar(&format, "format", "png", "Image format: png or jpeg")
+	fs.IntVar(&quality, "quality", 85, "JPEG quality (1-100)")
+	fs.BoolVar(&noBg, "no-bg", false, "Leave out the page backgrounds")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare extract-thumbs [--config config.toml] [-o <dir>] [--format png|jpeg] [--quality 85] [--no-bg] <file.note|dir>...")
+		fs.PrintDefaults()
+	}
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected .note files or directories")
+	}
+	if format == "jpg" {
+		format = "jpeg"
+	}
+	if format != "png" && format != "jpeg" {
+		return fmt.Errorf("--format must be png or jpeg, got %q", format)
+	}
+	if quality < 1 || quality > 100 {
+		return fmt.Errorf("--quality must be between 1 and 100")
+	}
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if err := logger.Configure(cfg.Log); err != nil {
+		return fmt.Errorf("config [log]: %w", err)
+	}
+	palette := cfg.Note.palette()
+
+	// Each notebook gets a directory named after it, relative to the input
+	// directory it was found in
+	var failed int
+	for _, in := range inputs {
+		info, err := os.Stat(in)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			dir := filepath.Join(output, strings.TrimSuffix(filepath.Base(in), filepath.Ext(in)))
+			if err := extractThumbs(in, dir, format, quality, noBg, palette); err != nil {
+				logger.Errorf("'%s': %v", in, err)
+				failed++
+			}
+			continue
+		}
+		filter := cfg.Filter.Paths()
+		err = filter.walk(in, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if filter.skipDir(in, path) {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if !strings.HasSuffix(path, ".note") || !filter.allows(in, path) {
+				return nil
+			}
+			rel, _ := filepath.Rel(in, path)
+			if err := extractThumbs(path, filepath.Join(output, strings.TrimSuffix(rel, ".note")), format, quality, noBg, palette); err != nil {
+				logger.Errorf("'%s': %v", path, err)
+				failed++
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d notebook(s) failed", failed)
+	}
+	return nil
+}
+
+// extractThumbs writes page-001.png... and, if the notebook has one,
+// cover.png to dir.
+func extractThumbs(path, dir, format string, quality int, noBg bool, p *Palette) error {
+	src, nb, err := openNotebook(path)
+	if err != nil {
+		return fmt.Errorf("parsing notebook: %w", err)
+	}
+	defer src.Close()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	ext := "." + strings.Replace(format, "jpeg", "jpg", 1)
+	write := func(name string, img image.Image) error {
+		var buf bytes.Buffer
+		if err := encodeImage(&buf, img, format, quality); err != nil {
+			return err
+		}
+		return os.WriteFile(filepath.Join(dir, name+ext), buf.Bytes(), 0644)
+	}
+
+	cover, err := noteCover(src, nb)
+	if err != nil {
+		logger.Warnf("'%s': %v", path, err)
+	} else if cover != nil {
+		if err := write("cover", cover); err != nil {
+			return err
+		}
+	}
+	for i := range nb.Pages {
+		img, err := pageThumbnail(src, nb, i, noBg, p)
+		if err != nil {
+			return fmt.Errorf("page %d: %w", i+1, err)
+		}
+		if err := write(fmt.Sprintf("page-%03d", i+1), img); err != nil {
+			return err
+		}
+	}
+	logger.Infof("Extracted %d page thumbnails of '%s' to '%s'", len(nb.Pages), filepath.Base(path), dir)
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/gob"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dennwc/gotrace"
+)
+
+// traceCacheVersion is hashed into every key; bump it whenever tracing
+// parameters or the cached format change so stale entries are never read.
+const traceCacheVersion = "gosnare-trace-2"
+
+// tracePruneEvery is how many stores may happen between size checks.
+const tracePruneEvery = 64
+
+// tracedGroup is the traced outline of one ink color group (see
+// groupOptions), or of a PNG layer when Group is -1. Colors are applied
+// afterwards, so cached paths stay valid when the palette changes.
+type tracedGroup struct {
+	Group int
+	Paths []gotrace.Path
+}
+
+// traceCache stores traced ink paths on disk keyed by a hash of a page's layer
+// bitmaps, so re-converting a notebook only re-traces the pages that changed.
+// A nil *traceCache is valid and caches nothing.
+type traceCache struct {
+	dir      string
+	maxBytes int64
+	stores   atomic.Int64
+	pruneMu  sync.Mutex
+}
+
+// traceCaches shares one traceCache per directory across conversions.
+var traceCaches sync.Map
+
+// open returns the trace cache configured by c, or nil if it is disabled.
+func (c CacheConfig) open() *traceCache {
+	if !c.Trace {
+		return nil
+	}
+	dir := c.Dir
+	if dir == "" {
+		base, err := os.UserCacheDir()
+		if err != nil {
+			return nil
+		}
+		dir = filepath.Join(base, "gosnare", "trace")
+	}
+	tc, _ := traceCaches.LoadOrStore(dir, &traceCache{dir: dir, maxBytes: int64(c.MaxMB) << 20})
+	return tc.(*traceCache)
+}
+
+func (tc *traceCache) path(key string) string {
+	return filepath.Join(tc.dir, key[:2], key)
+}
+
+// load returns the cached groups for key. Hits refresh the entry's mtime,
+// which pruning uses to evict least recently used entries first.
+func (tc *traceCache) load(key string) ([]tracedGroup, bool) {
+	if tc == nil {
+		return nil, false
+	}
+	p := tc.path(key)
+	data, err := os.ReadFile(p)
+	if err != nil {
+		return nil, false
+	}
+	zr, err := zlib.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, false
+	}
+	defer zr.Close()
+	var groups []tracedGroup
+	if err := gob.NewDecoder(zr).Decode(&groups); err != nil {
+		logger.Debugf("trace cache: discarding unreadable entry %s: %v", key, err)
+		os.Remove(p)
+		return nil, false
+	}
+	now := time.Now()
+	os.Chtimes(p, now, now)
+	return groups, true
+}
+
+// store writes groups under key. Failures only cost a re-trace later, so
+// they are logged at debug level and otherwise ignored.
+func (tc *traceCache) store(key string, groups []tracedGroup) {
+	if tc == nil {
+		return
+	}
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	if err := gob.NewEncoder(zw).Encode(groups); err != nil {
+		logger.Debugf("trace cache: encoding %s: %v", key, err)
+		return
+	}
+	if err := zw.Close(); err != nil {
+		return
+	}
+
+	p := tc.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		logger.Debugf("trace cache: %v", err)
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), key+".*.tmp")
+	if err != nil {
+		logger.Debugf("trace cache: %v", err)
+		return
+	}
+	_, err = tmp.Write(buf.Bytes())
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), p)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		logger.Debugf("trace cache: writing %s: %v", key, err)
+		return
+	}
+
+	if tc.stores.Add(1)%tracePruneEvery == 1 {
+		go tc.prune()
+	}
+}
+
+// prune evicts least recently used entries until the cache is below 90% of
+// its size limit.
+func (tc *traceCache) prune() {
+	if tc.maxBytes <= 0 || !tc.pruneMu.TryLock() {
+		return
+	}
+	defer tc.pruneMu.Unlock()
+
+	type entry struct {
+		path    string
+		size    int64
+		modTime time.Time
+	}
+	var entries []entry
+	var total int64
+	filepath.WalkDir(tc.dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if info, err := d.Info(); err == nil {
+			entries = append(entries, entry{p, info.Size(), info.ModTime()})
+			total += info.Size()
+		}
+		return nil
+	})
+	if total <= tc.maxBytes {
+		return
+	}
+
+	slices.SortFunc(entries, func(a, b entry) int { return a.modTime.Compare(b.modTime) })
+	removed := 0
+	for _, e := range entries {
+		if total <= tc.maxBytes*9/10 {
+			break
+		}
+		if os.Remove(e.path) == nil {
+			total -= e.size
+			removed++
+		}
+	}
+	logger.Debugf("trace cache: evicted %d entries from %s", removed, tc.dir)
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// defaultTrashDirs are the folder names that hold deleted notes: the device's
+// recycle bin and the trash folders of desktop sync clients.
+var defaultTrashDirs = []string{"RECYCLE", "Recycle Bin", ".Trash", ".recycle"}
+
+// trashDirs returns the folder names treated as trash.
+func (f FilterConfig) trashDirs() []string {
+	if f.Trash != nil {
+		return f.Trash
+	}
+	return defaultTrashDirs
+}
+
+// skippedTrash returns the trash folder names filters exclude: all of them
+// unless convert_trash is set.
+func (f FilterConfig) skippedTrash() []string {
+	if f.ConvertTrash {
+		return nil
+	}
+	return f.trashDirs()
+}
+
+// trashSegment returns the index of the first directory of p, relative to
+// root, named like one of trash, or -1 if p is not inside a trash folder. p
+// itself counts as a directory when dir is set.
+func trashSegment(root, p string, trash []string, dir bool) int {
+	if len(trash) == 0 {
+		return -1
+	}
+	rel, err := filepath.Rel(root, p)
+	if err != nil || rel == "." {
+		return -1
+	}
+	segs := strings.Split(filepath.ToSlash(rel), "/")
+	if !dir {
+		segs = segs[:len(segs)-1]
+	}
+	for i, seg := range segs {
+		if slices.Contains(trash, seg) {
+			return i
+		}
+	}
+	return -1
+}
+
+// watchFilter returns the filter for t's sources. With [watch] trash_output
+// set, notes in trash folders pass it so they can be archived.
+func (c *Config) watchFilter(t WatchTarget) pathFilter {
+	f := t.Filter(c.Filter)
+	if c.Watch.TrashOutput != "" {
+		f.trash = nil
+	}
+	return f
+}
+
+// archivesTrash reports whether the source path of t lies in a trash folder
+// whose conversions are archived to [watch] trash_output.
+func (c *Config) archivesTrash(t WatchTarget, path string) bool {
+	return c.Watch.TrashOutput != "" && !c.Filter.ConvertTrash &&
+		trashSegment(t.Input, path, c.Filter.trashDirs(), false) >= 0
+}
+
+// targetOutput maps a source of t to its output path, replacing oldExt with
+// newExt. Archived trash notes go to trash_output at the place they were
+// deleted from: the trash folder itself is left out of the path.
+func (c *Config) targetOutput(t WatchTarget, path, oldExt, newExt string) string {
+	if !c.archivesTrash(t, path) {
+		return outputPath(path, t.Input, t.Output, oldExt, newExt)
+	}
+	rel, _ := filepath.Rel(t.Input, path)
+	segs := strings.Split(rel, string(filepath.Separator))
+	i := trashSegment(t.Input, path, c.Filter.trashDirs(), false)
+	rel = filepath.Join(slices.Delete(segs, i, i+1)...)
+	return filepath.Join(c.Watch.TrashOutput, strings.TrimSuffix(rel, oldExt)+newExt)
+}
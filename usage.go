@@ -0,0 +1,122 @@
+package main
+
+import (
+	"math"
+	"os"
+	"runtime/metrics"
+	"sync"
+	"time"
+)
+
+// usageSampleInterval is how often process CPU time and memory are sampled
+// while conversions run.
+const usageSampleInterval = 100 * time.Millisecond
+
+// jobUsage is the resource cost of one conversion. CPU time is the process's,
+// split evenly between the conversions running at the same time; peak memory
+// is the process's while the conversion ran, so both are estimates when
+// several conversions overlap and exact with one worker.
+type jobUsage struct {
+	CPUSeconds   float64 `json:"cpuSeconds"`
+	PeakMemMB    float64 `json:"peakMemMB"`
+	BytesWritten int64   `json:"bytesWritten"` // size of the output
+}
+
+// usageMeter accumulates the usage of one running conversion.
+type usageMeter struct {
+	cpu  float64 // seconds
+	peak uint64  // bytes
+}
+
+// usage samples process totals and distributes them over active meters.
+var usage = struct {
+	sync.Mutex
+	active  map[*usageMeter]bool
+	lastCPU float64
+	stop    chan struct{}
+}{active: make(map[*usageMeter]bool)}
+
+// startUsage begins measuring a conversion.
+func startUsage() *usageMeter {
+	m := &usageMeter{}
+	usage.Lock()
+	defer usage.Unlock()
+	if len(usage.active) == 0 {
+		usage.lastCPU = processCPUSeconds()
+		usage.stop = make(chan struct{})
+		go sampleUsage(usage.stop)
+	} else {
+		// CPU used so far belongs to the conversions already running
+		sampleUsageLocked()
+	}
+	usage.active[m] = true
+	m.peak = processMemory()
+	return m
+}
+
+// event adds the usage to a convert-done event.
+func (u jobUsage) event(e Event) Event {
+	e.CPUSeconds, e.PeakMemMB, e.Bytes = u.CPUSeconds, u.PeakMemMB, u.BytesWritten
+	return e
+}
+
+// finish stops measuring and returns the usage, with the size of output.
+func (m *usageMeter) finish(output string) jobUsage {
+	usage.Lock()
+	sampleUsageLocked()
+	delete(usage.active, m)
+	if len(usage.active) == 0 {
+		close(usage.stop)
+	}
+	usage.Unlock()
+
+	u := jobUsage{
+		CPUSeconds: math.Round(m.cpu*1000) / 1000,
+		PeakMemMB:  math.Round(float64(m.peak)/(1<<20)*10) / 10,
+	}
+	if info, err := os.Stat(output); err == nil {
+		u.BytesWritten = info.Size()
+	}
+	return u
+}
+
+func sampleUsage(stop chan struct{}) {
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			usage.Lock()
+			sampleUsageLocked()
+			usage.Unlock()
+		}
+	}
+}
+
+func sampleUsageLocked() {
+	cpu := processCPUSeconds()
+	if n := len(usage.active); n > 0 {
+		share := (cpu - usage.lastCPU) / float64(n)
+		for m := range usage.active {
+			m.cpu += share
+		}
+	}
+	usage.lastCPU = cpu
+	mem := processMemory()
+	for m := range usage.active {
+		m.peak = max(m.peak, mem)
+	}
+}
+
+// processMemory estimates the resident memory of the process: memory mapped by
+// the Go runtime minus heap returned to the OS.
+func processMemory() uint64 {
+	s := []metrics.Sample{
+		{Name: "/memory/classes/total:bytes"},
+		{Name: "/memory/classes/heap/released:bytes"},
+	}
+	metrics.Read(s)
+	return s[0].Value.Uint64() - s[1].Value.Uint64()
+}
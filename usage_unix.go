@@ -0,0 +1,18 @@
+//go:build unix
+
+package main
+
+import "syscall"
+
+// processCPUSeconds returns the user and system CPU time of the process and of
+// its finished child processes (e.g. OCR engine runs).
+func processCPUSeconds() float64 {
+	var total float64
+	for _, who := range []int{syscall.RUSAGE_SELF, syscall.RUSAGE_CHILDREN} {
+		var ru syscall.Rusage
+		if syscall.Getrusage(who, &ru) == nil {
+			total += float64(ru.Utime.Nano()+ru.Stime.Nano()) / 1e9
+		}
+	}
+	return total
+}
@@ -0,0 +1,16 @@
+//go:build windows
+
+package main
+
+import "golang.org/x/sys/windows"
+
+// processCPUSeconds returns the user and kernel CPU time of the process.
+// Child processes (e.g. OCR engine runs) are not included.
+func processCPUSeconds() float64 {
+	var creation, exit, kernel, user windows.Filetime
+	if windows.GetProcessTimes(windows.CurrentProcess(), &creation, &exit, &kernel, &user) != nil {
+		return 0
+	}
+	ticks := func(t windows.Filetime) int64 { return int64(t.HighDateTime)<<32 | int64(t.LowDateTime) }
+	return float64(ticks(kernel)+ticks(user)) / 1e7 // 100ns units
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"image/png"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// validateIssue is one problem found in a notebook. Errors make the file (or
+// the page) unconvertible; warnings are oddities conversion works around.
+type validateIssue struct {
+	Page    int    `json:"page,omitempty"` // 1-indexed; 0 for file-level blocks
+	Block   string `json:"block"`
+	Addr    uint64 `json:"addr,omitempty"`
+	Warning bool   `json:"warning,omitempty"`
+	Problem string `json:"problem"`
+}
+
+// validateReport is the `validate` result of one file.
+type validateReport struct {
+	File   string          `json:"file"`
+	Pages  int             `json:"pages"`
+	Issues []validateIssue `json:"issues"`
+}
+
+func (r *validateReport) errorf(page int, block string, addr uint64, format string, args ...any) {
+	r.Issues = append(r.Issues, validateIssue{Page: page, Block: block, Addr: addr, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (r *validateReport) warnf(page int, block string, addr uint64, format string, args ...any) {
+	r.Issues = append(r.Issues, validateIssue{Page: page, Block: block, Addr: addr, Warning: true, Problem: fmt.Sprintf(format, args...)})
+}
+
+func (r *validateReport) errors() (n int) {
+	for _, is := range r.Issues {
+		if !is.Warning {
+			n++
+		}
+	}
+	return n
+}
+
+// runValidate implements `gosnare validate <file|dir>... [--json]`.
+func runValidate(args []string) error {
+	fs := flag.NewFlagSet("validate", flag.ExitOnError)
+	asJSON := fs.Bool("json", false, "Print the reports as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare validate <file.note|file.mark|dir>... [--json]")
+		fs.PrintDefaults()
+	}
+	inputs := parseInterspersed(fs, args)
+	if len(inputs) == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected .note or .mark files or directories")
+	}
+
+	var paths []string
+	for _, in := range inputs {
+		info, err := os.Stat(in)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			paths = append(paths, in)
+			continue
+		}
+		err = filepath.WalkDir(in, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if path != in && strings.HasPrefix(d.Name(), ".") {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if strings.HasSuffix(path, ".note") || strings.HasSuffix(path, ".mark") {
+				paths = append(paths, path)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	reports := make([]validateReport, 0, len(paths))
+	var corrupt int
+	for _, path := range paths {
+		r := validateNote(path)
+		if r.errors() > 0 {
+			corrupt++
+		}
+		reports = append(reports, r)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(reports); err != nil {
+			return err
+		}
+	} else {
+		printValidateReports(reports)
+	}
+	if corrupt > 0 {
+		return fmt.Errorf("%d of %d file(s) are corrupt", corrupt, len(reports))
+	}
+	return nil
+}
+
+// noteBlocks reads the length-prefixed blocks of a notebook, checking that
+// they lie within the file.
+type noteBlocks struct {
+	r    io.ReaderAt
+	size int64
+}
+
+func (b noteBlocks) read(addr uint64) ([]byte, error) {
+	if addr+4 > uint64(b.size) {
+		return nil, fmt.Errorf("address is past the end of the file (%d bytes)", b.size)
+	}
+	var lenBuf [4]byte
+	if err := readFullAt(b.r, lenBuf[:], int64(addr)); err != nil {
+		return nil, err
+	}
+	n := uint64(binary.LittleEndian.Uint32(lenBuf[:]))
+	if end := addr + 4 + n; end > uint64(b.size) {
+		return nil, fmt.Errorf("%d-byte block runs %d bytes past the end of the file", n, end-uint64(b.size))
+	}
+	buf := make([]byte, n)
+	if err := readFullAt(b.r, buf, int64(addr)+4); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// metadata reads the metadata block at addr, reporting it as block of page
+// when it cannot be read.
+func (b noteBlocks) metadata(r *validateReport, page int, block string, addr uint64) (map[string]string, bool) {
+	data, err := b.read(addr)
+	if err != nil {
+		r.errorf(page, block, addr, "%v", err)
+		return nil, false
+	}
+	return parseMetadata(data), true
+}
+
+// address parses the block address value of key in m, reported as block;
+// 0 means no block.
+func address(r *validateReport, page int, block string, m map[string]string, key string) (uint64, bool) {
+	v, ok := m[key]
+	if !ok {
+		return 0, false
+	}
+	addr, err := strconv.ParseUint(v, 10, 64)
+	if err != nil {
+		r.errorf(page, block, 0, "%s address %q is not a number", key, v)
+		return 0, false
+	}
+	return addr, addr != 0
+}
+
+// validateNote walks the footer, header, page, layer and bitmap blocks of
+// the notebook at path, decoding every bitmap, and reports what is broken.
+// Files still being synced typically end early: their footer (the last
+// thing written) is missing, or blocks point past the end of the file.
+func validateNote(path string) validateReport {
+	r := validateReport{File: path, Issues: []validateIssue{}}
+	f, err := os.Open(path)
+	if err != nil {
+		r.errorf(0, "file", 0, "%v", err)
+		return r
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		r.errorf(0, "file", 0, "%v", err)
+		return r
+	}
+	b := noteBlocks{r: f, size: info.Size()}
+	if b.size < 28 {
+		r.errorf(0, "file", 0, "%d bytes is too short for a notebook", b.size)
+		return r
+	}
+
+	if _, _, err := readFormatVersion(f); err != nil {
+		r.errorf(0, "signature", 4, "%v", err)
+		return r
+	}
+
+	// The footer address is stored in the last 4 bytes of the file
+	var tail [4]byte
+	if err := readFullAt(f, tail[:], b.size-4); err != nil {
+		r.errorf(0, "footer", 0, "%v", err)
+		return r
+	}
+	footerAddr := uint64(binary.LittleEndian.Uint32(tail[:]))
+	footer, ok := b.metadata(&r, 0, "footer", footerAddr)
+	if !ok {
+		return r
+	}
+	if len(footer) == 0 {
+		r.errorf(0, "footer", footerAddr, "footer is empty")
+		return r
+	}
+
+	width, height := NomadWidth, NomadHeight
+	if addr, ok := address(&r, 0, "FILE_FEATURE", footer, "FILE_FEATURE"); ok {
+		if header, ok := b.metadata(&r, 0, "FILE_FEATURE", addr); ok {
+			if isLockedHeader(header) {
+				r.errorf(0, "FILE_FEATURE", addr, "notebook is locked with a passcode; its blocks cannot be checked")
+				return r
+			}
+			if header["APPLY_EQUIPMENT"] == "N5" {
+				width, height = MantaWidth, MantaHeight
+			}
+		}
+	} else if _, present := footer["FILE_FEATURE"]; !present {
+		r.warnf(0, "FILE_FEATURE", 0, "no header block; assuming the %dx%d page size", width, height)
+	}
+
+	type pageEntry struct {
+		index int
+		addr  uint64
+	}
+	var pages []pageEntry
+	for k := range footer {
+		idx, err := strconv.Atoi(strings.TrimPrefix(k, "PAGE"))
+		if !strings.HasPrefix(k, "PAGE") || err != nil {
+			continue
+		}
+		if addr, ok := address(&r, 0, k, footer, k); ok {
+			pages = append(pages, pageEntry{idx, addr})
+		}
+	}
+	slices.SortFunc(pages, func(a, b pageEntry) int { return a.index - b.index })
+	r.Pages = len(pages)
+	if len(pages) == 0 {
+		r.errorf(0, "footer", footerAddr, "footer lists no pages")
+	}
+
+	for i, pe := range pages {
+		n := i + 1
+		pageMap, ok := b.metadata(&r, n, fmt.Sprintf("PAGE%d", pe.index), pe.addr)
+		if !ok {
+			continue
+		}
+		layerOrder := defaultLayerOrder
+		if seq, ok := pageMap["LAYERSEQ"]; ok {
+			layerOrder = strings.Split(seq, ",")
+		}
+		for _, key := range layerOrder {
+			addr, ok := address(&r, n, key, pageMap, key)
+			if !ok {
+				continue
+			}
+			layer, ok := b.metadata(&r, n, key, addr)
+			if !ok {
+				continue
+			}
+			bitmapAddr, ok := address(&r, n, key, layer, "LAYERBITMAP")
+			if !ok {
+				continue
+			}
+			block := key + " bitmap"
+			data, err := b.read(bitmapAddr)
+			if err != nil {
+				r.errorf(n, block, bitmapAddr, "%v", err)
+				continue
+			}
+			validateBitmap(&r, n, block, bitmapAddr, layer["LAYERPROTOCOL"], data, width, height)
+		}
+
+		if addr, ok := address(&r, n, "RECOGNTEXT", pageMap, "RECOGNTEXT"); ok {
+			if data, err := b.read(addr); err != nil {
+				r.errorf(n, "RECOGNTEXT", addr, "%v", err)
+			} else if _, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(data))); err != nil {
+				r.warnf(n, "RECOGNTEXT", addr, "recognized text is not valid base64: %v", err)
+			}
+		}
+		if addr, ok := address(&r, n, "TOTALPATH", pageMap, "TOTALPATH"); ok {
+			if data, err := b.read(addr); err != nil {
+				r.errorf(n, "TOTALPATH", addr, "%v", err)
+			} else if _, err := parseTotalPath(data); err != nil {
+				r.warnf(n, "TOTALPATH", addr, "strokes cannot be decoded: %v", err)
+			}
+		}
+	}
+
+	// Headings, keywords, links and the cover; their keys carry the page
+	for _, k := range slices.Sorted(maps.Keys(footer)) {
+		var page int
+		switch {
+		case strings.HasPrefix(k, "TITLE_") && len(k) >= 10:
+			page, _ = strconv.Atoi(k[6:10])
+		case strings.HasPrefix(k, "LINKO_") && len(k) >= 10:
+			page, _ = strconv.Atoi(k[6:10])
+		case strings.HasPrefix(k, "KEYWORD_") && len(k) >= 12:
+			page, _ = strconv.Atoi(k[8:12])
+		case k == "COVER_1":
+		default:
+			continue
+		}
+		if addr, ok := address(&r, page, k, footer, k); ok {
+			if _, err := b.read(addr); err != nil {
+				r.errorf(page, k, addr, "%v", err)
+			}
+		}
+	}
+	return r
+}
+
+// validateBitmap decodes a layer bitmap: RLE streams must cover the whole
+// page, PNG layers must decode.
+func validateBitmap(r *validateReport, page int, block string, addr uint64, protocol string, data []byte, width, height int) {
+	switch protocol {
+	case "RATTA_RLE":
+		rle := newRLEReader(data, width, height)
+		for {
+			if _, _, _, ok := rle.next(); !ok {
+				break
+			}
+		}
+		if rle.pos < rle.expected {
+			r.errorf(page, block, addr, "RLE stream ends after %d of %d pixels", rle.pos, rle.expected)
+		} else if extra := len(data) - rle.i; extra > 2 {
+			r.warnf(page, block, addr, "%d bytes of RLE data past the end of the page", extra)
+		}
+	case "PNG":
+		if _, err := png.Decode(bytes.NewReader(data)); err != nil {
+			r.errorf(page, block, addr, "PNG: %v", err)
+		}
+	default:
+		r.warnf(page, block, addr, "unknown bitmap protocol %q", protocol)
+	}
+}
+
+func printValidateReports(reports []validateReport) {
+	if len(reports) == 0 {
+		fmt.Println("No notebooks found.")
+		return
+	}
+	for _, r := range reports {
+		if len(r.Issues) == 0 {
+			fmt.Printf("%s: ok (%d pages)\n", r.File, r.Pages)
+			continue
+		}
+		errs := r.errors()
+		fmt.Printf("%s: %d error(s), %d warning(s)\n", r.File, errs, len(r.Issues)-errs)
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		for _, is := range r.Issues {
+			where := "file"
+			if is.Page > 0 {
+				where = fmt.Sprintf("page %d", is.Page)
+			}
+			block := is.Block
+			if is.Addr != 0 {
+				block += fmt.Sprintf(" @%d", is.Addr)
+			}
+			kind := "error"
+			if is.Warning {
+				kind = "warning"
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s: %s\n", where, block, kind, is.Problem)
+		}
+		tw.Flush()
+	}
+}
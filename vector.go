@@ -3,28 +3,43 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"image"
 	"image/color"
+	"image/png"
+	"io"
 	"math"
 	"os"
-	"runtime"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/dennwc/gotrace"
 )
 
 type colorLayer struct {
-	r, g, b byte
-	alpha   byte // 255 = fully opaque
-	paths   []gotrace.Path
+	r, g, b  byte
+	alpha    byte // 255 = fully opaque
+	multiply bool // blend with /BM /Multiply (translucent markers)
+	paths    []gotrace.Path
 }
 
-// canonicalGroup maps an RLE color code to one of 7 groups (0-6), or -1 to skip.
+// graphicsState is a translucent ExtGState of a page: an opacity, blended
+// normally or with Multiply.
+type graphicsState struct {
+	alpha    byte
+	multiply bool
+}
+
+// canonicalGroup maps an RLE color code to its group, or -1 to skip.
 // Groups: 0=black, 1=dark gray, 2=light gray, 3=white(skip), 4-6=markers.
+// Groups 7-13 are set up by groupOptions.
 func canonicalGroup(code byte) int {
 	switch code {
 	case 0x00, 0x61:
@@ -46,21 +61,244 @@ func canonicalGroup(code byte) int {
 	}
 }
 
+// groupCodes are the palette codes the fixed groups take their colors from:
+// black, dark gray, light gray and white, markers, the anti-aliasing edges of
+// black, dark gray and light gray, alternate grays, then blue and red pens.
+// The grays are the device's pen codes rather than the anchor positions 157
+// and 201, which are also the alternate gray codes 0x9d and 0xc9.
+var groupCodes = [fixedGroups]byte{0x61, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x61, 0x63, 0x64, 0x9d, 0xc9, codeBluePen, codeRedPen}
+
+// groupColor returns the color and opacity group is drawn in. Fixed groups
+// leave out [colors.codes], so an override recolors only its own code.
+func groupColor(p *Palette, opts groupOptions, group int) ([3]byte, byte) {
+	if group >= fixedGroups {
+		code := opts.codes[group-fixedGroups]
+		return p.Colors[code], p.Alphas[code]
+	}
+	code := groupCodes[group]
+	return p.fixed().Colors[code], p.fixed().Alphas[code]
+}
+
+// edgeAlpha is the opacity of anti-aliasing edge groups (7-9).
+const edgeAlpha = 0x80
+
+// fixedGroups is the number of color groups before those of [colors.codes].
+const fixedGroups = 14
+
+// groupOptions are the settings that change how RLE codes are grouped for
+// tracing, and how the traced paths are simplified.
+type groupOptions struct {
+	antialias string  // [trace] antialias
+	altGrays  bool    // alternate gray codes have colors of their own
+	pens      bool    // the colored pen codes have colors of their own
+	codes     []byte  // [colors.codes] entries, each traced as its own group
+	simplify  float64 // [trace] simplify
+}
+
+func (cfg *Config) groupOptions() groupOptions {
+	o := groupOptions{antialias: cfg.Trace.Antialias, altGrays: cfg.Note.altGrays(), pens: cfg.Note.coloredPens(), simplify: cfg.Trace.Simplify}
+	for _, c := range cfg.Note.codes {
+		o.codes = append(o.codes, c.code)
+	}
+	return o
+}
+
+// key identifies the options in trace cache keys; empty for the defaults.
+func (o groupOptions) key() string {
+	var key string
+	if o.antialias == "nearest" || o.antialias == "edges" {
+		key += "antialias=" + o.antialias + "\n"
+	}
+	if o.altGrays {
+		key += "altgrays\n"
+	}
+	if o.pens {
+		key += "pens\n"
+	}
+	if len(o.codes) > 0 {
+		key += fmt.Sprintf("codes=%x\n", o.codes)
+	}
+	if o.simplify > 0 {
+		key += fmt.Sprintf("simplify=%g\n", o.simplify)
+	}
+	return key
+}
+
+// group maps an RLE color code to its group like canonicalGroup. Codes with
+// a [colors.codes] entry form groups from fixedGroups on. With altGrays, the
+// alternate dark and light gray codes (0x9d/0x9e, 0xc9/0xca) form groups 10
+// and 11; with pens, the blue and red pen codes form groups 12 and 13.
+// Interpolated anti-aliasing codes are handled per
+// [trace] antialias: "nearest" merges them into the closest gray (white is
+// still skipped), "edges" puts them in a translucent edge group 7-9 of the
+// closest ink gray, drawn behind the strokes. Otherwise they are dropped (-1).
+func (o groupOptions) group(code byte) int {
+	if i := slices.Index(o.codes, code); i >= 0 {
+		return fixedGroups + i
+	}
+	if o.altGrays {
+		switch code {
+		case 0x9d, 0x9e:
+			return 10
+		case 0xc9, 0xca:
+			return 11
+		}
+	}
+	if o.pens {
+		switch code {
+		case codeBluePen:
+			return 12
+		case codeRedPen:
+			return 13
+		}
+	}
+	mode := o.antialias
+	g := canonicalGroup(code)
+	if g >= 0 || (mode != "nearest" && mode != "edges") {
+		return g
+	}
+	// Interpolated codes are gray levels between the anchors 0, 157, 201, 255
+	anchors := [4]int{0, 157, 201, 255}
+	if mode == "edges" {
+		g = 0
+		for i := range 3 {
+			if abs(int(code)-anchors[i]) < abs(int(code)-anchors[g]) {
+				g = i
+			}
+		}
+		return 7 + g
+	}
+	g = 0
+	for i := range anchors {
+		if abs(int(code)-anchors[i]) < abs(int(code)-anchors[g]) {
+			g = i
+		}
+	}
+	return g
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
 // decodeRLEToCodeMap decodes RATTA_RLE data into a raw color-code buffer.
 // Each pixel gets the original RLE color code. Transparent pixels (0x62) are left as 0xFF.
 func decodeRLEToCodeMap(data []byte, codeMap []byte, width, height int) {
-	decodeRLE(data, width, height, func(pos, length int, colorCode byte) {
-		fillCodes(codeMap, pos, length, colorCode)
-	})
+	r := newRLEReader(data, width, height)
+	for {
+		pos, length, code, ok := r.next()
+		if !ok {
+			return
+		}
+		fillCodes(codeMap, pos, length, code)
+	}
 }
 
-func renderContentColorLayers(path string, page Page, width, height int, p *Palette) ([]colorLayer, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
+// inkLayer is the raw bitmap of one content layer ("RATTA_RLE" or "PNG").
+type inkLayer struct {
+	protocol string
+	data     []byte
+}
+
+func renderContentColorLayers(src io.ReaderAt, page Page, width, height int, p *Palette, opts groupOptions, cache *traceCache) ([]colorLayer, error) {
+	params := gotrace.Defaults
+	params.TurdSize = 2
+
+	// Read the raw ink layers first: their bytes key the trace cache
+	var inks []inkLayer
+	h := sha256.New()
+	fmt.Fprintf(h, "%s %dx%d turdsize=%d\n", traceCacheVersion, width, height, params.TurdSize)
+	h.Write([]byte(opts.key()))
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
+			continue
+		}
+		if layer.Protocol != "RATTA_RLE" && layer.Protocol != "PNG" {
+			continue
+		}
+		data, err := readLayerData(src, layer.BitmapAddress)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s layer %s: %w", layer.Protocol, layer.Key, err)
+		}
+		inks = append(inks, inkLayer{layer.Protocol, data})
+		fmt.Fprintf(h, "%s %d\n", layer.Protocol, len(data))
+		h.Write(data)
+	}
+	key := hex.EncodeToString(h.Sum(nil))
+
+	traceStart := time.Now()
+	groups, cached := cache.load(key)
+	if !cached {
+		var err error
+		groups, err = traceInkLayers(inks, width, height, opts, &params)
+		if err != nil {
+			return nil, err
+		}
+		cache.store(key, groups)
 	}
-	defer f.Close()
+	traceTime := time.Since(traceStart)
 
+	var layers []colorLayer
+	for _, tg := range groups {
+		if tg.Group < 0 {
+			// PNG layers are drawn in opaque black
+			c := p.fixed().Colors[0x61]
+			layers = append(layers, colorLayer{
+				r: c[0], g: c[1], b: c[2],
+				alpha: 255,
+				paths: tg.Paths,
+			})
+			continue
+		}
+		c, alpha := groupColor(p, opts, tg.Group)
+		edge := tg.Group >= 7 && tg.Group <= 9
+		if edge {
+			alpha = edgeAlpha
+		}
+		layers = append(layers, colorLayer{
+			r:        c[0],
+			g:        c[1],
+			b:        c[2],
+			alpha:    alpha,
+			multiply: p.Multiply && alpha < 255 && !edge,
+			paths:    tg.Paths,
+		})
+	}
+
+	// Markers (alpha < 255) first so they're drawn behind opaque strokes
+	slices.SortStableFunc(layers, func(a, b colorLayer) int {
+		aMarker := a.alpha < 255
+		bMarker := b.alpha < 255
+		if aMarker && !bMarker {
+			return -1
+		}
+		if !aMarker && bMarker {
+			return 1
+		}
+		return 0
+	})
+
+	numPaths := 0
+	for _, l := range layers {
+		numPaths += len(l.paths)
+	}
+	how := "traced"
+	if cached {
+		how = "loaded from trace cache"
+	}
+	logger.Debugf("page %d: %d ink layers -> %d color layers, %d paths, %s in %s",
+		page.Number, len(inks), len(layers), numPaths, how, traceTime.Round(time.Millisecond))
+
+	return layers, nil
+}
+
+// traceInkLayers decodes a page's ink layers and traces them: RLE layers are
+// merged into one code map and traced per color group (see groupOptions),
+// PNG layers each as one black group (-1).
+func traceInkLayers(inks []inkLayer, width, height int, opts groupOptions, params *gotrace.Params) ([]tracedGroup, error) {
 	totalPixels := width * height
 
 	codeMap := make([]byte, totalPixels)
@@ -70,33 +308,23 @@ func renderContentColorLayers(path string, page Page, width, height int, p *Pale
 	}
 
 	var pngLayers []image.Image
-
-	for _, layer := range page.Layers {
-		if layer.BitmapAddress == 0 || layer.Key == "BGLAYER" {
-			continue
-		}
-
-		switch layer.Protocol {
+	for _, ink := range inks {
+		switch ink.protocol {
 		case "RATTA_RLE":
-			data, err := readLayerData(f, layer.BitmapAddress)
-			if err != nil {
-				return nil, fmt.Errorf("reading RLE layer %s: %w", layer.Key, err)
-			}
-			decodeRLEToCodeMap(data, codeMap, width, height)
-
+			decodeRLEToCodeMap(ink.data, codeMap, width, height)
 		case "PNG":
-			img, err := decodePNGLayer(f, layer.BitmapAddress)
+			img, err := png.Decode(bytes.NewReader(ink.data))
 			if err != nil {
-				return nil, fmt.Errorf("decoding PNG layer %s: %w", layer.Key, err)
+				return nil, fmt.Errorf("decoding PNG layer: %w", err)
 			}
 			pngLayers = append(pngLayers, img)
 		}
 	}
 
-	var masks [7]*image.Gray
+	masks := make([]*image.Gray, fixedGroups+len(opts.codes))
 	for i := range totalPixels {
 		code := codeMap[i]
-		g := canonicalGroup(code)
+		g := opts.group(code)
 		if g < 0 || g == 3 {
 			continue
 		}
@@ -110,15 +338,8 @@ func renderContentColorLayers(path string, page Page, width, height int, p *Pale
 	}
 	codeMap = nil
 
-	params := gotrace.Defaults
-	params.TurdSize = 2
-
-	var layers []colorLayer
-	// Representative palette indices for each group:
-	// Black=0, Dark Gray=157, Light Gray=201, White=255, Markers=0x66-0x68
-	groupPaletteIdx := [7]byte{0, 157, 201, 255, 0x66, 0x67, 0x68}
-
-	for g := range 7 {
+	var groups []tracedGroup
+	for g := range masks {
 		if g == 3 || masks[g] == nil {
 			continue
 		}
@@ -126,21 +347,13 @@ func renderContentColorLayers(path string, page Page, width, height int, p *Pale
 			v, _, _, _ := cl.RGBA()
 			return v < 0x8000
 		})
-		paths, err := gotrace.Trace(bm, &params)
+		paths, err := gotrace.Trace(bm, params)
 		if err != nil {
 			return nil, fmt.Errorf("tracing color group %d: %w", g, err)
 		}
-		if len(paths) == 0 {
-			continue
+		if paths = simplifyPaths(paths, opts.simplify); len(paths) > 0 {
+			groups = append(groups, tracedGroup{Group: g, Paths: paths})
 		}
-		idx := groupPaletteIdx[g]
-		layers = append(layers, colorLayer{
-			r:     p.Colors[idx][0],
-			g:     p.Colors[idx][1],
-			b:     p.Colors[idx][2],
-			alpha: p.Alphas[idx],
-			paths: paths,
-		})
 	}
 
 	for _, img := range pngLayers {
@@ -164,42 +377,18 @@ func renderContentColorLayers(path string, page Page, width, height int, p *Pale
 			v, _, _, _ := cl.RGBA()
 			return v < 0x8000
 		})
-		paths, err := gotrace.Trace(bm, &params)
+		paths, err := gotrace.Trace(bm, params)
 		if err != nil {
 			return nil, fmt.Errorf("tracing PNG layer: %w", err)
 		}
-		if len(paths) > 0 {
-			layers = append(layers, colorLayer{
-				r: p.Colors[0][0], g: p.Colors[0][1], b: p.Colors[0][2],
-				alpha: 255,
-				paths: paths,
-			})
+		if paths = simplifyPaths(paths, opts.simplify); len(paths) > 0 {
+			groups = append(groups, tracedGroup{Group: -1, Paths: paths})
 		}
 	}
-
-	// Markers (alpha < 255) first so they're drawn behind opaque strokes
-	slices.SortStableFunc(layers, func(a, b colorLayer) int {
-		aMarker := a.alpha < 255
-		bMarker := b.alpha < 255
-		if aMarker && !bMarker {
-			return -1
-		}
-		if !aMarker && bMarker {
-			return 1
-		}
-		return 0
-	})
-
-	return layers, nil
+	return groups, nil
 }
 
-func renderBGLayerRGB(path string, page Page, width, height int, p *Palette) ([]byte, error) {
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, err
-	}
-	defer f.Close()
-
+func renderBGLayerRGB(src io.ReaderAt, page Page, width, height int, p *Palette) ([]byte, error) {
 	totalPixels := width * height
 	rgb := make([]byte, totalPixels*3)
 
@@ -215,18 +404,18 @@ func renderBGLayerRGB(path string, page Page, width, height int, p *Palette) ([]
 
 		switch layer.Protocol {
 		case "RATTA_RLE":
-			data, err := readLayerData(f, layer.BitmapAddress)
+			data, err := readLayerData(src, layer.BitmapAddress)
 			if err != nil {
 				return nil, fmt.Errorf("reading BG RLE layer: %w", err)
 			}
-			decodeRLEToRGB(data, rgb, width, height, p)
+			decodeRLEToRGB(data, rgb, width, height, p.background())
 
 		case "PNG":
-			img, err := decodePNGLayer(f, layer.BitmapAddress)
+			img, err := decodePNGLayer(src, layer.BitmapAddress)
 			if err != nil {
 				return nil, fmt.Errorf("decoding BG PNG layer: %w", err)
 			}
-			compositePNGToRGB(img, rgb, width, height)
+			compositePNGToRGB(fitBackground(img, width, height), rgb, width, height)
 		}
 	}
 
@@ -246,25 +435,63 @@ func appendFloat2(buf []byte, f float64) []byte {
 	return strconv.AppendFloat(buf, rounded, 'f', 2, 64)
 }
 
+// appendFloatPrec appends a float formatted to prec decimal places.
+func appendFloatPrec(buf []byte, f float64, prec int) []byte {
+	scale := math.Pow10(prec)
+	return strconv.AppendFloat(buf, math.Round(f*scale)/scale, 'f', prec, 64)
+}
+
 type pdfObject struct {
 	id   int
 	data []byte
 }
 
+// contentStreamObject returns a page content stream object, Flate-compressed
+// unless compression fails.
+func contentStreamObject(id int, content []byte) pdfObject {
+	compressed, err := compressZlib(content)
+	if err != nil {
+		return pdfObject{id: id, data: fmt.Appendf(nil, "%d 0 obj\n<< /Length %d >>\nstream\n%sendstream\nendobj\n", id, len(content), content)}
+	}
+	data := fmt.Appendf(make([]byte, 0, len(compressed)+80), "%d 0 obj\n<< /Length %d /Filter /FlateDecode >>\nstream\n", id, len(compressed))
+	data = append(data, compressed...)
+	return pdfObject{id: id, data: append(data, "\nendstream\nendobj\n"...)}
+}
+
 type vectorPageChunk struct {
 	objects []pdfObject
 }
 
+// buildVectorPageChunk builds the objects of one page. The page object gets
+// pageObjID; its contents, graphics states, image and OCR font objects are
+// numbered from objStart, and their count is returned. Link destinations are
+// left as "PAGEOBJ_<n> " placeholders for the caller to resolve. Pen strokes
+// are drawn above the traced layers, recognized words, if any, as invisible
+// text in ocrFont (Helvetica if nil). The background is bgRGB or, for
+// built-in templates, bgVector. With bgOCG set, it is marked as content of
+// that optional content group, and stored as bgImage sets out.
 func buildVectorPageChunk(
 	colorLayers []colorLayer,
+	strokes []penStroke,
 	bgRGB []byte,
+	bgVector *vectorTemplate,
+	bgOCG int,
 	width, height int,
 	pageWidthPt, pageHeightPt float64,
 	links []pdfLink,
-	objStart int,
+	words []ocrWord,
+	ocrFont textFont,
+	pageObjID, objStart int,
 	ocrFallback bool,
+	trace TraceConfig,
+	cs colorSpace,
+	bgImage bgImageOptions,
+	margins pageMargins,
 ) (vectorPageChunk, int) {
 	hasBG := bgRGB != nil
+	if !hasBG && bgVector == nil {
+		bgOCG = 0
+	}
 	bgWidth, bgHeight := width, height
 	if !hasBG && ocrFallback {
 		// 1x1 white pixel triggers macOS Preview.app Live Text OCR on vector-only pages
@@ -274,24 +501,40 @@ func buildVectorPageChunk(
 	}
 
 	type gsEntry struct {
-		name  string
-		alpha byte
+		name string
+		gs   graphicsState
 	}
 	var gsEntries []gsEntry
-	gsMap := make(map[byte]string)
-	for _, cl := range colorLayers {
-		if cl.alpha < 255 {
-			if _, ok := gsMap[cl.alpha]; !ok {
+	gsMap := make(map[graphicsState]string)
+	addGS := func(gs graphicsState) {
+		if gs.alpha < 255 {
+			if _, ok := gsMap[gs]; !ok {
 				name := fmt.Sprintf("/GS%d", len(gsEntries)+1)
-				gsMap[cl.alpha] = name
-				gsEntries = append(gsEntries, gsEntry{name: name, alpha: cl.alpha})
+				gsMap[gs] = name
+				gsEntries = append(gsEntries, gsEntry{name: name, gs: gs})
 			}
 		}
 	}
+	for _, cl := range colorLayers {
+		addGS(graphicsState{cl.alpha, cl.multiply})
+	}
+	for _, s := range strokes {
+		addGS(graphicsState{s.alpha, s.multiply})
+	}
 
 	// Build content stream using byte buffer for performance
 	content := make([]byte, 0, 16*1024)
 
+	sx := pageWidthPt / float64(width)
+	sy := pageHeightPt / float64(height)
+	prec := trace.precision(sx)
+
+	if bgOCG != 0 {
+		content = append(content, "/OC /BG BDC\n"...)
+	}
+	if bgVector != nil {
+		content = bgVector.appendContent(content, pageWidthPt, pageHeightPt, sx, sy, cs)
+	}
 	if hasBG {
 		content = append(content, "q\n"...)
 		content = appendFloat4(content, pageWidthPt)
@@ -299,9 +542,9 @@ func buildVectorPageChunk(
 		content = appendFloat4(content, pageHeightPt)
 		content = append(content, " 0 0 cm\n/Im1 Do\nQ\n"...)
 	}
-
-	sx := pageWidthPt / float64(width)
-	sy := pageHeightPt / float64(height)
+	if bgOCG != 0 {
+		content = append(content, "EMC\n"...)
+	}
 
 	for _, cl := range colorLayers {
 		if len(cl.paths) == 0 {
@@ -311,31 +554,38 @@ func buildVectorPageChunk(
 		content = append(content, "q\n"...)
 
 		if cl.alpha < 255 {
-			content = append(content, gsMap[cl.alpha]...)
+			content = append(content, gsMap[graphicsState{cl.alpha, cl.multiply}]...)
 			content = append(content, " gs\n"...)
 		}
 
-		content = appendFloat4(content, float64(cl.r)/255.0)
-		content = append(content, ' ')
-		content = appendFloat4(content, float64(cl.g)/255.0)
-		content = append(content, ' ')
-		content = appendFloat4(content, float64(cl.b)/255.0)
-		content = append(content, " rg\n"...)
+		content = cs.appendColor(content, cl.r, cl.g, cl.b, false)
+
+		if trace.Outline {
+			content = cs.appendColor(content, cl.r, cl.g, cl.b, true)
+			content = appendFloat2(content, trace.OutlineWidth)
+			content = append(content, " w\n"...)
+			content = strconv.AppendInt(content, int64(trace.lineJoin()), 10)
+			content = append(content, " j\n"...)
+		}
 
 		for _, p := range cl.paths {
-			content = appendPDFSubpathTree(content, p, sx, sy, pageHeightPt)
+			content = appendPDFSubpathTree(content, p, sx, sy, pageHeightPt, prec)
 		}
 
-		content = append(content, "f*\nQ\n"...)
+		content = append(content, trace.paintOperator()...)
+		content = append(content, "\nQ\n"...)
+	}
+
+	if len(strokes) > 0 {
+		content = appendStrokes(content, strokes, sx, sy, pageHeightPt, prec, cs, gsMap)
 	}
 
-	pageObjID := objStart
-	contentsObjID := objStart + 1
-	numObjects := 2
+	contentsObjID := objStart
+	numObjects := 1
 
-	gsObjIDs := make(map[byte]int)
+	gsObjIDs := make(map[graphicsState]int)
 	for _, gs := range gsEntries {
-		gsObjIDs[gs.alpha] = objStart + numObjects
+		gsObjIDs[gs.gs] = objStart + numObjects
 		numObjects++
 	}
 
@@ -345,6 +595,28 @@ func buildVectorPageChunk(
 		numObjects++
 	}
 
+	// The OCR font's objects follow it; a font that cannot be subset falls
+	// back to Helvetica
+	var fontObjID int
+	var fontObjects []pdfObject
+	if len(words) > 0 {
+		fontObjID = objStart + numObjects
+		numObjects++
+		if ocrFont == nil {
+			ocrFont = helvetica
+		}
+		text := appendOCRText(nil, words, ocrFont, sx, sy, pageHeightPt)
+		objs, next, err := ocrFont.objects(fontObjID, objStart+numObjects)
+		if err != nil {
+			text = appendOCRText(nil, words, helvetica, sx, sy, pageHeightPt)
+			objs, next, _ = helvetica.objects(fontObjID, objStart+numObjects)
+		}
+		content = append(content, text...)
+		fontObjects = objs
+		numObjects = next - objStart
+	}
+	content = margins.wrapContent(content)
+
 	var annots string
 	if len(links) > 0 {
 		var buf bytes.Buffer
@@ -359,103 +631,97 @@ func buildVectorPageChunk(
 
 	var resBuf strings.Builder
 	resBuf.WriteString("<< ")
+	resBuf.WriteString(cs.resources())
 	if hasBG {
 		fmt.Fprintf(&resBuf, "/XObject << /Im1 %d 0 R >> ", imageObjID)
 	}
 	if len(gsEntries) > 0 {
 		resBuf.WriteString("/ExtGState << ")
 		for _, gs := range gsEntries {
-			fmt.Fprintf(&resBuf, "%s %d 0 R ", gs.name, gsObjIDs[gs.alpha])
+			fmt.Fprintf(&resBuf, "%s %d 0 R ", gs.name, gsObjIDs[gs.gs])
 		}
 		resBuf.WriteString(">> ")
 	}
+	if fontObjID != 0 {
+		fmt.Fprintf(&resBuf, "/Font << /OCR %d 0 R >> ", fontObjID)
+	}
+	if bgOCG != 0 {
+		fmt.Fprintf(&resBuf, "/Properties << /BG %d 0 R >> ", bgOCG)
+	}
 	resBuf.WriteString(">>")
 	resources := resBuf.String()
 
+	mediaW, mediaH := margins.size(pageWidthPt, pageHeightPt)
 	pageObj := fmt.Sprintf(
 		"%d 0 obj\n<< /Type /Page\n   /Parent 2 0 R\n   /MediaBox [0 0 %.2f %.2f]\n   /Contents %d 0 R\n   /Resources %s%s\n>>\nendobj\n",
-		pageObjID, pageWidthPt, pageHeightPt, contentsObjID, resources, annots,
-	)
-
-	contentsObj := fmt.Sprintf(
-		"%d 0 obj\n<< /Length %d >>\nstream\n%sendstream\nendobj\n",
-		contentsObjID, len(content), content,
+		pageObjID, mediaW, mediaH, contentsObjID, resources, annots,
 	)
 
 	var objects []pdfObject
 	objects = append(objects,
 		pdfObject{id: pageObjID, data: []byte(pageObj)},
-		pdfObject{id: contentsObjID, data: []byte(contentsObj)},
+		contentStreamObject(contentsObjID, content),
 	)
 
 	for _, gs := range gsEntries {
-		objID := gsObjIDs[gs.alpha]
+		objID := gsObjIDs[gs.gs]
+		blend := ""
+		if gs.gs.multiply {
+			blend = " /BM /Multiply"
+		}
 		gsObj := fmt.Sprintf(
-			"%d 0 obj\n<< /Type /ExtGState /ca %.4f >>\nendobj\n",
-			objID, float64(gs.alpha)/255.0,
+			"%d 0 obj\n<< /Type /ExtGState /ca %.4f /CA %.4f%s >>\nendobj\n",
+			objID, float64(gs.gs.alpha)/255.0, float64(gs.gs.alpha)/255.0, blend,
 		)
 		objects = append(objects, pdfObject{id: objID, data: []byte(gsObj)})
 	}
 
 	if hasBG {
-		compressed, err := compressZlib(bgRGB)
-		if err != nil {
-			compressed = bgRGB
-		}
-
-		imageHeader := fmt.Sprintf(
-			"%d 0 obj\n<< /Type /XObject\n   /Subtype /Image\n   /Width %d\n   /Height %d\n   /ColorSpace /DeviceRGB\n   /BitsPerComponent 8\n   /Filter /FlateDecode\n   /Length %d >>\nstream\n",
-			imageObjID, bgWidth, bgHeight, len(compressed),
-		)
-
-		var imageObj bytes.Buffer
-		imageObj.Grow(len(imageHeader) + len(compressed) + 30)
-		imageObj.WriteString(imageHeader)
-		imageObj.Write(compressed)
-		imageObj.WriteString("\nendstream\nendobj\n")
-
-		objects = append(objects, pdfObject{id: imageObjID, data: imageObj.Bytes()})
+		objects = append(objects, backgroundImageObject(imageObjID, bgRGB, bgWidth, bgHeight, cs, bgImage))
 	}
 
+	objects = append(objects, fontObjects...)
+
 	return vectorPageChunk{objects: objects}, numObjects
 }
 
-// appendPDFSubpath appends a single traced path as PDF subpath operators to buf.
-func appendPDFSubpath(buf []byte, p gotrace.Path, sx, sy, pageHeightPt float64) []byte {
+// appendPDFSubpath appends a single traced path as PDF subpath operators to buf,
+// its coordinates rounded to prec decimals.
+func appendPDFSubpath(buf []byte, p gotrace.Path, sx, sy, pageHeightPt float64, prec int) []byte {
 	c := p.Curve
 	if len(c) == 0 {
 		return buf
 	}
 
 	last := c[len(c)-1]
-	buf = appendFloat4(buf, last.Pnt[2].X*sx)
+	buf = appendFloatPrec(buf, last.Pnt[2].X*sx, prec)
 	buf = append(buf, ' ')
-	buf = appendFloat4(buf, pageHeightPt-last.Pnt[2].Y*sy)
+	buf = appendFloatPrec(buf, pageHeightPt-last.Pnt[2].Y*sy, prec)
 	buf = append(buf, " m\n"...)
 
 	for _, seg := range c {
 		switch seg.Type {
 		case gotrace.TypeBezier:
-			buf = appendFloat4(buf, seg.Pnt[0].X*sx)
+			buf = appendFloatPrec(buf, seg.Pnt[0].X*sx, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, pageHeightPt-seg.Pnt[0].Y*sy)
+			buf = appendFloatPrec(buf, pageHeightPt-seg.Pnt[0].Y*sy, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, seg.Pnt[1].X*sx)
+			buf = appendFloatPrec(buf, seg.Pnt[1].X*sx, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, pageHeightPt-seg.Pnt[1].Y*sy)
+			buf = appendFloatPrec(buf, pageHeightPt-seg.Pnt[1].Y*sy, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, seg.Pnt[2].X*sx)
+			buf = appendFloatPrec(buf, seg.Pnt[2].X*sx, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, pageHeightPt-seg.Pnt[2].Y*sy)
+			buf = appendFloatPrec(buf, pageHeightPt-seg.Pnt[2].Y*sy, prec)
 			buf = append(buf, " c\n"...)
 		case gotrace.TypeCorner:
-			buf = appendFloat4(buf, seg.Pnt[1].X*sx)
+			buf = appendFloatPrec(buf, seg.Pnt[1].X*sx, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, pageHeightPt-seg.Pnt[1].Y*sy)
+			buf = appendFloatPrec(buf, pageHeightPt-seg.Pnt[1].Y*sy, prec)
 			buf = append(buf, " l\n"...)
-			buf = appendFloat4(buf, seg.Pnt[2].X*sx)
+			buf = appendFloatPrec(buf, seg.Pnt[2].X*sx, prec)
 			buf = append(buf, ' ')
-			buf = appendFloat4(buf, pageHeightPt-seg.Pnt[2].Y*sy)
+			buf = appendFloatPrec(buf, pageHeightPt-seg.Pnt[2].Y*sy, prec)
 			buf = append(buf, " l\n"...)
 		}
 	}
@@ -465,19 +731,34 @@ func appendPDFSubpath(buf []byte, p gotrace.Path, sx, sy, pageHeightPt float64)
 }
 
 // appendPDFSubpathTree recursively appends a path and all its children (holes, islands)
-// so the even-odd fill rule (f*) correctly cuts out enclosed counters.
-func appendPDFSubpathTree(buf []byte, p gotrace.Path, sx, sy, pageHeightPt float64) []byte {
-	buf = appendPDFSubpath(buf, p, sx, sy, pageHeightPt)
+// so enclosed counters are cut out: potrace alternates the orientation of
+// nested paths, so both the even-odd (f*) and nonzero (f) fill rules apply.
+func appendPDFSubpathTree(buf []byte, p gotrace.Path, sx, sy, pageHeightPt float64, prec int) []byte {
+	buf = appendPDFSubpath(buf, p, sx, sy, pageHeightPt, prec)
 	for _, child := range p.Childs {
-		buf = appendPDFSubpathTree(buf, child, sx, sy, pageHeightPt)
+		buf = appendPDFSubpathTree(buf, child, sx, sy, pageHeightPt, prec)
 	}
 	return buf
 }
 
 // pdfWriter wraps a buffered writer with offset tracking for PDF generation.
+// It records where each object goes for the cross-reference table; with
+// objStreams set, objects other than streams are packed into compressed object
+// streams and the table is written as a cross-reference stream (PDF 1.5).
 type pdfWriter struct {
-	w      *bufio.Writer
+	w          *bufio.Writer
+	offset     uint64
+	objStreams bool
+	xref       []xrefEntry // by object ID - 1
+	packed     []pdfObject // objects waiting for an object stream
+}
+
+// xrefEntry locates an object: at a file offset, or as the index-th object of
+// object stream stream.
+type xrefEntry struct {
 	offset uint64
+	stream int
+	index  int
 }
 
 func (pw *pdfWriter) write(data []byte) {
@@ -494,13 +775,35 @@ func (pw *pdfWriter) writeHeader() {
 	pw.write([]byte("%PDF-1.7\n%\xe2\xe3\xcf\xd3\n"))
 }
 
-func (pw *pdfWriter) writeXrefTrailer(xrefOffsets []uint64, totalObjects int) {
+func (pw *pdfWriter) setEntry(id int, e xrefEntry) {
+	if id > len(pw.xref) {
+		pw.xref = append(pw.xref, make([]xrefEntry, id-len(pw.xref))...)
+	}
+	pw.xref[id-1] = e
+}
+
+// writeObject writes obj, or holds it back for an object stream.
+func (pw *pdfWriter) writeObject(obj pdfObject) {
+	if pw.objStreams && !bytes.HasSuffix(obj.data, []byte("endstream\nendobj\n")) {
+		pw.packed = append(pw.packed, obj)
+		return
+	}
+	pw.setEntry(obj.id, xrefEntry{offset: pw.offset})
+	pw.write(obj.data)
+}
+
+// writeXrefTrailer finishes the file for objects 1..totalObjects.
+func (pw *pdfWriter) writeXrefTrailer(totalObjects int) {
+	if pw.objStreams {
+		pw.writeXrefStream(totalObjects)
+		return
+	}
 	xrefStart := pw.offset
 	pw.writeStr("xref\n")
 	pw.writeStr(fmt.Sprintf("0 %d\n", totalObjects+1))
 	pw.writeStr("0000000000 65535 f \n")
-	for _, off := range xrefOffsets {
-		fmt.Fprintf(pw.w, "%010d 00000 n \n", off)
+	for _, e := range pw.xref[:totalObjects] {
+		fmt.Fprintf(pw.w, "%010d 00000 n \n", e.offset)
 		pw.offset += 20
 	}
 	pw.writeStr("trailer\n")
@@ -510,193 +813,524 @@ func (pw *pdfWriter) writeXrefTrailer(xrefOffsets []uint64, totalObjects int) {
 	pw.writeStr("%%EOF\n")
 }
 
-func ConvertNoteToPDFVector(inputPath, outputPath string, noBg, parallel bool, cfg *Config) error {
-	notebook, err := ParseNotebook(inputPath)
+// ConvertNote converts a .note to the format chosen by [note] format: a
+// vector PDF, a comic book archive or an EPUB.
+func ConvertNote(ctx context.Context, inputPath, outputPath string, noBg bool, pool pagePool, cfg *Config, onPage func()) (*Result, error) {
+	switch cfg.Note.outputExt() {
+	case ".cbz":
+		return ConvertNoteToCBZ(ctx, inputPath, outputPath, noBg, cfg, onPage)
+	case ".epub":
+		return ConvertNoteToEPUB(ctx, inputPath, outputPath, noBg, cfg, onPage)
+	}
+	return ConvertNoteToPDFVector(ctx, inputPath, outputPath, noBg, pool, cfg, onPage)
+}
+
+// ConvertNoteToPDFVector renders a .note as a vector PDF. onPage, if non-nil,
+// is called (possibly concurrently) after each page is rendered. Pages render
+// on the workers of pool, one at a time if it is nil. Cancelling
+// ctx stops the conversion between pages and processing steps and returns
+// ctx's error; an existing output is left untouched.
+func ConvertNoteToPDFVector(ctx context.Context, inputPath, outputPath string, noBg bool, pool pagePool, cfg *Config, onPage func()) (*Result, error) {
+	res := &Result{}
+	return res, convertNoteToPDFVector(ctx, inputPath, outputPath, noBg, pool, cfg, onPage, res)
+}
+
+func convertNoteToPDFVector(ctx context.Context, inputPath, outputPath string, noBg bool, pool pagePool, cfg *Config, onPage func(), res *Result) error {
+	defer res.sort()
+	src, notebook, err := openNotebook(inputPath)
 	if err != nil {
 		return fmt.Errorf("parsing notebook: %w", err)
 	}
+	defer src.Close()
+	res.warnFormatVersion(notebook)
+	notebook.selectLayers(cfg.Note)
+	if notebook.Realtime && cfg.Note.RealtimeMode == "text" {
+		if !cfg.Note.filtersLayers() {
+			return convertRealtimeNoteToTextPDF(src, outputPath, notebook, noBg, cfg, res)
+		}
+		// The recognized text cannot be split by layer
+		res.warnf(WarnTextFallback, 0, "rendered as ink: the recognized text would include left out layers")
+	}
 
-	palette := BuildPalette(cfg.Note.ColorConfig, 0.2)
+	palette := cfg.Note.palette()
+	cache := cfg.Cache.open()
+	cs, err := cfg.PDF.colorSpace()
+	if err != nil {
+		return err
+	}
+	margins, err := cfg.PDF.pageMargins()
+	if err != nil {
+		return err
+	}
+	ocr, err := cfg.OCR.engine()
+	if err != nil {
+		return err
+	}
+	var ocrFont textFont
+	if ocr != nil {
+		if ocrFont, _, err = cfg.Resources.textFonts(); err != nil {
+			return err
+		}
+	}
 
 	width := notebook.Width
 	height := notebook.Height
 	pageWidthPt := float64(width) / notebook.PPI * 72.0
 	pageHeightPt := float64(height) / notebook.PPI * 72.0
 	totalPages := len(notebook.Pages)
-
+	if cs.mode == "icc" {
+		// The profile is shared by all pages and follows the page objects
+		cs.iccID = 3 + totalPages
+	}
+	// So does the background layer, after the profile
+	var bgOCG int
+	if cfg.PDF.backgroundLayer(noBg) {
+		bgOCG = 3 + totalPages
+		if cs.iccID != 0 {
+			bgOCG++
+		}
+	}
 	scale := 72.0 / notebook.PPI
+
+	// Headings become the document outline and, with [pdf] toc_page, contents
+	// pages in front of the notebook's pages; starred pages get their own
+	// outline section. The outline root follows the background layer
+	var headings []heading
+	if len(notebook.Titles) > 0 {
+		if headings, err = readHeadings(src, notebook, ocr, cfg.PDF.TOCPage, res); err != nil {
+			return fmt.Errorf("reading headings: %w", err)
+		}
+	}
+	// Outline destinations and link rectangles are in page space, where the
+	// content sits inside the margins
+	outline := headingOutline(headings, pageHeightPt+margins.bottom, scale)
+	if starred := starredOutline(notebook, pageHeightPt+margins.bottom); starred != nil {
+		outline = append(outline, starred)
+	}
+	res.Starred = starredPages(notebook)
+	var outlineID int
+	if len(outline) > 0 {
+		outlineID = 3 + totalPages
+		if cs.iccID != 0 {
+			outlineID++
+		}
+		if bgOCG != 0 {
+			outlineID++
+		}
+	}
+	catalog := withOutlines(withOCProperties(withMargins(catalogObject(notebook), margins), bgOCG), outlineID)
+
 	pageLinks := make(map[int][]pdfLink)
 	for _, nl := range notebook.Links {
-		if !nl.SameFile || nl.DestPage < 0 || nl.DestPage >= totalPages {
+		if !nl.SameFile {
+			continue
+		}
+		if nl.DestPage < 0 || nl.DestPage >= totalPages {
+			res.warnf(WarnDanglingLink, nl.SourcePage+1, "link to page %d left out (notebook has %d pages)", nl.DestPage+1, totalPages)
 			continue
 		}
 		pageLinks[nl.SourcePage] = append(pageLinks[nl.SourcePage], pdfLink{
 			Rect: [4]float64{
-				float64(nl.X) * scale,
-				pageHeightPt - float64(nl.Y+nl.H)*scale,
-				float64(nl.X+nl.W) * scale,
-				pageHeightPt - float64(nl.Y)*scale,
+				margins.left + float64(nl.X)*scale,
+				margins.bottom + pageHeightPt - float64(nl.Y+nl.H)*scale,
+				margins.left + float64(nl.X+nl.W)*scale,
+				margins.bottom + pageHeightPt - float64(nl.Y)*scale,
 			},
 			DestPage: nl.DestPage,
 		})
 	}
 
 	type pageResult struct {
+		index       int
+		hash        string
+		unchanged   bool      // same as in the output being updated in place
+		reuse       *prevPage // unchanged since the previous output; copied as is
 		colorLayers []colorLayer
+		strokes     []penStroke
 		bgRGB       []byte
+		bgVector    *vectorTemplate
+		raster      bool // bgRGB includes the ink
+		words       []ocrWord
 		err         error
 	}
 
-	results := make([]pageResult, totalPages)
+	// The provenance note makes the first page differ on every conversion
+	prov := newProvenance(inputPath, noBg, cfg)
+
+	// Pages whose [[note.background]] rule names a PDF get it stamped under
+	// their content once the file is written
+	bgImages := newBackgroundImages(width, height)
+	pdfBackgrounds := make(map[string][]int)
+	if !noBg {
+		for i, page := range notebook.Pages {
+			if rule := cfg.Note.backgroundFor(page.Style); rule != nil && rule.isPDF() {
+				pdfBackgrounds[rule.File] = append(pdfBackgrounds[rule.File], i)
+			}
+		}
+	}
 
-	renderPage := func(i int) {
+	// Pages whose fingerprint matches a page of the existing output are
+	// copied from it instead of being rendered again, unless pdfcpu rewrote
+	// that output to stamp PDF backgrounds or encrypt it.
+	var prev *prevOutput
+	if len(pdfBackgrounds) == 0 && !cfg.PDF.encrypted() {
+		prev = openPrevOutput(outputPath)
+	}
+	defer prev.Close()
+	var reused atomic.Int64
+
+	// With [pdf] incremental, pages are fingerprinted up front to decide
+	// whether only the changed ones can be appended to the existing output.
+	// The outline and contents pages are not updated in place
+	var hashes []string
+	var update *incrementalUpdate
+	if cfg.PDF.Incremental && !cfg.PDF.ObjectStreams && prev != nil && prev.classic && outlineID == 0 {
+		if hashes, err = pageHashes(src, notebook, pageWidthPt, pageHeightPt, noBg, cfg, cs, pageLinks); err != nil {
+			return err
+		}
+		update = planIncrementalUpdate(prev, hashes, catalog, cs, bgOCG)
+		if update != nil && prov != nil && slices.Contains(update.changed, true) {
+			update.changed[0] = true
+		}
+	}
+
+	// Pages are rendered concurrently and written in page order, so at most
+	// window pages (rendering or waiting to be written) are held in memory
+	// regardless of notebook length.
+	pool = pool.orSingle()
+	window := cfg.Performance.pageWindow(width, height)
+	logger.Debugf("'%s': %d pages, %d workers, window of %d pages", filepath.Base(inputPath), totalPages, min(cap(pool), window), window)
+
+	done := make(chan pageResult, window)
+
+	renderPage := func(i int) (r pageResult) {
 		page := notebook.Pages[i]
+		if onPage != nil {
+			defer onPage()
+		}
+		pageStart := time.Now()
+		defer func() {
+			logger.Debugf("page %d/%d of '%s' rendered in %s", i+1, totalPages, filepath.Base(inputPath), time.Since(pageStart).Round(time.Millisecond))
+		}()
 
-		layers, err := renderContentColorLayers(inputPath, page, width, height, palette)
-		if err != nil {
-			results[i].err = err
-			return
+		if r.err = ctx.Err(); r.err != nil {
+			return r
+		}
+		res.warnUnknownLayers(page)
+		if hashes != nil {
+			r.hash = hashes[i]
+		} else {
+			r.hash, r.err = pageHash(src, page, width, height, pageWidthPt, pageHeightPt, noBg, cfg, cs, pageLinks[i])
+			if r.err != nil {
+				return r
+			}
+		}
+		if update != nil && !update.changed[i] {
+			r.unchanged = true
+			return r
+		}
+		if pp, ok := prev.page(r.hash); ok && (i > 0 || prov == nil) {
+			r.reuse = &pp
+			reused.Add(1)
+			return r
 		}
-		results[i].colorLayers = layers
 
-		if !noBg {
-			bgRGB, err := renderBGLayerRGB(inputPath, page, width, height, palette)
+		raster := cfg.Trace.Raster == "always"
+		// Stroke data covers all layers, so it cannot leave some out
+		if !raster && cfg.Trace.Strokes && !cfg.Note.filtersLayers() {
+			var err error
+			if r.strokes, err = pageStrokes(src, page, width, height, notebook.PPI, palette); err != nil {
+				res.warnOncef(WarnStrokeFallback, i+1, "stroke data not used (%v); pages without it were traced instead", err)
+			}
+		}
+		if !raster && r.strokes == nil {
+			r.colorLayers, r.err = renderContentColorLayers(src, page, width, height, palette, cfg.groupOptions(), cache)
+			if r.err != nil {
+				return r
+			}
+			if raster = cfg.Trace.rasterize(r.colorLayers); raster {
+				res.warnf(WarnRasterFallback, i+1, "%d path segments, embedded as an image", pathSegments(r.colorLayers))
+			}
+		}
+		if r.err = ctx.Err(); r.err != nil {
+			return r
+		}
+		if ocr != nil && (raster || len(r.colorLayers) > 0 || len(r.strokes) > 0) {
+			img, err := renderInkGray(src, page, width, height)
+			if err == nil {
+				r.words, err = ocr.recognize(img, notebook.PPI)
+			}
 			if err != nil {
-				results[i].err = err
-				return
+				// Unfingerprinted, so the page is recognized again next time
+				res.warnf(WarnOCRFailed, i+1, "no text layer: %v", err)
+				r.words, r.hash = nil, ""
 			}
-			allWhite := true
-			for _, b := range bgRGB {
-				if b != 0xFF {
-					allWhite = false
-					break
-				}
+		}
+		var bgRGB []byte
+		if !noBg {
+			if bgRGB, _, r.err = pageBackground(src, page, width, height, palette, cfg.Note, bgImages); r.err != nil {
+				return r
 			}
-			if !allWhite {
-				results[i].bgRGB = bgRGB
+		}
+		if raster {
+			// The page is one image: ink composited over the background
+			r.colorLayers, r.raster = nil, true
+			r.bgRGB, r.err = renderRasterPage(src, page, width, height, palette, bgRGB)
+			return r
+		}
+		for _, b := range bgRGB {
+			if b != 0xFF {
+				r.bgRGB = bgRGB
+				break
+			}
+		}
+		if r.bgRGB != nil && cfg.Note.VectorTemplates && standardTemplate(page.Style) {
+			if r.bgVector = vectorizeTemplate(r.bgRGB, width, height); r.bgVector != nil {
+				r.bgRGB = nil
 			}
 		}
+		return r
 	}
 
-	if parallel {
-		var wg sync.WaitGroup
-		sem := make(chan struct{}, runtime.GOMAXPROCS(0))
-		for i := range notebook.Pages {
-			wg.Add(1)
-			sem <- struct{}{}
+	quit := make(chan struct{})
+	defer close(quit)
+	slots := make(chan struct{}, window)
+	go func() {
+		for i := range totalPages {
+			select {
+			case slots <- struct{}{}:
+			case <-quit:
+				return
+			case <-ctx.Done():
+				return
+			}
+			if !pool.acquire(ctx, quit) {
+				return
+			}
 			go func() {
-				defer wg.Done()
-				defer func() { <-sem }()
-				renderPage(i)
+				defer pool.release()
+				r := renderPage(i)
+				r.index = i
+				done <- r
 			}()
 		}
-		wg.Wait()
-	} else {
-		for i := range notebook.Pages {
-			renderPage(i)
-		}
+	}()
+
+	// Page objects are numbered 3..totalPages+2 up front so links, the page
+	// tree and the outline can point at pages in any order; the objects a page
+	// owns are numbered as it is written.
+	pageObjIDs := make([]int, totalPages)
+	for i := range pageObjIDs {
+		pageObjIDs[i] = 3 + i
+	}
+	nextObjID := 3 + totalPages
+	if cs.iccID != 0 {
+		nextObjID++
+	}
+	if bgOCG != 0 {
+		nextObjID++
+	}
+	if outlineID != 0 {
+		nextObjID++
 	}
 
-	for i, r := range results {
-		if r.err != nil {
-			return fmt.Errorf("rendering page %d: %w", i+1, r.err)
+	// An incremental update is spilled to a file of its own and appended at
+	// the end, so a failure leaves the existing output untouched
+	var pw *pdfWriter
+	tmpPath := outputPath + ".tmp"
+	if update != nil {
+		tmpPath = outputPath + ".update.tmp"
+	}
+	outFile, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		outFile.Close()
+		os.Remove(tmpPath)
+	}()
+	if update != nil {
+		pw = &pdfWriter{w: bufio.NewWriter(outFile), offset: uint64(prev.size)}
+		nextObjID = prev.nextID
+	} else {
+		pw = &pdfWriter{w: bufio.NewWriter(outFile), objStreams: cfg.PDF.ObjectStreams}
+		pw.writeHeader()
+		pw.writeObject(catalog)
+		if cs.iccID != 0 {
+			pw.writeObject(cs.profileObject())
+		}
+		if bgOCG != 0 {
+			pw.writeObject(ocgObject(bgOCG))
 		}
 	}
 
-	nextObjID := 3
-	pageObjIDs := make([]int, totalPages)
-	chunks := make([]vectorPageChunk, totalPages)
-
-	for i := range results {
-		pageObjIDs[i] = nextObjID
+	// Results are written in page order, so that object numbers and the output
+	// bytes do not depend on which page finished first; a page held back by a
+	// slower one before it keeps its slot until written
+	finished := make(map[int]pageResult, window)
+	for i := range totalPages {
+		r, ok := finished[i]
+		for !ok {
+			select {
+			case got := <-done:
+				if got.err != nil {
+					return fmt.Errorf("rendering page %d: %w", got.index+1, got.err)
+				}
+				finished[got.index] = got
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+			r, ok = finished[i]
+		}
+		delete(finished, i)
+		if r.unchanged {
+			<-slots
+			continue
+		}
+		if r.reuse != nil {
+			objects, err := prev.copyPage(*r.reuse, pageObjIDs[i], nextObjID, cs.iccID, bgOCG)
+			if err != nil {
+				return fmt.Errorf("copying unchanged page %d: %w", i+1, err)
+			}
+			nextObjID += len(objects) - 1
+			for _, obj := range objects {
+				pw.writeObject(obj)
+			}
+			<-slots
+			continue
+		}
+		// Pages rasterized with their ink stay lossless, at full resolution
+		bgImage := cfg.PDF.backgroundImage(notebook.PPI)
+		if r.raster {
+			bgImage = bgImageOptions{}
+		}
 		chunk, numObjs := buildVectorPageChunk(
-			results[i].colorLayers,
-			results[i].bgRGB,
+			r.colorLayers,
+			r.strokes,
+			r.bgRGB,
+			r.bgVector,
+			bgOCG,
 			width, height,
 			pageWidthPt, pageHeightPt,
 			pageLinks[i],
-			nextObjID,
-			true,
+			r.words, freshFont(ocrFont),
+			pageObjIDs[i], nextObjID,
+			ocr == nil,
+			cfg.Trace,
+			cs,
+			bgImage,
+			margins,
 		)
-		chunks[i] = chunk
 		nextObjID += numObjs
-	}
 
-	// Replace PAGEOBJ_N placeholders with actual object IDs for link annotations
-	for i := range chunks {
-		data := chunks[i].objects[0].data
-		for destPage, destObjID := range pageObjIDs {
-			placeholder := fmt.Appendf(nil, "PAGEOBJ_%d", destPage)
-			replacement := fmt.Appendf(nil, "%d 0 R", destObjID)
-			data = bytes.ReplaceAll(data, placeholder, replacement)
+		// The first page is left unfingerprinted under provenance, so that its
+		// annotation is never copied onto another page by reuse
+		if r.hash != "" && (i > 0 || prov == nil) {
+			chunk.objects[0].data = bytes.Replace(chunk.objects[0].data, []byte("/Type /Page\n"),
+				fmt.Appendf(nil, "/Type /Page\n   /GoSNareHash <%s>\n", r.hash), 1)
 		}
-		chunks[i].objects[0].data = data
-	}
 
-	outFile, err := os.Create(outputPath)
-	if err != nil {
-		return err
-	}
-	defer outFile.Close()
+		// Resolve PAGEOBJ_N placeholders with the destination page object IDs
+		for _, l := range pageLinks[i] {
+			placeholder := fmt.Appendf(nil, "PAGEOBJ_%d ", l.DestPage)
+			replacement := fmt.Appendf(nil, "%d 0 R ", pageObjIDs[l.DestPage])
+			chunk.objects[0].data = bytes.ReplaceAll(chunk.objects[0].data, placeholder, replacement)
+		}
+		if i == 0 && prov != nil {
+			chunk.objects[0].data = addAnnotation(chunk.objects[0].data, prov.annotation(pageHeightPt+margins.bottom+margins.top, cfg.PDF.Provenance == "visible"))
+		}
 
-	pw := &pdfWriter{w: bufio.NewWriter(outFile)}
-	totalObjects := nextObjID - 1
-	xrefOffsets := make([]uint64, totalObjects)
+		for _, obj := range chunk.objects {
+			pw.writeObject(obj)
+		}
+		<-slots
+	}
 
-	pw.writeHeader()
+	if update != nil {
+		return finishIncrementalUpdate(pw, outFile, update, nextObjID, outputPath, inputPath)
+	}
 
-	xrefOffsets[0] = pw.offset
-	pw.write([]byte("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n"))
+	if outlineID != 0 {
+		var objects []pdfObject
+		objects, nextObjID = outlineObjects(outline, outlineID, nextObjID, pageObjIDs)
+		for _, obj := range objects {
+			pw.writeObject(obj)
+		}
+	}
+	kids := pageObjIDs
+	if cfg.PDF.TOCPage && len(headings) > 0 {
+		mediaW, mediaH := margins.size(pageWidthPt, pageHeightPt)
+		objects, contentsIDs, next, err := contentsPages(headings, notebook, mediaW, mediaH, pageObjIDs, nextObjID, cfg)
+		if err != nil {
+			return fmt.Errorf("contents page: %w", err)
+		}
+		for _, obj := range objects {
+			pw.writeObject(obj)
+		}
+		nextObjID = next
+		kids = append(contentsIDs, pageObjIDs...)
+		res.ExtraPages = len(contentsIDs)
+	}
 
-	xrefOffsets[1] = pw.offset
 	var pageRefs strings.Builder
-	for i := range totalPages {
+	for i, id := range kids {
 		if i > 0 {
 			pageRefs.WriteByte(' ')
 		}
-		fmt.Fprintf(&pageRefs, "%d 0 R", pageObjIDs[i])
+		fmt.Fprintf(&pageRefs, "%d 0 R", id)
 	}
-	pw.writeStr(fmt.Sprintf("2 0 obj\n<< /Type /Pages /Kids [ %s ] /Count %d >>\nendobj\n", pageRefs.String(), totalPages))
+	pw.writeObject(pdfObject{id: 2, data: fmt.Appendf(nil, "2 0 obj\n<< /Type /Pages /Kids [ %s ] /Count %d >>\nendobj\n", pageRefs.String(), len(kids))})
 
-	for _, chunk := range chunks {
-		for _, obj := range chunk.objects {
-			xrefOffsets[obj.id-1] = pw.offset
-			pw.write(obj.data)
+	pw.writeXrefTrailer(nextObjID - 1)
+	if err := pw.w.Flush(); err != nil {
+		return err
+	}
+	if err := outFile.Close(); err != nil {
+		return err
+	}
+	if n := reused.Load(); n > 0 {
+		logger.Debugf("'%s': %d of %d pages unchanged, copied from the previous output", filepath.Base(inputPath), n, totalPages)
+	}
+	prev.Close()
+	if len(pdfBackgrounds) > 0 {
+		// Output pages follow the contents pages
+		for file, pages := range pdfBackgrounds {
+			for j := range pages {
+				pages[j] += 1 + res.ExtraPages
+			}
+			pdfBackgrounds[file] = pages
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := stampPDFBackgrounds(tmpPath, pdfBackgrounds, cfg.Note.backgroundOpacity()); err != nil {
+			return fmt.Errorf("stamping backgrounds: %w", err)
 		}
 	}
-
-	pw.writeXrefTrailer(xrefOffsets, totalObjects)
-	return pw.w.Flush()
-}
-
-// writeOnePageVectorPDF writes a single-page vector PDF.
-// Used for mark overlay pages that get stamped onto the companion PDF via pdfcpu.
-func writeOnePageVectorPDF(outPath string, chunk vectorPageChunk, pageWidthPt, pageHeightPt float64) error {
-	outFile, err := os.Create(outPath)
-	if err != nil {
+	if err := encryptPDF(tmpPath, cfg.PDF); err != nil {
 		return err
 	}
-	defer outFile.Close()
+	return os.Rename(tmpPath, outputPath)
+}
 
+// onePageVectorPDF returns a single-page vector PDF whose page is chunk's
+// object 3. Used for mark overlay pages that get stamped onto the companion
+// PDF via pdfcpu.
+func onePageVectorPDF(chunk vectorPageChunk) []byte {
 	pageObjID := 3
-	numChunkObjs := len(chunk.objects)
-	totalObjects := 2 + numChunkObjs
-	xrefOffsets := make([]uint64, totalObjects)
+	totalObjects := 2 + len(chunk.objects)
 
-	pw := &pdfWriter{w: bufio.NewWriter(outFile)}
+	var buf bytes.Buffer
+	pw := &pdfWriter{w: bufio.NewWriter(&buf)}
 	pw.writeHeader()
-
-	xrefOffsets[0] = pw.offset
-	pw.write([]byte("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n"))
-
-	xrefOffsets[1] = pw.offset
-	pw.writeStr(fmt.Sprintf("2 0 obj\n<< /Type /Pages /Kids [ %d 0 R ] /Count 1 >>\nendobj\n", pageObjID))
+	pw.writeObject(pdfObject{id: 1, data: []byte("1 0 obj\n<< /Type /Catalog /Pages 2 0 R >>\nendobj\n")})
+	pw.writeObject(pdfObject{id: 2, data: fmt.Appendf(nil, "2 0 obj\n<< /Type /Pages /Kids [ %d 0 R ] /Count 1 >>\nendobj\n", pageObjID)})
 
 	for _, obj := range chunk.objects {
-		xrefOffsets[obj.id-1] = pw.offset
-		pw.write(obj.data)
+		pw.writeObject(obj)
 	}
 
-	pw.writeXrefTrailer(xrefOffsets, totalObjects)
-	return pw.w.Flush()
+	pw.writeXrefTrailer(totalObjects)
+	pw.w.Flush()
+	return buf.Bytes()
 }
@@ -0,0 +1,66 @@
+package main
+
+import "testing"
+
+// defaultColors is the default [note] color config.
+func defaultColors() ColorConfig {
+	return defaultConfig().Note.ColorConfig
+}
+
+func TestAltGraysKeepPlainGrays(t *testing.T) {
+	cc := defaultColors()
+	cc.DarkGrayAlt, cc.LightGrayAlt = "#FF0000", "#00FF00"
+	p := BuildPalette(cc)
+	opts := groupOptions{altGrays: true}
+
+	for _, tc := range []struct {
+		name  string
+		group int
+		want  [3]byte
+	}{
+		{"dark gray", 1, [3]byte{0x9d, 0x9d, 0x9d}},
+		{"light gray", 2, [3]byte{0xc9, 0xc9, 0xc9}},
+		{"dark gray edges", 8, [3]byte{0x9d, 0x9d, 0x9d}},
+		{"light gray edges", 9, [3]byte{0xc9, 0xc9, 0xc9}},
+		{"alternate dark gray", 10, [3]byte{0xff, 0, 0}},
+		{"alternate light gray", 11, [3]byte{0, 0xff, 0}},
+	} {
+		if c, _ := groupColor(p, opts, tc.group); c != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, c, tc.want)
+		}
+	}
+	if c := p.Colors[0x63]; c != [3]byte{0x9d, 0x9d, 0x9d} {
+		t.Errorf("raster dark gray pen: got %v, want the dark gray", c)
+	}
+}
+
+func TestCodeOverrideRecolorsOnlyItsCode(t *testing.T) {
+	codes, err := ColorsConfig{Codes: map[string]string{"0x00": "#00FF00", "0x63": "#FF0000", "0x9d": "#3366CC"}}.parseCodes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cc := defaultColors()
+	cc.codes = codes
+	p := BuildPalette(cc)
+	cfg := defaultConfig()
+	cfg.Note.codes = codes
+	opts := cfg.groupOptions()
+
+	for _, tc := range []struct {
+		name  string
+		group int
+		want  [3]byte
+	}{
+		{"black", 0, [3]byte{0, 0, 0}},
+		{"dark gray", 1, [3]byte{0x9d, 0x9d, 0x9d}},
+		{"light gray", 2, [3]byte{0xc9, 0xc9, 0xc9}},
+		{"dark gray edges", 8, [3]byte{0x9d, 0x9d, 0x9d}},
+		{"0x00", fixedGroups, [3]byte{0, 0xff, 0}},
+		{"0x63", fixedGroups + 1, [3]byte{0xff, 0, 0}},
+		{"0x9d", fixedGroups + 2, [3]byte{0x33, 0x66, 0xcc}},
+	} {
+		if c, _ := groupColor(p, opts, tc.group); c != tc.want {
+			t.Errorf("%s: got %v, want %v", tc.name, c, tc.want)
+		}
+	}
+}
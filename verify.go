@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// verifyItem is one output whose state no longer matches the state DB.
+type verifyItem struct {
+	Output string `json:"output"`
+	Source string `json:"source,omitempty"`
+	Pages  int    `json:"pages,omitempty"`    // page count of the output on disk
+	Want   int    `json:"expected,omitempty"` // page count recorded at conversion time
+	Detail string `json:"detail"`
+}
+
+// verifyReport is the result of checking existing outputs against the state DB.
+type verifyReport struct {
+	Verified   int          `json:"verified"`
+	Modified   []verifyItem `json:"modified"`
+	Missing    []verifyItem `json:"missing"`
+	Unreadable []verifyItem `json:"unreadable"`
+}
+
+func (r *verifyReport) issues() int {
+	return len(r.Modified) + len(r.Missing) + len(r.Unreadable)
+}
+
+// runVerify implements `gosnare verify [--config config.toml] [-o dir] [--json]`.
+// It converts nothing: every output recorded in the state DB is re-hashed and
+// its page count re-read, so copies changed by other tools (e.g. annotated in
+// a PDF editor) are found before the daemon would overwrite them.
+func runVerify(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	var output, configPath string
+	fs.StringVar(&output, "o", "", "Output directory (default: [watch] output directories from config)")
+	fs.StringVar(&output, "output", "", "Output directory (default: [watch] output directories from config)")
+	fs.StringVar(&configPath, "config", defaultConfigPath(), "Path to config file (TOML)")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: gosnare verify [--config config.toml] [-o <dir>] [--json]")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+
+	outDirs, stateOverride := []string{output}, ""
+	if output == "" {
+		outDirs, stateOverride = cfg.Watch.OutputDirs(), cfg.Watch.StateDB
+		if len(outDirs) == 0 {
+			return fmt.Errorf("verify needs -o or a [watch] section with a location")
+		}
+	}
+	if len(outDirs) > 1 {
+		stateOverride = ""
+	}
+
+	report := &verifyReport{Modified: []verifyItem{}, Missing: []verifyItem{}, Unreadable: []verifyItem{}}
+	for _, outDir := range outDirs {
+		state, err := openStateDB(outDir, stateOverride)
+		if err != nil {
+			return fmt.Errorf("opening state DB: %w", err)
+		}
+		verifyOutputs(report, state, cfg.PDF)
+	}
+
+	if *asJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(report); err != nil {
+			return err
+		}
+	} else {
+		printVerifyReport(report)
+	}
+
+	if n := report.issues(); n > 0 {
+		return fmt.Errorf("verify found %d issue(s)", n)
+	}
+	return nil
+}
+
+// verifyOutputs checks every successfully converted output recorded in state.
+func verifyOutputs(report *verifyReport, state *stateDB, pdf PDFConfig) {
+	entries := state.snapshot()
+	keys := make([]string, 0, len(entries))
+	for k := range entries {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		e := entries[k]
+		if e.Quarantined() {
+			continue
+		}
+		item := verifyItem{Output: state.outputPath(k), Source: e.Source}
+
+		if _, err := os.Stat(item.Output); err != nil {
+			item.Detail = "output missing"
+			report.Missing = append(report.Missing, item)
+			continue
+		}
+		// CBZ outputs are only checked against their hash
+		isPDF := strings.EqualFold(filepath.Ext(item.Output), ".pdf")
+		if isPDF {
+			dims, err := pdfPageDims(item.Output, pdf)
+			if err != nil {
+				item.Detail = err.Error()
+				report.Unreadable = append(report.Unreadable, item)
+				continue
+			}
+			item.Pages = len(dims)
+
+			// .note outputs have one page per notebook page, after any
+			// contents pages
+			item.Want = e.Pages + e.ExtraPages
+		}
+		// .mark outputs keep the page count of their companion PDF
+		if e.Companion != "" {
+			item.Want = 0
+			if dims, err := api.PageDimsFile(e.Companion); err == nil {
+				item.Want = len(dims)
+			}
+		}
+
+		h, err := hashFile(item.Output)
+		switch {
+		case err != nil:
+			item.Detail = err.Error()
+			report.Unreadable = append(report.Unreadable, item)
+		case item.Want > 0 && item.Pages != item.Want:
+			item.Detail = fmt.Sprintf("page count changed since conversion on %s", e.ConvertedAt.Format("2006-01-02 15:04"))
+			report.Modified = append(report.Modified, item)
+		case h != e.OutputHash:
+			item.Detail = fmt.Sprintf("content changed since conversion on %s", e.ConvertedAt.Format("2006-01-02 15:04"))
+			report.Modified = append(report.Modified, item)
+		default:
+			report.Verified++
+		}
+	}
+}
+
+func printVerifyReport(r *verifyReport) {
+	sections := []struct {
+		title string
+		items []verifyItem
+	}{
+		{"Modified outputs", r.Modified},
+		{"Missing outputs", r.Missing},
+		{"Unreadable outputs", r.Unreadable},
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	for _, sec := range sections {
+		fmt.Fprintf(tw, "%s (%d)\n", sec.title, len(sec.items))
+		for _, it := range sec.items {
+			pages := ""
+			if it.Want > 0 {
+				pages = fmt.Sprintf("%d/%d pages", it.Pages, it.Want)
+			}
+			fmt.Fprintf(tw, "  %s\t%s\t%s\n", it.Output, pages, it.Detail)
+		}
+	}
+	tw.Flush()
+
+	fmt.Printf("%d output(s) match the state DB.\n", r.Verified)
+}
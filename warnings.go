@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"sync"
+)
+
+// Warning kinds, reported in the "kind" field of warnings.
+const (
+	WarnCompanionMissing = "companion-missing"
+	WarnUnknownLayer     = "unknown-layer"
+	WarnDanglingLink     = "dangling-link"
+	WarnRasterFallback   = "raster-fallback"
+	WarnStrokeFallback   = "stroke-fallback"
+	WarnTextFallback     = "text-fallback"
+	WarnNavigationLost   = "navigation-lost"
+	WarnFormatVersion    = "format-version"
+	WarnOCRFailed        = "ocr-failed"
+)
+
+// Warning is a problem that did not stop a conversion but leaves its output
+// incomplete or different from what was asked for.
+type Warning struct {
+	Kind    string `json:"kind"`
+	Source  string `json:"source,omitempty"` // set when not reported with a conversion
+	Page    int    `json:"page,omitempty"`   // 1-indexed; 0 when not about one page
+	Message string `json:"message"`
+}
+
+func (w Warning) String() string {
+	s := w.Message
+	if w.Page > 0 {
+		s = fmt.Sprintf("page %d: %s", w.Page, s)
+	}
+	if w.Source != "" {
+		s = fmt.Sprintf("'%s' %s", w.Source, s)
+	}
+	return s
+}
+
+// Result is the outcome of a successful conversion. Warnings are collected
+// while pages render and reported by the caller: CLI summaries, convert-done
+// events and the state DB.
+type Result struct {
+	mu         sync.Mutex
+	Warnings   []Warning
+	ExtraPages int   // pages added in front of the source's pages (contents)
+	Starred    []int // 1-indexed source pages marked with the star on the device
+}
+
+// warningSummary returns " with N warning(s)" for summary lines, or "".
+func warningSummary(n int) string {
+	if n == 0 {
+		return ""
+	}
+	return fmt.Sprintf(" with %d warning(s)", n)
+}
+
+// warnf records a warning. It is safe for concurrent use by page workers.
+func (r *Result) warnf(kind string, page int, format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.Warnings = append(r.Warnings, Warning{Kind: kind, Page: page, Message: fmt.Sprintf(format, args...)})
+}
+
+// warnOncef records a warning of a kind that is reported once per file: a
+// later one replaces it only if it is about an earlier page, so the report
+// does not depend on the order workers finish in.
+func (r *Result) warnOncef(kind string, page int, format string, args ...any) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	w := Warning{Kind: kind, Page: page, Message: fmt.Sprintf(format, args...)}
+	if i := slices.IndexFunc(r.Warnings, func(w Warning) bool { return w.Kind == kind }); i >= 0 {
+		if page < r.Warnings[i].Page {
+			r.Warnings[i] = w
+		}
+		return
+	}
+	r.Warnings = append(r.Warnings, w)
+}
+
+// sort orders the warnings by page, which workers finish in any order.
+func (r *Result) sort() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	slices.SortStableFunc(r.Warnings, func(a, b Warning) int { return cmp.Compare(a.Page, b.Page) })
+}
+
+// warnUnknownLayers records the layers of page with a protocol the renderers
+// do not decode, which are left out of the output.
+func (r *Result) warnUnknownLayers(page Page) {
+	for _, layer := range page.Layers {
+		if layer.BitmapAddress != 0 && layer.Protocol != "RATTA_RLE" && layer.Protocol != "PNG" {
+			r.warnf(WarnUnknownLayer, page.Number, "layer %s has unknown protocol %q and was left out", layer.Key, layer.Protocol)
+		}
+	}
+}
@@ -2,11 +2,11 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/signal"
 	"path/filepath"
-	"runtime"
 	"strings"
 	"sync"
 	"syscall"
@@ -88,76 +88,205 @@ func (d *debouncer) stop() {
 	}
 }
 
-func runWatchMode(cfg *Config, noBg bool) error {
+func runWatchMode(cfg *Config, configPath string, noBg, force bool, overrides func(*Config)) error {
+	unlockDaemon, err := lockDaemon(cfg.Watch.OutputDirs())
+	if err != nil {
+		return err
+	}
+	defer unlockDaemon()
+
 	w, err := fsnotify.NewWatcher()
 	if err != nil {
 		return fmt.Errorf("creating watcher: %w", err)
 	}
 	defer w.Close()
 
-	for _, dir := range cfg.Watch.InputDirs() {
-		if err := watchRecursive(w, dir); err != nil {
-			return fmt.Errorf("watching %s: %w", dir, err)
-		}
-		fmt.Printf("Watching: %s\n", dir)
+	state, err := openStateSet(cfg.Watch.OutputDirs(), cfg.Watch.StateDB)
+	if err != nil {
+		return fmt.Errorf("opening state DB: %w", err)
 	}
 
+	live := &liveConfig{path: configPath, overrides: overrides}
+	live.Store(cfg)
+
+	outLock := newPathLocker()
+
+	// Cancelled on shutdown, which interrupts conversions in flight
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
+	// A source that comes back (e.g. after a remount) is watched again,
+	// cleaned of outputs deleted meanwhile and scanned for missed changes
+	var health *sourceHealth
+	health = newSourceHealth(func(t WatchTarget) {
+		if err := watchRecursive(w, t.Input, live.Load().Filter.Paths()); err != nil {
+			logger.Errorf("watching %s: %v", t.Input, err)
+		}
+		cfg := live.Load()
+		if health.outputAvailable(cfg.Watch, t.Output) {
+			syncOrphanedOutputsIn(cfg.Watch, t.Output, ".pdf", cfg.Watch.InputDirsFor(t.Output), state)
+		}
+		scanTargets(ctx, cfg, []WatchTarget{t}, noBg, false, outLock, state, health)
+	})
+
+	// Remote sources are mirrored into local directories watched like any
+	// other input; the first sync runs before the initial scan
+	mirrors, err := cfg.Watch.remoteMirrors()
+	if err != nil {
+		return err
+	}
+	for _, m := range mirrors {
+		if err := os.MkdirAll(m.dir, 0755); err != nil {
+			return fmt.Errorf("creating mirror of %s: %w", m.src.name(), err)
+		}
+		if n, err := m.sync(context.Background()); err != nil {
+			logger.Warnf("%v", err)
+		} else {
+			logger.Infof("%s: %d file(s) synced into %s", m.src.name(), n, m.dir)
+		}
+	}
+
+	for _, t := range cfg.Watch.Targets() {
+		if !health.probe(t, cfg.Watch) {
+			continue // watched once it becomes available
+		}
+		if err := watchRecursive(w, t.Input, live.Load().Filter.Paths()); err != nil {
+			return fmt.Errorf("watching %s: %w", t.Input, err)
+		}
+		logger.Infof("Watching: %s -> %s", t.Input, t.Output)
+	}
+
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		<-sigCh
-		fmt.Println("\nShutting down...")
+		logger.Infof("Shutting down...")
 		cancel()
 	}()
 
-	outLock := newPathLocker()
+	for _, m := range mirrors {
+		go m.loop(ctx)
+	}
+	outputs := cfg.Watch.remoteOutputs()
+	for _, o := range outputs {
+		go o.loop(ctx)
+	}
 
-	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	// Sized from the live config, so a reloaded workers setting applies as
+	// conversions start and finish
+	sem := newJobLimit(func() int { return live.Load().Performance.WorkerCount() })
 	var wg sync.WaitGroup
 
-	db := newDebouncer(500*time.Millisecond, func(path string) {
-		j := classifyEvent(path, cfg)
-		if j == nil {
-			return
+	// Classification stats sources and outputs, which is slow on network
+	// mounts, so it has its own limit independent of conversions
+	classifySem := make(chan struct{}, cfg.Watch.ClassifyWorkerCount())
+
+	// Sources still being written (sync clients write large notes in chunks)
+	// are checked again once they have settled
+	stability := newStabilityGate(cfg.Watch.StabilityDuration())
+
+	var batcher *eventBatcher
+	batcher = newEventBatcher(500*time.Millisecond, func(paths []string) {
+		classifySem <- struct{}{}
+		jobs := make(map[string]*convJob)
+		for _, path := range paths {
+			if t := targetFor(path, live.Load()); t != nil && !health.available(t.Input) {
+				continue
+			}
+			if _, err := os.Stat(path); err != nil {
+				continue // removed or renamed away since the event
+			}
+			j := classifyEvent(path, live.Load())
+			if j == nil {
+				continue
+			}
+			if ok, wait := stability.ready(*j, time.Now()); !ok {
+				logger.Debugf("'%s' may still be written; checking again in %v", j.input, wait)
+				time.AfterFunc(wait, func() {
+					if ctx.Err() == nil {
+						batcher.trigger(path)
+					}
+				})
+				continue
+			}
+			jobs[path] = j
 		}
-		wg.Add(1)
-		sem <- struct{}{}
-		go func() {
-			defer func() { <-sem; wg.Done() }()
-			outLock.Lock(j.output)
-			defer outLock.Unlock(j.output)
-			if recheck := classifyEvent(path, cfg); recheck == nil {
-				return
+		<-classifySem
+
+		for _, path := range paths {
+			j, ok := jobs[path]
+			if !ok {
+				continue
 			}
-			convertJob(*j, noBg, cfg)
-		}()
+			wg.Add(1)
+			sem.acquire()
+			go func() {
+				defer func() { sem.release(); wg.Done() }()
+				outLock.Lock(j.output)
+				defer outLock.Unlock(j.output)
+				cfg := live.Load()
+				if recheck := classifyEvent(path, cfg); recheck == nil {
+					return
+				}
+				convertJob(ctx, *j, noBg, cfg, state)
+			}()
+		}
 	})
-	defer db.stop()
+	defer batcher.stop()
+
+	initialScan(ctx, cfg, noBg, force, outLock, state, health)
+	for _, db := range state.all() {
+		indexes.touch(db, cfg)
+	}
 
-	initialScan(cfg, noBg, outLock)
+	logger.Infof("Daemon ready. Waiting for file changes...")
 
-	fmt.Println("Daemon ready. Waiting for file changes...")
+	// Failed conversions are retried with backoff, through the same path as changes
+	go retryLoop(ctx, state, func(path string) {
+		batcher.trigger(path)
+	})
 
 	// Polling fallback for network/virtual filesystems where kqueue doesn't fire
-	go pollLoop(ctx, cfg, cfg.Watch.PollDuration(), func(path string) {
-		db.trigger(path)
+	go pollLoop(ctx, live, health, func(path string) {
+		batcher.trigger(path)
 	}, func(path string) {
-		handleDeletion(path, cfg)
+		handleDeletion(path, live.Load(), state, health)
+	})
+
+	go reloadLoop(ctx, live, func(added []WatchTarget) {
+		for _, t := range added {
+			if err := state.add(t.Output); err != nil {
+				logger.Errorf("opening state DB for %s: %v", t.Output, err)
+			}
+			if !health.probe(t, live.Load().Watch) {
+				continue
+			}
+			if err := watchRecursive(w, t.Input, live.Load().Filter.Paths()); err != nil {
+				logger.Errorf("watching %s: %v", t.Input, err)
+				continue
+			}
+			logger.Infof("Watching: %s -> %s", t.Input, t.Output)
+		}
+		scanTargets(ctx, live.Load(), added, noBg, false, outLock, state, health)
 	})
 
-	eventLoop(ctx, w, db, cfg)
+	eventLoop(ctx, w, batcher, live, state, health)
 
-	fmt.Println("Waiting for in-flight conversions...")
+	logger.Infof("Waiting for in-flight conversions...")
 	wg.Wait()
-	fmt.Println("Shutdown complete.")
+	for _, o := range outputs {
+		if _, err := o.push(context.Background()); err != nil {
+			logger.Warnf("%v", err)
+		}
+	}
+	logger.Infof("Shutdown complete.")
 	return nil
 }
 
-func watchRecursive(w *fsnotify.Watcher, dir string) error {
-	return filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
+// watchRecursive watches dir and the directories below it, following
+// symlinked ones if filter does.
+func watchRecursive(w *fsnotify.Watcher, dir string, filter pathFilter) error {
+	return filter.walk(dir, func(path string, d os.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
@@ -168,44 +297,71 @@ func watchRecursive(w *fsnotify.Watcher, dir string) error {
 	})
 }
 
-// initialScan processes stale files in watched directories.
-// Jobs are deduplicated by output path to prevent concurrent writes.
-func initialScan(cfg *Config, noBg bool, outLock *pathLocker) {
-	syncOrphanedOutputs(cfg)
+// initialScan processes stale files (all files with force) in watched
+// directories. Jobs are deduplicated by output path to prevent concurrent writes.
+func initialScan(ctx context.Context, cfg *Config, noBg, force bool, outLock *pathLocker, state *stateSet, health *sourceHealth) {
+	syncOrphanedOutputs(cfg, state, health)
+	scanTargets(ctx, cfg, cfg.Watch.Targets(), noBg, force, outLock, state, health)
+}
 
+// scanTargets converts stale files (all files with force) under the given
+// targets' input directories, skipping unavailable sources.
+func scanTargets(ctx context.Context, cfg *Config, targets []WatchTarget, noBg, force bool, outLock *pathLocker, state *stateSet, health *sourceHealth) {
 	jobs := make(map[string]convJob)
 
-	for _, dir := range cfg.Watch.InputDirs() {
-		filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-			if err != nil || d.IsDir() {
+	for _, t := range targets {
+		if !health.probe(t, cfg.Watch) {
+			continue
+		}
+		filter := cfg.watchFilter(t)
+		found := 0
+		filter.walk(t.Input, func(path string, d os.DirEntry, err error) error {
+			if err != nil {
+				return nil
+			}
+			if d.IsDir() {
+				if filter.skipDir(t.Input, path) {
+					return filepath.SkipDir
+				}
 				return nil
 			}
 			if !strings.HasSuffix(path, ".note") && !strings.HasSuffix(path, ".mark") {
 				return nil
 			}
-			if j := classifyEvent(path, cfg); j != nil {
+			if j := classifySource(path, cfg, force); j != nil {
+				if !footerComplete(j.input) {
+					logger.Debugf("'%s' may still be written; converting it once its writes settle", j.input)
+					return nil
+				}
 				jobs[j.output] = *j
+				found++
 			}
 			return nil
 		})
+		logger.Event(Event{Name: EventScan, Input: t.Input, Found: found}, "")
 	}
 
-	sem := make(chan struct{}, runtime.GOMAXPROCS(0))
+	sem := make(chan struct{}, cfg.Performance.WorkerCount())
 	var wg sync.WaitGroup
 	for _, j := range jobs {
+		if ctx.Err() != nil {
+			break
+		}
 		wg.Add(1)
 		sem <- struct{}{}
 		go func() {
 			defer func() { <-sem; wg.Done() }()
 			outLock.Lock(j.output)
 			defer outLock.Unlock(j.output)
-			convertJob(j, noBg, cfg)
+			convertJob(ctx, j, noBg, cfg, state)
 		}()
 	}
 	wg.Wait()
 }
 
-func eventLoop(ctx context.Context, w *fsnotify.Watcher, db *debouncer, cfg *Config) {
+// eventLoop hands events to the batcher. It stats only paths that may be new
+// directories; everything else is checked when the batch is flushed.
+func eventLoop(ctx context.Context, w *fsnotify.Watcher, batcher *eventBatcher, live *liveConfig, state *stateSet, health *sourceHealth) {
 	for {
 		select {
 		case <-ctx.Done():
@@ -215,43 +371,78 @@ func eventLoop(ctx context.Context, w *fsnotify.Watcher, db *debouncer, cfg *Con
 			if !ok {
 				return
 			}
+			logger.Debugf("fsnotify: %s %s", ev.Op, ev.Name)
 			if ev.Has(fsnotify.Remove) {
 				if strings.HasSuffix(ev.Name, ".note") || strings.HasSuffix(ev.Name, ".mark") {
-					handleDeletion(ev.Name, cfg)
+					handleDeletion(ev.Name, live.Load(), state, health)
 				}
 				continue
 			}
-			if ev.Has(fsnotify.Create) {
+			if ev.Has(fsnotify.Create) && !isSourceName(ev.Name) {
 				if info, err := os.Stat(ev.Name); err == nil && info.IsDir() {
-					watchRecursive(w, ev.Name)
+					watchRecursive(w, ev.Name, live.Load().Filter.Paths())
 					continue
 				}
 			}
-			// Atomic file replacement (common on macOS/kqueue): verify the
-			// renamed path still exists and re-add parent for inode tracking.
+			// Atomic file replacement (common on macOS/kqueue): re-add the
+			// parent for inode tracking. Whether the renamed path still
+			// exists is checked when the batch is flushed.
 			if ev.Has(fsnotify.Rename) {
-				if _, err := os.Stat(ev.Name); err != nil {
-					continue
-				}
 				w.Add(filepath.Dir(ev.Name))
 			}
-			db.trigger(ev.Name)
+			batcher.trigger(ev.Name)
 
 		case err, ok := <-w.Errors:
 			if !ok {
 				return
 			}
-			fmt.Fprintf(os.Stderr, "Watcher error: %v\n", err)
+			logger.Errorf("watcher: %v", err)
 		}
 	}
 }
 
+// jobLimit bounds how many conversions run at once, to a limit that may
+// change while they run. A lower limit lets running conversions finish and
+// holds new ones until fewer are left.
+type jobLimit struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	running int
+	limit   func() int
+}
+
+func newJobLimit(limit func() int) *jobLimit {
+	l := &jobLimit{limit: limit}
+	l.cond = sync.NewCond(&l.mu)
+	return l
+}
+
+// acquire blocks until fewer conversions than the current limit are running
+// and counts one more.
+func (l *jobLimit) acquire() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.running >= max(1, l.limit()) {
+		l.cond.Wait()
+	}
+	l.running++
+}
+
+// release ends a conversion counted by acquire.
+func (l *jobLimit) release() {
+	l.mu.Lock()
+	l.running--
+	l.mu.Unlock()
+	l.cond.Broadcast()
+}
+
 // pollLoop walks input directories at a fixed interval to detect mtime changes
 // on network/virtual filesystems (WebDAV, Supernote Private Cloud).
-func pollLoop(ctx context.Context, cfg *Config, interval time.Duration, onChanged func(path string), onDeleted func(path string)) {
+func pollLoop(ctx context.Context, live *liveConfig, health *sourceHealth, onChanged func(path string), onDeleted func(path string)) {
 	mtimes := make(map[string]time.Time)
 	prevSources := make(map[string]bool)
 
+	interval := live.Load().Watch.PollDuration()
 	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
@@ -262,17 +453,52 @@ func pollLoop(ctx context.Context, cfg *Config, interval time.Duration, onChange
 		case <-ticker.C:
 		}
 
+		cfg := live.Load()
+		if d := cfg.Watch.PollDuration(); d != interval {
+			interval = d
+			ticker.Reset(interval)
+		}
+
 		seen := make(map[string]bool)
 		sources := make(map[string]bool)
-		for _, dir := range cfg.Watch.InputDirs() {
-			filepath.WalkDir(dir, func(path string, d os.DirEntry, err error) error {
-				if err != nil || d.IsDir() {
+		held := make(map[string]bool) // sources of unavailable targets, carried over
+		for _, t := range cfg.Watch.Targets() {
+			if !health.probe(t, cfg.Watch) {
+				// Keep what was seen, so its files don't look deleted
+				for path := range prevSources {
+					if isUnderDir(path, t.Input) {
+						sources[path], held[path] = true, true
+					}
+				}
+				for path := range mtimes {
+					if isUnderDir(path, t.Input) {
+						seen[path] = true
+					}
+				}
+				continue
+			}
+			filter := cfg.watchFilter(t)
+			filter.walk(t.Input, func(path string, d os.DirEntry, err error) error {
+				if err != nil {
+					return nil
+				}
+				if d.IsDir() {
+					if filter.skipDir(t.Input, path) {
+						return filepath.SkipDir
+					}
 					return nil
 				}
 				ext := strings.ToLower(filepath.Ext(path))
 				if ext != ".note" && ext != ".mark" && ext != ".pdf" {
 					return nil
 				}
+				src := path
+				if ext == ".pdf" {
+					src += ".mark" // companion PDFs follow their .mark
+				}
+				if !filter.allows(t.Input, src) {
+					return nil
+				}
 				seen[path] = true
 				if ext == ".note" || ext == ".mark" {
 					sources[path] = true
@@ -283,6 +509,9 @@ func pollLoop(ctx context.Context, cfg *Config, interval time.Duration, onChange
 				}
 				mt := info.ModTime()
 				if prev, ok := mtimes[path]; !ok || !mt.Equal(prev) {
+					if ok {
+						logger.Debugf("poll: '%s' modified", path)
+					}
 					mtimes[path] = mt
 					onChanged(path)
 				}
@@ -290,14 +519,22 @@ func pollLoop(ctx context.Context, cfg *Config, interval time.Duration, onChange
 			})
 		}
 
+		// A source that is still there but no longer passes a reloaded filter
+		// was not deleted, and its output is left alone
 		for path := range prevSources {
 			if !sources[path] {
+				if _, err := os.Lstat(path); err == nil {
+					continue
+				}
 				onDeleted(path)
 			}
 		}
 		prevSources = sources
 
 		for path := range sources {
+			if held[path] {
+				continue
+			}
 			out := outputPathForSource(path, cfg)
 			if out == "" {
 				continue
@@ -315,80 +552,160 @@ func pollLoop(ctx context.Context, cfg *Config, interval time.Duration, onChange
 	}
 }
 
+// isSourceName reports whether path has an extension classifyEvent handles.
+func isSourceName(path string) bool {
+	switch filepath.Ext(path) {
+	case ".note", ".mark", ".pdf":
+		return true
+	}
+	return false
+}
+
 func classifyEvent(path string, cfg *Config) *convJob {
-	srcDir := sourceDir(path, cfg)
-	if srcDir == "" {
+	return classifySource(path, cfg, false)
+}
+
+// classifySource returns the job converting path, or nil if it is not a
+// source to convert or (unless force) its output is up to date.
+func classifySource(path string, cfg *Config, force bool) *convJob {
+	t := targetFor(path, cfg)
+	if t == nil {
 		return nil
 	}
-	outDir := cfg.Watch.Location
+	srcDir := t.Input
+	filter := cfg.watchFilter(*t)
 
 	switch {
 	case strings.HasSuffix(path, ".note"):
-		out := outputPath(path, srcDir, outDir, ".note", ".pdf")
-		if isUpToDate(path, out) {
+		if !filter.allows(srcDir, path) {
+			logger.Debugf("Skipping '%s': excluded by filter", path)
+			return nil
+		}
+		out := cfg.targetOutput(*t, path, ".note", ".pdf")
+		if !force && isUpToDate(path, out) {
+			logger.Debugf("Skipping '%s': output is up-to-date", path)
 			return nil
 		}
-		return &convJob{input: path, output: out}
+		return &convJob{input: path, output: out, root: srcDir, noBg: t.NoBg, force: force}
 
 	case strings.HasSuffix(path, ".mark"):
+		if !filter.allows(srcDir, path) {
+			logger.Debugf("Skipping '%s': excluded by filter", path)
+			return nil
+		}
 		companionPDF := strings.TrimSuffix(path, ".mark")
 		if _, err := os.Stat(companionPDF); err != nil {
-			fmt.Printf("Skipping '%s': companion PDF not found (will retry when PDF arrives)\n", filepath.Base(path))
+			logger.Infof("Skipping '%s': companion PDF not found (will retry when PDF arrives)", filepath.Base(path))
 			return nil
 		}
-		out := outputPath(path, srcDir, outDir, ".mark", "")
-		if isMarkUpToDate(path, companionPDF, out) {
+		out := cfg.targetOutput(*t, path, ".mark", "")
+		if !force && isMarkUpToDate(path, companionPDF, out) {
+			logger.Debugf("Skipping '%s': output is up-to-date", path)
 			return nil
 		}
-		return &convJob{input: path, output: out, companionPDF: companionPDF}
+		return &convJob{input: path, output: out, companionPDF: companionPDF, root: srcDir, force: force}
 
 	// .pdf arriving — retry for late-arriving companion PDFs
 	case strings.HasSuffix(path, ".pdf"):
 		markPath := path + ".mark"
+		if !filter.allows(srcDir, markPath) {
+			return nil
+		}
 		if _, err := os.Stat(markPath); err != nil {
 			return nil
 		}
-		out := outputPath(markPath, srcDir, outDir, ".mark", "")
-		if isMarkUpToDate(markPath, path, out) {
+		out := cfg.targetOutput(*t, markPath, ".mark", "")
+		if !force && isMarkUpToDate(markPath, path, out) {
 			return nil
 		}
-		return &convJob{input: markPath, output: out, companionPDF: path}
+		return &convJob{input: markPath, output: out, companionPDF: path, root: srcDir, force: force}
 
 	default:
 		return nil
 	}
 }
 
-func convertJob(j convJob, noBg bool, cfg *Config) {
+func convertJob(ctx context.Context, j convJob, noBg bool, cfg *Config, state *stateSet) {
+	if e, ok := state.isQuarantined(j); ok {
+		logger.Infof("Skipping '%s': quarantined after failed conversion (%s); %s", filepath.Base(j.input), e.Error, e.retryStatus())
+		return
+	}
+
 	if dir := filepath.Dir(j.output); dir != "." {
 		if err := os.MkdirAll(dir, 0755); err != nil {
-			fmt.Fprintf(os.Stderr, "Error creating directory '%s': %v\n", dir, err)
+			logger.Errorf("creating directory '%s': %v", dir, err)
 			return
 		}
 	}
+	defer lockOutput(j.output)()
+	if j.upToDate() {
+		logger.Debugf("Skipping '%s': converted by another process", j.input)
+		return
+	}
+	if e, ok := state.outputModified(j.output); ok {
+		msg := fmt.Sprintf("not overwriting '%s': modified by another program since conversion on %s; move or delete it to regenerate",
+			j.output, e.ConvertedAt.Format("2006-01-02 15:04"))
+		logger.Event(Event{Name: EventError, Input: j.input, Output: j.output, Error: msg}, "%s", msg)
+		return
+	}
 
+	logger.Event(Event{Name: EventConvertStart, Input: j.input, Output: j.output}, "")
 	start := time.Now()
-	var err error
-	if j.companionPDF != "" {
-		err = ConvertMarkToPDFVector(j.input, j.companionPDF, j.output, false, cfg)
-	} else {
-		err = ConvertNoteToPDFVector(j.input, j.output, noBg, false, cfg)
+	meter := startUsage()
+	var res *Result
+	jcfg, jnoBg, err := cfg.forSource(j.root, j.input, noBg || j.noBg)
+	switch {
+	case err != nil:
+	case j.companionPDF != "":
+		res, err = ConvertMarkToPDFVector(ctx, j.input, j.companionPDF, j.output, nil, jcfg, nil)
+	default:
+		res, err = ConvertNoteToPDFVector(ctx, j.input, j.output, jnoBg, nil, jcfg, nil)
 	}
+	u := meter.finish(j.output)
 
+	if errors.Is(err, context.Canceled) {
+		// Shutting down; converted again on the next start
+		logger.Infof("Interrupted converting '%s'", filepath.Base(j.input))
+		return
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error converting '%s': %v\n", j.input, err)
+		logger.Event(Event{Name: EventError, Input: j.input, Output: j.output, Error: err.Error()}, "converting '%s': %v", j.input, err)
+		e, serr := state.recordFailure(j, err, cfg.Watch.retryPolicy())
+		if serr != nil {
+			logger.Warnf("updating state DB: %v", serr)
+		} else {
+			logger.Infof("'%s': %s", filepath.Base(j.input), e.retryStatus())
+		}
+		// Notified on the first failure and when retries run out, not on every retry
+		if cfg.Watch.Notify && (serr != nil || e.Attempts <= 1 || e.RetryAt.IsZero()) {
+			desktop.conversionFailed(filepath.Base(j.input), err)
+		}
 		return
 	}
-	fmt.Printf("Converted '%s' -> '%s' (%.2fs)\n", filepath.Base(j.input), filepath.Base(j.output), time.Since(start).Seconds())
+	secs := time.Since(start).Seconds()
+	pages := sourcePageCount(j.input)
+	logger.Event(u.event(Event{Name: EventConvertDone, Input: j.input, Output: j.output, Pages: pages, Seconds: secs, Warnings: res.Warnings, Starred: res.Starred}),
+		"Converted '%s' -> '%s' (%.2fs)%s", filepath.Base(j.input), filepath.Base(j.output), secs, warningSummary(len(res.Warnings)))
+	logger.Warnings(filepath.Base(j.input), res.Warnings)
+	if cfg.Watch.Notify {
+		desktop.conversionDone(filepath.Base(j.input), pages, len(res.Warnings))
+	}
+	if err := state.recordSuccess(j, pages, u, res); err != nil {
+		logger.Warnf("updating state DB: %v", err)
+	}
+	indexes.touch(state.forOutput(j.output), cfg)
 }
 
-func sourceDir(path string, cfg *Config) string {
-	for _, dir := range cfg.Watch.InputDirs() {
-		if isUnderDir(path, dir) {
-			return dir
+// targetFor returns the watch target whose input directory contains path,
+// preferring the most specific (deepest) input directory, or nil.
+func targetFor(path string, cfg *Config) *WatchTarget {
+	var best *WatchTarget
+	for _, t := range cfg.Watch.Targets() {
+		if isUnderDir(path, t.Input) && (best == nil || len(t.Input) > len(best.Input)) {
+			best = &t
 		}
 	}
-	return ""
+	return best
 }
 
 func outputPath(path, srcDir, outDir, oldExt, newExt string) string {
@@ -409,16 +726,15 @@ func isUnderDir(path, dir string) bool {
 }
 
 func outputPathForSource(path string, cfg *Config) string {
-	srcDir := sourceDir(path, cfg)
-	if srcDir == "" {
+	t := targetFor(path, cfg)
+	if t == nil {
 		return ""
 	}
-	outDir := cfg.Watch.Location
 	switch {
 	case strings.HasSuffix(path, ".note"):
-		return outputPath(path, srcDir, outDir, ".note", ".pdf")
+		return cfg.targetOutput(*t, path, ".note", ".pdf")
 	case strings.HasSuffix(path, ".mark"):
-		return outputPath(path, srcDir, outDir, ".mark", "")
+		return cfg.targetOutput(*t, path, ".mark", "")
 	default:
 		return ""
 	}
@@ -426,20 +742,62 @@ func outputPathForSource(path string, cfg *Config) string {
 
 // handleDeletion removes the output PDF for a deleted source file
 // and cleans up empty parent directories up to the output root.
-func handleDeletion(path string, cfg *Config) {
+func handleDeletion(path string, cfg *Config, state *stateSet, health *sourceHealth) {
 	out := outputPathForSource(path, cfg)
 	if out == "" {
 		return
 	}
+	t := targetFor(path, cfg)
+	if t == nil {
+		return
+	}
+	// Excluded sources were never converted, so an output at their path is
+	// not GoSNare's to remove
+	if !cfg.watchFilter(*t).allows(t.Input, path) {
+		logger.Debugf("Keeping '%s': source excluded by filter", out)
+		return
+	}
+	if !health.probe(*t, cfg.Watch) {
+		logger.Debugf("Keeping '%s': source unavailable", out)
+		return
+	}
+	if cfg.archivesTrash(*t, path) {
+		logger.Debugf("Keeping '%s': archived conversion of a deleted note", out)
+		return
+	}
+	if !mayRemoveOutput(cfg.Watch, t.Output, out, state) {
+		return
+	}
+	if err := state.remove(out); err != nil {
+		logger.Warnf("updating state DB: %v", err)
+	}
 	if _, err := os.Stat(out); err != nil {
 		return
 	}
 	if err := os.Remove(out); err != nil {
-		fmt.Fprintf(os.Stderr, "Error removing output '%s': %v\n", out, err)
+		logger.Errorf("removing output '%s': %v", out, err)
 		return
 	}
-	fmt.Printf("Removed output '%s' (source deleted)\n", filepath.Base(out))
-	removeEmptyParents(filepath.Dir(out), cfg.Watch.Location)
+	logger.Infof("Removed output '%s' (source deleted)", filepath.Base(out))
+	removeEmptyParents(filepath.Dir(out), t.Output)
+	indexes.touch(state.forOutput(out), cfg)
+}
+
+// mayRemoveOutput reports whether cleanup may delete output under outDir: it
+// does not match a [watch] protect glob and, with cleanup = "state", the
+// state DB records it as generated by GoSNare.
+func mayRemoveOutput(w WatchConfig, outDir, output string, state *stateSet) bool {
+	if !(pathFilter{ignore: w.Protect}).allows(outDir, output) {
+		logger.Debugf("Keeping '%s': protected", output)
+		return false
+	}
+	if w.Cleanup == "state" {
+		if _, ok := state.lookup(output); !ok {
+			logger.Debugf("Keeping '%s': not recorded in the state DB", output)
+			return false
+		}
+	}
+	return true
 }
 
 func removeEmptyParents(dir, stopDir string) {
@@ -466,41 +824,89 @@ func removeEmptyParents(dir, stopDir string) {
 	}
 }
 
-func syncOrphanedOutputs(cfg *Config) {
-	outDir := cfg.Watch.Location
-	if outDir == "" {
-		return
+// syncOrphanedOutputs removes orphaned outputs in every output directory whose
+// sources are all available.
+func syncOrphanedOutputs(cfg *Config, state *stateSet, health *sourceHealth) {
+	for _, outDir := range cfg.Watch.OutputDirs() {
+		if !health.outputAvailable(cfg.Watch, outDir) {
+			logger.Warnf("Skipping orphan cleanup in '%s': a source is unavailable", outDir)
+			continue
+		}
+		syncOrphanedOutputsIn(cfg.Watch, outDir, ".pdf", cfg.Watch.InputDirsFor(outDir), state)
 	}
+}
+
+// syncOrphanedOutputsIn removes outputs under outDir (PDFs, and notes
+// converted to noteExt) that have no source in inputDirs, within the cleanup
+// scope of w. The output directories of other targets nested in outDir are
+// left alone.
+func syncOrphanedOutputsIn(w WatchConfig, outDir, noteExt string, inputDirs []string, state *stateSet) {
+	nested := w.nestedOutputDirs(outDir)
 	filepath.WalkDir(outDir, func(path string, d os.DirEntry, err error) error {
-		if err != nil || d.IsDir() {
+		if err != nil {
 			return nil
 		}
-		if !strings.HasSuffix(path, ".pdf") {
+		if d.IsDir() {
+			return skipNested(path, nested)
+		}
+		if !strings.HasSuffix(path, ".pdf") && !strings.HasSuffix(path, noteExt) {
 			return nil
 		}
-		if !hasSourceFile(path, cfg) {
+		if !hasSourceFileIn(path, outDir, inputDirs) && mayRemoveOutput(w, outDir, path, state) {
 			if err := os.Remove(path); err != nil {
-				fmt.Fprintf(os.Stderr, "Error removing orphaned output '%s': %v\n", path, err)
+				logger.Errorf("removing orphaned output '%s': %v", path, err)
 			} else {
-				fmt.Printf("Removed orphaned output '%s'\n", filepath.Base(path))
+				logger.Infof("Removed orphaned output '%s'", filepath.Base(path))
 				removeEmptyParents(filepath.Dir(path), outDir)
+				if err := state.remove(path); err != nil {
+					logger.Warnf("updating state DB: %v", err)
+				}
 			}
 		}
 		return nil
 	})
 }
 
-func hasSourceFile(outputPDF string, cfg *Config) bool {
-	outDir := cfg.Watch.Location
-	rel, err := filepath.Rel(outDir, outputPDF)
+// nestedOutputDirs returns the output directories of other targets, and the
+// trash_output archive, that lie inside outDir. Their outputs have sources in
+// those targets' inputs or trash folders, not in the inputs of outDir.
+func (w WatchConfig) nestedOutputDirs(outDir string) []string {
+	var dirs []string
+	for _, o := range append(w.OutputDirs(), w.TrashOutput) {
+		if o != "" && isUnderDir(o, outDir) && !isUnderDir(outDir, o) {
+			dirs = append(dirs, o)
+		}
+	}
+	return dirs
+}
+
+// skipNested returns filepath.SkipDir for a directory of a walk that is one
+// of nested, or below one.
+func skipNested(dir string, nested []string) error {
+	for _, n := range nested {
+		if isUnderDir(dir, n) {
+			return filepath.SkipDir
+		}
+	}
+	return nil
+}
+
+// hasSourceFileIn reports whether output under outDir has a .note source (or,
+// for a PDF, a .mark source) in any of inputDirs.
+func hasSourceFileIn(output, outDir string, inputDirs []string) bool {
+	rel, err := filepath.Rel(outDir, output)
 	if err != nil {
 		return false
 	}
-	for _, dir := range cfg.Watch.InputDirs() {
-		noteSource := filepath.Join(dir, strings.TrimSuffix(rel, ".pdf")+".note")
+	isPDF := strings.HasSuffix(rel, ".pdf")
+	for _, dir := range inputDirs {
+		noteSource := filepath.Join(dir, strings.TrimSuffix(rel, filepath.Ext(rel))+".note")
 		if _, err := os.Stat(noteSource); err == nil {
 			return true
 		}
+		if !isPDF {
+			continue
+		}
 		markSource := filepath.Join(dir, rel+".mark")
 		if _, err := os.Stat(markSource); err == nil {
 			return true
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// isWebDAVURL reports whether [watch] webdav is a server URL rather than the
+// path of a mounted volume.
+func isWebDAVURL(s string) bool {
+	return strings.HasPrefix(s, "http://") || strings.HasPrefix(s, "https://")
+}
+
+// webdavClient lists and downloads files from a WebDAV server, so the share
+// does not have to be mounted (mounted WebDAV volumes drop, on macOS
+// especially). Folders are listed one level at a time (Depth: 1), as many
+// servers refuse Depth: infinity.
+type webdavClient struct {
+	base     *url.URL
+	user     string
+	password string
+	client   *http.Client
+}
+
+func newWebDAVClient(rawURL, user, password string) (*webdavClient, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("[watch] webdav: %w", err)
+	}
+	if !strings.HasSuffix(u.Path, "/") {
+		u.Path += "/"
+	}
+	return &webdavClient{base: u, user: user, password: password, client: &http.Client{Timeout: 5 * time.Minute}}, nil
+}
+
+func (c *webdavClient) name() string { return "WebDAV " + c.base.Host }
+
+// request sends a request for the resource at rel, a slash-separated path
+// below the base URL.
+func (c *webdavClient) request(ctx context.Context, method, rel string, body io.Reader) (*http.Response, error) {
+	u := *c.base
+	u.Path = path.Join(c.base.Path, rel)
+	if strings.HasSuffix(rel, "/") || rel == "" {
+		u.Path += "/"
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if c.user != "" {
+		req.SetBasicAuth(c.user, c.password)
+	}
+	if method == "PROPFIND" {
+		req.Header.Set("Depth", "1")
+		req.Header.Set("Content-Type", "application/xml")
+	}
+	return c.client.Do(req)
+}
+
+const propfindBody = `<?xml version="1.0" encoding="utf-8"?>
+<propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+
+type davMultistatus struct {
+	Responses []struct {
+		Href     string `xml:"href"`
+		Propstat []struct {
+			Status string `xml:"status"`
+			Prop   struct {
+				ResourceType struct {
+					Collection *struct{} `xml:"collection"`
+				} `xml:"resourcetype"`
+				ContentLength string `xml:"getcontentlength"`
+				LastModified  string `xml:"getlastmodified"`
+			} `xml:"prop"`
+		} `xml:"propstat"`
+	} `xml:"response"`
+}
+
+func (c *webdavClient) list(ctx context.Context) ([]remoteFile, error) {
+	return c.walk(ctx, "")
+}
+
+// walk lists the files below the folder rel (relative to the base URL,
+// "" for the root).
+func (c *webdavClient) walk(ctx context.Context, rel string) ([]remoteFile, error) {
+	resp, err := c.request(ctx, "PROPFIND", rel+"/", strings.NewReader(propfindBody))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusMultiStatus {
+		return nil, fmt.Errorf("PROPFIND /%s: %s", rel, resp.Status)
+	}
+	var ms davMultistatus
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, fmt.Errorf("PROPFIND /%s: %w", rel, err)
+	}
+
+	var files []remoteFile
+	for _, r := range ms.Responses {
+		p, err := c.relPath(r.Href)
+		if err != nil || p == rel {
+			continue // the folder itself
+		}
+		for _, ps := range r.Propstat {
+			if !strings.Contains(ps.Status, " 200 ") {
+				continue
+			}
+			if ps.Prop.ResourceType.Collection != nil {
+				sub, err := c.walk(ctx, p)
+				if err != nil {
+					return nil, err
+				}
+				files = append(files, sub...)
+				break
+			}
+			size, _ := strconv.ParseInt(ps.Prop.ContentLength, 10, 64)
+			mod, _ := http.ParseTime(ps.Prop.LastModified)
+			files = append(files, remoteFile{path: p, size: size, modTime: mod, id: p})
+			break
+		}
+	}
+	return files, nil
+}
+
+// relPath returns an href of a PROPFIND response (absolute URL or path) as a
+// path relative to the base URL.
+func (c *webdavClient) relPath(href string) (string, error) {
+	u, err := url.Parse(href)
+	if err != nil {
+		return "", err
+	}
+	p, base := path.Clean(u.Path), path.Clean(c.base.Path)
+	if p == base {
+		return "", nil
+	}
+	if !strings.HasPrefix(p, strings.TrimSuffix(base, "/")+"/") {
+		return "", fmt.Errorf("%s is outside %s", href, c.base)
+	}
+	return strings.TrimPrefix(p, strings.TrimSuffix(base, "/")+"/"), nil
+}
+
+func (c *webdavClient) download(ctx context.Context, f remoteFile, w io.Writer) error {
+	resp, err := c.request(ctx, http.MethodGet, f.id, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET /%s: %s", f.id, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}